@@ -16,6 +16,7 @@ import (
 	"github.com/canonical/lxd/lxd/db"
 	dbCluster "github.com/canonical/lxd/lxd/db/cluster"
 	"github.com/canonical/lxd/lxd/db/warningtype"
+	"github.com/canonical/lxd/lxd/device/cdi"
 	"github.com/canonical/lxd/lxd/instance"
 	instanceDrivers "github.com/canonical/lxd/lxd/instance/drivers"
 	"github.com/canonical/lxd/lxd/instance/instancetype"
@@ -451,6 +452,17 @@ func internalMetrics(ctx context.Context, s *state.State, tx *db.ClusterTx) *met
 		}
 	}
 
+	// CDI hook metrics
+	for outcome, outcomeName := range cdi.GetHookOutcomesNames() {
+		out.AddSamples(
+			metrics.CDIHookOutcomesTotal,
+			metrics.Sample{
+				Labels: map[string]string{"outcome": outcomeName},
+				Value:  float64(cdi.GetHookOutcomes(outcome)),
+			},
+		)
+	}
+
 	// Daemon uptime
 	out.AddSamples(metrics.UptimeSeconds, metrics.Sample{Value: time.Since(s.StartTime).Seconds()})
 
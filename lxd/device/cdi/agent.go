@@ -0,0 +1,78 @@
+package cdi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CDIAgentHooksFile is the name of the file holding the CDI hooks staged for the lxd-agent.
+const CDIAgentHooksFile = "cdi-hooks.json"
+
+// StageHooksForAgent writes the CDI hooks into stagingDir so that the lxd-agent can replay them
+// inside a VM guest. The hooks are written to the CDIAgentHooksFile file using the same format as the
+// container hooks file, with the symlinks sorted so that they can be created in order and the linker
+// cache updates resolved and normalized. The container root filesystem is not relevant to the guest
+// and is dropped.
+// The file is replaced atomically so that the agent never reads a partially written file.
+func StageHooksForAgent(hooks *Hooks, stagingDir string) error {
+	err := ValidateHooks(hooks)
+	if err != nil {
+		return err
+	}
+
+	updates, err := resolveLDCacheUpdates(hooks.LDCacheUpdates, hooks.LDCacheBase)
+	if err != nil {
+		return err
+	}
+
+	symlinks, err := sortSymlinks(hooks.Symlinks)
+	if err != nil {
+		return err
+	}
+
+	staged := Hooks{
+		LDCacheUpdates:     normalizeLDCacheUpdates(updates),
+		Symlinks:           symlinks,
+		LinkerConfSuffix:   hooks.LinkerConfSuffix,
+		LinkerConfPriority: hooks.LinkerConfPriority,
+	}
+
+	content, err := json.Marshal(staged)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling the CDI hooks to JSON: %w", err)
+	}
+
+	err = os.MkdirAll(stagingDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating the CDI staging directory %q: %w", stagingDir, err)
+	}
+
+	f, err := os.CreateTemp(stagingDir, "."+CDIAgentHooksFile+".*")
+	if err != nil {
+		return fmt.Errorf("Failed creating the staged CDI hooks file: %w", err)
+	}
+
+	tmpPath := f.Name()
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	_, err = f.Write(content)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("Failed writing the staged CDI hooks file: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed closing the staged CDI hooks file: %w", err)
+	}
+
+	hooksPath := filepath.Join(stagingDir, CDIAgentHooksFile)
+	err = os.Rename(tmpPath, hooksPath)
+	if err != nil {
+		return fmt.Errorf("Failed moving the staged CDI hooks file to %q: %w", hooksPath, err)
+	}
+
+	return nil
+}
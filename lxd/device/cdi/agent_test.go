@@ -0,0 +1,62 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageHooksForAgent(t *testing.T) {
+	t.Run("stages replayable hooks", func(t *testing.T) {
+		stagingDir := filepath.Join(t.TempDir(), "config", "cdi")
+
+		hooks := &Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/c1/rootfs",
+			LDCacheUpdates:  []string{"/usr/lib/nvidia/", "/usr/lib/nvidia"},
+			Symlinks: []SymlinkEntry{
+				{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+				{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+			},
+		}
+
+		err := StageHooksForAgent(hooks, stagingDir)
+		require.NoError(t, err)
+
+		staged, err := loadHooksFile(filepath.Join(stagingDir, CDIAgentHooksFile))
+		require.NoError(t, err)
+		assert.Empty(t, staged.ContainerRootFS)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, staged.LDCacheUpdates)
+		assert.Equal(t, []SymlinkEntry{
+			{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+			{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+		}, staged.Symlinks)
+
+		entries, err := os.ReadDir(stagingDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		// The staged file can be replayed with the container code path.
+		guestRoot := t.TempDir()
+		_, _, err = applyHooksWithFS(filepath.Join(stagingDir, CDIAgentHooksFile), &localFS{rootFS: guestRoot}, ApplyOptions{})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(guestRoot, "usr", "lib", "nvidia", "libcuda.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libcuda.so.1", target)
+	})
+
+	t.Run("rejects relative links and escaping library directories", func(t *testing.T) {
+		stagingDir := t.TempDir()
+
+		err := StageHooksForAgent(&Hooks{Symlinks: []SymlinkEntry{{Target: "/lib/libfoo.so.1", Link: "lib/libfoo.so"}}}, stagingDir)
+		assert.ErrorContains(t, err, "is not an absolute path")
+
+		err = StageHooksForAgent(&Hooks{LDCacheUpdates: []string{"../../../etc"}, LDCacheBase: "/usr/lib"}, stagingDir)
+		assert.ErrorContains(t, err, "escapes the container rootfs")
+
+		assert.NoFileExists(t, filepath.Join(stagingDir, CDIAgentHooksFile))
+	})
+}
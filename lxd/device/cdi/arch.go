@@ -0,0 +1,254 @@
+package cdi
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/shared/logger"
+	"github.com/canonical/lxd/shared/osarch"
+)
+
+// elfArch is the ELF identification of the libraries of an architecture. A data encoding of
+// elf.ELFDATANONE matches both byte orders, as the architecture names do not tell them apart.
+type elfArch struct {
+	machine elf.Machine
+	class   elf.Class
+	data    elf.Data
+}
+
+// elfArchs are the ELF identifications of the architectures known to osarch.
+var elfArchs = map[int]elfArch{
+	osarch.ARCH_32BIT_INTEL_X86:             {machine: elf.EM_386, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB},
+	osarch.ARCH_64BIT_INTEL_X86:             {machine: elf.EM_X86_64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB},
+	osarch.ARCH_32BIT_ARMV6_LITTLE_ENDIAN:   {machine: elf.EM_ARM, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB},
+	osarch.ARCH_32BIT_ARMV7_LITTLE_ENDIAN:   {machine: elf.EM_ARM, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB},
+	osarch.ARCH_32BIT_ARMV8_LITTLE_ENDIAN:   {machine: elf.EM_ARM, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB},
+	osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN:   {machine: elf.EM_AARCH64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB},
+	osarch.ARCH_32BIT_POWERPC_BIG_ENDIAN:    {machine: elf.EM_PPC, class: elf.ELFCLASS32, data: elf.ELFDATA2MSB},
+	osarch.ARCH_64BIT_POWERPC_BIG_ENDIAN:    {machine: elf.EM_PPC64, class: elf.ELFCLASS64, data: elf.ELFDATA2MSB},
+	osarch.ARCH_64BIT_POWERPC_LITTLE_ENDIAN: {machine: elf.EM_PPC64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB},
+	osarch.ARCH_64BIT_S390_BIG_ENDIAN:       {machine: elf.EM_S390, class: elf.ELFCLASS64, data: elf.ELFDATA2MSB},
+	osarch.ARCH_32BIT_MIPS:                  {machine: elf.EM_MIPS, class: elf.ELFCLASS32, data: elf.ELFDATANONE},
+	osarch.ARCH_64BIT_MIPS:                  {machine: elf.EM_MIPS, class: elf.ELFCLASS64, data: elf.ELFDATANONE},
+	osarch.ARCH_32BIT_RISCV_LITTLE_ENDIAN:   {machine: elf.EM_RISCV, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB},
+	osarch.ARCH_64BIT_RISCV_LITTLE_ENDIAN:   {machine: elf.EM_RISCV, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB},
+	osarch.ARCH_64BIT_LOONGARCH:             {machine: elf.EM_LOONGARCH, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB},
+}
+
+// matches returns whether the ELF file f is built for the architecture.
+func (a elfArch) matches(f *elf.File) bool {
+	return f.Machine == a.machine && f.Class == a.class && (a.data == elf.ELFDATANONE || f.Data == a.data)
+}
+
+// parseLibraryArch returns the ELF identification of the architecture named arch, which can be any of
+// the names and aliases known to osarch (e.g. "x86_64" or "amd64").
+func parseLibraryArch(arch string) (elfArch, error) {
+	id, err := osarch.ArchitectureId(arch)
+	if err != nil {
+		return elfArch{}, fmt.Errorf("Unknown architecture %q", arch)
+	}
+
+	a, found := elfArchs[id]
+	if !found {
+		return elfArch{}, fmt.Errorf("Unsupported architecture %q", arch)
+	}
+
+	return a, nil
+}
+
+// resolveLDCacheArchs returns archs with their relative library directories resolved like the
+// LDCacheUpdates by resolveLDCacheUpdates and cleaned.
+func resolveLDCacheArchs(archs map[string]string, base string) (map[string]string, error) {
+	if archs == nil {
+		return nil, nil
+	}
+
+	resolved := make(map[string]string, len(archs))
+	for dir, arch := range archs {
+		dirs, err := resolveLDCacheUpdates([]string{dir}, base)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved[filepath.Clean(dirs[0])] = arch
+	}
+
+	return resolved, nil
+}
+
+// validateLDCacheArchs checks that each library directory of archs is one of updates and that its
+// architecture is known.
+func validateLDCacheArchs(archs map[string]string, updates []string) error {
+	for dir, arch := range archs {
+		if !slices.ContainsFunc(updates, func(update string) bool { return filepath.Clean(update) == filepath.Clean(dir) }) {
+			return fmt.Errorf("The library directory %q of the architecture %q is not in the linker cache updates", dir, arch)
+		}
+
+		_, err := parseLibraryArch(arch)
+		if err != nil {
+			return fmt.Errorf("Invalid architecture for the library directory %q: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// checkLDCacheArchs checks that the libraries of each directory of archs are built for its
+// architecture, inspecting the first shared library found in it. A directory without any shared
+// library cannot be checked and is skipped.
+func checkLDCacheArchs(cfs containerFS, archs map[string]string, l logger.Logger) error {
+	dirs := make([]string, 0, len(archs))
+	for dir := range archs {
+		dirs = append(dirs, dir)
+	}
+
+	slices.Sort(dirs)
+
+	for _, dir := range dirs {
+		want, err := parseLibraryArch(archs[dir])
+		if err != nil {
+			return err
+		}
+
+		path, f, err := sampleSharedLibrary(cfs, dir)
+		if err != nil {
+			return err
+		}
+
+		if f == nil {
+			l.Debug("No shared library to check the architecture of the CDI library directory", logger.Ctx{"dir": dir, "arch": archs[dir]})
+			continue
+		}
+
+		if !want.matches(f) {
+			return fmt.Errorf("The library directory %q is for the architecture %q but holds the %s %s library %q", dir, archs[dir], f.Class, f.Machine, path)
+		}
+	}
+
+	return nil
+}
+
+// sampleSharedLibrary returns the path and the ELF file of the first shared library of dir, following
+// the symlinks, or a nil file when there is none or the directory does not exist.
+func sampleSharedLibrary(cfs containerFS, dir string) (string, *elf.File, error) {
+	files, err := cfs.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, nil
+		}
+
+		return "", nil, fmt.Errorf("Failed listing the library directory %q: %w", dir, err)
+	}
+
+	slices.SortFunc(files, func(a os.FileInfo, b os.FileInfo) int { return strings.Compare(a.Name(), b.Name()) })
+
+	for _, file := range files {
+		if !strings.Contains(file.Name(), ".so") || file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		resolved, err := resolveContainerPath(cfs, path)
+		if err != nil {
+			// Broken symlinks are reported by the verification.
+			continue
+		}
+
+		f, err := readELFHeader(cfs, resolved)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if f != nil && f.Type == elf.ET_DYN {
+			return path, f, nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+// readELFHeader returns the ELF file at path, or nil if it is not an ELF file.
+func readELFHeader(cfs containerFS, path string) (*elf.File, error) {
+	f, err := cfs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening the library %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading the library %q: %w", path, err)
+		}
+
+		r = bytes.NewReader(content)
+	}
+
+	elfFile, err := elf.NewFile(r)
+	if err != nil {
+		return nil, nil
+	}
+
+	return elfFile, nil
+}
+
+// hostArchitecture returns the osarch id of the architecture of the host. It is a variable so that
+// the tests can pretend to run on another architecture.
+var hostArchitecture = osarch.ArchitectureGetLocalID
+
+// isForeignBinary returns whether the ELF file at path in the container is built for an architecture
+// the host cannot run natively, that is neither its own nor one of its personalities, together with a
+// description of the architecture of the file. A file that is not an ELF file, e.g. a wrapper script,
+// is checked through its ".real" sibling when it has one, like the ldconfig of Debian, and is otherwise
+// not foreign. An unknown host architecture makes every file native.
+func isForeignBinary(cfs containerFS, path string) (bool, string, error) {
+	var f *elf.File
+	for _, candidate := range []string{path, path + ".real"} {
+		resolved, err := resolveContainerPath(cfs, candidate)
+		if err != nil {
+			if isMissingPath(err) {
+				continue
+			}
+
+			return false, "", fmt.Errorf("Failed resolving %q: %w", candidate, err)
+		}
+
+		f, err = readELFHeader(cfs, resolved)
+		if err != nil {
+			return false, "", err
+		}
+
+		if f != nil {
+			break
+		}
+	}
+
+	if f == nil {
+		return false, "", nil
+	}
+
+	id, err := hostArchitecture()
+	if err != nil {
+		return false, "", nil
+	}
+
+	personalities, _ := osarch.ArchitecturePersonalities(id)
+	for _, arch := range append([]int{id}, personalities...) {
+		a, found := elfArchs[arch]
+		if !found || a.matches(f) {
+			return false, "", nil
+		}
+	}
+
+	return true, fmt.Sprintf("%s %s", f.Class, f.Machine), nil
+}
@@ -0,0 +1,155 @@
+package cdi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd/shared/osarch"
+)
+
+func TestApplyHooksLDCacheArchs(t *testing.T) {
+	setup := func(t *testing.T, arch string) (string, string) {
+		tmpDir := t.TempDir()
+		writeSharedLibrary(t, filepath.Join(tmpDir, "opt/cdi/libfoo.so.1.2"), "libfoo.so.1")
+
+		hooks := Hooks{
+			LDCacheBase:    "/usr",
+			LDCacheUpdates: []string{"lib/cdi"},
+			LDCacheArchs:   map[string]string{"lib/cdi": arch},
+			Symlinks:       []SymlinkEntry{{Target: "/opt/cdi/libfoo.so.1.2", Link: "/usr/lib/cdi/libfoo.so.1"}},
+		}
+
+		return tmpDir, writeHooksFile(t, t.TempDir(), hooks)
+	}
+
+	t.Run("matching architecture", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t, "amd64")
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+	})
+
+	t.Run("mismatched architecture", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t, "arm64")
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{Rollback: true})
+		assert.ErrorContains(t, err, `The library directory "/usr/lib/cdi" is for the architecture "arm64" but holds the ELFCLASS64 EM_X86_64 library "/usr/lib/cdi/libfoo.so.1"`)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+		assert.NoFileExists(t, filepath.Join(tmpDir, linkerConfDir, CDILinkerConfFile))
+	})
+
+	t.Run("directory without libraries", func(t *testing.T) {
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/empty"}, LDCacheArchs: map[string]string{"/usr/lib/empty": "aarch64"}}
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: t.TempDir()}, ApplyOptions{})
+		require.NoError(t, err)
+	})
+
+	tests := []struct {
+		name    string
+		hooks   Hooks
+		wantErr string
+	}{
+		{
+			name:    "unknown architecture",
+			hooks:   Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}, LDCacheArchs: map[string]string{"/usr/lib/cdi": "vax"}},
+			wantErr: `Unknown architecture "vax"`,
+		},
+		{
+			name:    "directory not updated",
+			hooks:   Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}, LDCacheArchs: map[string]string{"/usr/lib/other": "x86_64"}},
+			wantErr: "is not in the linker cache updates",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateHooks(&test.hooks)
+			assert.ErrorIs(t, err, ErrInvalidHook)
+			assert.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestMergeHooksLDCacheArchs(t *testing.T) {
+	a := &Hooks{LDCacheBase: "/usr", LDCacheUpdates: []string{"lib/cdi"}, LDCacheArchs: map[string]string{"lib/cdi": "x86_64"}}
+	b := &Hooks{LDCacheUpdates: []string{"/usr/lib/cdi32"}, LDCacheArchs: map[string]string{"/usr/lib/cdi32": "i686"}}
+
+	merged, err := MergeHooks(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/usr/lib/cdi": "x86_64", "/usr/lib/cdi32": "i686"}, merged.LDCacheArchs)
+
+	_, err = MergeHooks(a, &Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}, LDCacheArchs: map[string]string{"/usr/lib/cdi": "aarch64"}})
+	assert.ErrorContains(t, err, "Conflicting CDI library directory architecture")
+}
+
+func TestUpdateLDCacheForeignLdconfig(t *testing.T) {
+	setup := func(t *testing.T, hostArch int) string {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), []byte("old cache"), 0644))
+
+		// Debian ships ldconfig as a wrapper script of ldconfig.real.
+		createLibrary(t, tmpDir, LdconfigPath)
+		writeSharedLibrary(t, filepath.Join(tmpDir, LdconfigPath+".real"), "")
+
+		previous := hostArchitecture
+		hostArchitecture = func() (int, error) { return hostArch, nil }
+		t.Cleanup(func() { hostArchitecture = previous })
+
+		return tmpDir
+	}
+
+	qemu := []string{"/usr/bin/qemu-x86_64-static", LdconfigPath}
+
+	t.Run("skipped without a foreign ldconfig", func(t *testing.T) {
+		tmpDir := setup(t, osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN)
+		inst := &ldconfigInstance{rootFS: tmpDir}
+
+		ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		require.NoError(t, err)
+		assert.False(t, ran)
+		assert.Empty(t, inst.commands)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+		assert.Equal(t, "old cache", string(content))
+	})
+
+	t.Run("runs the foreign ldconfig", func(t *testing.T) {
+		tmpDir := setup(t, osarch.ARCH_64BIT_ARMV8_LITTLE_ENDIAN)
+		inst := &ldconfigInstance{rootFS: tmpDir}
+
+		ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, qemu, "")
+		require.NoError(t, err)
+		assert.True(t, ran)
+		require.NotEmpty(t, inst.commands)
+		assert.Equal(t, append(qemu, "-X", "-C", ldconfigCacheTmpFile), inst.commands[0])
+
+		for _, command := range inst.commands[1:] {
+			assert.Equal(t, qemu, command[:len(qemu)])
+		}
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+		assert.Equal(t, "new cache", string(content))
+	})
+
+	for name, hostArch := range map[string]int{"native host": osarch.ARCH_64BIT_INTEL_X86, "unknown host": osarch.ARCH_UNKNOWN} {
+		t.Run("runs ldconfig on a "+name, func(t *testing.T) {
+			tmpDir := setup(t, hostArch)
+			inst := &ldconfigInstance{rootFS: tmpDir}
+
+			ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, qemu, "")
+			require.NoError(t, err)
+			assert.True(t, ran)
+			assert.Equal(t, []string{LdconfigPath, "-X", "-C", ldconfigCacheTmpFile}, inst.commands[0])
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// MountPointType is the kind of mount point prepared for a CDI bind mount.
+type MountPointType string
+
+const (
+	// MountPointDirectory is a directory mount point, for a source directory.
+	MountPointDirectory MountPointType = "directory"
+	// MountPointFile is a file mount point, for any other source.
+	MountPointFile MountPointType = "file"
+)
+
+// MountResult is the mount point prepared for a bind mount of ConfigDevices.BindMounts.
+type MountResult struct {
+	// Source is the host path of the bind mount.
+	Source string `json:"source" yaml:"source"`
+	// Path is the mount point inside the container.
+	Path string `json:"path" yaml:"path"`
+	// Type is the kind of mount point, following the kind of the source.
+	Type MountPointType `json:"type" yaml:"type"`
+	// Created indicates whether the mount point was created rather than already present.
+	Created bool `json:"created" yaml:"created"`
+}
+
+// ApplyBindMounts prepares the mount points of the bind mounts of cd inside the container c, so that
+// the disk devices mounting them can succeed. A directory is created for a source directory and an
+// empty file for any other source, along with their missing parents. The existing mount points are
+// kept as long as they match the kind of their source. The mount points already created are removed
+// if one of them cannot be prepared.
+func ApplyBindMounts(cd *ConfigDevices, c instance.Container) ([]MountResult, error) {
+	if cd == nil {
+		return nil, errors.New("No CDI config devices")
+	}
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return applyBindMountsWithFS(cd.BindMounts, &sftpContainerFS{client: sftpClient})
+}
+
+// applyBindMountsWithFS is the testable core of ApplyBindMounts.
+func applyBindMountsWithFS(bindMounts []map[string]string, cfs containerFS) ([]MountResult, error) {
+	for i, mount := range bindMounts {
+		for _, key := range []string{"source", "path"} {
+			err := validateConfigDevicePath(mount, key)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CDI bind mount at index %d: %w", i, err)
+			}
+		}
+
+		if pathEscapesRoot(mount["path"]) {
+			return nil, fmt.Errorf("Invalid CDI bind mount at index %d: The path %q escapes the container rootfs", i, mount["path"])
+		}
+	}
+
+	tx := &hooksTransaction{cfs: cfs, systemFS: cfs, l: loggerOrNop(nil)}
+	results, err := prepareMountPoints(tx, bindMounts)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return nil, fmt.Errorf("%w (rollback failed: %w)", err, rollbackErr)
+		}
+
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// prepareMountPoints prepares the mount points of the validated mounts, recording the changes in the
+// transaction.
+func prepareMountPoints(tx *hooksTransaction, mounts []map[string]string) ([]MountResult, error) {
+	results := make([]MountResult, 0, len(mounts))
+	for _, mount := range mounts {
+		result, err := prepareMountPoint(tx, mount["source"], filepath.Clean(mount["path"]))
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+// prepareMountPoint creates the mount point at path for the bind mount of the host path source,
+// recording the changes in the transaction.
+func prepareMountPoint(tx *hooksTransaction, source string, path string) (*MountResult, error) {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed checking the CDI bind mount source %q: %w", source, err)
+	}
+
+	result := &MountResult{Source: source, Path: path, Type: MountPointFile}
+	if sourceInfo.IsDir() {
+		result.Type = MountPointDirectory
+	}
+
+	// The mount follows the symlinks of the mount point.
+	resolved, err := resolveContainerPath(tx.cfs, path)
+
+	var pathInfo os.FileInfo
+	if err == nil {
+		pathInfo, err = tx.cfs.Lstat(resolved)
+	}
+
+	if err == nil {
+		if pathInfo.IsDir() != sourceInfo.IsDir() {
+			return nil, fmt.Errorf("The mount point %q does not match the kind of the CDI bind mount source %q", path, source)
+		}
+
+		return result, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed checking the mount point %q: %w", path, err)
+	}
+
+	if sourceInfo.IsDir() {
+		err = tx.MkdirAll(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed creating the mount point %q: %w", path, err)
+		}
+
+		result.Created = true
+		return result, nil
+	}
+
+	err = tx.MkdirAll(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating the directory of the mount point %q: %w", path, err)
+	}
+
+	f, err := tx.cfs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating the mount point %q: %w", path, err)
+	}
+
+	_ = f.Close()
+
+	tx.record(func() error {
+		err := tx.cfs.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Failed removing the mount point %q: %w", path, err)
+		}
+
+		return nil
+	})
+
+	result.Created = true
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyBindMounts(t *testing.T) {
+	hostDir := t.TempDir()
+	sourceDir := filepath.Join(hostDir, "firmware")
+	require.NoError(t, os.Mkdir(sourceDir, 0755))
+	sourceFile := filepath.Join(hostDir, "nvidia-smi")
+	require.NoError(t, os.WriteFile(sourceFile, []byte("binary"), 0755))
+
+	t.Run("creates the mount points", func(t *testing.T) {
+		rootFS := t.TempDir()
+		cd := &ConfigDevices{BindMounts: []map[string]string{
+			{"type": "disk", "source": sourceDir, "path": "/lib/firmware/nvidia"},
+			{"type": "disk", "source": sourceFile, "path": "/usr/bin/nvidia-smi"},
+		}}
+
+		results, err := applyBindMountsWithFS(cd.BindMounts, &localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []MountResult{
+			{Source: sourceDir, Path: "/lib/firmware/nvidia", Type: MountPointDirectory, Created: true},
+			{Source: sourceFile, Path: "/usr/bin/nvidia-smi", Type: MountPointFile, Created: true},
+		}, results)
+
+		assert.DirExists(t, filepath.Join(rootFS, "lib", "firmware", "nvidia"))
+		content, err := os.ReadFile(filepath.Join(rootFS, "usr", "bin", "nvidia-smi"))
+		require.NoError(t, err)
+		assert.Empty(t, content)
+
+		// The mount points are kept once prepared.
+		results, err = applyBindMountsWithFS(cd.BindMounts, &localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.False(t, results[0].Created)
+		assert.False(t, results[1].Created)
+	})
+
+	t.Run("mount point of another kind", func(t *testing.T) {
+		rootFS := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootFS, "usr", "bin", "nvidia-smi"), 0755))
+
+		cd := &ConfigDevices{BindMounts: []map[string]string{
+			{"type": "disk", "source": sourceDir, "path": "/lib/firmware/nvidia"},
+			{"type": "disk", "source": sourceFile, "path": "/usr/bin/nvidia-smi"},
+		}}
+
+		_, err := applyBindMountsWithFS(cd.BindMounts, &localFS{rootFS: rootFS})
+		assert.ErrorContains(t, err, `The mount point "/usr/bin/nvidia-smi" does not match the kind of the CDI bind mount source`)
+
+		// The mount point created before the failure is removed.
+		assert.NoDirExists(t, filepath.Join(rootFS, "lib"))
+	})
+
+	t.Run("symlinked mount point", func(t *testing.T) {
+		rootFS := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootFS, "usr", "lib", "firmware"), 0755))
+		require.NoError(t, os.Symlink("usr/lib", filepath.Join(rootFS, "lib")))
+
+		cd := &ConfigDevices{BindMounts: []map[string]string{{"type": "disk", "source": sourceDir, "path": "/lib/firmware"}}}
+
+		results, err := applyBindMountsWithFS(cd.BindMounts, &localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.False(t, results[0].Created)
+	})
+
+	t.Run("invalid bind mounts", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			mount map[string]string
+			err   string
+		}{
+			{name: "missing source", mount: map[string]string{"path": "/lib/firmware"}, err: `Missing "source"`},
+			{name: "relative path", mount: map[string]string{"source": sourceDir, "path": "lib/firmware"}, err: "is not an absolute path"},
+			{name: "escaping path", mount: map[string]string{"source": sourceDir, "path": "/../firmware"}, err: "escapes the container rootfs"},
+			{name: "missing source path", mount: map[string]string{"source": filepath.Join(hostDir, "missing"), "path": "/lib/firmware"}, err: "Failed checking the CDI bind mount source"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rootFS := t.TempDir()
+
+				_, err := applyBindMountsWithFS([]map[string]string{tt.mount}, &localFS{rootFS: rootFS})
+				assert.ErrorContains(t, err, tt.err)
+
+				entries, err := os.ReadDir(rootFS)
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			})
+		}
+	})
+
+	t.Run("no config devices", func(t *testing.T) {
+		_, err := ApplyBindMounts(nil, nil)
+		assert.ErrorContains(t, err, "No CDI config devices")
+	})
+}
@@ -0,0 +1,129 @@
+// Package cditest provides a fake container rootfs for the tests exercising the CDI hooks without a
+// container or a GPU.
+package cditest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd/lxd/device/cdi"
+)
+
+// RootFS is a fake glibc based container rootfs in a temporary directory of a test.
+type RootFS struct {
+	// Path is the host path of the rootfs, as given to the functions of the cdi package working on a
+	// rootfs mounted on the host.
+	Path string
+
+	t              testing.TB
+	ldconfigLogDir string
+}
+
+// NewFakeRootFS returns a fake rootfs holding the linker configuration of a glibc based container and
+// a stub ldconfig at cdi.LdconfigPath, which only records its invocations. The directory of the stub
+// is put ahead of PATH for the duration of the test so that it is also found when ldconfig is run from
+// the host, which prevents the test from running in parallel with the others.
+func NewFakeRootFS(t testing.TB) *RootFS {
+	t.Helper()
+
+	r := &RootFS{Path: t.TempDir(), t: t, ldconfigLogDir: t.TempDir()}
+
+	for _, dir := range []string{"/etc/ld.so.conf.d", "/usr/lib", "/lib"} {
+		require.NoError(t, os.MkdirAll(r.HostPath(dir), 0755))
+	}
+
+	r.AddFile("/etc/ld.so.conf", "include /etc/ld.so.conf.d/*.conf\n")
+
+	stub := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> '%s'\n", r.ldconfigLog())
+	r.AddFile(cdi.LdconfigPath, stub)
+	require.NoError(t, os.Chmod(r.HostPath(cdi.LdconfigPath), 0755))
+
+	t.Setenv("PATH", r.HostPath(filepath.Dir(cdi.LdconfigPath))+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return r
+}
+
+// HostPath returns the host path of the path inside the container.
+func (r *RootFS) HostPath(path string) string {
+	return filepath.Join(r.Path, path)
+}
+
+// AddFile writes content to the file at path inside the container, creating its missing parents.
+func (r *RootFS) AddFile(path string, content string) {
+	r.t.Helper()
+
+	require.NoError(r.t, os.MkdirAll(filepath.Dir(r.HostPath(path)), 0755))
+	require.NoError(r.t, os.WriteFile(r.HostPath(path), []byte(content), 0644))
+}
+
+// AddLibrary adds a fake library at path inside the container, for the CDI symlinks to point at.
+func (r *RootFS) AddLibrary(path string) {
+	r.t.Helper()
+
+	r.AddFile(path, "library")
+}
+
+// AssertSymlink checks that link inside the container is a symlink to target.
+func (r *RootFS) AssertSymlink(link string, target string) {
+	r.t.Helper()
+
+	actual, err := os.Readlink(r.HostPath(link))
+	if assert.NoError(r.t, err, "The CDI symlink %q is missing", link) {
+		assert.Equal(r.t, target, actual, "Unexpected target for the CDI symlink %q", link)
+	}
+}
+
+// AssertNoFile checks that nothing exists at path inside the container.
+func (r *RootFS) AssertNoFile(path string) {
+	r.t.Helper()
+
+	_, err := os.Lstat(r.HostPath(path))
+	assert.ErrorIs(r.t, err, os.ErrNotExist, "Unexpected file at %q", path)
+}
+
+// AssertLinkerConfEntries checks that the entries of the CDI linker conf file of the container, the
+// one of the hooks without a linker conf file suffix, are exactly entries.
+func (r *RootFS) AssertLinkerConfEntries(entries ...string) {
+	r.t.Helper()
+
+	actual, err := cdi.ParseLdConfEntries(r.HostPath(filepath.Join("/etc/ld.so.conf.d", cdi.CDILinkerConfFile)))
+	require.NoError(r.t, err)
+
+	if entries == nil {
+		entries = []string{}
+	}
+
+	assert.Equal(r.t, entries, actual, "Unexpected CDI linker conf entries")
+}
+
+// LdconfigCalls returns the arguments of each invocation of the stub ldconfig, in order.
+func (r *RootFS) LdconfigCalls() [][]string {
+	r.t.Helper()
+
+	content, err := os.ReadFile(r.ldconfigLog())
+	if errors.Is(err, fs.ErrNotExist) {
+		return [][]string{}
+	}
+
+	require.NoError(r.t, err)
+
+	calls := [][]string{}
+	for line := range strings.SplitSeq(strings.TrimSuffix(string(content), "\n"), "\n") {
+		calls = append(calls, strings.Fields(line))
+	}
+
+	return calls
+}
+
+// ldconfigLog returns the host path of the file the stub ldconfig records its invocations in.
+func (r *RootFS) ldconfigLog() string {
+	return filepath.Join(r.ldconfigLogDir, "ldconfig.log")
+}
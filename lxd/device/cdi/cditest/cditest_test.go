@@ -0,0 +1,39 @@
+package cditest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd/lxd/device/cdi"
+)
+
+func TestNewFakeRootFS(t *testing.T) {
+	rootFS := NewFakeRootFS(t)
+	rootFS.AddLibrary("/usr/lib/cdi/libcuda.so.535")
+
+	hooks := `
+ld_cache_updates:
+  - /usr/lib/cdi
+symlinks:
+  - target: libcuda.so.535
+    link: /usr/lib/cdi/libcuda.so.1
+`
+
+	hooksFile := filepath.Join(t.TempDir(), "hooks.yaml")
+	require.NoError(t, os.WriteFile(hooksFile, []byte(hooks), 0644))
+
+	_, err := cdi.ApplyHooksToRootFS(hooksFile, rootFS.Path, cdi.ApplyOptions{BuildMode: true})
+	require.NoError(t, err)
+	rootFS.AssertSymlink("/usr/lib/cdi/libcuda.so.1", "libcuda.so.535")
+	rootFS.AssertLinkerConfEntries("/usr/lib/cdi")
+	rootFS.AssertNoFile("/usr/lib/cdi/libcuda.so")
+
+	assert.Empty(t, rootFS.LdconfigCalls())
+	require.NoError(t, exec.Command("ldconfig", "-X", "-r", rootFS.Path).Run())
+	assert.Equal(t, [][]string{{"-X", "-r", rootFS.Path}}, rootFS.LdconfigCalls())
+}
@@ -0,0 +1,281 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// CheckType is the kind of precondition described by a CheckResult.
+type CheckType string
+
+const (
+	// CheckSymlink checks that a CDI symlink can be created at its link path.
+	CheckSymlink CheckType = "symlink"
+	// CheckSymlinkTarget checks that the target of a CDI symlink exists.
+	CheckSymlinkTarget CheckType = "symlink-target"
+	// CheckDirectory checks that a directory can be created or used for the CDI files.
+	CheckDirectory CheckType = "directory"
+	// CheckLinkerConf checks that a library directory can be added to the linker configuration.
+	CheckLinkerConf CheckType = "linker-conf"
+	// CheckLdconfig checks that ldconfig is present in the container.
+	CheckLdconfig CheckType = "ldconfig"
+)
+
+// CheckResult is the outcome of a precondition ApplyHooksToContainer relies on.
+type CheckResult struct {
+	// Type is the kind of precondition.
+	Type CheckType `json:"type" yaml:"type"`
+	// Path is the symlink, the directory, the library directory or the binary being checked.
+	Path string `json:"path" yaml:"path"`
+	// Passed indicates whether the precondition holds.
+	Passed bool `json:"passed" yaml:"passed"`
+	// Reason explains why the precondition does not hold.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// CheckHooks runs the precondition checks ApplyHooksToContainer relies on against a container and
+// reports the outcome of each of them without modifying the container. Unlike
+// ApplyHooksToContainerDryRun, which lists the planned changes, it reports whether the hooks can be
+// applied at all. An error is only returned when the checks cannot be run.
+func CheckHooks(hooksFilePath string, c instance.Container) ([]CheckResult, error) {
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return checkHooksWithFS(hooksFilePath, &sftpContainerFS{client: sftpClient})
+}
+
+// checkHooksWithFS is the testable core of CheckHooks.
+func checkHooksWithFS(hooksFilePath string, cfs containerFS) ([]CheckResult, error) {
+	hooks, err := loadHooksFile(hooksFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	libc, err := detectLibc(cfs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed detecting the C library of the container: %w", err)
+	}
+
+	results := []CheckResult{}
+	checkedDirs := make(map[string]bool)
+	checkDir := func(path string) (bool, error) {
+		passed, checked := checkedDirs[path]
+		if checked {
+			return passed, nil
+		}
+
+		reason, err := checkDirectory(cfs, path)
+		if err != nil {
+			return false, err
+		}
+
+		checkedDirs[path] = reason == ""
+		results = append(results, CheckResult{Type: CheckDirectory, Path: path, Passed: reason == "", Reason: reason})
+		return reason == "", nil
+	}
+
+	// The links of the batch are created before the links pointing at them.
+	batchLinks := make(map[string]bool, len(hooks.Symlinks))
+	for _, symlink := range hooks.Symlinks {
+		batchLinks[filepath.Clean(symlink.Link)] = true
+	}
+
+	for _, symlink := range hooks.Symlinks {
+		result := CheckResult{Type: CheckSymlink, Path: symlink.Link}
+
+		target, err := resolveTarget(symlink.Link, symlink.Target, symlink.KeepAbsolute)
+		if err != nil {
+			result.Reason = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		dirPassed, err := checkDir(filepath.Dir(symlink.Link))
+		if err != nil {
+			return nil, err
+		}
+
+		if !dirPassed {
+			// The link cannot be checked further without its directory.
+			result.Reason = "The directory of the link cannot be used"
+			results = append(results, result)
+			continue
+		}
+
+		result.Reason, err = checkLinkPath(cfs, symlink)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Passed = result.Reason == ""
+		results = append(results, result)
+
+		targetResult := CheckResult{Type: CheckSymlinkTarget, Path: absoluteSymlinkTarget(symlink.Link, target)}
+		if !batchLinks[targetResult.Path] {
+			targetResult.Reason, err = checkLinkTarget(cfs, symlink, targetResult.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		targetResult.Passed = targetResult.Reason == ""
+		results = append(results, targetResult)
+	}
+
+	if len(hooks.LDCacheUpdates) == 0 {
+		return results, nil
+	}
+
+	if libc.flavor == LibcFlavorMusl {
+		_, err = checkDir("/etc")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, confErr := linkerConfFilePath(hooks.LinkerConfSuffix, hooks.LinkerConfPriority)
+
+		_, err = checkDir(linkerConfDir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, update := range hooks.LDCacheUpdates {
+			result := CheckResult{Type: CheckLinkerConf, Path: update, Passed: confErr == nil}
+			if confErr != nil {
+				result.Reason = confErr.Error()
+			}
+
+			results = append(results, result)
+		}
+
+		// A missing ldconfig does not fail ApplyHooksToContainer but leaves the linker cache stale.
+		result := CheckResult{Type: CheckLdconfig, Path: LdconfigPath, Passed: true}
+		ldconfig, err := findLdconfig(cfs, "")
+		if err != nil {
+			result.Passed = false
+			result.Reason = err.Error()
+		} else {
+			result.Path = ldconfig
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// checkDirectory returns why the directory at path cannot be used for the CDI files, or an empty
+// string if it can. The directory either exists or its nearest existing ancestor is a directory it
+// can be created in. Only the root user of the container writes to it so the permissions are not
+// checked.
+func checkDirectory(cfs containerFS, path string) (string, error) {
+	dir := filepath.Clean(path)
+	for {
+		resolved, err := resolveContainerPath(cfs, dir)
+		if err == nil {
+			var fileInfo os.FileInfo
+			fileInfo, err = cfs.Lstat(resolved)
+			if err == nil {
+				if !fileInfo.IsDir() {
+					return fmt.Sprintf("%q is not a directory", dir), nil
+				}
+
+				return "", nil
+			}
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("Failed checking the directory %q: %w", dir, err)
+		}
+
+		if dir == "/" {
+			// A missing root is the case of a writable root not created yet.
+			return "", nil
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// checkLinkPath returns why the CDI link of symlink cannot be created, or an empty string if it can.
+// An existing symlink is replaced and an existing regular file is backed up for a symlink, while
+// any other file is left in place, which fails the apply unless it is already the hard link
+// requested.
+func checkLinkPath(cfs containerFS, symlink SymlinkEntry) (string, error) {
+	fileInfo, err := cfs.Lstat(symlink.Link)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Failed checking the CDI symlink path %q: %w", symlink.Link, err)
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return "", nil
+	}
+
+	if fileInfo.Mode().IsRegular() {
+		if symlink.Kind == SymlinkKindHardlink {
+			// Whether it is the target is checked with the target.
+			return "", nil
+		}
+
+		_, err = cfs.Lstat(symlink.Link + symlinkBackupSuffix)
+		if err == nil {
+			return fmt.Sprintf("A backup of the file at %q already exists", symlink.Link), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("Failed checking the backup path of %q: %w", symlink.Link, err)
+		}
+
+		return "", nil
+	}
+
+	return fmt.Sprintf("A file that is not a symlink already exists at %q", symlink.Link), nil
+}
+
+// checkLinkTarget returns why the target of symlink at targetPath is not usable, or an empty string
+// if it is. A symlink to a missing target is created broken while a hard link cannot be created.
+func checkLinkTarget(cfs containerFS, symlink SymlinkEntry, targetPath string) (string, error) {
+	resolved, err := resolveContainerPath(cfs, targetPath)
+
+	var targetInfo os.FileInfo
+	if err == nil {
+		targetInfo, err = cfs.Lstat(resolved)
+	}
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Sprintf("The target %q does not exist", targetPath), nil
+		}
+
+		return "", fmt.Errorf("Failed checking the target %q of the CDI symlink %q: %w", targetPath, symlink.Link, err)
+	}
+
+	if symlink.Kind != SymlinkKindHardlink {
+		return "", nil
+	}
+
+	if !targetInfo.Mode().IsRegular() {
+		return fmt.Sprintf("The target %q is not a regular file", targetPath), nil
+	}
+
+	linkInfo, err := cfs.Lstat(symlink.Link)
+	if err == nil && linkInfo.Mode().IsRegular() && !sameFile(linkInfo, targetInfo) {
+		return fmt.Sprintf("A file that is not the target already exists at %q", symlink.Link), nil
+	}
+
+	return "", nil
+}
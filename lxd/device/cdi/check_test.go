@@ -0,0 +1,109 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHooks(t *testing.T) {
+	t.Run("applicable hooks pass", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+		createLibrary(t, tmpDir, "/sbin/ldconfig")
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libfoo.so", Link: "/usr/lib/nvidia/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		results, err := checkHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		for _, result := range results {
+			assert.True(t, result.Passed, "%s %s: %s", result.Type, result.Path, result.Reason)
+		}
+
+		assert.Equal(t, []CheckResult{
+			{Type: CheckDirectory, Path: "/usr/lib", Passed: true},
+			{Type: CheckSymlink, Path: "/usr/lib/libfoo.so", Passed: true},
+			{Type: CheckSymlinkTarget, Path: "/usr/lib/libfoo.so.1", Passed: true},
+			{Type: CheckDirectory, Path: "/usr/lib/nvidia", Passed: true},
+			{Type: CheckSymlink, Path: "/usr/lib/nvidia/libfoo.so", Passed: true},
+			{Type: CheckSymlinkTarget, Path: "/usr/lib/libfoo.so", Passed: true},
+			{Type: CheckDirectory, Path: linkerConfDir, Passed: true},
+			{Type: CheckLinkerConf, Path: "/usr/lib/nvidia", Passed: true},
+			{Type: CheckLdconfig, Path: "/sbin/ldconfig", Passed: true},
+		}, results)
+
+		// Nothing was created.
+		assert.NoDirExists(t, filepath.Join(tmpDir, "usr", "lib", "nvidia"))
+		assert.NoDirExists(t, filepath.Join(tmpDir, "etc"))
+	})
+
+	t.Run("failures are reported per entry", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(tmpDir, "usr", "lib"), 0755)
+		require.NoError(t, err)
+		err = os.Mkdir(filepath.Join(tmpDir, "usr", "lib", "libbar.so"), 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(tmpDir, "usr", "lib", "nvidia"), nil, 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+				{Target: "/usr/lib/libbaz.so.1", Link: "/usr/lib/nvidia/libbaz.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		results, err := checkHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		failed := map[string]string{}
+		for _, result := range results {
+			if !result.Passed {
+				assert.NotEmpty(t, result.Reason)
+				failed[string(result.Type)+" "+result.Path] = result.Reason
+			}
+		}
+
+		assert.Contains(t, failed, "symlink-target /usr/lib/libfoo.so.1")
+		assert.Contains(t, failed, "symlink /usr/lib/libbar.so")
+		assert.Contains(t, failed, "directory /usr/lib/nvidia")
+		assert.Contains(t, failed, "symlink /usr/lib/nvidia/libbaz.so")
+		assert.Contains(t, failed, "ldconfig "+LdconfigPath)
+		assert.NotContains(t, failed, "symlink /usr/lib/libfoo.so")
+	})
+
+	t.Run("hardlink to a missing target fails", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		results, err := checkHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, CheckSymlinkTarget, results[2].Type)
+		assert.False(t, results[2].Passed)
+	})
+}
@@ -0,0 +1,152 @@
+package cdi
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+const (
+	// ConditionTargetExists only applies a symlink when its target exists in the container. A symlink
+	// with a SearchDir is applied when a versioned file of its soname is found there.
+	ConditionTargetExists = "targetExists"
+	// ConditionDirExists only applies a symlink when the directory of its target (or its SearchDir)
+	// exists in the container, and a library directory of the LDCacheUpdates when it exists.
+	ConditionDirExists = "dirExists"
+)
+
+// validateSymlinkCondition checks that the condition of symlink is known.
+func validateSymlinkCondition(symlink SymlinkEntry) error {
+	switch symlink.Condition {
+	case "", ConditionTargetExists, ConditionDirExists:
+		return nil
+	default:
+		return fmt.Errorf("Unknown condition %q for the link %q", symlink.Condition, symlink.Link)
+	}
+}
+
+// validateLDCacheConditions checks that each library directory of conditions is one of updates and
+// that its condition applies to a directory.
+func validateLDCacheConditions(conditions map[string]string, updates []string) error {
+	for dir, condition := range conditions {
+		if !containsCleanPath(updates, dir) {
+			return fmt.Errorf("The library directory %q of the condition %q is not in the linker cache updates", dir, condition)
+		}
+
+		if condition != ConditionDirExists {
+			return fmt.Errorf("Unknown condition %q for the library directory %q, only %q applies to the library directories", condition, dir, ConditionDirExists)
+		}
+	}
+
+	return nil
+}
+
+// containsCleanPath returns whether paths holds p once both are cleaned.
+func containsCleanPath(paths []string, p string) bool {
+	for _, path := range paths {
+		if filepath.Clean(path) == filepath.Clean(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// symlinkConditionHolds returns whether the condition of symlink holds in the container.
+func symlinkConditionHolds(cfs containerFS, symlink SymlinkEntry) (bool, error) {
+	if symlink.SearchDir != "" {
+		if symlink.Condition == ConditionDirExists {
+			return isContainerDir(cfs, symlink.SearchDir)
+		}
+
+		_, candidates, err := sonameCandidates(cfs, symlink)
+		if err != nil {
+			if isMissingPath(err) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		return len(candidates) > 0, nil
+	}
+
+	target := absoluteSymlinkTarget(filepath.Clean(symlink.Link), symlink.Target)
+	if symlink.Condition == ConditionDirExists {
+		return isContainerDir(cfs, filepath.Dir(target))
+	}
+
+	_, err := resolveContainerPath(cfs, target)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the target %q of the link %q: %w", symlink.Target, symlink.Link, err)
+	}
+
+	return true, nil
+}
+
+// filterConditionalHooks returns hooks without the symlinks and the library directories whose
+// condition does not hold in the container, checked through cfs, which are returned too. The hooks
+// are returned as they are when nothing is skipped and are never changed.
+func filterConditionalHooks(cfs containerFS, hooks *Hooks, l logger.Logger) (*Hooks, []SymlinkEntry, []string, error) {
+	l = loggerOrNop(l)
+
+	symlinks := make([]SymlinkEntry, 0, len(hooks.Symlinks))
+	skippedSymlinks := []SymlinkEntry{}
+	for _, symlink := range hooks.Symlinks {
+		if symlink.Condition == "" {
+			symlinks = append(symlinks, symlink)
+			continue
+		}
+
+		holds, err := symlinkConditionHolds(cfs, symlink)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if holds {
+			symlinks = append(symlinks, symlink)
+			continue
+		}
+
+		l.Debug("Skipped CDI symlink whose condition does not hold", logger.Ctx{"link": symlink.Link, "target": symlink.Target, "condition": symlink.Condition})
+		skippedSymlinks = append(skippedSymlinks, symlink)
+	}
+
+	updates := make([]string, 0, len(hooks.LDCacheUpdates))
+	skippedUpdates := []string{}
+	for _, update := range hooks.LDCacheUpdates {
+		condition := hooks.LDCacheConditions[filepath.Clean(update)]
+		if condition == "" {
+			updates = append(updates, update)
+			continue
+		}
+
+		holds, err := isContainerDir(cfs, update)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if holds {
+			updates = append(updates, update)
+			continue
+		}
+
+		l.Debug("Skipped CDI library directory whose condition does not hold", logger.Ctx{"dir": update, "condition": condition})
+		skippedUpdates = append(skippedUpdates, update)
+	}
+
+	if len(skippedSymlinks) == 0 && len(skippedUpdates) == 0 {
+		return hooks, nil, nil, nil
+	}
+
+	filtered := *hooks
+	filtered.Symlinks = symlinks
+	filtered.LDCacheUpdates = updates
+
+	return &filtered, skippedSymlinks, skippedUpdates, nil
+}
@@ -0,0 +1,79 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHooksConditions(t *testing.T) {
+	tmpDir := t.TempDir()
+	createLibrary(t, tmpDir, "/usr/lib/nvidia/libcuda.so.535")
+	createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.1.535")
+
+	hooks := Hooks{
+		LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib/nvidia/32"},
+		LDCacheConditions: map[string]string{
+			"/usr/lib/nvidia":    ConditionDirExists,
+			"/usr/lib/nvidia/32": ConditionDirExists,
+		},
+		Symlinks: []SymlinkEntry{
+			{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1", Condition: ConditionTargetExists},
+			{Target: "libvdpau_nvidia.so.535", Link: "/usr/lib/nvidia/libvdpau_nvidia.so", Condition: ConditionTargetExists},
+			{Target: "/usr/lib/nvidia/32/libcuda.so.535", Link: "/usr/lib/libcuda32.so", Condition: ConditionDirExists},
+			{Target: "libnvidia-ml.so.1", Link: "/usr/lib/nvidia/libnvidia-ml.so.1", SearchDir: "/usr/lib/nvidia", Condition: ConditionTargetExists},
+			{Target: "libnvidia-encode.so.1", Link: "/usr/lib/nvidia/libnvidia-encode.so.1", SearchDir: "/usr/lib/nvidia", Condition: ConditionTargetExists},
+		},
+	}
+
+	result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []SymlinkEntry{
+		{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1", Condition: ConditionTargetExists},
+		{Target: "/usr/lib/nvidia/libnvidia-ml.so.1.535", Link: "/usr/lib/nvidia/libnvidia-ml.so.1", Condition: ConditionTargetExists},
+	}, result.CreatedSymlinks)
+	assert.Equal(t, []SymlinkEntry{hooks.Symlinks[1], hooks.Symlinks[2], hooks.Symlinks[4]}, result.ConditionallySkippedSymlinks)
+	assert.Equal(t, []string{"/usr/lib/nvidia"}, result.LDCacheEntries)
+	assert.Equal(t, []string{"/usr/lib/nvidia/32"}, result.ConditionallySkippedLDCacheUpdates)
+
+	for _, link := range []string{"/usr/lib/nvidia/libvdpau_nvidia.so", "/usr/lib/libcuda32.so", "/usr/lib/nvidia/libnvidia-encode.so.1"} {
+		_, err := os.Lstat(filepath.Join(tmpDir, link))
+		assert.ErrorIs(t, err, os.ErrNotExist, link)
+	}
+}
+
+func TestValidateHooksConditions(t *testing.T) {
+	tests := []struct {
+		name  string
+		hooks Hooks
+		want  string
+	}{
+		{
+			name:  "unknown symlink condition",
+			hooks: Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Condition: "fileExists"}}},
+			want:  `Unknown condition "fileExists" for the link "/usr/lib/libfoo.so"`,
+		},
+		{
+			name:  "library directory not updated",
+			hooks: Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}, LDCacheConditions: map[string]string{"/usr/lib/other": ConditionDirExists}},
+			want:  `The library directory "/usr/lib/other" of the condition "dirExists" is not in the linker cache updates`,
+		},
+		{
+			name:  "target condition for a library directory",
+			hooks: Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}, LDCacheConditions: map[string]string{"/usr/lib/cdi": ConditionTargetExists}},
+			want:  `Unknown condition "targetExists" for the library directory "/usr/lib/cdi"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHooks(&tt.hooks)
+			assert.ErrorIs(t, err, ErrInvalidHook)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
+	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
 	"tags.cncf.io/container-device-interface/specs-go"
 
 	"github.com/canonical/lxd/lxd/instance"
@@ -56,6 +58,10 @@ func specDevToInstanceDev(configDevices *ConfigDevices, d specs.DeviceNode) erro
 		instanceDev["gid"] = strconv.FormatUint(uint64(*d.GID), 10)
 	}
 
+	if d.FileMode != nil {
+		instanceDev["mode"] = fmt.Sprintf("%04o", d.FileMode.Perm())
+	}
+
 	configDevices.UnixCharDevs = append(configDevices.UnixCharDevs, instanceDev)
 	return nil
 }
@@ -183,6 +189,9 @@ func specMountToInstanceDev(configDevices *ConfigDevices, cdiID ID, mounts []*sp
 	return indirectSymlinks, nil
 }
 
+// ignoredUpdateLdcacheFlags are the flags of the update-ldcache CDI hook that are not folders.
+var ignoredUpdateLdcacheFlags = []string{"--ldconfig-path", "--container-spec"}
+
 // specHookToLXDCDIHook will translate a hook from a CDI spec into an entry in a `Hooks`.
 // Some CDI hooks are not relevant for LXD and will be ignored.
 func specHookToLXDCDIHook(hook *specs.Hook, hooks *Hooks) error {
@@ -238,12 +247,25 @@ func specHookToLXDCDIHook(hook *specs.Hook, hooks *Hooks) error {
 		// `--folder <folder> --folder <folder> ...`
 		// or `--folder=<folder> --folder=<folder> ...`
 		// and we need to handle both cases as they are both valid.
+		// The recent versions of the hook also take the path of ldconfig and of the OCI spec, which are
+		// not folders.
 		var folder string
-		for i := range args {
+		for i := 0; i < len(args); i++ {
 			if args[i] == "--folder" {
 				continue
 			}
 
+			if slices.Contains(ignoredUpdateLdcacheFlags, args[i]) {
+				// Skip the value of the flag too.
+				i++
+				continue
+			}
+
+			flag, _, _ := strings.Cut(args[i], "=")
+			if slices.Contains(ignoredUpdateLdcacheFlags, flag) {
+				continue
+			}
+
 			_, after, found := strings.Cut(args[i], "=")
 			if found {
 				// We can assume the arg is `--folder=<folder>`
@@ -292,6 +314,11 @@ func applyContainerEdits(edits specs.ContainerEdits, configDevices *ConfigDevice
 		}
 	}
 
+	return applyContainerEditsHooks(edits, hooks)
+}
+
+// applyContainerEditsHooks updates the hooks with the CDI hooks of "container edits".
+func applyContainerEditsHooks(edits specs.ContainerEdits, hooks *Hooks) error {
 	for _, hook := range edits.Hooks {
 		err := specHookToLXDCDIHook(hook, hooks)
 		if err != nil {
@@ -302,6 +329,112 @@ func applyContainerEdits(edits specs.ContainerEdits, configDevices *ConfigDevice
 	return nil
 }
 
+// minSpecVersion is the oldest CDI spec version GenerateHooks supports. The newest one is the
+// current version of the CDI spec package.
+const minSpecVersion = "0.5.0"
+
+// GenerateHooks reads the CDI specification file at cdiSpecPath (JSON or YAML) and returns the
+// hooks (symlinks to create and folders to add to the linker cache) of all its container edits,
+// both device specific and general ones. The hooks are meant to be applied to the container whose
+// rootfs is containerRootFS.
+// The version of the spec is detected from its cdiVersion and recorded in the hooks. The specs whose
+// version is not supported are rejected rather than read as empty hooks.
+func GenerateHooks(cdiSpecPath string, containerRootFS string) (*Hooks, error) {
+	return GenerateHooksForVersion(cdiSpecPath, containerRootFS, "")
+}
+
+// GenerateHooksForVersion is GenerateHooks reading the spec as the given CDI spec version (e.g.
+// "0.6.0") instead of its cdiVersion, unless version is empty.
+func GenerateHooksForVersion(cdiSpecPath string, containerRootFS string, version string) (*Hooks, error) {
+	content, err := os.ReadFile(cdiSpecPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the CDI spec file at %q: %w", cdiSpecPath, err)
+	}
+
+	spec, err := cdiapi.ParseSpec(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing the CDI spec file at %q: %w", cdiSpecPath, err)
+	}
+
+	if version == "" && spec != nil {
+		version = spec.Version
+	}
+
+	version, err = checkSpecVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the CDI spec file at %q: %w", cdiSpecPath, err)
+	}
+
+	hooks := &Hooks{ContainerRootFS: containerRootFS, SpecVersion: version}
+	if spec == nil {
+		return hooks, nil
+	}
+
+	for _, device := range spec.Devices {
+		err = applyContainerEditsHooks(device.ContainerEdits, hooks)
+		if err != nil {
+			return nil, fmt.Errorf("Failed processing the hooks of CDI device %q: %w", device.Name, err)
+		}
+	}
+
+	err = applyContainerEditsHooks(spec.ContainerEdits, hooks)
+	if err != nil {
+		return nil, fmt.Errorf("Failed processing the CDI hooks: %w", err)
+	}
+
+	return hooks, nil
+}
+
+// checkSpecVersion checks that the CDI spec version is between minSpecVersion and the current
+// version of the CDI spec package and returns it without its optional "v" prefix.
+func checkSpecVersion(version string) (string, error) {
+	if version == "" {
+		return "", errors.New("The CDI spec has no version")
+	}
+
+	version = strings.TrimPrefix(version, "v")
+	parsed, err := parseSpecVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	minVersion, err := parseSpecVersion(minSpecVersion)
+	if err != nil {
+		return "", err
+	}
+
+	maxVersion, err := parseSpecVersion(specs.CurrentVersion)
+	if err != nil {
+		return "", err
+	}
+
+	if slices.Compare(parsed, minVersion) < 0 || slices.Compare(parsed, maxVersion) > 0 {
+		return "", fmt.Errorf("Unsupported CDI spec version %q, the supported versions are %s to %s", version, minSpecVersion, specs.CurrentVersion)
+	}
+
+	return version, nil
+}
+
+// parseSpecVersion returns the major, minor and patch numbers of a CDI spec version.
+func parseSpecVersion(version string) ([]int, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid CDI spec version %q", version)
+	}
+
+	numbers := make([]int, 0, len(parts))
+	for _, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("Invalid CDI spec version %q", version)
+		}
+
+		numbers = append(numbers, number)
+	}
+
+	return numbers, nil
+}
+
 // GenerateFromCDI does several things:
 // 1. Generate a CDI specification from a CDI ID and an instance. According the
 // the specified 'vendor', 'class' and 'name' (this assembled triplet is called
@@ -389,21 +522,99 @@ func GenerateFromCDI(isCore bool, inst instance.Instance, cdiID ID) (*ConfigDevi
 	return configDevices, hooks, nil
 }
 
-// ReloadConfigDevicesFromDisk reads the paths to the CDI configuration devices file from the disk.
-// This is useful in order to cache the CDI configuration devices file so that wee don't have to re-generate a CDI spec whhen stopping the container.
-func ReloadConfigDevicesFromDisk(pathsToConfigDevicesFilePath string) (ConfigDevices, error) {
-	// Load the config devices file from the disk
-	pathsToCDIConfigDevicesFile, err := os.Open(pathsToConfigDevicesFilePath)
+// LoadConfigDevices reads and decodes the CDI configuration devices file (see CDIConfigDevicesFileSuffix)
+// at path.
+func LoadConfigDevices(path string) (*ConfigDevices, error) {
+	configDevicesFile, err := os.Open(path)
 	if err != nil {
-		return ConfigDevices{}, fmt.Errorf("Failed opening the paths to CDI conf file at %q: %w", pathsToConfigDevicesFilePath, err)
+		return nil, fmt.Errorf("Failed opening the CDI config devices file at %q: %w", path, err)
 	}
 
-	defer pathsToCDIConfigDevicesFile.Close()
+	defer configDevicesFile.Close()
 
 	configDevices := &ConfigDevices{}
-	err = json.NewDecoder(pathsToCDIConfigDevicesFile).Decode(configDevices)
+	err = json.NewDecoder(configDevicesFile).Decode(configDevices)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decoding the CDI config devices file at %q: %w", path, err)
+	}
+
+	return configDevices, nil
+}
+
+// ValidateConfigDevices checks that the CDI configuration devices are complete before they are used to
+// configure the instance devices. Each unix-char device must have absolute "source" and "path" and
+// integer "major" and "minor" (and "uid" and "gid" when set, as well as an octal "mode"). Each bind
+// mount must have absolute "source" and "path".
+func ValidateConfigDevices(cd *ConfigDevices) error {
+	if cd == nil {
+		return errors.New("No CDI config devices")
+	}
+
+	for i, dev := range cd.UnixCharDevs {
+		for _, key := range []string{"source", "path"} {
+			err := validateConfigDevicePath(dev, key)
+			if err != nil {
+				return fmt.Errorf("Invalid CDI unix-char device at index %d: %w", i, err)
+			}
+		}
+
+		for _, key := range []string{"major", "minor", "uid", "gid"} {
+			value, ok := dev[key]
+			if !ok && (key == "uid" || key == "gid") {
+				continue
+			}
+
+			if value == "" {
+				return fmt.Errorf("Invalid CDI unix-char device at index %d: Missing %q", i, key)
+			}
+
+			_, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid CDI unix-char device at index %d: Invalid %q %q: %w", i, key, value, err)
+			}
+		}
+
+		mode, ok := dev["mode"]
+		if ok {
+			_, err := parseFileMode(mode)
+			if err != nil {
+				return fmt.Errorf("Invalid CDI unix-char device at index %d: %w", i, err)
+			}
+		}
+	}
+
+	for i, mount := range cd.BindMounts {
+		for _, key := range []string{"source", "path"} {
+			err := validateConfigDevicePath(mount, key)
+			if err != nil {
+				return fmt.Errorf("Invalid CDI bind mount at index %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateConfigDevicePath checks that the key of a CDI config device is an absolute path.
+func validateConfigDevicePath(dev map[string]string, key string) error {
+	value := dev[key]
+	if value == "" {
+		return fmt.Errorf("Missing %q", key)
+	}
+
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("The %q %q is not an absolute path", key, value)
+	}
+
+	return nil
+}
+
+// ReloadConfigDevicesFromDisk reads the paths to the CDI configuration devices file from the disk.
+// This is useful in order to cache the CDI configuration devices file so that wee don't have to re-generate a CDI spec whhen stopping the container.
+func ReloadConfigDevicesFromDisk(pathsToConfigDevicesFilePath string) (ConfigDevices, error) {
+	configDevices, err := LoadConfigDevices(pathsToConfigDevicesFilePath)
 	if err != nil {
-		return ConfigDevices{}, fmt.Errorf("Failed decoding the paths to CDI conf file at %q: %w", pathsToConfigDevicesFilePath, err)
+		return ConfigDevices{}, err
 	}
 
 	return *configDevices, nil
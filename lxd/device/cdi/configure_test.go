@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -157,6 +158,7 @@ func TestGenerateFromCDI(t *testing.T) {
 	t.Run("Device with UID and GID", func(t *testing.T) {
 		uid := uint32(1000)
 		gid := uint32(44)
+		mode := os.FileMode(0660)
 		generateSpec = func(isCore bool, cdiID ID, inst instance.Instance) (*specs.Spec, error) {
 			return &specs.Spec{
 				Version: "0.5.0",
@@ -173,6 +175,7 @@ func TestGenerateFromCDI(t *testing.T) {
 									Minor:    0,
 									UID:      &uid,
 									GID:      &gid,
+									FileMode: &mode,
 								},
 							},
 						},
@@ -195,6 +198,7 @@ func TestGenerateFromCDI(t *testing.T) {
 		assert.Equal(t, "0", config.UnixCharDevs[0]["minor"])
 		assert.Equal(t, "1000", config.UnixCharDevs[0]["uid"])
 		assert.Equal(t, "44", config.UnixCharDevs[0]["gid"])
+		assert.Equal(t, "0660", config.UnixCharDevs[0]["mode"])
 	})
 
 	t.Run("Device without UID and GID", func(t *testing.T) {
@@ -233,6 +237,7 @@ func TestGenerateFromCDI(t *testing.T) {
 		assert.Equal(t, "/dev/kfd", config.UnixCharDevs[0]["path"])
 		assert.NotContains(t, config.UnixCharDevs[0], "uid")
 		assert.NotContains(t, config.UnixCharDevs[0], "gid")
+		assert.NotContains(t, config.UnixCharDevs[0], "mode")
 		assert.Equal(t, "509", config.UnixCharDevs[0]["major"])
 		assert.Equal(t, "0", config.UnixCharDevs[0]["minor"])
 	})
@@ -370,3 +375,189 @@ func TestSpecMountToInstanceDev_SymlinkHostPath(t *testing.T) {
 	require.Len(t, indirectSymlinks, 1)
 	assert.Equal(t, SymlinkEntry{Target: expectedHostPath2, Link: expectedContainerSymlinkPath2}, indirectSymlinks[0])
 }
+
+func TestGenerateHooks(t *testing.T) {
+	t.Run("Hooks from devices and general edits", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		specPath := filepath.Join(tmpDir, "nvidia.yaml")
+		spec := `cdiVersion: 0.6.0
+kind: nvidia.com/gpu
+devices:
+- name: "0"
+  containerEdits:
+    hooks:
+    - hookName: createContainer
+      path: /usr/bin/nvidia-cdi-hook
+      args: ["nvidia-cdi-hook", "create-symlinks", "--link", "libcuda.so.1::/usr/lib/x86_64-linux-gnu/libcuda.so"]
+containerEdits:
+  hooks:
+  - hookName: createContainer
+    path: /usr/bin/nvidia-cdi-hook
+    args: ["nvidia-cdi-hook", "update-ldcache", "--folder", "/usr/lib/x86_64-linux-gnu", "--folder=/usr/lib/nvidia"]
+`
+		err := os.WriteFile(specPath, []byte(spec), 0644)
+		require.NoError(t, err)
+
+		hooks, err := GenerateHooks(specPath, "/var/lib/lxd/containers/c1/rootfs")
+		require.NoError(t, err)
+
+		assert.Equal(t, "/var/lib/lxd/containers/c1/rootfs", hooks.ContainerRootFS)
+		assert.Equal(t, []SymlinkEntry{{Target: "libcuda.so.1", Link: "/usr/lib/x86_64-linux-gnu/libcuda.so"}}, hooks.Symlinks)
+		assert.Equal(t, []string{"/usr/lib/x86_64-linux-gnu", "/usr/lib/nvidia"}, hooks.LDCacheUpdates)
+		assert.Equal(t, "0.6.0", hooks.SpecVersion)
+	})
+
+	t.Run("Spec versions", func(t *testing.T) {
+		tests := []struct {
+			version string
+			err     string
+		}{
+			{version: "0.5.0"},
+			{version: "0.6.0"},
+			{version: "0.7.0"},
+			{version: "v0.8.0"},
+			{version: "1.0.0"},
+			{version: "0.4.0", err: `Unsupported CDI spec version "0.4.0", the supported versions are 0.5.0 to `},
+			{version: "9.0.0", err: `Unsupported CDI spec version "9.0.0"`},
+			{version: "0.6", err: `Invalid CDI spec version "0.6"`},
+			{version: "", err: "The CDI spec has no version"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.version, func(t *testing.T) {
+				specPath := filepath.Join(t.TempDir(), "nvidia.yaml")
+				spec := "cdiVersion: \"" + tt.version + "\"\nkind: nvidia.com/gpu\ncontainerEdits:\n  hooks:\n  - hookName: createContainer\n    path: /usr/bin/nvidia-ctk\n    args: [\"nvidia-ctk\", \"hook\", \"update-ldcache\", \"--folder\", \"/usr/lib/nvidia\"]\n"
+				require.NoError(t, os.WriteFile(specPath, []byte(spec), 0644))
+
+				hooks, err := GenerateHooks(specPath, "/")
+				if tt.err != "" {
+					assert.ErrorContains(t, err, tt.err)
+					return
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, strings.TrimPrefix(tt.version, "v"), hooks.SpecVersion)
+				assert.Equal(t, []string{"/usr/lib/nvidia"}, hooks.LDCacheUpdates)
+			})
+		}
+	})
+
+	t.Run("Given version", func(t *testing.T) {
+		specPath := filepath.Join(t.TempDir(), "nvidia.yaml")
+		require.NoError(t, os.WriteFile(specPath, []byte("cdiVersion: 0.4.0\nkind: nvidia.com/gpu\n"), 0644))
+
+		hooks, err := GenerateHooksForVersion(specPath, "/", "0.5.0")
+		require.NoError(t, err)
+		assert.Equal(t, "0.5.0", hooks.SpecVersion)
+
+		_, err = GenerateHooksForVersion(specPath, "/", "0.3.0")
+		assert.ErrorContains(t, err, "Unsupported CDI spec version")
+	})
+
+	t.Run("Flags of the recent update-ldcache hooks", func(t *testing.T) {
+		specPath := filepath.Join(t.TempDir(), "nvidia.yaml")
+		spec := `cdiVersion: 0.8.0
+kind: nvidia.com/gpu
+containerEdits:
+  hooks:
+  - hookName: createContainer
+    path: /usr/bin/nvidia-cdi-hook
+    args: ["nvidia-cdi-hook", "update-ldcache", "--ldconfig-path", "/sbin/ldconfig", "--folder", "/usr/lib/nvidia", "--container-spec=/run/spec.json", "--folder=/usr/lib/nvidia/32"]
+`
+		require.NoError(t, os.WriteFile(specPath, []byte(spec), 0644))
+
+		hooks, err := GenerateHooks(specPath, "/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/nvidia/32"}, hooks.LDCacheUpdates)
+	})
+
+	t.Run("Missing spec file", func(t *testing.T) {
+		_, err := GenerateHooks(filepath.Join(t.TempDir(), "missing.json"), "/")
+		assert.ErrorContains(t, err, "Failed reading the CDI spec file")
+	})
+
+	t.Run("Invalid spec file", func(t *testing.T) {
+		specPath := filepath.Join(t.TempDir(), "invalid.json")
+		err := os.WriteFile(specPath, []byte(`{"cdiVersion": "0.6.0", "unknown": true}`), 0644)
+		require.NoError(t, err)
+
+		_, err = GenerateHooks(specPath, "/")
+		assert.ErrorContains(t, err, "Failed parsing the CDI spec file")
+	})
+}
+
+func TestLoadConfigDevices(t *testing.T) {
+	t.Run("Valid file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "gpu0"+CDIConfigDevicesFileSuffix)
+		content := `{"unix_char_devs": [{"path": "/dev/nvidia0", "type": "unix-char"}], "bind_mounts": [{"source": "/usr/lib/libcuda.so.1", "path": "/usr/lib/libcuda.so.1"}]}`
+		err := os.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+
+		configDevices, err := LoadConfigDevices(path)
+		require.NoError(t, err)
+		assert.Equal(t, []map[string]string{{"path": "/dev/nvidia0", "type": "unix-char"}}, configDevices.UnixCharDevs)
+		assert.Equal(t, []map[string]string{{"source": "/usr/lib/libcuda.so.1", "path": "/usr/lib/libcuda.so.1"}}, configDevices.BindMounts)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := LoadConfigDevices(filepath.Join(t.TempDir(), "missing.json"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.ErrorContains(t, err, "Failed opening the CDI config devices file")
+	})
+
+	t.Run("Invalid file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "invalid.json")
+		err := os.WriteFile(path, []byte("not json"), 0644)
+		require.NoError(t, err)
+
+		_, err = LoadConfigDevices(path)
+		assert.ErrorContains(t, err, "Failed decoding the CDI config devices file")
+	})
+}
+
+func TestValidateConfigDevices(t *testing.T) {
+	validCharDev := func() map[string]string {
+		return map[string]string{"type": "unix-char", "source": "/dev/nvidia0", "path": "/dev/nvidia0", "major": "195", "minor": "0"}
+	}
+
+	validMount := func() map[string]string {
+		return map[string]string{"type": "disk", "source": "/usr/lib/libcuda.so.1", "path": "/usr/lib/libcuda.so.1"}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cd *ConfigDevices)
+		err    string
+	}{
+		{"Valid", func(cd *ConfigDevices) {}, ""},
+		{"Valid with UID and GID", func(cd *ConfigDevices) { cd.UnixCharDevs[0]["uid"] = "1000"; cd.UnixCharDevs[0]["gid"] = "1000" }, ""},
+		{"Missing path", func(cd *ConfigDevices) { delete(cd.UnixCharDevs[1], "path") }, `unix-char device at index 1: Missing "path"`},
+		{"Relative path", func(cd *ConfigDevices) { cd.UnixCharDevs[0]["path"] = "dev/nvidia0" }, `unix-char device at index 0: The "path" "dev/nvidia0" is not an absolute path`},
+		{"Missing major", func(cd *ConfigDevices) { delete(cd.UnixCharDevs[0], "major") }, `unix-char device at index 0: Missing "major"`},
+		{"Non numeric minor", func(cd *ConfigDevices) { cd.UnixCharDevs[1]["minor"] = "zero" }, `unix-char device at index 1: Invalid "minor" "zero"`},
+		{"Non numeric GID", func(cd *ConfigDevices) { cd.UnixCharDevs[0]["gid"] = "-1" }, `unix-char device at index 0: Invalid "gid" "-1"`},
+		{"Valid with mode", func(cd *ConfigDevices) { cd.UnixCharDevs[0]["mode"] = "0666" }, ""},
+		{"Non octal mode", func(cd *ConfigDevices) { cd.UnixCharDevs[1]["mode"] = "0888" }, `unix-char device at index 1: Invalid mode "0888"`},
+		{"Missing mount source", func(cd *ConfigDevices) { delete(cd.BindMounts[0], "source") }, `bind mount at index 0: Missing "source"`},
+		{"Relative mount path", func(cd *ConfigDevices) { cd.BindMounts[0]["path"] = "libcuda.so.1" }, `bind mount at index 0: The "path" "libcuda.so.1" is not an absolute path`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := &ConfigDevices{
+				UnixCharDevs: []map[string]string{validCharDev(), validCharDev()},
+				BindMounts:   []map[string]string{validMount()},
+			}
+
+			tt.modify(cd)
+
+			err := ValidateConfigDevices(cd)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/lxd/locking"
+)
+
+// lockRootFS locks the CDI changes to the container rootfs mounted at containerRootFSMount on the host
+// until the returned function is called. It is the only lock of the CDI changes to a rootfs, be it the
+// one of a container or a shared base, so that they all exclude each other. The symlinks of the mount
+// are resolved as the instance paths of LXD are symlinks to the storage pools.
+func lockRootFS(ctx context.Context, containerRootFSMount string) (locking.UnlockFunc, error) {
+	rootFS, err := filepath.EvalSymlinks(containerRootFSMount)
+	if err != nil {
+		rootFS = filepath.Clean(containerRootFSMount)
+	}
+
+	return locking.Lock(ctx, "CDIRootFS_"+rootFS)
+}
+
+// ConfigureCDIDevice configures a CDI device in the container c from the CDI hooks file at hooksPath
+// (see CDIHooksFileSuffix) and the CDI config devices file at configDevicesPath (see
+// CDIConfigDevicesFileSuffix) using SFTP. Both files are loaded and validated before anything is
+// changed. The mount points of the bind mounts and unix-char devices are then prepared like
+// ApplyBindMounts does, so that the instance devices mounting them can succeed, and the hooks are
+// applied. The mount points and the changes made by the hooks are rolled back on failure.
+// The changes are made under a lock of the rootfs and the linker cache is updated once, after all
+// of them, with updateLDCache like ApplyHooksToContainer does. The failure of ldconfig is reported
+// in ApplyResult.LdconfigErr. The device nodes of the hooks are left in
+// ApplyResult.PendingDeviceNodes for the device manager.
+func ConfigureCDIDevice(hooksPath string, configDevicesPath string, c instance.Container) (*ApplyResult, error) {
+	start := time.Now()
+	hooks, err := loadHooksFile(hooksPath)
+	if err != nil {
+		return nil, &stageError{stage: FailureStageLoad, err: err}
+	}
+
+	decode := time.Since(start)
+
+	configDevices, err := LoadConfigDevices(configDevicesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ValidateConfigDevices(configDevices)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CDI config devices file at %q: %w", configDevicesPath, err)
+	}
+
+	ctx := context.Background()
+
+	unlock, err := lockHooks(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	result, err := configureCDIDeviceWithFS(ctx, c, hooks, configDevices, &sftpContainerFS{client: sftpClient}, ApplyOptions{Rollback: true, rootFS: containerRootFS(c)})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Timings.Decode = decode
+
+	return result, nil
+}
+
+// configureCDIDeviceWithFS is the testable core of ConfigureCDIDevice, applying the validated hooks
+// and config devices to the container c with opts.
+func configureCDIDeviceWithFS(ctx context.Context, c instance.Container, hooks *Hooks, configDevices *ConfigDevices, cfs containerFS, opts ApplyOptions) (*ApplyResult, error) {
+	l := loggerOrNop(opts.Logger)
+
+	// The unix-char devices are bind mounted from the device nodes created on the host.
+	mounts := make([]map[string]string, 0, len(configDevices.BindMounts)+len(configDevices.UnixCharDevs))
+	mounts = append(mounts, configDevices.BindMounts...)
+	mounts = append(mounts, configDevices.UnixCharDevs...)
+
+	for i, mount := range mounts {
+		if pathEscapesRoot(mount["path"]) {
+			return nil, fmt.Errorf("Invalid CDI config device at index %d: The path %q escapes the container rootfs", i, mount["path"])
+		}
+	}
+
+	tx := &hooksTransaction{cfs: cfs, systemFS: cfs, l: l}
+	rollback := func(err error) error {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %w)", err, rollbackErr)
+		}
+
+		return err
+	}
+
+	mountPoints, err := prepareMountPoints(tx, mounts)
+	if err != nil {
+		return nil, rollback(err)
+	}
+
+	result, regenerateLDCache, err := applyLoadedHooksWithFS(ctx, hooks, cfs, opts)
+	if err != nil {
+		return nil, rollback(err)
+	}
+
+	result.MountPoints = mountPoints
+
+	var ldconfigErr error
+	if regenerateLDCache && !opts.SkipLdCache {
+		start := time.Now()
+		if opts.NativeLdCache {
+			result.LdCacheWritten = updateLDCacheNativeFromConf(cfs, opts.Logger)
+		}
+
+		if !result.LdCacheWritten {
+			result.LdconfigRan, result.Warnings, ldconfigErr = updateLDCache(ctx, c, cfs, opts.Logger, opts.LdconfigPath, opts.LdconfigTimeout, opts.ForeignLdconfig, opts.EtcDir)
+			result.LdconfigErr = ldconfigErr
+		}
+
+		result.Timings.LDCache = time.Since(start)
+	}
+
+	countApplyResult(result, ldconfigErr)
+
+	return result, nil
+}
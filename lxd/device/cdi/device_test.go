@@ -0,0 +1,121 @@
+package cdi
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureCDIDevice(t *testing.T) {
+	hostDir := t.TempDir()
+	sourceDir := filepath.Join(hostDir, "firmware")
+	require.NoError(t, os.Mkdir(sourceDir, 0755))
+
+	writeConfigDevices := func(t *testing.T, cd ConfigDevices) string {
+		path := filepath.Join(t.TempDir(), "gpu"+CDIConfigDevicesFileSuffix)
+		content, err := json.Marshal(cd)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+
+		return path
+	}
+
+	configure := func(t *testing.T, c *pathContainer, rootFS string, hooks Hooks, cd ConfigDevices) (*ApplyResult, error) {
+		loaded, err := loadHooksFile(writeHooksFile(t, t.TempDir(), hooks))
+		require.NoError(t, err)
+
+		return configureCDIDeviceWithFS(context.Background(), c, loaded, &cd, &localFS{rootFS: rootFS}, ApplyOptions{Rollback: true, rootFS: rootFS})
+	}
+
+	configDevices := ConfigDevices{
+		UnixCharDevs: []map[string]string{{"type": "unix-char", "source": "/dev/null", "path": "/dev/nvidia0", "major": "195", "minor": "0"}},
+		BindMounts:   []map[string]string{{"type": "disk", "source": sourceDir, "path": "/lib/firmware/nvidia"}},
+	}
+
+	t.Run("prepares the mount points and applies the hooks", func(t *testing.T) {
+		c, rootFS := newRootFSContainer(t)
+		createLibrary(t, rootFS, "/opt/cdi/libcuda.so.1")
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/cdi"},
+			Symlinks:       []SymlinkEntry{{Target: "/opt/cdi/libcuda.so.1", Link: "/usr/lib/cdi/libcuda.so"}},
+		}
+
+		result, err := configure(t, c, rootFS, hooks, configDevices)
+		require.NoError(t, err)
+		assert.Equal(t, []MountResult{
+			{Source: sourceDir, Path: "/lib/firmware/nvidia", Type: MountPointDirectory, Created: true},
+			{Source: "/dev/null", Path: "/dev/nvidia0", Type: MountPointFile, Created: true},
+		}, result.MountPoints)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+
+		assert.DirExists(t, filepath.Join(rootFS, "lib", "firmware", "nvidia"))
+		assert.FileExists(t, filepath.Join(rootFS, "dev", "nvidia0"))
+
+		target, err := os.Readlink(filepath.Join(rootFS, "usr", "lib", "cdi", "libcuda.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "../../../opt/cdi/libcuda.so.1", target)
+	})
+
+	t.Run("updates the linker cache with ldconfig by default", func(t *testing.T) {
+		c, rootFS := newRootFSContainer(t)
+		createLibrary(t, rootFS, "/usr/lib/cdi/libcuda.so.1")
+
+		// The cache could be written natively, which is only done with NativeLdCache.
+		require.NoError(t, os.MkdirAll(filepath.Join(rootFS, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(rootFS, "etc", "ld.so.cache"), marshalLDCache(nil), 0644))
+
+		past := time.Now().Add(-24 * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(rootFS, "usr"), past, past))
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}}
+
+		result, err := configure(t, c, rootFS, hooks, ConfigDevices{})
+		require.NoError(t, err)
+		assert.False(t, result.LdCacheWritten)
+		assert.False(t, result.LdconfigRan)
+		assert.NoError(t, result.LdconfigErr)
+
+		// The container is stopped so ldconfig.service rebuilds the cache at its next boot.
+		usrInfo, err := os.Stat(filepath.Join(rootFS, "usr"))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), usrInfo.ModTime(), time.Hour)
+	})
+
+	t.Run("failing hooks roll back the mount points", func(t *testing.T) {
+		c, rootFS := newRootFSContainer(t)
+		createLibrary(t, rootFS, "/opt/cdi/libcuda.so.1")
+		require.NoError(t, os.WriteFile(filepath.Join(rootFS, "usr"), []byte("not a directory"), 0644))
+
+		hooks := Hooks{Symlinks: []SymlinkEntry{{Target: "/opt/cdi/libcuda.so.1", Link: "/usr/lib/cdi/libcuda.so"}}}
+
+		_, err := configure(t, c, rootFS, hooks, configDevices)
+		require.Error(t, err)
+		assert.NoDirExists(t, filepath.Join(rootFS, "lib"))
+		assert.NoDirExists(t, filepath.Join(rootFS, "dev"))
+	})
+
+	t.Run("invalid config devices", func(t *testing.T) {
+		c, rootFS := newRootFSContainer(t)
+		cd := ConfigDevices{BindMounts: []map[string]string{{"type": "disk", "source": sourceDir, "path": "lib/firmware"}}}
+
+		_, err := ConfigureCDIDevice(writeHooksFile(t, t.TempDir(), Hooks{}), writeConfigDevices(t, cd), c)
+		assert.ErrorContains(t, err, `Invalid CDI bind mount at index 0: The "path" "lib/firmware" is not an absolute path`)
+
+		entries, err := os.ReadDir(rootFS)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("missing hooks file", func(t *testing.T) {
+		c, _ := newRootFSContainer(t)
+		_, err := ConfigureCDIDevice(filepath.Join(t.TempDir(), "missing.json"), writeConfigDevices(t, configDevices), c)
+		assert.ErrorIs(t, err, ErrHooksFileNotFound)
+	})
+}
@@ -0,0 +1,245 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// DeviceNode is a device node to create inside the container, as requested by the deviceNodes of the
+// container edits of a CDI spec.
+type DeviceNode struct {
+	// Path is the absolute path of the node inside the container.
+	Path string `json:"path" yaml:"path"`
+	// Type is the type of the node, either DeviceNodeTypeChar (the default) or DeviceNodeTypeBlock.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// Major and Minor are the device number of the node.
+	Major int64 `json:"major" yaml:"major"`
+	Minor int64 `json:"minor" yaml:"minor"`
+	// Mode is the octal permissions (e.g. "0660") of the node. Defaults to defaultDeviceNodeMode.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+const (
+	// DeviceNodeTypeChar is the DeviceNode type of a character device.
+	DeviceNodeTypeChar = "c"
+	// DeviceNodeTypeBlock is the DeviceNode type of a block device.
+	DeviceNodeTypeBlock = "b"
+
+	// defaultDeviceNodeMode is the mode of the device nodes without one.
+	defaultDeviceNodeMode = "0666"
+
+	// maxDeviceMajor and maxDeviceMinor are the largest device numbers of the kernel, whose majors
+	// have 12 bits and minors 20 bits.
+	maxDeviceMajor = 1<<12 - 1
+	maxDeviceMinor = 1<<20 - 1
+)
+
+// mknodFS is a containerFS able to create device nodes.
+type mknodFS interface {
+	containerFS
+	Mknod(path string, mode uint32, dev uint64) error
+}
+
+// validateDeviceNode checks that node is well formed.
+func validateDeviceNode(node DeviceNode) error {
+	if node.Path == "" {
+		return errors.New("The path is empty")
+	}
+
+	if !filepath.IsAbs(node.Path) {
+		return fmt.Errorf("The path %q is not an absolute path", node.Path)
+	}
+
+	if pathEscapesRoot(node.Path) {
+		return fmt.Errorf("The path %q escapes the container rootfs", node.Path)
+	}
+
+	if filepath.Clean(node.Path) == "/" {
+		return fmt.Errorf("The path %q is the root directory", node.Path)
+	}
+
+	switch node.Type {
+	case "", DeviceNodeTypeChar, DeviceNodeTypeBlock:
+	default:
+		return fmt.Errorf("Unknown type %q for the device node %q", node.Type, node.Path)
+	}
+
+	if node.Major < 0 || node.Major > maxDeviceMajor {
+		return fmt.Errorf("Invalid major %d for the device node %q", node.Major, node.Path)
+	}
+
+	if node.Minor < 0 || node.Minor > maxDeviceMinor {
+		return fmt.Errorf("Invalid minor %d for the device node %q", node.Minor, node.Path)
+	}
+
+	if node.Major == 0 && node.Minor == 0 {
+		return fmt.Errorf("The device node %q has no device number", node.Path)
+	}
+
+	if node.Mode != "" {
+		_, err := parseFileMode(node.Mode)
+		if err != nil {
+			return fmt.Errorf("Invalid mode for the device node %q: %w", node.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// deviceNodeMode returns the mode of node, including its type bits, as given to mknod.
+func deviceNodeMode(node DeviceNode) (uint32, os.FileMode, error) {
+	mode := node.Mode
+	if mode == "" {
+		mode = defaultDeviceNodeMode
+	}
+
+	perm, err := parseFileMode(mode)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	typeBits := uint32(unix.S_IFCHR)
+	if node.Type == DeviceNodeTypeBlock {
+		typeBits = unix.S_IFBLK
+	}
+
+	return typeBits | uint32(perm.Perm()), perm, nil
+}
+
+// createContainerDeviceNodes creates the PendingDeviceNodes of result in the rootfs mounted at rootFS
+// on the host, moving them to its CreatedDeviceNodes.
+func createContainerDeviceNodes(rootFS string, result *ApplyResult, l logger.Logger) error {
+	cfs, err := openHostRootFS(rootFS)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = cfs.Close() }()
+
+	result.CreatedDeviceNodes, err = createDeviceNodes(cfs, result.PendingDeviceNodes, l)
+	if err != nil {
+		return err
+	}
+
+	result.PendingDeviceNodes = nil
+
+	return nil
+}
+
+// createDeviceNodes creates the device nodes inside the container, along with their missing parent
+// directories, and returns the paths of the created ones. The nodes that already exist with the same
+// type and device number are kept. The nodes and directories already created are removed if one of
+// the nodes cannot be created.
+// The nodes can only be created in the privileged containers as the kernel refuses mknod in a user
+// namespace. The cgroup device rules allowing their use are left to the device manager.
+func createDeviceNodes(cfs mknodFS, nodes []DeviceNode, l logger.Logger) ([]string, error) {
+	tx := &hooksTransaction{cfs: cfs, systemFS: cfs, l: loggerOrNop(l)}
+
+	created := []string{}
+	for _, node := range nodes {
+		path, err := createDeviceNode(tx, cfs, node)
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			if rollbackErr != nil {
+				return nil, fmt.Errorf("%w (rollback failed: %w)", err, rollbackErr)
+			}
+
+			return nil, err
+		}
+
+		if path != "" {
+			created = append(created, path)
+		}
+	}
+
+	return created, nil
+}
+
+// createDeviceNode creates the device node inside the container, recording the changes in the
+// transaction. It returns the path of the node, or an empty path if it already existed.
+func createDeviceNode(tx *hooksTransaction, cfs mknodFS, node DeviceNode) (string, error) {
+	path := filepath.Clean(node.Path)
+
+	mode, perm, err := deviceNodeMode(node)
+	if err != nil {
+		return "", fmt.Errorf("Invalid mode for the CDI device node %q: %w", path, err)
+	}
+
+	dev := unix.Mkdev(uint32(node.Major), uint32(node.Minor))
+
+	fileInfo, err := cfs.Lstat(path)
+	if err == nil {
+		sys, ok := fileInfo.Sys().(*syscall.Stat_t)
+		if ok && sys.Mode&unix.S_IFMT == mode&unix.S_IFMT && uint64(sys.Rdev) == dev {
+			tx.l.Debug("CDI device node already exists", logger.Ctx{"path": path})
+			return "", nil
+		}
+
+		return "", fmt.Errorf("The path %q of the CDI device node is already used", path)
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("Failed checking the CDI device node %q: %w", path, err)
+	}
+
+	err = tx.MkdirAll(filepath.Dir(path))
+	if err != nil {
+		return "", fmt.Errorf("Failed creating the directory of the CDI device node %q: %w", path, err)
+	}
+
+	err = cfs.Mknod(path, mode, dev)
+	if err != nil {
+		return "", fmt.Errorf("Failed creating the CDI device node %q: %w", path, err)
+	}
+
+	tx.record(func() error {
+		err := cfs.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Failed removing the CDI device node %q: %w", path, err)
+		}
+
+		return nil
+	})
+
+	// The mode given to mknod is masked by the umask of LXD.
+	err = cfs.Chmod(path, perm)
+	if err != nil {
+		return "", fmt.Errorf("Failed setting the mode of the CDI device node %q: %w", path, err)
+	}
+
+	tx.l.Debug("Created CDI device node", logger.Ctx{"path": path, "type": node.Type, "major": node.Major, "minor": node.Minor})
+
+	return path, nil
+}
+
+// removeDeviceNode removes the CDI device node at path. A missing node or a path that is not a device
+// node anymore is left untouched.
+func removeDeviceNode(cfs containerFS, path string) error {
+	fileInfo, err := cfs.Lstat(path)
+	if err != nil {
+		if isMissingPath(err) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed checking the CDI device node %q: %w", path, err)
+	}
+
+	if fileInfo.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	err = cfs.Remove(path)
+	if err != nil && !isMissingPath(err) {
+		return fmt.Errorf("Failed removing the CDI device node %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package cdi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDeviceNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    DeviceNode
+		wantErr string
+	}{
+		{name: "valid char device", node: DeviceNode{Path: "/dev/nvidia0", Major: 195, Minor: 0}},
+		{name: "valid block device", node: DeviceNode{Path: "/dev/sdz", Type: DeviceNodeTypeBlock, Major: 8, Minor: 16, Mode: "0660"}},
+		{name: "empty path", node: DeviceNode{Major: 1, Minor: 3}, wantErr: "The path is empty"},
+		{name: "relative path", node: DeviceNode{Path: "dev/null", Major: 1, Minor: 3}, wantErr: "is not an absolute path"},
+		{name: "escaping path", node: DeviceNode{Path: "/../dev/null", Major: 1, Minor: 3}, wantErr: "escapes the container rootfs"},
+		{name: "root directory", node: DeviceNode{Path: "/", Major: 1, Minor: 3}, wantErr: "is the root directory"},
+		{name: "unknown type", node: DeviceNode{Path: "/dev/null", Type: "p", Major: 1, Minor: 3}, wantErr: "Unknown type"},
+		{name: "negative major", node: DeviceNode{Path: "/dev/null", Major: -1, Minor: 3}, wantErr: "Invalid major"},
+		{name: "major too large", node: DeviceNode{Path: "/dev/null", Major: maxDeviceMajor + 1, Minor: 3}, wantErr: "Invalid major"},
+		{name: "minor too large", node: DeviceNode{Path: "/dev/null", Major: 1, Minor: maxDeviceMinor + 1}, wantErr: "Invalid minor"},
+		{name: "no device number", node: DeviceNode{Path: "/dev/null"}, wantErr: "has no device number"},
+		{name: "invalid mode", node: DeviceNode{Path: "/dev/null", Major: 1, Minor: 3, Mode: "rw"}, wantErr: "Invalid mode"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateDeviceNode(test.node)
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateDeviceNodes(t *testing.T) {
+	openRootFS := func(t *testing.T) (string, *hostRootFS) {
+		tmpDir := t.TempDir()
+		cfs, err := openHostRootFS(tmpDir)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = cfs.Close() })
+
+		// Probe for the ability to create device nodes, which requires CAP_MKNOD.
+		err = cfs.Mknod("/probe", syscall.S_IFCHR|0600, 0x103)
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("Creating device nodes is not permitted")
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, cfs.Remove("/probe"))
+
+		return tmpDir, cfs
+	}
+
+	t.Run("nodes are created", func(t *testing.T) {
+		tmpDir, cfs := openRootFS(t)
+
+		nodes := []DeviceNode{{Path: "/dev/cdi/null", Major: 1, Minor: 3, Mode: "0640"}}
+		created, err := createDeviceNodes(cfs, nodes, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/cdi/null"}, created)
+
+		fileInfo, err := os.Lstat(filepath.Join(tmpDir, "dev/cdi/null"))
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeDevice|os.ModeCharDevice|0640, fileInfo.Mode())
+		assert.Equal(t, uint64(0x103), uint64(fileInfo.Sys().(*syscall.Stat_t).Rdev))
+
+		// The existing nodes are kept.
+		created, err = createDeviceNodes(cfs, nodes, nil)
+		require.NoError(t, err)
+		assert.Empty(t, created)
+	})
+
+	t.Run("used paths are rejected and the created nodes removed", func(t *testing.T) {
+		tmpDir, cfs := openRootFS(t)
+		createLibrary(t, tmpDir, "/dev/used")
+
+		nodes := []DeviceNode{
+			{Path: "/dev/cdi/null", Major: 1, Minor: 3},
+			{Path: "/dev/used", Major: 1, Minor: 5},
+		}
+
+		_, err := createDeviceNodes(cfs, nodes, nil)
+		assert.ErrorContains(t, err, "is already used")
+		assert.NoFileExists(t, filepath.Join(tmpDir, "dev/cdi/null"))
+		assert.NoDirExists(t, filepath.Join(tmpDir, "dev/cdi"))
+	})
+}
+
+func TestApplyHooksDeviceNodes(t *testing.T) {
+	tmpDir := t.TempDir()
+	nodes := []DeviceNode{{Path: "/dev/nvidia0", Major: 195, Minor: 0}}
+
+	result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{DeviceNodes: nodes}), &localFS{rootFS: tmpDir}, ApplyOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, nodes, result.PendingDeviceNodes)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "dev/nvidia0"))
+
+	hooks := Hooks{DeviceNodes: []DeviceNode{{Path: "/dev/nvidia0", Major: 195, Minor: 0}, {Path: "/dev/nvidia0", Major: 195, Minor: 1}}}
+	err = ValidateHooks(&hooks)
+	assert.ErrorIs(t, err, ErrInvalidHook)
+	assert.ErrorContains(t, err, "is listed several times")
+
+	_, err = MergeHooks(&Hooks{DeviceNodes: hooks.DeviceNodes[:1]}, &Hooks{DeviceNodes: hooks.DeviceNodes[1:]})
+	assert.ErrorContains(t, err, "Conflicting CDI device node")
+}
@@ -0,0 +1,111 @@
+package cdi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// FailureStage is the step of the application of the CDI hooks a FailureReport is about.
+type FailureStage string
+
+const (
+	// FailureStageApply is any step not covered by a more specific stage (e.g. a cancellation).
+	FailureStageApply FailureStage = "apply"
+	// FailureStageLoad is the loading of the hooks file.
+	FailureStageLoad FailureStage = "load"
+	// FailureStageDetectLibc is the detection of the C library of the container.
+	FailureStageDetectLibc FailureStage = "detect-libc"
+	// FailureStageSymlink is the creation of the symlinks.
+	FailureStageSymlink FailureStage = "symlink"
+	// FailureStageLinkerConf is the update of the linker configuration.
+	FailureStageLinkerConf FailureStage = "linker-conf"
+	// FailureStageLdconfig is the update of the linker cache.
+	FailureStageLdconfig FailureStage = "ldconfig"
+	// FailureStageVerify is the verification of the created symlinks.
+	FailureStageVerify FailureStage = "verify"
+)
+
+// FailureReport is the machine readable description of a failure to apply CDI hooks.
+type FailureReport struct {
+	// Stage is the step that failed.
+	Stage FailureStage `json:"stage" yaml:"stage"`
+	// Error is the error message.
+	Error string `json:"error" yaml:"error"`
+	// Errno is the system error number behind the failure, when available.
+	Errno int `json:"errno,omitempty" yaml:"errno,omitempty"`
+	// Symlinks are the symlinks at fault.
+	Symlinks []SymlinkEntry `json:"symlinks,omitempty" yaml:"symlinks,omitempty"`
+	// Entries are the library directories being added to the linker configuration.
+	Entries []string `json:"entries,omitempty" yaml:"entries,omitempty"`
+	// LdconfigOutput is the combined output of a failed ldconfig.
+	LdconfigOutput string `json:"ldconfig_output,omitempty" yaml:"ldconfig_output,omitempty"`
+	// LdconfigExitCode is the exit code of a failed ldconfig.
+	LdconfigExitCode int `json:"ldconfig_exit_code,omitempty" yaml:"ldconfig_exit_code,omitempty"`
+}
+
+// stageError annotates an error with the stage it happened at and the items at fault.
+type stageError struct {
+	stage    FailureStage
+	symlinks []SymlinkEntry
+	entries  []string
+	output   string
+	exitCode int
+	err      error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// newFailureReport returns the failure report describing err.
+func newFailureReport(err error) FailureReport {
+	report := FailureReport{
+		Stage: FailureStageApply,
+		Error: err.Error(),
+	}
+
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		report.Stage = stageErr.stage
+		report.Symlinks = stageErr.symlinks
+		report.Entries = stageErr.entries
+		report.LdconfigOutput = stageErr.output
+		report.LdconfigExitCode = stageErr.exitCode
+	}
+
+	var brokenLinksErr *BrokenLinksError
+	if errors.As(err, &brokenLinksErr) {
+		report.Stage = FailureStageVerify
+		report.Symlinks = brokenLinksErr.Links
+	}
+
+	var missingSonamesErr *MissingSonamesError
+	if errors.As(err, &missingSonamesErr) {
+		report.Stage = FailureStageVerify
+		report.Entries = missingSonamesErr.Sonames
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		report.Errno = int(errno)
+	}
+
+	return report
+}
+
+// writeFailureReport writes the JSON failure report describing err to w. Failing to write it is only
+// logged as it must not hide err.
+func writeFailureReport(w io.Writer, err error, l logger.Logger) {
+	writeErr := json.NewEncoder(w).Encode(newFailureReport(err))
+	if writeErr != nil {
+		loggerOrNop(l).Warn("Failed writing the CDI hooks failure report", logger.Ctx{"error": writeErr})
+	}
+}
@@ -0,0 +1,74 @@
+package cdi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReport(t *testing.T) {
+	t.Run("symlink failure", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		// A file in place of the symlink directory.
+		err := os.MkdirAll(filepath.Join(tmpDir, "usr"), 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(tmpDir, "usr", "lib"), nil, 0644)
+		require.NoError(t, err)
+
+		symlink := SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{Symlinks: []SymlinkEntry{symlink}})
+
+		var diagnostics bytes.Buffer
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{Diagnostics: &diagnostics})
+		require.Error(t, err)
+
+		report := FailureReport{}
+		err = json.Unmarshal(diagnostics.Bytes(), &report)
+		require.NoError(t, err)
+		assert.Equal(t, FailureStageSymlink, report.Stage)
+		assert.Equal(t, []SymlinkEntry{symlink}, report.Symlinks)
+		assert.Equal(t, int(syscall.ENOTDIR), report.Errno)
+		assert.NotEmpty(t, report.Error)
+	})
+
+	t.Run("load failure", func(t *testing.T) {
+		var diagnostics bytes.Buffer
+		_, _, err := applyHooksWithFS("/nonexistent/hooks.json", &localFS{rootFS: t.TempDir()}, ApplyOptions{Diagnostics: &diagnostics})
+		require.Error(t, err)
+
+		report := FailureReport{}
+		err = json.Unmarshal(diagnostics.Bytes(), &report)
+		require.NoError(t, err)
+		assert.Equal(t, FailureStageLoad, report.Stage)
+		assert.Equal(t, int(syscall.ENOENT), report.Errno)
+	})
+
+	t.Run("no report on success", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}})
+
+		var diagnostics bytes.Buffer
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{Diagnostics: &diagnostics})
+		require.NoError(t, err)
+		assert.Zero(t, diagnostics.Len())
+	})
+
+	t.Run("ldconfig and verification failures", func(t *testing.T) {
+		report := newFailureReport(&stageError{stage: FailureStageLdconfig, output: "ldconfig: Cannot mmap file", exitCode: 1, err: errors.New("ldconfig failed")})
+		assert.Equal(t, FailureReport{Stage: FailureStageLdconfig, Error: "ldconfig failed", LdconfigOutput: "ldconfig: Cannot mmap file", LdconfigExitCode: 1}, report)
+
+		links := []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}}
+		report = newFailureReport(&BrokenLinksError{Links: links})
+		assert.Equal(t, FailureStageVerify, report.Stage)
+		assert.Equal(t, links, report.Symlinks)
+	})
+}
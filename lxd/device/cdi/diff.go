@@ -0,0 +1,135 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// DiffHooks compares the desired CDI hooks against the hooks applied to the container c, as
+// reconstructed by InspectAppliedHooks, so that only the difference needs to be applied. It returns
+// the links that are missing or point elsewhere, the applied symlinks that are not desired anymore,
+// and the library directories to add to and remove from the linker configuration. The desired links
+// are checked directly since the inspection only finds the symlinks of the CDI library directories.
+func DiffHooks(desired *Hooks, c instance.Container) (toCreate []SymlinkEntry, toRemove []SymlinkEntry, cacheToAdd []string, cacheToRemove []string, err error) {
+	// Use FileSFTPNoLock so that the diff can be computed during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return diffHooksWithFS(desired, &sftpContainerFS{client: sftpClient})
+}
+
+// diffHooksWithFS is the testable core of DiffHooks.
+func diffHooksWithFS(desired *Hooks, cfs containerFS) (toCreate []SymlinkEntry, toRemove []SymlinkEntry, cacheToAdd []string, cacheToRemove []string, err error) {
+	err = ValidateHooks(desired)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	desired, err = resolveSonameTargets(cfs, desired)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	applied, err := inspectAppliedHooksWithFS(cfs)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	toCreate = []SymlinkEntry{}
+	desiredLinks := make(map[string]bool, len(desired.Symlinks))
+	for _, symlink := range desired.Symlinks {
+		link := filepath.Clean(symlink.Link)
+		desiredLinks[link] = true
+
+		linked, err := isLinkApplied(cfs, symlink)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		if !linked {
+			toCreate = append(toCreate, symlink)
+		}
+	}
+
+	toRemove = []SymlinkEntry{}
+	for _, symlink := range applied.Symlinks {
+		if !desiredLinks[symlink.Link] {
+			toRemove = append(toRemove, symlink)
+		}
+	}
+
+	desiredUpdates := normalizeLDCacheUpdates(desired.LDCacheUpdates)
+
+	cacheToAdd = []string{}
+	for _, update := range desiredUpdates {
+		if !slices.Contains(applied.LDCacheUpdates, update) {
+			cacheToAdd = append(cacheToAdd, update)
+		}
+	}
+
+	cacheToRemove = []string{}
+	for _, update := range applied.LDCacheUpdates {
+		if !slices.Contains(desiredUpdates, update) {
+			cacheToRemove = append(cacheToRemove, update)
+		}
+	}
+
+	return toCreate, toRemove, cacheToAdd, cacheToRemove, nil
+}
+
+// isLinkApplied returns whether the link of symlink already is a symlink to its target or, for a
+// hard link, the file its target points at.
+func isLinkApplied(cfs containerFS, symlink SymlinkEntry) (bool, error) {
+	link := filepath.Clean(symlink.Link)
+	targetPath := absoluteSymlinkTarget(link, symlink.Target)
+
+	fileInfo, err := cfs.Lstat(link)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the CDI symlink path %q: %w", link, err)
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		// A hard link falls back to a symlink when its target is on another filesystem.
+		target, err := cfs.Readlink(link)
+		if err != nil {
+			return false, fmt.Errorf("Failed reading the CDI symlink %q: %w", link, err)
+		}
+
+		return absoluteSymlinkTarget(link, target) == targetPath, nil
+	}
+
+	if symlinkKind(symlink) != SymlinkKindHardlink || !fileInfo.Mode().IsRegular() {
+		return false, nil
+	}
+
+	resolved, err := resolveContainerPath(cfs, targetPath)
+
+	var targetInfo os.FileInfo
+	if err == nil {
+		targetInfo, err = cfs.Lstat(resolved)
+	}
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the target %q of the CDI hardlink %q: %w", targetPath, link, err)
+	}
+
+	return sameFile(fileInfo, targetInfo), nil
+}
@@ -0,0 +1,82 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffHooks(t *testing.T) {
+	t.Run("nothing applied", func(t *testing.T) {
+		desired := &Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+			Symlinks:       []SymlinkEntry{{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"}},
+		}
+
+		toCreate, toRemove, cacheToAdd, cacheToRemove, err := diffHooksWithFS(desired, &localFS{rootFS: t.TempDir()})
+		require.NoError(t, err)
+		assert.Equal(t, desired.Symlinks, toCreate)
+		assert.Empty(t, toRemove)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, cacheToAdd)
+		assert.Empty(t, cacheToRemove)
+	})
+
+	t.Run("only the delta", func(t *testing.T) {
+		rootFS := t.TempDir()
+
+		libDir := filepath.Join(rootFS, "usr", "lib", "nvidia")
+		require.NoError(t, os.MkdirAll(libDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(libDir, "libcuda.so.535"), nil, 0644))
+
+		applied := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib/old"},
+			Symlinks: []SymlinkEntry{
+				{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+				{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+				{Target: "libnvidia-ml.so.535", Link: "/usr/lib/nvidia/libnvidia-ml.so.1"},
+			},
+		}
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), applied), &localFS{rootFS: rootFS}, ApplyOptions{})
+		require.NoError(t, err)
+
+		desired := &Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia/", "/usr/lib/new"},
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/nvidia/libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+				{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so"},
+				{Target: "/usr/lib/nvidia/libcuda.so.1", Link: "/usr/lib/libcuda.so"},
+			},
+		}
+
+		toCreate, toRemove, cacheToAdd, cacheToRemove, err := diffHooksWithFS(desired, &localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []SymlinkEntry{
+			{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so"},
+			{Target: "/usr/lib/nvidia/libcuda.so.1", Link: "/usr/lib/libcuda.so"},
+		}, toCreate)
+		assert.Equal(t, []SymlinkEntry{{Target: "libnvidia-ml.so.535", Link: "/usr/lib/nvidia/libnvidia-ml.so.1"}}, toRemove)
+		assert.Equal(t, []string{"/usr/lib/new"}, cacheToAdd)
+		assert.Equal(t, []string{"/usr/lib/old"}, cacheToRemove)
+	})
+
+	t.Run("applied hard link", func(t *testing.T) {
+		rootFS := t.TempDir()
+		createLibrary(t, rootFS, "/usr/lib/libfoo.so.1")
+		require.NoError(t, os.Link(filepath.Join(rootFS, "usr", "lib", "libfoo.so.1"), filepath.Join(rootFS, "usr", "lib", "libfoo.so")))
+
+		desired := &Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink}}}
+
+		toCreate, _, _, _, err := diffHooksWithFS(desired, &localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Empty(t, toCreate)
+	})
+
+	t.Run("invalid desired hooks", func(t *testing.T) {
+		_, _, _, _, err := diffHooksWithFS(&Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "libfoo.so"}}}, &localFS{rootFS: t.TempDir()})
+		assert.ErrorContains(t, err, "is not an absolute path")
+	})
+}
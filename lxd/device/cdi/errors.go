@@ -0,0 +1,88 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrHooksFileNotFound is returned when the CDI hooks file does not exist.
+	ErrHooksFileNotFound = errors.New("CDI hooks file not found")
+
+	// ErrInvalidHook is returned when the CDI hooks cannot be decoded or are not well formed.
+	ErrInvalidHook = errors.New("Invalid CDI hook")
+
+	// ErrSymlinkEscape is returned when a CDI symlink or its target resolves outside of the container
+	// rootfs.
+	ErrSymlinkEscape = errors.New("CDI symlink escapes the container rootfs")
+
+	// ErrLdconfigFailed is returned when ldconfig failed to update the linker cache of the container.
+	// The error is a LdconfigError holding the output of ldconfig.
+	ErrLdconfigFailed = errors.New("ldconfig failed")
+
+	// ErrInvalidRootFS is returned when the container rootfs mount on the host is not an absolute path
+	// to an existing directory.
+	ErrInvalidRootFS = errors.New("Invalid container rootfs mount")
+
+	// ErrDirNotAllowed is returned when a CDI symlink or library directory is outside of the
+	// directories allowed by ApplyOptions.AllowedDirs.
+	ErrDirNotAllowed = errors.New("CDI directory not allowed")
+
+	// ErrImmutableFile is returned when a CDI change fails as the file or its directory is immutable
+	// (see chattr(1)) and ApplyOptions.ClearImmutable is not set.
+	ErrImmutableFile = errors.New("Immutable file in the container")
+)
+
+// LdconfigError is the failure of ldconfig in the container. It matches ErrLdconfigFailed.
+type LdconfigError struct {
+	// Output is the combined output of ldconfig.
+	Output string
+	// ExitCode is the exit code of ldconfig.
+	ExitCode int
+	// Warnings are the diagnostics parsed from Output.
+	Warnings []string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *LdconfigError) Error() string {
+	if len(e.Warnings) == 0 {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", e.Err.Error(), strings.Join(e.Warnings, "; "))
+}
+
+func (e *LdconfigError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes LdconfigError match ErrLdconfigFailed.
+func (e *LdconfigError) Is(target error) bool {
+	return target == ErrLdconfigFailed
+}
+
+// kindError marks err with one of the sentinel errors of the package without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// withKind returns err marked with the sentinel error kind so that errors.Is(err, kind) holds.
+func withKind(kind error, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// withKindf is fmt.Errorf marked with the sentinel error kind.
+func withKindf(kind error, format string, args ...any) error {
+	return withKind(kind, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,114 @@
+package cdi
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	t.Run("hooks file not found", func(t *testing.T) {
+		_, err := loadHooksFile(filepath.Join(t.TempDir(), "missing.json"))
+		assert.ErrorIs(t, err, ErrHooksFileNotFound)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.NotErrorIs(t, err, ErrInvalidHook)
+		assert.ErrorContains(t, err, "Failed opening the CDI hooks file")
+	})
+
+	t.Run("invalid hooks", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksFile := filepath.Join(tmpDir, "hooks.json")
+		require.NoError(t, os.WriteFile(hooksFile, []byte("{"), 0644))
+
+		_, err := loadHooksFile(hooksFile)
+		assert.ErrorIs(t, err, ErrInvalidHook)
+		assert.NotErrorIs(t, err, ErrHooksFileNotFound)
+
+		_, err = loadHooksFile(writeHooksFile(t, tmpDir, Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "libfoo.so"}}}))
+		assert.ErrorIs(t, err, ErrInvalidHook)
+
+		err = ValidateHooks(&Hooks{LinkerConfSuffix: "../nvidia"})
+		assert.ErrorIs(t, err, ErrInvalidHook)
+
+		_, err = loadHooks(strings.NewReader("symlinks: {"))
+		assert.ErrorIs(t, err, ErrInvalidHook)
+	})
+
+	t.Run("symlink escape", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooks := Hooks{Symlinks: []SymlinkEntry{{Target: "../../../../etc/shadow", Link: "/usr/lib/libfoo.so"}}}
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorIs(t, err, ErrSymlinkEscape)
+		assert.ErrorContains(t, err, "The link target escapes the container rootfs")
+
+		var stageErr *stageError
+		require.ErrorAs(t, err, &stageErr)
+		assert.Equal(t, FailureStageSymlink, stageErr.stage)
+	})
+
+	t.Run("ldconfig failed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		createLibrary(t, tmpDir, LdconfigPath)
+
+		_, _, err := updateLDCache(context.Background(), &ldconfigInstance{rootFS: tmpDir, exitCode: 2}, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		assert.ErrorIs(t, err, ErrLdconfigFailed)
+
+		var ldconfigErr *LdconfigError
+		require.ErrorAs(t, err, &ldconfigErr)
+		assert.Equal(t, 2, ldconfigErr.ExitCode)
+		assert.ErrorContains(t, ldconfigErr, "exited with code 2")
+
+		// A missing ldconfig is not a failure of ldconfig.
+		_, _, err = updateLDCache(context.Background(), &ldconfigInstance{rootFS: t.TempDir()}, &localFS{rootFS: t.TempDir()}, nil, "", 0, nil, "")
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrLdconfigFailed)
+	})
+}
+
+func TestValidateRootFS(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	require.NoError(t, os.Symlink(tmpDir, filepath.Join(tmpDir, "link")))
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "directory", path: tmpDir},
+		{name: "symlink to a directory", path: filepath.Join(tmpDir, "link")},
+		{name: "empty", path: "", wantErr: "No container rootfs mount"},
+		{name: "relative", path: "rootfs", wantErr: "is not an absolute path"},
+		{name: "missing", path: filepath.Join(tmpDir, "missing"), wantErr: "Failed checking the container rootfs mount"},
+		{name: "file", path: file, wantErr: "is not a directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRootFS(tt.path)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrInvalidRootFS)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("entry points", func(t *testing.T) {
+		hooksFile := writeHooksFile(t, t.TempDir(), Hooks{})
+
+		_, err := ApplyHooksToRootFS(hooksFile, file, ApplyOptions{BuildMode: true})
+		assert.ErrorIs(t, err, ErrInvalidRootFS)
+	})
+}
@@ -0,0 +1,130 @@
+package cdi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultEtcDir is the system configuration directory of the container, relative to its rootfs.
+	defaultEtcDir = "etc"
+
+	// etcDir is the path inside the container of the default system configuration directory, which
+	// the paths of the linker configuration and cache are built from.
+	etcDir = "/" + defaultEtcDir
+)
+
+// validateEtcDir checks that dir (see ApplyOptions.EtcDir) is a path relative to the container
+// rootfs that does not lead outside of it.
+func validateEtcDir(dir string) error {
+	if filepath.IsAbs(dir) {
+		return fmt.Errorf("The etc directory %q is not relative to the container rootfs", dir)
+	}
+
+	if pathEscapesRoot(dir) {
+		return withKindf(ErrSymlinkEscape, "The etc directory %q escapes the container rootfs", dir)
+	}
+
+	return nil
+}
+
+// etcDirFS is a containerFS whose paths under /etc are interpreted under dir inside the container, so
+// that the linker configuration and cache are read and written in another system configuration
+// directory than /etc. The other paths are left as they are.
+type etcDirFS struct {
+	cfs containerFS
+	dir string
+}
+
+// newEtcDirFS returns cfs with its /etc paths moved to the etc directory dir (see ApplyOptions.EtcDir),
+// once its symlinks are followed. An empty dir is the default etc directory. The etc directory must
+// resolve within the container rootfs.
+func newEtcDirFS(cfs containerFS, dir string) (*etcDirFS, error) {
+	if dir == "" || filepath.Clean(dir) == defaultEtcDir {
+		return &etcDirFS{cfs: cfs, dir: etcDir}, nil
+	}
+
+	err := validateEtcDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveContainerDir(cfs, "/"+dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed resolving the etc directory %q: %w", dir, err)
+	}
+
+	return &etcDirFS{cfs: cfs, dir: resolved}, nil
+}
+
+// remapped returns whether the etc directory is another one than /etc.
+func (e *etcDirFS) remapped() bool {
+	return e.dir != etcDir
+}
+
+// path returns the path of p inside the container.
+func (e *etcDirFS) path(p string) string {
+	p = filepath.Clean(p)
+	if p == etcDir {
+		return e.dir
+	}
+
+	rel, found := strings.CutPrefix(p, etcDir+"/")
+	if !found {
+		return p
+	}
+
+	return filepath.Join(e.dir, rel)
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents.
+func (e *etcDirFS) MkdirAll(path string) error { return e.cfs.MkdirAll(e.path(path)) }
+
+// Symlink creates newname as a symbolic link to oldname.
+func (e *etcDirFS) Symlink(oldname, newname string) error {
+	return e.cfs.Symlink(oldname, e.path(newname))
+}
+
+// OpenFile opens the named file with the specified flags.
+func (e *etcDirFS) OpenFile(path string, flags int) (io.ReadWriteCloser, error) {
+	return e.cfs.OpenFile(e.path(path), flags)
+}
+
+// Remove removes the named file.
+func (e *etcDirFS) Remove(path string) error { return e.cfs.Remove(e.path(path)) }
+
+// Chtimes changes the access and modification times of the named file.
+func (e *etcDirFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return e.cfs.Chtimes(e.path(path), atime, mtime)
+}
+
+// Lstat returns a FileInfo structure describing the named file without following symbolic links.
+func (e *etcDirFS) Lstat(path string) (os.FileInfo, error) { return e.cfs.Lstat(e.path(path)) }
+
+// Readlink returns the destination of the named symbolic link.
+func (e *etcDirFS) Readlink(path string) (string, error) { return e.cfs.Readlink(e.path(path)) }
+
+// ReadDir reads the named directory and returns a list of its entries.
+func (e *etcDirFS) ReadDir(path string) ([]os.FileInfo, error) { return e.cfs.ReadDir(e.path(path)) }
+
+// Rename atomically renames oldname to newname, replacing newname if it already exists.
+func (e *etcDirFS) Rename(oldname, newname string) error {
+	return e.cfs.Rename(e.path(oldname), e.path(newname))
+}
+
+// Chmod changes the mode of the named file.
+func (e *etcDirFS) Chmod(path string, mode os.FileMode) error { return e.cfs.Chmod(e.path(path), mode) }
+
+// Chown changes the owner of the named file.
+func (e *etcDirFS) Chown(path string, uid int, gid int) error {
+	return e.cfs.Chown(e.path(path), uid, gid)
+}
+
+// Link creates newname as a hard link to the oldname file.
+func (e *etcDirFS) Link(oldname, newname string) error {
+	return e.cfs.Link(e.path(oldname), e.path(newname))
+}
@@ -0,0 +1,133 @@
+package cdi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEtcDirFSPath(t *testing.T) {
+	efs := &etcDirFS{dir: "/sysroot/etc"}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/etc", want: "/sysroot/etc"},
+		{path: "/etc/ld.so.conf.d/00-lxdcdi.conf", want: "/sysroot/etc/ld.so.conf.d/00-lxdcdi.conf"},
+		{path: "/etc/../usr/lib", want: "/usr/lib"},
+		{path: "/etcetera/ld.so.conf", want: "/etcetera/ld.so.conf"},
+		{path: "/usr/lib/libfoo.so", want: "/usr/lib/libfoo.so"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, efs.path(tt.path))
+		})
+	}
+}
+
+func TestApplyHooksEtcDir(t *testing.T) {
+	hooks := Hooks{
+		LDCacheUpdates: []string{"/usr/lib/cdi"},
+		Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so"}},
+	}
+
+	setup := func(t *testing.T) string {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libfoo.so.1")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sysroot", "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sysroot", "etc", "ld.so.conf"), []byte("/usr/local/lib\n"), 0644))
+
+		return tmpDir
+	}
+
+	t.Run("linker configuration written to the etc directory", func(t *testing.T) {
+		tmpDir := setup(t)
+		opts := ApplyOptions{EtcDir: "sysroot/etc"}
+
+		result, regenerate, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, opts)
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.True(t, result.MainLinkerConfUpdated)
+
+		entries, err := ParseLdConfEntries(filepath.Join(tmpDir, "sysroot", "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, entries)
+		assert.NoDirExists(t, filepath.Join(tmpDir, "etc"))
+
+		// The include directive is relative so that ldconfig reads it from the etc directory.
+		content, err := os.ReadFile(filepath.Join(tmpDir, "sysroot", "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/local/lib\n"+ldConfBlockBegin+"\ninclude ld.so.conf.d/*.conf\n"+ldConfBlockEnd+"\n", string(content))
+
+		result, _, err = applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, opts)
+		require.NoError(t, err)
+		assert.False(t, result.MainLinkerConfUpdated)
+		assert.Empty(t, result.LDCacheEntries)
+	})
+
+	t.Run("removed from state", func(t *testing.T) {
+		tmpDir := setup(t)
+
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{EtcDir: "sysroot/etc"})
+		require.NoError(t, err)
+
+		_, err = removeFromStateWithFS(newAppliedState(result, "", "sysroot/etc"), &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "sysroot", "etc", "ld.so.conf.d", CDILinkerConfFile))
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so"))
+	})
+
+	t.Run("invalid etc directory", func(t *testing.T) {
+		tmpDir := setup(t)
+		require.NoError(t, os.Symlink("../../..", filepath.Join(tmpDir, "sysroot", "outside")))
+
+		tests := []struct {
+			name   string
+			etcDir string
+			kind   error
+			want   string
+		}{
+			{name: "absolute", etcDir: "/sysroot/etc", want: "is not relative to the container rootfs"},
+			{name: "escaping", etcDir: "../etc", kind: ErrSymlinkEscape, want: "escapes the container rootfs"},
+			{name: "escaping symlink", etcDir: "sysroot/outside/etc", kind: ErrSymlinkEscape, want: "resolves outside of the container rootfs"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{EtcDir: tt.etcDir})
+				assert.ErrorContains(t, err, tt.want)
+				if tt.kind != nil {
+					assert.ErrorIs(t, err, tt.kind)
+				}
+			})
+		}
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so"))
+	})
+}
+
+func TestUpdateLDCacheEtcDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "sysroot", "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sysroot", "etc", "ld.so.cache"), []byte("old cache"), 0644))
+	createLibrary(t, tmpDir, LdconfigPath)
+
+	inst := &ldconfigInstance{rootFS: tmpDir}
+
+	ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "sysroot/etc")
+	require.NoError(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, []string{LdconfigPath, "-f", "/sysroot/etc/ld.so.conf", "-X", "-C", "/sysroot/etc/.lxdcdi-ld.so.cache.tmp"}, inst.commands[0])
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "sysroot", "etc", "ld.so.cache"))
+	require.NoError(t, err)
+	assert.Equal(t, "new cache", string(content))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "sysroot", "etc", ".lxdcdi-ld.so.cache.tmp"))
+}
@@ -0,0 +1,80 @@
+package cdi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+const (
+	// exportedSpecKind is the kind of the CDI specs written by ExportAsCDISpec, which do not describe
+	// the devices of a vendor.
+	exportedSpecKind = "lxd.canonical.com/cdi-hooks"
+
+	// exportedHookPath is the path of the hook binary in the CDI specs written by ExportAsCDISpec, as
+	// in the specs generated by the NVIDIA container toolkit.
+	exportedHookPath = "/usr/bin/nvidia-cdi-hook"
+)
+
+// ExportAsCDISpec returns a minimal CDI spec, as JSON, whose general container edits hold the
+// create-symlinks and update-ldcache hooks that hooks were generated from, so that what LXD applied to
+// a container can be audited against the source spec. It is the inverse of GenerateHooks: the
+// symlinks and library directories the exported spec generates are the ones of hooks, the relative
+// library directories being resolved against hooks.LDCacheBase. The spec has the version of hooks, or
+// the current one when unknown.
+// The hard links, architectures and device nodes of hooks have no create-symlinks or update-ldcache
+// equivalent. The hard links are an error as they would be exported as symlinks, while the
+// architectures and device nodes are left out.
+func ExportAsCDISpec(hooks *Hooks) ([]byte, error) {
+	if hooks == nil {
+		return nil, errors.New("No CDI hooks to export")
+	}
+
+	err := ValidateHooks(hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := resolveLDCacheUpdates(hooks.LDCacheUpdates, hooks.LDCacheBase)
+	if err != nil {
+		return nil, withKind(ErrInvalidHook, err)
+	}
+
+	version := hooks.SpecVersion
+	if version == "" {
+		version = specs.CurrentVersion
+	}
+
+	spec := specs.Spec{Version: version, Kind: exportedSpecKind}
+
+	if len(hooks.Symlinks) > 0 {
+		args := []string{"nvidia-cdi-hook", "create-symlinks"}
+		for _, symlink := range hooks.Symlinks {
+			if symlinkKind(symlink) == SymlinkKindHardlink {
+				return nil, fmt.Errorf("The CDI hard link %q cannot be exported as a CDI spec", symlink.Link)
+			}
+
+			args = append(args, "--link", symlink.Target+"::"+symlink.Link)
+		}
+
+		spec.ContainerEdits.Hooks = append(spec.ContainerEdits.Hooks, &specs.Hook{HookName: "createContainer", Path: exportedHookPath, Args: args})
+	}
+
+	if len(updates) > 0 {
+		args := []string{"nvidia-cdi-hook", "update-ldcache"}
+		for _, update := range normalizeLDCacheUpdates(updates) {
+			args = append(args, "--folder", update)
+		}
+
+		spec.ContainerEdits.Hooks = append(spec.ContainerEdits.Hooks, &specs.Hook{HookName: "createContainer", Path: exportedHookPath, Args: args})
+	}
+
+	content, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Failed encoding the CDI spec: %w", err)
+	}
+
+	return content, nil
+}
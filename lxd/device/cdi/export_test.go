@@ -0,0 +1,66 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tags.cncf.io/container-device-interface/specs-go"
+)
+
+func TestExportAsCDISpec(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		hooks := &Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libcuda.so.1", Link: "/usr/lib/x86_64-linux-gnu/libcuda.so"},
+				{Target: "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1", Link: "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/x86_64-linux-gnu", "nvidia"},
+			LDCacheBase:    "/usr/lib",
+			SpecVersion:    "0.6.0",
+		}
+
+		content, err := ExportAsCDISpec(hooks)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"cdiVersion": "0.6.0"`)
+
+		specPath := filepath.Join(t.TempDir(), "spec.json")
+		require.NoError(t, os.WriteFile(specPath, content, 0644))
+
+		generated, err := GenerateHooks(specPath, "/rootfs")
+		require.NoError(t, err)
+		assert.Equal(t, hooks.Symlinks, generated.Symlinks)
+		assert.Equal(t, []string{"/usr/lib/x86_64-linux-gnu", "/usr/lib/nvidia"}, generated.LDCacheUpdates)
+		assert.Equal(t, "0.6.0", generated.SpecVersion)
+	})
+
+	t.Run("empty hooks", func(t *testing.T) {
+		content, err := ExportAsCDISpec(&Hooks{})
+		require.NoError(t, err)
+		assert.Contains(t, string(content), `"cdiVersion": "`+specs.CurrentVersion+`"`)
+		assert.Contains(t, string(content), `"kind": "`+exportedSpecKind+`"`)
+
+		specPath := filepath.Join(t.TempDir(), "spec.json")
+		require.NoError(t, os.WriteFile(specPath, content, 0644))
+
+		generated, err := GenerateHooks(specPath, "/rootfs")
+		require.NoError(t, err)
+		assert.Empty(t, generated.Symlinks)
+		assert.Empty(t, generated.LDCacheUpdates)
+	})
+
+	t.Run("hard links", func(t *testing.T) {
+		_, err := ExportAsCDISpec(&Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink}}})
+		assert.ErrorContains(t, err, `The CDI hard link "/usr/lib/libfoo.so" cannot be exported`)
+	})
+
+	t.Run("invalid hooks", func(t *testing.T) {
+		_, err := ExportAsCDISpec(&Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "libfoo.so"}}})
+		assert.ErrorIs(t, err, ErrInvalidHook)
+
+		_, err = ExportAsCDISpec(nil)
+		assert.ErrorContains(t, err, "No CDI hooks to export")
+	})
+}
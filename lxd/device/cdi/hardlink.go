@@ -0,0 +1,213 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/sftp"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// isCrossDeviceLinkError returns whether a hard link could not be created because its target is on
+// another filesystem. The SFTP server reports EXDEV as a generic failure so it is treated the same,
+// as is a server without the hard link extension.
+func isCrossDeviceLinkError(err error) bool {
+	if errors.Is(err, syscall.EXDEV) {
+		return true
+	}
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.FxCode()
+		return code == sftp.ErrSSHFxFailure || code == sftp.ErrSSHFxOpUnsupported
+	}
+
+	return false
+}
+
+// sameFile returns whether a and b describe the same file. SFTP does not expose inode numbers so
+// regular files with the same mode, size and modification time are considered the same.
+func sameFile(a os.FileInfo, b os.FileInfo) bool {
+	if os.SameFile(a, b) {
+		return true
+	}
+
+	return a.Mode().IsRegular() && a.Mode() == b.Mode() && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// createHardlinkInContainer creates link as a hard link to the file target points at, target being
+// relative to the directory of link. The target must already exist. An existing hard link to the
+// target is kept while an existing symlink is replaced. When the target is on another filesystem,
+// a symlink is created instead.
+func createHardlinkInContainer(tx *hooksTransaction, target string, link string) (bool, error) {
+	targetPath := absoluteSymlinkTarget(link, target)
+
+	resolvedTarget, err := resolveContainerPath(tx.cfs, targetPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("Failed resolving the target %q of the CDI hardlink %q: %w", targetPath, link, err)
+	}
+
+	var targetInfo os.FileInfo
+	if err == nil {
+		targetInfo, err = tx.cfs.Lstat(resolvedTarget)
+	}
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("The target %q of the CDI hardlink %q does not exist", targetPath, link)
+		}
+
+		return false, fmt.Errorf("Failed checking the target %q of the CDI hardlink %q: %w", targetPath, link, err)
+	}
+
+	if !targetInfo.Mode().IsRegular() {
+		return false, fmt.Errorf("The target %q of the CDI hardlink %q is not a regular file", targetPath, link)
+	}
+
+	fileInfo, err := tx.cfs.Lstat(link)
+	if err == nil {
+		if fileInfo.Mode().IsRegular() && sameFile(fileInfo, targetInfo) {
+			tx.l.Debug("Skipped existing CDI hardlink", logger.Ctx{"link": link, "target": targetPath})
+			return false, nil
+		}
+
+		if fileInfo.Mode()&os.ModeSymlink != os.ModeSymlink {
+			return false, fmt.Errorf("Failed creating the CDI hardlink %q: %w", link, fs.ErrExist)
+		}
+
+		return replaceSymlinkWithHardlink(tx, resolvedTarget, target, link)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("Failed checking the CDI hardlink path %q: %w", link, err)
+	}
+
+	err = tx.cfs.Link(resolvedTarget, link)
+	if err != nil {
+		if isCrossDeviceLinkError(err) {
+			tx.l.Warn("Failed creating the CDI hardlink, falling back to a symlink", logger.Ctx{"link": link, "target": targetPath, "error": err})
+			return createSymlinkInContainer(tx, target, link, fileAttrs{})
+		}
+
+		return false, fmt.Errorf("Failed creating the CDI hardlink %q to %q: %w", link, targetPath, err)
+	}
+
+	tx.record(func() error {
+		err := tx.cfs.Remove(link)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Failed removing the CDI hardlink %q: %w", link, err)
+		}
+
+		return nil
+	})
+
+	tx.l.Debug("Created CDI hardlink", logger.Ctx{"link": link, "target": targetPath})
+	return true, nil
+}
+
+// replaceSymlinkWithHardlink atomically replaces the symlink at link with a hard link to
+// resolvedTarget by creating a temporary hard link next to it and renaming it over link.
+// When the target is on another filesystem, the symlink is pointed at target instead.
+func replaceSymlinkWithHardlink(tx *hooksTransaction, resolvedTarget string, target string, link string) (bool, error) {
+	oldTarget, err := tx.cfs.Readlink(link)
+	if err != nil {
+		return false, fmt.Errorf("Failed reading existing CDI symlink path %q: %w", link, err)
+	}
+
+	tmpLink := filepath.Join(filepath.Dir(link), ".lxdcdi-"+filepath.Base(link)+".tmp")
+
+	// Remove any leftover from an interrupted replacement.
+	err = tx.cfs.Remove(tmpLink)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("Failed removing the temporary CDI hardlink %q: %w", tmpLink, err)
+	}
+
+	err = tx.cfs.Link(resolvedTarget, tmpLink)
+	if err != nil {
+		if isCrossDeviceLinkError(err) {
+			tx.l.Warn("Failed creating the CDI hardlink, falling back to a symlink", logger.Ctx{"link": link, "target": resolvedTarget, "error": err})
+			return createSymlinkInContainer(tx, target, link, fileAttrs{})
+		}
+
+		return false, fmt.Errorf("Failed creating the temporary CDI hardlink %q to %q: %w", tmpLink, resolvedTarget, err)
+	}
+
+	err = tx.cfs.Rename(tmpLink, link)
+	if err != nil {
+		_ = tx.cfs.Remove(tmpLink)
+		return false, fmt.Errorf("Failed replacing the CDI symlink %q with %q: %w", link, tmpLink, err)
+	}
+
+	// Put the previous symlink back on rollback.
+	tx.record(func() error {
+		err := replaceSymlink(tx.cfs, oldTarget, link)
+		if err != nil {
+			return fmt.Errorf("Failed restoring the CDI symlink %q to %q: %w", link, oldTarget, err)
+		}
+
+		return nil
+	})
+
+	tx.repairedSymlinks = append(tx.repairedSymlinks, link)
+	tx.l.Debug("Replaced CDI symlink with a hardlink", logger.Ctx{"link": link, "target": resolvedTarget, "oldTarget": oldTarget})
+	return true, nil
+}
+
+// removeHardlinkFromContainer removes the hard link at link only if it is still the file target
+// points at. The symlink created when the hard link could not be is removed the same way as other
+// CDI symlinks. A missing link or a link that was changed since the hooks were applied is left
+// untouched. It returns whether the link was removed.
+func removeHardlinkFromContainer(cfs containerFS, target string, link string) (bool, error) {
+	fileInfo, err := cfs.Lstat(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the CDI hardlink path %q: %w", link, err)
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return removeSymlinkFromContainer(cfs, target, link)
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return false, nil
+	}
+
+	targetPath, err := resolveContainerPath(cfs, absoluteSymlinkTarget(link, target))
+	if err != nil && !isMissingPath(err) {
+		return false, fmt.Errorf("Failed resolving the target of the CDI hardlink %q: %w", link, err)
+	}
+
+	var targetInfo os.FileInfo
+	if err == nil {
+		targetInfo, err = cfs.Lstat(targetPath)
+	}
+
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the target of the CDI hardlink %q: %w", link, err)
+	}
+
+	if !sameFile(fileInfo, targetInfo) {
+		return false, nil
+	}
+
+	err = cfs.Remove(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed removing the CDI hardlink %q: %w", link, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,168 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crossDeviceFS wraps a containerFS and fails every hard link creation with EXDEV.
+type crossDeviceFS struct {
+	containerFS
+}
+
+func (c *crossDeviceFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+}
+
+// createLibrary creates an empty library file at path inside rootFS.
+func createLibrary(t *testing.T, rootFS string, path string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Join(rootFS, filepath.Dir(path)), 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(rootFS, path), []byte("library"), 0644)
+	require.NoError(t, err)
+}
+
+func TestApplyHardlinks(t *testing.T) {
+	t.Run("creates hardlinks", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/nvidia/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, hooks.Symlinks, result.CreatedSymlinks)
+
+		linkInfo, err := os.Lstat(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so"))
+		require.NoError(t, err)
+		targetInfo, err := os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libfoo.so.1"))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(linkInfo, targetInfo))
+
+		// Applying again keeps the existing hardlink.
+		result, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, result.CreatedSymlinks)
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so"))
+		assert.FileExists(t, filepath.Join(tmpDir, "usr", "lib", "libfoo.so.1"))
+	})
+
+	t.Run("replaces an existing symlink", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		err := os.Symlink("libfoo.so.0", filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		linkInfo, err := os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.True(t, linkInfo.Mode().IsRegular())
+	})
+
+	t.Run("falls back to a symlink across filesystems", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/nvidia/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		cfs := &crossDeviceFS{containerFS: &localFS{rootFS: tmpDir}}
+		_, _, err := applyHooksWithFS(hooksFile, cfs, ApplyOptions{})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "../libfoo.so.1", target)
+
+		_, err = removeHooksWithFS(hooksFile, cfs)
+		require.NoError(t, err)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("missing target errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "does not exist")
+	})
+
+	t.Run("keeps a regular file that is not the target", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		err := os.WriteFile(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"), []byte("other library"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		assert.FileExists(t, filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+	})
+
+	t.Run("unknown kind errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: "copy"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, `Unknown kind "copy"`)
+	})
+}
@@ -2,18 +2,28 @@ package cdi
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/sftp"
+	"go.yaml.in/yaml/v2"
+	"golang.org/x/sys/unix"
 
 	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/lxd/locking"
+	"github.com/canonical/lxd/lxd/util"
 	"github.com/canonical/lxd/shared/api"
 	"github.com/canonical/lxd/shared/logger"
 )
@@ -36,8 +46,40 @@ const (
 type SymlinkEntry struct {
 	Target string `json:"target" yaml:"target"`
 	Link   string `json:"link" yaml:"link"`
+	// Kind is the kind of link to create, either SymlinkKindSymlink (the default) or
+	// SymlinkKindHardlink. A hardlink requires the target to exist when the hooks are applied.
+	Kind string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	// Mode is the octal mode (e.g. "0755") given to the directories created for the link and to the
+	// file backed up out of its way. The created directories get the mode of their parent and the
+	// backed up file keeps its own when empty.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// UID and GID are the owner given to the directories created for the link and to the file backed
+	// up out of its way. The other one defaults to 0 when only one of them is set. The created
+	// directories are owned by the container root and the backed up file keeps its owner when both
+	// are unset.
+	UID *uint32 `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID *uint32 `json:"gid,omitempty" yaml:"gid,omitempty"`
+	// KeepAbsolute keeps an absolute target as is instead of making it relative to the link, for the
+	// targets outside of the tree the link belongs to. See resolveTarget for the trade-off.
+	KeepAbsolute bool `json:"keep_absolute,omitempty" yaml:"keep_absolute,omitempty"`
+	// SearchDir makes Target a soname (e.g. libnvidia-ml.so.1) rather than a path, the link pointing at
+	// the versioned file of the soname (e.g. libnvidia-ml.so.1.535.104.05) found in this absolute
+	// directory of the container when the hooks are applied. Exactly one regular file must match.
+	SearchDir string `json:"search_dir,omitempty" yaml:"search_dir,omitempty"`
+	// Condition only applies the link when it holds in the container, either ConditionTargetExists or
+	// ConditionDirExists, for the specs covering several hardware variants. The links whose condition
+	// does not hold are reported in ApplyResult.ConditionallySkippedSymlinks.
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
 }
 
+const (
+	// SymlinkKindSymlink is the SymlinkEntry kind creating a symbolic link.
+	SymlinkKindSymlink = "symlink"
+	// SymlinkKindHardlink is the SymlinkEntry kind creating a hard link, falling back to a symbolic
+	// link when the target is on another filesystem.
+	SymlinkKindHardlink = "hardlink"
+)
+
 // Hooks represents all the hook instructions that can be executed by
 // `lxd-cdi-hook`.
 type Hooks struct {
@@ -47,6 +89,36 @@ type Hooks struct {
 	LDCacheUpdates []string `json:"ld_cache_updates" yaml:"ld_cache_updates"`
 	// SymLinks is a list of entries to create a symlink.
 	Symlinks []SymlinkEntry `json:"symlinks" yaml:"symlinks"`
+	// LDCacheArchs optionally gives the architecture (e.g. "x86_64" or "arm64") of the libraries of
+	// some of the LDCacheUpdates directories, as in multi-arch or emulated rootfs. The linker conf file
+	// has no syntax for it as ldconfig reads the architecture of each library from its ELF header, so a
+	// directory whose libraries do not match is rejected instead of being silently ignored by the
+	// dynamic linker. The relative directories are resolved like the LDCacheUpdates ones.
+	LDCacheArchs map[string]string `json:"ld_cache_archs,omitempty" yaml:"ld_cache_archs,omitempty"`
+	// LDCacheConditions optionally gives a condition to some of the LDCacheUpdates directories, which
+	// are only added to the linker configuration when it holds in the container. Only
+	// ConditionDirExists applies to them. The directories whose condition does not hold are reported in
+	// ApplyResult.ConditionallySkippedLDCacheUpdates. The relative directories are resolved like the
+	// LDCacheUpdates ones.
+	LDCacheConditions map[string]string `json:"ld_cache_conditions,omitempty" yaml:"ld_cache_conditions,omitempty"`
+	// LDCacheBase is the absolute path inside the container the relative LDCacheUpdates entries are
+	// resolved against. Defaults to the container root.
+	LDCacheBase string `json:"ld_cache_base,omitempty" yaml:"ld_cache_base,omitempty"`
+	// LinkerConfSuffix gives the LDCacheUpdates a linker conf file of their own
+	// (e.g. "nvidia" for 00-lxdcdi-nvidia.conf), which is deleted when the hooks are removed.
+	// The shared 00-lxdcdi.conf file is used when empty.
+	LinkerConfSuffix string `json:"linker_conf_suffix,omitempty" yaml:"linker_conf_suffix,omitempty"`
+	// LinkerConfPriority is the numeric prefix, from 0 to 99, of the linker conf file of the
+	// LDCacheUpdates. ldconfig reads the linker conf files in lexical order and the libraries of the
+	// first directories take precedence, so the lower priorities win: with a priority of 5 and the
+	// "nvidia" suffix, the file is 05-lxdcdi-nvidia.conf and its libraries take precedence over the ones
+	// of 10-lxdcdi-amd.conf. The hooks without a suffix share the 05-lxdcdi.conf file of their priority.
+	// Defaults to 0, that is the 00-lxdcdi files.
+	LinkerConfPriority int `json:"linker_conf_priority,omitempty" yaml:"linker_conf_priority,omitempty"`
+	// SpecVersion is the version of the CDI spec the hooks were generated from by GenerateHooks.
+	SpecVersion string `json:"spec_version,omitempty" yaml:"spec_version,omitempty"`
+	// DeviceNodes is a list of device nodes to create inside the container.
+	DeviceNodes []DeviceNode `json:"device_nodes,omitempty" yaml:"device_nodes,omitempty"`
 }
 
 // ConfigDevices represents devices and mounts that need to be configured from a CDI specification.
@@ -58,12 +130,264 @@ type ConfigDevices struct {
 }
 
 const (
-	// customCDILinkerConfFile is the name of the linker conf file we will write to
-	// inside the container. The `00-lxdcdi` prefix is chosen to ensure that these libraries have
-	// a higher precedence than other libraries on the system.
-	customCDILinkerConfFile = "00-lxdcdi.conf"
+	// CDILinkerConfFilePrefix is the prefix shared by the linker conf files written for CDI inside
+	// the container for the hooks of the default Hooks.LinkerConfPriority. The `00-` prefix is chosen
+	// to ensure that these libraries have a higher precedence than other libraries on the system.
+	CDILinkerConfFilePrefix = "00-" + cdiLinkerConfFileName
+
+	// CDILinkerConfFile is the name of the linker conf file written inside the container for the hooks
+	// without a Hooks.LinkerConfSuffix. The hooks with one are written to
+	// `<CDILinkerConfFilePrefix>-<suffix>.conf` instead. The hooks with a Hooks.LinkerConfPriority
+	// replace the `00` prefix with their two digits priority, e.g. `05-lxdcdi-<suffix>.conf`.
+	CDILinkerConfFile = CDILinkerConfFilePrefix + ".conf"
+
+	// cdiLinkerConfFileName is the name of the linker conf files written for CDI, after their
+	// priority prefix.
+	cdiLinkerConfFileName = "lxdcdi"
+
+	// maxLinkerConfPriority is the highest Hooks.LinkerConfPriority, which is written in two digits.
+	maxLinkerConfPriority = 99
+
+	// linkerConfDir is the directory inside the container holding the linker conf files.
+	linkerConfDir = "/etc/ld.so.conf.d"
+
+	// ldConfBlockBegin and ldConfBlockEnd surround the entries LXD manages in a linker conf file so
+	// that the lines added by hand are kept.
+	ldConfBlockBegin = "# BEGIN LXD CDI"
+	ldConfBlockEnd   = "# END LXD CDI"
+
+	// linkerConfFileMode is the mode of the linker conf file, musl path file and linker cache, which
+	// must be readable by everyone for the dynamic linker and ldconfig.
+	linkerConfFileMode os.FileMode = 0644
 )
 
+// LinkerConfPath returns the path of the CDILinkerConfFile inside the container rootfs at rootfs.
+func LinkerConfPath(rootfs string) string {
+	return filepath.Join(rootfs, linkerConfDir, CDILinkerConfFile)
+}
+
+// linkerConfFilePath returns the path of the linker conf file holding the CDI library directories for
+// the given suffix and priority (see Hooks.LinkerConfSuffix and Hooks.LinkerConfPriority).
+func linkerConfFilePath(suffix string, priority int) (string, error) {
+	if priority < 0 || priority > maxLinkerConfPriority {
+		return "", fmt.Errorf("Invalid CDI linker conf file priority %d, it must be between 0 and %d", priority, maxLinkerConfPriority)
+	}
+
+	prefix := fmt.Sprintf("%02d-%s", priority, cdiLinkerConfFileName)
+	if suffix == "" {
+		return filepath.Join(linkerConfDir, prefix+".conf"), nil
+	}
+
+	if strings.ContainsAny(suffix, "/\x00") || strings.TrimSpace(suffix) != suffix {
+		return "", fmt.Errorf("Invalid CDI linker conf file suffix %q", suffix)
+	}
+
+	return filepath.Join(linkerConfDir, prefix+"-"+suffix+".conf"), nil
+}
+
+// isCDILinkerConfFile returns whether name is the name of a linker conf file written for CDI, whatever
+// its priority.
+func isCDILinkerConfFile(name string) bool {
+	if len(name) < 2 || name[0] < '0' || name[0] > '9' || name[1] < '0' || name[1] > '9' {
+		return false
+	}
+
+	return strings.HasPrefix(name[2:], "-"+cdiLinkerConfFileName) && strings.HasSuffix(name, ".conf")
+}
+
+// ParseLdConfEntries returns the entries LXD manages in the linker conf file at path on the host, in
+// order. They are the lines between the ldConfBlockBegin and ldConfBlockEnd markers, or all the lines
+// of a file written before the markers were used. The lines are trimmed and stripped of their
+// comments and the empty ones are skipped. A missing file has no entries.
+func ParseLdConfEntries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return nil, fmt.Errorf("Failed opening the linker conf file at %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	conf, err := parseLdConfFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the linker conf file at %q: %w", path, err)
+	}
+
+	return conf.entries, nil
+}
+
+// ldConfFile is a linker conf file holding a block of entries managed by LXD, surrounded by lines
+// added by hand.
+type ldConfFile struct {
+	// head holds the lines before the managed block, as they are.
+	head []string
+	// entries holds the entries of the managed block.
+	entries []string
+	// tail holds the lines after the managed block, as they are.
+	tail []string
+}
+
+// parseLdConfFile parses the linker conf content read from r. A block missing its end marker lasts
+// until the end of the file.
+func parseLdConfFile(r io.Reader) (*ldConfFile, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &ldConfFile{entries: []string{}}
+
+	begin := slices.IndexFunc(lines, func(line string) bool { return strings.TrimSpace(line) == ldConfBlockBegin })
+	if begin < 0 {
+		// The whole file was written by LXD before the block markers were used.
+		conf.entries = ldConfEntries(lines)
+		return conf, nil
+	}
+
+	conf.head = lines[:begin]
+	block := lines[begin+1:]
+
+	end := slices.IndexFunc(block, func(line string) bool { return strings.TrimSpace(line) == ldConfBlockEnd })
+	if end >= 0 {
+		conf.tail = block[end+1:]
+		block = block[:end]
+	}
+
+	conf.entries = ldConfEntries(block)
+	return conf, nil
+}
+
+// ldConfEntries returns the trimmed, non-empty lines without their comments.
+func ldConfEntries(lines []string) []string {
+	entries := []string{}
+	for _, line := range lines {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+
+	return entries
+}
+
+// hasUnmanagedLines returns whether the file has non-empty lines outside of the managed block.
+func (c *ldConfFile) hasUnmanagedLines() bool {
+	for _, line := range slices.Concat(c.head, c.tail) {
+		if strings.TrimSpace(line) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// content returns the content of the linker conf file, with the lines outside of the managed block
+// kept as they are. A managed block without entries is left out. A non-empty content always ends with
+// exactly one newline, the blank lines at the end of the file being dropped, as some ldconfig versions
+// warn about a missing final newline.
+func (c *ldConfFile) content() []byte {
+	lines := slices.Clone(c.head)
+	if len(c.entries) > 0 {
+		lines = append(lines, ldConfBlockBegin)
+		lines = append(lines, c.entries...)
+		lines = append(lines, ldConfBlockEnd)
+	}
+
+	lines = append(lines, c.tail...)
+
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// readLinkerConfEntries returns the entries of the linker conf file at path inside the container, as
+// described by ParseLdConfEntries.
+func readLinkerConfEntries(cfs containerFS, path string) ([]string, error) {
+	f, err := cfs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return nil, fmt.Errorf("Failed opening the linker conf file at %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	conf, err := parseLdConfFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the linker conf file at %q: %w", path, err)
+	}
+
+	return conf.entries, nil
+}
+
+// readCDILinkerConfEntries returns the library directories listed in all the CDI linker conf files of
+// the container, in the order the files are read by ldconfig.
+func readCDILinkerConfEntries(cfs containerFS) ([]string, error) {
+	paths, err := cdiLinkerConfFiles(cfs)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, path := range paths {
+		fileEntries, err := readLinkerConfEntries(cfs, path)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, fileEntries...)
+	}
+
+	return normalizeLDCacheUpdates(entries), nil
+}
+
+// cdiLinkerConfFiles returns the paths of the CDI linker conf files of the container, in the order
+// they are read by ldconfig.
+func cdiLinkerConfFiles(cfs containerFS) ([]string, error) {
+	confDir, err := resolveContainerDir(cfs, linkerConfDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := cfs.ReadDir(confDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed listing the linker conf directory %q: %w", linkerConfDir, err)
+	}
+
+	paths := []string{}
+	for _, file := range files {
+		if isCDILinkerConfFile(file.Name()) {
+			paths = append(paths, filepath.Join(confDir, file.Name()))
+		}
+	}
+
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
 type containerFS interface {
 	MkdirAll(path string) error
 	Symlink(oldname, newname string) error
@@ -71,6 +395,12 @@ type containerFS interface {
 	Remove(path string) error
 	Chtimes(path string, atime time.Time, mtime time.Time) error
 	Lstat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Rename(oldname, newname string) error
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid int, gid int) error
+	Link(oldname, newname string) error
 }
 
 type sftpContainerFS struct {
@@ -106,198 +436,3107 @@ func (s *sftpContainerFS) Lstat(path string) (os.FileInfo, error) {
 	return s.client.Lstat(path)
 }
 
-// resolveTargetRelativeToLink converts a link's target into a path relative to the link's path.
-func resolveTargetRelativeToLink(link string, target string) (string, error) {
-	if !filepath.IsAbs(link) {
-		return "", fmt.Errorf("The link must be an absolute path: %q (target: %q)", link, target)
-	}
+// Readlink returns the destination of the named symbolic link.
+func (s *sftpContainerFS) Readlink(path string) (string, error) {
+	return s.client.ReadLink(path)
+}
 
-	// If target is already relative, return as-is.
-	if !filepath.IsAbs(target) {
-		return target, nil
-	}
+// ReadDir reads the named directory and returns a list of its entries.
+func (s *sftpContainerFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return s.client.ReadDir(path)
+}
 
-	// Clean both paths to normalize them.
-	linkClean := filepath.Clean(link)
-	targetClean := filepath.Clean(target)
+// Rename atomically renames oldname to newname, replacing newname if it already exists.
+func (s *sftpContainerFS) Rename(oldname, newname string) error {
+	return s.client.PosixRename(oldname, newname)
+}
 
-	linkDir := filepath.Dir(linkClean)
+// Chmod changes the mode of the named file.
+func (s *sftpContainerFS) Chmod(path string, mode os.FileMode) error {
+	return s.client.Chmod(path, mode)
+}
 
-	// Calculate the relative path from link's directory to the target.
-	relPath, err := filepath.Rel(linkDir, targetClean)
-	if err != nil {
-		return "", err
-	}
+// Chown changes the owner of the named file. The ids are the ones inside the container.
+func (s *sftpContainerFS) Chown(path string, uid int, gid int) error {
+	return s.client.Chown(path, uid, gid)
+}
 
-	return relPath, nil
+// Link creates newname as a hard link to the oldname file.
+func (s *sftpContainerFS) Link(oldname, newname string) error {
+	return s.client.Link(oldname, newname)
 }
 
-// ApplyHooksToContainer applies CDI hooks to a container by creating symlinks
-// and updating the linker configuration using SFTP.
-func ApplyHooksToContainer(hooksFilePath string, c instance.Container) error {
-	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
-	sftpClient, err := c.FileSFTPNoLock()
-	if err != nil {
-		return fmt.Errorf("Failed getting SFTP client: %w", err)
-	}
+// rootedFS is a containerFS whose paths are interpreted relative to root inside the container.
+// The symlink targets are kept as is so that they resolve the same way once root is merged over
+// the container rootfs.
+type rootedFS struct {
+	cfs  containerFS
+	root string
+}
 
-	defer func() { _ = sftpClient.Close() }()
+// path returns the path of p inside the container.
+func (r *rootedFS) path(p string) string {
+	return filepath.Join(r.root, p)
+}
 
-	err = applyHooksWithFS(hooksFilePath, &sftpContainerFS{client: sftpClient})
-	if err != nil {
-		return err
-	}
+// MkdirAll creates a directory named path, along with any necessary parents.
+func (r *rootedFS) MkdirAll(path string) error { return r.cfs.MkdirAll(r.path(path)) }
 
-	updateLDCache(context.Background(), c, &sftpContainerFS{client: sftpClient})
+// Symlink creates newname as a symbolic link to oldname.
+func (r *rootedFS) Symlink(oldname, newname string) error {
+	return r.cfs.Symlink(oldname, r.path(newname))
+}
 
-	return nil
+// OpenFile opens the named file with the specified flags.
+func (r *rootedFS) OpenFile(path string, flags int) (io.ReadWriteCloser, error) {
+	return r.cfs.OpenFile(r.path(path), flags)
 }
 
-// applyHooksWithFS is the testable core of ApplyHooksToContainer.
-// It applies CDI hooks using the provided containerFS implementation.
-func applyHooksWithFS(hooksFilePath string, cfs containerFS) error {
-	hookFile, err := os.Open(hooksFilePath)
-	if err != nil {
-		return fmt.Errorf("Failed opening the CDI hooks file at %q: %w", hooksFilePath, err)
-	}
+// Remove removes the named file.
+func (r *rootedFS) Remove(path string) error { return r.cfs.Remove(r.path(path)) }
 
-	defer hookFile.Close()
+// Chtimes changes the access and modification times of the named file.
+func (r *rootedFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return r.cfs.Chtimes(r.path(path), atime, mtime)
+}
 
-	hooks := &Hooks{}
-	err = json.NewDecoder(hookFile).Decode(hooks)
-	if err != nil {
-		return fmt.Errorf("Failed decoding the CDI hooks file at %q: %w", hooksFilePath, err)
-	}
+// Lstat returns a FileInfo structure describing the named file without following symbolic links.
+func (r *rootedFS) Lstat(path string) (os.FileInfo, error) { return r.cfs.Lstat(r.path(path)) }
 
-	// Creating the symlinks
-	for _, symlink := range hooks.Symlinks {
-		// Resolve hook link from target
-		target, err := resolveTargetRelativeToLink(symlink.Link, symlink.Target)
-		if err != nil {
-			return fmt.Errorf("Failed resolving a CDI symlink: %w", err)
+// Readlink returns the destination of the named symbolic link.
+func (r *rootedFS) Readlink(path string) (string, error) { return r.cfs.Readlink(r.path(path)) }
+
+// ReadDir reads the named directory and returns a list of its entries.
+func (r *rootedFS) ReadDir(path string) ([]os.FileInfo, error) { return r.cfs.ReadDir(r.path(path)) }
+
+// Rename atomically renames oldname to newname, replacing newname if it already exists.
+func (r *rootedFS) Rename(oldname, newname string) error {
+	return r.cfs.Rename(r.path(oldname), r.path(newname))
+}
+
+// Chmod changes the mode of the named file under root.
+func (r *rootedFS) Chmod(path string, mode os.FileMode) error { return r.cfs.Chmod(r.path(path), mode) }
+
+// Chown changes the owner of the named file under root.
+func (r *rootedFS) Chown(path string, uid int, gid int) error {
+	return r.cfs.Chown(r.path(path), uid, gid)
+}
+
+// Link creates newname as a hard link to the oldname file, both under root.
+func (r *rootedFS) Link(oldname, newname string) error {
+	return r.cfs.Link(r.path(oldname), r.path(newname))
+}
+
+// missingDirs returns the directories that would be created by a MkdirAll of path,
+// ordered from the top-most one.
+func missingDirs(cfs containerFS, path string) ([]string, error) {
+	dirs := []string{}
+	for dir := filepath.Clean(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		_, err := cfs.Lstat(dir)
+		if err == nil {
+			break
 		}
 
-		// Try to create the directory if it doesn't exist
-		linkDir := filepath.Dir(symlink.Link)
-		err = cfs.MkdirAll(linkDir)
-		if err != nil {
-			return fmt.Errorf("Failed creating the directory for the CDI symlink: %w", err)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
 		}
 
-		// Create the symlink
-		err = createSymlinkInContainer(cfs, target, symlink.Link)
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	return dirs, nil
+}
+
+// hooksTransaction records the changes made to a container filesystem while applying CDI hooks
+// so that they can be undone if a later step fails.
+type hooksTransaction struct {
+	cfs containerFS
+	// systemFS is used to inspect the container C library. It differs from cfs when the changes
+	// are written to a writable root.
+	systemFS containerFS
+	l        logger.Logger
+	// rootOwned makes the created directories owned by the container root user.
+	rootOwned bool
+	// replaceLdConf rewrites the managed block of the linker conf file instead of merging into it.
+	replaceLdConf bool
+	// symlinksOnly skips the linker configuration and ldCacheOnly the symlinks.
+	symlinksOnly bool
+	ldCacheOnly  bool
+	// preserveMainLinkerConf leaves the main linker conf file untouched even when it does not include
+	// the linker conf directory.
+	preserveMainLinkerConf bool
+	// relativeLinkerConfInclude makes the include directive added to the main linker conf file
+	// relative to it, as the etc directory is not /etc.
+	relativeLinkerConfInclude bool
+	// skipMissingLibDirs leaves the missing library directories out of the linker configuration and
+	// requireLibDirs fails on them.
+	skipMissingLibDirs bool
+	requireLibDirs     bool
+	// backedUpFiles are the regular files renamed out of the way of a symlink.
+	backedUpFiles []string
+	// repairedSymlinks are the stale symlinks that were replaced.
+	repairedSymlinks []string
+	// crossDeviceSymlinks are the created symlinks resolving to another filesystem.
+	crossDeviceSymlinks []string
+	// knownDirs are the directories known to exist, so that the many CDI symlinks sharing a directory
+	// do not walk its path again.
+	knownDirs map[string]bool
+	// targets resolves the targets of the symlinks. resolveTarget is used when it is nil.
+	targets   *targetResolver
+	undoFuncs []func() error
+}
+
+// record adds a function undoing a change to the transaction.
+func (t *hooksTransaction) record(undo func() error) {
+	t.undoFuncs = append(t.undoFuncs, undo)
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents, and records every
+// directory that did not exist beforehand. The created directories are given the permissions of their
+// nearest existing ancestor so that they are not more open than it, and when rootOwned is set, they
+// are chowned to the container root user. The mode is set once they are created so that it does not
+// depend on the umask of the process creating them, which would otherwise leave the directories
+// unreadable by the guest on hosts with a restrictive umask. The existing directories are left
+// untouched.
+func (t *hooksTransaction) MkdirAll(path string) error {
+	return t.mkdirAllWithAttrs(path, fileAttrs{})
+}
+
+// mkdirAllWithAttrs is MkdirAll giving the created directories the mode and owner of attrs, when set,
+// instead of the default ones.
+func (t *hooksTransaction) mkdirAllWithAttrs(path string, attrs fileAttrs) error {
+	path = filepath.Clean(path)
+	if t.knownDirs[path] {
+		return nil
+	}
+
+	dirs, err := missingDirs(t.cfs, path)
+	if err != nil {
+		return err
+	}
+
+	if len(dirs) == 0 {
+		t.markKnownDir(path)
+		return nil
+	}
+
+	mode := attrs.mode
+	if !attrs.hasMode {
+		mode, err = dirPerm(t.cfs, filepath.Dir(dirs[0]))
 		if err != nil {
 			return err
 		}
 	}
 
-	// Updating the linker configuration.
-	if len(hooks.LDCacheUpdates) > 0 {
-		ldConfDirPath := "/etc/ld.so.conf.d"
-		err = cfs.MkdirAll(ldConfDirPath)
+	// Record the missing directories from the top-most one so that the rollback removes the deepest
+	// ones first. This is done before creating them to also cover a partially successful MkdirAll.
+	for _, dir := range dirs {
+		t.record(func() error {
+			err := t.cfs.Remove(dir)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed removing CDI directory %q: %w", dir, err)
+			}
+
+			return nil
+		})
+	}
+
+	err = t.cfs.MkdirAll(path)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		err := t.cfs.Chmod(dir, mode)
 		if err != nil {
-			return fmt.Errorf("Failed creating the linker conf directory at %q: %w", ldConfDirPath, err)
+			return fmt.Errorf("Failed changing the mode of CDI directory %q: %w", dir, err)
 		}
 
-		ldConfFilePath := filepath.Join(ldConfDirPath, customCDILinkerConfFile)
+		if attrs.hasOwner {
+			err = t.cfs.Chown(dir, attrs.uid, attrs.gid)
+		} else if t.rootOwned {
+			err = t.cfs.Chown(dir, 0, 0)
+		}
 
-		// Try to open existing file for reading and appending.
-		ldConfFile, err := cfs.OpenFile(ldConfFilePath, os.O_APPEND|os.O_RDWR)
-		if err == nil {
-			defer ldConfFile.Close()
-
-			// The file already exists. Read it first, analyze its entries
-			// and add the ones that are not already there.
-			existingLinkerEntries := make(map[string]bool)
-			scanner := bufio.NewScanner(ldConfFile)
-			for scanner.Scan() {
-				existingLinkerEntries[strings.TrimSpace(scanner.Text())] = true
-			}
+		if err != nil {
+			return fmt.Errorf("Failed changing the owner of CDI directory %q: %w", dir, err)
+		}
+	}
 
-			if scanner.Err() != nil {
-				return fmt.Errorf("Failed reading the linker conf file at %q: %w", ldConfFilePath, scanner.Err())
-			}
+	t.markKnownDir(path)
 
-			for _, update := range hooks.LDCacheUpdates {
-				if !existingLinkerEntries[update] {
-					_, err = fmt.Fprintln(ldConfFile, update)
-					if err != nil {
-						return fmt.Errorf("Failed writing to the linker conf file at %q: %w", ldConfFilePath, err)
-					}
+	return nil
+}
 
-					existingLinkerEntries[update] = true
-				}
-			}
-		} else {
-			// The file does not exist. Create it with our entries.
-			ldConfFile, err := cfs.OpenFile(ldConfFilePath, os.O_CREATE|os.O_WRONLY)
-			if err != nil {
-				return fmt.Errorf("Failed creating the linker conf file at %q: %w", ldConfFilePath, err)
-			}
+// markKnownDir records that the directory at path exists.
+func (t *hooksTransaction) markKnownDir(path string) {
+	if t.knownDirs == nil {
+		t.knownDirs = make(map[string]bool)
+	}
 
-			defer ldConfFile.Close()
+	t.knownDirs[path] = true
+}
 
-			for _, update := range hooks.LDCacheUpdates {
-				_, err = fmt.Fprintln(ldConfFile, update)
-				if err != nil {
-					return fmt.Errorf("Failed writing to the linker conf file at %q: %w", ldConfFilePath, err)
-				}
-			}
+// forgetKnownDirs forgets the known directories at or below path once a link replaced what was there.
+func (t *hooksTransaction) forgetKnownDirs(path string) {
+	for dir := range t.knownDirs {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			delete(t.knownDirs, dir)
 		}
 	}
+}
 
-	return nil
+// fileAttrs are the mode and owner requested by a SymlinkEntry for the files created or backed up
+// for its link.
+type fileAttrs struct {
+	mode     os.FileMode
+	hasMode  bool
+	uid      int
+	gid      int
+	hasOwner bool
 }
 
-// createSymlinkInContainer creates a symlink inside the container, removing any existing symlink at the same path if needed.
-func createSymlinkInContainer(cfs containerFS, target string, link string) error {
-	// Remove any existing symlink at the target path.
-	fileInfo, err := cfs.Lstat(link)
-	if err == nil && fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
-		err = cfs.Remove(link)
+// symlinkFileAttrs returns the mode and owner requested by symlink.
+func symlinkFileAttrs(symlink SymlinkEntry) (fileAttrs, error) {
+	attrs := fileAttrs{}
+	if symlink.Mode != "" {
+		mode, err := parseFileMode(symlink.Mode)
 		if err != nil {
-			return fmt.Errorf("Failed removing existing CDI symlink path %q: %w", link, err)
+			return fileAttrs{}, err
 		}
+
+		attrs.mode = mode
+		attrs.hasMode = true
 	}
 
-	err = cfs.Symlink(target, link)
-	if err != nil {
-		return fmt.Errorf("Failed creating the CDI symlink %q to %q: %w", link, target, err)
+	if symlink.UID != nil {
+		attrs.uid = int(*symlink.UID)
+		attrs.hasOwner = true
 	}
 
-	return nil
+	if symlink.GID != nil {
+		attrs.gid = int(*symlink.GID)
+		attrs.hasOwner = true
+	}
+
+	return attrs, nil
 }
 
-// updateLDCache updates the linker cache inside the instance. It ignores
-// possible errors and logs them instead since this is a best effort action and
-// failure should not impact the container's start or hotplugging.
-func updateLDCache(ctx context.Context, inst instance.Instance, cfs containerFS) {
-	l := logger.AddContext(logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+// fileOwner returns the owner of the file described by fileInfo, if the filesystem reports it.
+func fileOwner(fileInfo os.FileInfo) (int, int, bool) {
+	switch sys := fileInfo.Sys().(type) {
+	case *sftp.FileStat:
+		return int(sys.UID), int(sys.GID), true
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid), true
+	}
 
-	if inst.IsRunning() {
-		// Run ldconfig to update the linker cache, note we do not update symlinks via
-		// -X as those are handled by the CDI hooks.
-		cmd, err := inst.Exec(ctx, api.InstanceExecPost{
-			Command:   []string{"/sbin/ldconfig", "-X"},
-			WaitForWS: false,
-		}, nil, nil, nil)
+	return 0, 0, false
+}
 
-		if err != nil {
-			l.Warn("Failed starting ldconfig in the container", logger.Ctx{"error": err})
-			return
-		}
+// dirPerm returns the permissions of the directory at path, following the symlinks leading to it.
+// A missing root, which is the case of a writable root not created yet, has the usual 0755 mode.
+func dirPerm(cfs containerFS, path string) (os.FileMode, error) {
+	resolved, err := resolveContainerPath(cfs, path)
+	if err != nil {
+		return 0, fmt.Errorf("Failed resolving the directory %q: %w", path, err)
+	}
 
-		p, err := cmd.Wait()
-		if err != nil {
-			l.Warn("Failed executing ldconfig in the container", logger.Ctx{"error": err, "exit code": p})
-		}
-	} else {
-		// For stopped containers, add touch /usr mtime. This triggers systemd's
-		// ldconfig.service at boot to pick up the CDI libraries.
-		// See systemctl cat ldconfig.service for details.
-		err := cfs.Chtimes("/usr", time.Now(), time.Now())
+	fileInfo, err := cfs.Lstat(resolved)
+	if errors.Is(err, fs.ErrNotExist) && resolved == "/" {
+		return 0755, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed checking the directory %q: %w", path, err)
+	}
+
+	return fileInfo.Mode().Perm(), nil
+}
+
+// Rollback undoes the recorded changes in reverse order. All the undo functions are run
+// even if some of them fail, and the returned error joins all the failures.
+func (t *hooksTransaction) Rollback() error {
+	var errs []error
+	for i := len(t.undoFuncs) - 1; i >= 0; i-- {
+		err := t.undoFuncs[i]()
 		if err != nil {
-			l.Warn("Failed updating mtime of /usr in the container to trigger ldconfig.service", logger.Ctx{"error": err})
+			errs = append(errs, err)
 		}
 	}
+
+	t.undoFuncs = nil
+	// The rollback removed the directories it created.
+	t.knownDirs = nil
+
+	return errors.Join(errs...)
+}
+
+// pathEscapesRoot reports whether path climbs above the root directory when its ".." elements are
+// resolved lexically. filepath.Clean silently drops such elements, which would hide a path escaping
+// the container rootfs once joined with the rootfs mount path.
+func pathEscapesRoot(path string) bool {
+	depth := 0
+	for elem := range strings.SplitSeq(path, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return true
+			}
+
+			depth--
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
+// resolveTargetRelativeToLink converts a link's target into a path relative to the link's path.
+// Both the link and its target must stay within the container rootfs.
+func resolveTargetRelativeToLink(link string, target string) (string, error) {
+	return resolveTarget(link, target, false)
+}
+
+// resolveTarget returns the target given to the symlink at link, once checked that both the link and
+// its target stay within the container rootfs. An absolute target is converted into a path relative to
+// the link's directory unless keepAbsolute is set, a relative one being kept as is.
+// A relative target keeps pointing at the same file when the rootfs is relocated or viewed from the
+// host, which is why it is the default. An absolute target is resolved from the root of whoever
+// follows the symlink, which is needed when the target is outside of the tree the link belongs to,
+// e.g. on a read-only mount shared with the host that may be mounted elsewhere.
+func resolveTarget(link string, target string, keepAbsolute bool) (string, error) {
+	err := checkSymlinkInRoot(link, target)
+	if err != nil {
+		return "", err
+	}
+
+	// If target is already relative, return as-is.
+	if !filepath.IsAbs(target) {
+		return target, nil
+	}
+
+	// Clean both paths to normalize them.
+	linkClean := filepath.Clean(link)
+	targetClean := filepath.Clean(target)
+
+	if keepAbsolute {
+		return targetClean, nil
+	}
+
+	linkDir := filepath.Dir(linkClean)
+
+	// Calculate the relative path from link's directory to the target.
+	relPath, err := filepath.Rel(linkDir, targetClean)
+	if err != nil {
+		return "", err
+	}
+
+	return relPath, nil
+}
+
+// checkSymlinkInRoot checks that both the symlink at link and its target stay within the container
+// rootfs.
+func checkSymlinkInRoot(link string, target string) error {
+	if !filepath.IsAbs(link) {
+		return fmt.Errorf("The link must be an absolute path: %q (target: %q)", link, target)
+	}
+
+	if pathEscapesRoot(link) {
+		return withKindf(ErrSymlinkEscape, "The link escapes the container rootfs: %q (target: %q)", link, target)
+	}
+
+	// A relative target is resolved from the link's directory.
+	resolvedTarget := target
+	if !filepath.IsAbs(target) {
+		resolvedTarget = filepath.Dir(filepath.Clean(link)) + "/" + target
+	}
+
+	if pathEscapesRoot(resolvedTarget) {
+		return withKindf(ErrSymlinkEscape, "The link target escapes the container rootfs: %q (link: %q)", target, link)
+	}
+
+	return nil
+}
+
+// targetResolver resolves the targets of the symlinks like resolveTarget, reusing the path from the
+// link's directory to the target's directory computed for an earlier symlink, as the many CDI symlinks
+// of a spec share a few directories. A resolver is meant for a single apply or removal so that nothing
+// is shared between the rootfs.
+type targetResolver struct {
+	// relDirs are the paths from a link's directory to a target's directory, by pair of directories.
+	relDirs map[[2]string]string
+}
+
+// newTargetResolver returns an empty targetResolver.
+func newTargetResolver() *targetResolver {
+	return &targetResolver{relDirs: map[[2]string]string{}}
+}
+
+// resolve returns the target given to the symlink at link, like resolveTarget does. A nil resolver
+// uses resolveTarget.
+func (r *targetResolver) resolve(link string, target string, keepAbsolute bool) (string, error) {
+	targetClean := filepath.Clean(target)
+	if r == nil || keepAbsolute || !filepath.IsAbs(target) || targetClean == "/" {
+		return resolveTarget(link, target, keepAbsolute)
+	}
+
+	err := checkSymlinkInRoot(link, target)
+	if err != nil {
+		return "", err
+	}
+
+	linkDir := filepath.Dir(filepath.Clean(link))
+
+	// The path to the link's directory or to one of its parents does not go through the target's
+	// directory, e.g. "." rather than "../cdi".
+	if linkDir == targetClean || strings.HasPrefix(linkDir, targetClean+"/") {
+		return resolveTarget(link, target, keepAbsolute)
+	}
+
+	key := [2]string{linkDir, filepath.Dir(targetClean)}
+
+	relDir, found := r.relDirs[key]
+	if !found {
+		relDir, err = filepath.Rel(key[0], key[1])
+		if err != nil {
+			return "", err
+		}
+
+		r.relDirs[key] = relDir
+	}
+
+	return filepath.Join(relDir, filepath.Base(targetClean)), nil
+}
+
+// ApplyOptions controls how CDI hooks are applied to a container.
+type ApplyOptions struct {
+	// Context cancels the application of the hooks. No further changes are made to the container
+	// filesystem once it is cancelled. Defaults to context.Background().
+	Context context.Context
+
+	// Logger receives the changes made to the container at the debug level. A nil logger disables logging.
+	Logger logger.Logger
+
+	// LdconfigPath overrides the package level LdconfigPath for this call.
+	LdconfigPath string
+
+	// ForeignLdconfig is the command run in the container instead of its ldconfig when that one is
+	// built for an architecture the host cannot run natively, as in a foreign rootfs relying on
+	// binfmt and qemu-user (e.g. {"/usr/bin/qemu-aarch64-static", "/sbin/ldconfig"}). The ldconfig
+	// arguments are appended to it. The linker cache update is skipped with a warning when it is
+	// empty and ldconfig is foreign.
+	ForeignLdconfig []string
+
+	// LdconfigTimeout bounds the time given to ldconfig to update the linker cache.
+	// Defaults to 30 seconds.
+	LdconfigTimeout time.Duration
+
+	// RetryAttempts is the number of attempts given to each directory and symlink creation failing
+	// with a transient error (EAGAIN or EBUSY), with a short backoff between them. Any other error
+	// fails immediately. Defaults to 3, 1 disabling the retries.
+	RetryAttempts int
+
+	// DryRun logs the changes that would be made to the container without making them, and returns
+	// them in ApplyResult.PlannedActions.
+	DryRun bool
+
+	// SkipLdCache disables the linker cache regeneration after the hooks are applied.
+	SkipLdCache bool
+
+	// SymlinksOnly only creates the symlinks of the hooks, leaving the linker configuration and cache
+	// untouched, so that they can be updated in a later step with LdCacheOnly.
+	SymlinksOnly bool
+
+	// LdCacheOnly only updates the linker configuration and regenerates the linker cache, the symlinks
+	// being left untouched, e.g. as they were created in an earlier step with SymlinksOnly or are
+	// provided by a bind mount. The cache is regenerated even when the linker configuration is already
+	// up to date. It cannot be combined with SymlinksOnly or SkipLdCache.
+	LdCacheOnly bool
+
+	// Rollback undoes the changes already made to the container filesystem when a step fails.
+	Rollback bool
+
+	// WritableRoot is an absolute path inside the container (e.g. the upper layer of an overlay merged
+	// over a read-only rootfs) under which the symlinks and the linker configuration are written
+	// instead of the container root.
+	WritableRoot string
+
+	// EtcDir is the system configuration directory of the container relative to its rootfs, "etc"
+	// when empty, under which the linker conf files, the main linker conf file, the musl path file and
+	// the linker cache are read and written instead of /etc, e.g. for the images keeping it elsewhere
+	// or an alternate sysroot. It must resolve within the container rootfs. ldconfig is pointed at the
+	// main linker conf file and the linker cache of EtcDir.
+	EtcDir string
+
+	// ClearImmutable clears the immutable flag (see chattr(1)) of the files and directories preventing
+	// a change, restoring it right after the change, instead of failing with ErrImmutableFile. The
+	// flags are read on the host, so they are only checked when the container rootfs is reachable
+	// from it.
+	ClearImmutable bool
+
+	// RootOwned chowns the directories created for the symlinks and the linker configuration to the
+	// root user of the container. The ids are the ones inside the container and are shifted through
+	// the idmap of the container, so that they appear as root:root in the guest.
+	RootOwned bool
+
+	// ReplaceLdConf rewrites the managed block of the glibc linker conf file to exactly the library
+	// directories of the hooks, dropping the ones left by previous hooks, instead of adding the
+	// missing ones. The lines outside of the block are kept.
+	ReplaceLdConf bool
+
+	// NativeLdCache updates the glibc linker cache of the container directly instead of running
+	// ldconfig, falling back to ldconfig when the cache format is not supported.
+	NativeLdCache bool
+
+	// CheckSearchPaths warns about the symlinked libraries that are neither in a directory listed in
+	// the hooks nor in one searched by default by the dynamic linker of the container, as it cannot find
+	// them. They are reported in ApplyResult.UnsearchedSymlinks.
+	CheckSearchPaths bool
+
+	// Diagnostics receives a JSON FailureReport when applying the hooks fails, when the linker cache
+	// cannot be updated or when the verification fails.
+	Diagnostics io.Writer
+
+	// Verify checks that each created symlink resolves to an existing file inside the container once the
+	// hooks are applied. The broken symlinks are reported with a BrokenLinksError.
+	Verify bool
+
+	// RequireSonames are the sonames (e.g. libcuda.so.1) the linker cache of the container must resolve
+	// once it is regenerated, so that a broken GPU passthrough fails the apply rather than the first
+	// program loading the libraries. The cache is parsed after ldconfig and the missing sonames are
+	// reported with a MissingSonamesError, along with the changes. It requires a glibc container and
+	// is only checked by ApplyHooksToContainerWithOptions.
+	RequireSonames []string
+
+	// RelabelSELinux gives the created symlinks and linker configuration file the SELinux context of
+	// the directory they are in when SELinux is enabled on the host, so that a confined container can
+	// load the CDI libraries. It is a no-op otherwise. AppArmor confines by path so the created files
+	// need nothing for it.
+	RelabelSELinux bool
+
+	// SkipRootFSCheck disables the check that the ContainerRootFS of the hooks, when set, is the rootfs
+	// of the container they are applied to. It is meant for callers relocating the rootfs on purpose.
+	SkipRootFSCheck bool
+
+	// BuildMode applies the hooks with ApplyHooksToRootFS to a plain rootfs directory being built into
+	// an image rather than to a live container, so that the CDI libraries are present as soon as the
+	// containers created from the image start. The directory is written directly, its ids being the
+	// ones of the container, and the ContainerRootFS of the hooks is not checked as they are generated
+	// for another rootfs. As ldconfig cannot run in the directory, the mtime of /usr is touched so that
+	// ldconfig.service rebuilds the cache at first boot, the cache being also updated natively with
+	// NativeLdCache.
+	BuildMode bool
+
+	// OverrideDuplicateLinks keeps the last of the symlinks sharing a link instead of failing on a
+	// link listed several times with different targets.
+	OverrideDuplicateLinks bool
+
+	// PreserveMainLinkerConf leaves /etc/ld.so.conf untouched when it does not include the linker conf
+	// directory, as in some minimal images, instead of appending the include directive to it in a
+	// managed block. The CDI library directories are then not read by ldconfig.
+	PreserveMainLinkerConf bool
+
+	// SkipMissingLibraryDirs leaves the library directories of the hooks that do not exist in the
+	// container out of the linker configuration, as they only add broken entries ldconfig warns about
+	// when a directory of the CDI spec was not mounted. They are reported in
+	// ApplyResult.SkippedLDCacheUpdates.
+	SkipMissingLibraryDirs bool
+
+	// RequireLibraryDirs fails the apply when one of the library directories of the hooks does not
+	// exist in the container. It cannot be combined with SkipMissingLibraryDirs.
+	RequireLibraryDirs bool
+
+	// AllowedDirs restricts the directories the hooks can change to these absolute container paths and
+	// their descendants, so that the hooks of an untrusted CDI spec cannot touch, say, /etc or /bin.
+	// The parent directory of every symlink and every library directory must be within one of them,
+	// once the symlinks of the container are followed, or the apply fails with ErrDirNotAllowed before
+	// anything is changed. The linker configuration files are not restricted. A nil AllowedDirs does not
+	// restrict anything while an empty one allows no directory.
+	AllowedDirs []string
+
+	// StateFile is the host path of a file recording what the apply created in the container, as an
+	// AppliedState, so that RemoveFromState can undo it without the hooks file. AppliedStatePath returns
+	// the one RemoveHooksFromContainer uses. Only ApplyHooksToContainerWithOptions writes it.
+	StateFile string
+
+	// SharedBaseRootFS is the host path of a golden rootfs shared by several containers, each of them
+	// mounting it as the read-only lower layer of an overlay holding its own changes. The symlinks and
+	// the linker configuration are then applied once to the shared base, whose linker cache is updated
+	// natively, and only the entries the container does not see from the base, as its overlay shadows
+	// them, are applied to the container. They are split in ApplyResult.BaseSymlinks and
+	// ApplyResult.BaseLDCacheEntries on one hand and ApplyResult.CreatedSymlinks and
+	// ApplyResult.LDCacheEntries on the other, and only the latter are recorded for removal in the
+	// StateFile, which is required, so that RemoveHooksFromContainer leaves the base to the other
+	// containers. The linker cache is still regenerated in the container when it holds its own copy of
+	// it. The base is changed while the overlays using it are mounted, which overlayfs leaves undefined
+	// but which in practice shows the new entries in the directories of the containers. The ones a
+	// container still does not see are created in its overlay. The files of the base are owned by the
+	// root user of the host, the base not being shifted for any one of the containers, so that the
+	// unprivileged ones need idmapped mounts. It is only supported by
+	// ApplyHooksToContainerWithOptions and cannot be combined with DryRun, BuildMode or WritableRoot.
+	SharedBaseRootFS string
+
+	// rootFS is the host path of the rootfs of the container the hooks are applied to, checked against
+	// the ContainerRootFS of the hooks. The check is skipped when it is empty.
+	rootFS string
+}
+
+// absoluteSymlinkTarget returns the absolute path the target of a symlink at link points at.
+func absoluteSymlinkTarget(link string, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+
+	return filepath.Join(filepath.Dir(link), target)
+}
+
+// sortSymlinks orders the symlinks so that a symlink whose target is another symlink of the batch
+// (e.g. libcuda.so -> libcuda.so.1 -> libcuda.so.535.x) comes after it. The original order is kept
+// otherwise. It fails if the symlinks form a cycle.
+func sortSymlinks(symlinks []SymlinkEntry) ([]SymlinkEntry, error) {
+	byLink := make(map[string]int, len(symlinks))
+	for i, symlink := range symlinks {
+		byLink[filepath.Clean(symlink.Link)] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(symlinks))
+	sorted := make([]SymlinkEntry, 0, len(symlinks))
+	chain := []string{}
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		link := filepath.Clean(symlinks[i].Link)
+
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("The CDI symlinks form a cycle: %s -> %s", strings.Join(chain, " -> "), link)
+		}
+
+		state[i] = visiting
+		chain = append(chain, link)
+
+		dep, found := byLink[absoluteSymlinkTarget(symlinks[i].Link, symlinks[i].Target)]
+		if found && dep != i {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		} else if found {
+			return fmt.Errorf("The CDI symlink %q points at itself", link)
+		}
+
+		chain = chain[:len(chain)-1]
+		state[i] = visited
+		sorted = append(sorted, symlinks[i])
+
+		return nil
+	}
+
+	for i := range symlinks {
+		err := visit(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// ApplyResult describes the changes made to a container when applying CDI hooks.
+type ApplyResult struct {
+	// CreatedSymlinks are the symlinks that were created or replaced.
+	CreatedSymlinks []SymlinkEntry `json:"created_symlinks" yaml:"created_symlinks"`
+	// RepairedSymlinks are the links of CreatedSymlinks that replaced a stale symlink.
+	RepairedSymlinks []string `json:"repaired_symlinks,omitempty" yaml:"repaired_symlinks,omitempty"`
+	// SkippedSymlinks are the symlinks that already pointed at their target.
+	SkippedSymlinks []SymlinkEntry `json:"skipped_symlinks" yaml:"skipped_symlinks"`
+	// LDCacheEntries are the library directories added to the linker configuration.
+	LDCacheEntries []string `json:"ld_cache_entries" yaml:"ld_cache_entries"`
+	// LinkerConfFile is the linker configuration file (or musl path file) LDCacheEntries were added to
+	// and DroppedLDCacheEntries removed from.
+	LinkerConfFile string `json:"linker_conf_file,omitempty" yaml:"linker_conf_file,omitempty"`
+	// SkippedLDCacheUpdates are the missing library directories left out of the linker configuration
+	// when ApplyOptions.SkipMissingLibraryDirs is set.
+	SkippedLDCacheUpdates []string `json:"skipped_ld_cache_updates,omitempty" yaml:"skipped_ld_cache_updates,omitempty"`
+	// DroppedLDCacheEntries are the stale library directories removed from the linker configuration
+	// when ApplyOptions.ReplaceLdConf is set.
+	DroppedLDCacheEntries []string `json:"dropped_ld_cache_entries,omitempty" yaml:"dropped_ld_cache_entries,omitempty"`
+	// MainLinkerConfUpdated indicates whether the include directive of the linker conf directory was
+	// added to /etc/ld.so.conf so that ldconfig reads LinkerConfFile.
+	MainLinkerConfUpdated bool `json:"main_linker_conf_updated,omitempty" yaml:"main_linker_conf_updated,omitempty"`
+	// LdconfigRan indicates whether ldconfig was run in the container.
+	LdconfigRan bool `json:"ldconfig_ran" yaml:"ldconfig_ran"`
+	// LdCacheWritten indicates whether the linker cache was updated natively, without ldconfig.
+	LdCacheWritten bool `json:"ld_cache_written" yaml:"ld_cache_written"`
+	// Warnings are the warnings ldconfig printed while updating the linker cache, even when it succeeded.
+	// They often explain why a library is not found in the container.
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+	// LdconfigErr is why the linker cache could not be updated. Its update is best effort so it does not
+	// fail the apply. It matches ErrLdconfigFailed when ldconfig ran and failed.
+	LdconfigErr error `json:"-" yaml:"-"`
+	// UnsearchedSymlinks are the symlinked libraries that the dynamic linker cannot find, when
+	// ApplyOptions.CheckSearchPaths is set.
+	UnsearchedSymlinks []SymlinkEntry `json:"unsearched_symlinks,omitempty" yaml:"unsearched_symlinks,omitempty"`
+	// BackedUpFiles are the regular files that occupied a symlink path and were renamed with the
+	// symlinkBackupSuffix so that the removal of the hooks restores them.
+	BackedUpFiles []string `json:"backed_up_files,omitempty" yaml:"backed_up_files,omitempty"`
+	// CrossDeviceSymlinks are the links of CreatedSymlinks resolving to a file on another filesystem
+	// than the link, which frequently breaks in nested containers. They are only detected when the
+	// container filesystem reports the devices of its files, which SFTP does not.
+	CrossDeviceSymlinks []string `json:"cross_device_symlinks,omitempty" yaml:"cross_device_symlinks,omitempty"`
+	// CreatedDeviceNodes are the paths of the device nodes of the hooks that were created, which is
+	// only done for the privileged containers.
+	CreatedDeviceNodes []string `json:"created_device_nodes,omitempty" yaml:"created_device_nodes,omitempty"`
+	// PendingDeviceNodes are the device nodes of the hooks that could not be created in the container,
+	// as it is unprivileged, and are left to the device manager.
+	PendingDeviceNodes []DeviceNode `json:"pending_device_nodes,omitempty" yaml:"pending_device_nodes,omitempty"`
+	// MountPoints are the mount points prepared for the config devices by ConfigureCDIDevice.
+	MountPoints []MountResult `json:"mount_points,omitempty" yaml:"mount_points,omitempty"`
+	// Timings are how long the stages of the apply took.
+	Timings ApplyTimings `json:"timings" yaml:"timings"`
+	// BaseSymlinks are the symlinks of the hooks the container sees from the shared base rootfs (see
+	// ApplyOptions.SharedBaseRootFS), whether they were created by this apply or an earlier one.
+	BaseSymlinks []SymlinkEntry `json:"base_symlinks,omitempty" yaml:"base_symlinks,omitempty"`
+	// BaseLDCacheEntries are the library directories of the hooks the container sees in the linker
+	// configuration of the shared base rootfs.
+	BaseLDCacheEntries []string `json:"base_ld_cache_entries,omitempty" yaml:"base_ld_cache_entries,omitempty"`
+	// ConditionallySkippedSymlinks are the symlinks whose SymlinkEntry.Condition does not hold.
+	ConditionallySkippedSymlinks []SymlinkEntry `json:"conditionally_skipped_symlinks,omitempty" yaml:"conditionally_skipped_symlinks,omitempty"`
+	// ConditionallySkippedLDCacheUpdates are the library directories whose condition in
+	// Hooks.LDCacheConditions does not hold.
+	ConditionallySkippedLDCacheUpdates []string `json:"conditionally_skipped_ld_cache_updates,omitempty" yaml:"conditionally_skipped_ld_cache_updates,omitempty"`
+	// PlannedActions are the changes that would be made to the container when ApplyOptions.DryRun is
+	// set, nothing being changed then.
+	PlannedActions []PlannedAction `json:"planned_actions,omitempty" yaml:"planned_actions,omitempty"`
+
+	// rollback undoes the changes made by the hooks when ApplyOptions.Rollback is set, for the steps
+	// failing once the hooks were applied. It is nil otherwise.
+	rollback func() error
+}
+
+// ApplyTimings are how long the stages of an apply of CDI hooks took, to tell where the hotplug
+// latency goes. A stage that did not run took no time.
+type ApplyTimings struct {
+	// Decode is the loading and validation of the hooks file.
+	Decode time.Duration `json:"decode" yaml:"decode"`
+	// Symlinks is the creation of the symlinks.
+	Symlinks time.Duration `json:"symlinks" yaml:"symlinks"`
+	// LinkerConf is the update of the linker configuration.
+	LinkerConf time.Duration `json:"linker_conf" yaml:"linker_conf"`
+	// LDCache is the regeneration of the linker cache, natively or by ldconfig.
+	LDCache time.Duration `json:"ld_cache" yaml:"ld_cache"`
+}
+
+// logApplyTimings logs how long the stages of an apply took at the debug level to l.
+func logApplyTimings(l logger.Logger, timings ApplyTimings) {
+	loggerOrNop(l).Debug("Timed the stages of the CDI hooks apply", logger.Ctx{"decode": timings.Decode, "symlinks": timings.Symlinks, "linker conf": timings.LinkerConf, "ld cache": timings.LDCache})
+}
+
+// lockHooks locks the CDI hooks of c until the returned function is called. The applies and removals
+// of CDI hooks hold it from the first change to the container filesystem until the linker cache is
+// regenerated, so that concurrent hotplugs on the same container do not interleave their linker
+// configuration and cache updates. The lock is only held within the LXD daemon, which is the only one
+// applying the hooks. It is the lock of the rootfs of c, see lockRootFS.
+func lockHooks(ctx context.Context, c instance.Container) (locking.UnlockFunc, error) {
+	return lockRootFS(ctx, containerRootFS(c))
+}
+
+// ApplyHooksToContainer applies CDI hooks to a container by creating symlinks
+// and updating the linker configuration using SFTP.
+func ApplyHooksToContainer(hooksFilePath string, c instance.Container) error {
+	_, err := ApplyHooksToContainerWithOptions(hooksFilePath, c, ApplyOptions{})
+	return err
+}
+
+// ApplyHooksToContainerCtx is ApplyHooksToContainer with a context. When the context is cancelled,
+// no further changes are made to the container filesystem and the ones already made are rolled back.
+func ApplyHooksToContainerCtx(ctx context.Context, hooksFilePath string, c instance.Container) error {
+	_, err := ApplyHooksToContainerWithOptions(hooksFilePath, c, ApplyOptions{Context: ctx, Rollback: true})
+	return err
+}
+
+// ApplyHooksToContainerWithOptions applies CDI hooks to a container like ApplyHooksToContainer,
+// with the behavior controlled by opts, and returns the changes made to the container.
+// When opts.Verify is set and some symlinks are broken, the changes are returned along with a
+// BrokenLinksError. When opts.Rollback is set, the changes are rolled back if a step following the
+// apply of the hooks fails, that is the creation of the device nodes, the write of opts.StateFile, the
+// verification of the symlinks or the check of opts.RequireSonames. The linker cache is not restored
+// as it is regenerated from the linker configuration.
+func ApplyHooksToContainerWithOptions(hooksFilePath string, c instance.Container, opts ApplyOptions) (*ApplyResult, error) {
+	return applyHooksToContainer(hooksSource{path: hooksFilePath}, c, opts)
+}
+
+// applyHooksToContainer is the core of ApplyHooksToContainerWithOptions and ApplyHooks, applying the
+// hooks of src to the container c through SFTP.
+func applyHooksToContainer(src hooksSource, c instance.Container, opts ApplyOptions) (*ApplyResult, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	opts.rootFS = containerRootFS(c)
+
+	unlock, err := lockHooks(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	result, regenerateLDCache, err := applyHooksSourceWithFS(src, &sftpContainerFS{client: sftpClient}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	efs, err := newEtcDirFS(&sftpContainerFS{client: sftpClient}, opts.EtcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.PendingDeviceNodes) > 0 && !opts.DryRun && c.IsPrivileged() {
+		err = createContainerDeviceNodes(opts.rootFS, result, opts.Logger)
+		if err != nil {
+			return nil, rollbackApply(efs, result, err)
+		}
+	}
+
+	if opts.StateFile != "" && !opts.DryRun {
+		state := newAppliedState(result, opts.WritableRoot, opts.EtcDir)
+		state.SharedBaseRootFS = opts.SharedBaseRootFS
+
+		err = writeAppliedState(opts.StateFile, state)
+		if err != nil {
+			return nil, rollbackApply(efs, result, err)
+		}
+	}
+
+	start := time.Now()
+	if regenerateLDCache && !opts.SkipLdCache && opts.NativeLdCache {
+		result.LdCacheWritten = updateLDCacheNativeFromConf(efs, opts.Logger)
+	}
+
+	var ldconfigErr error
+	if regenerateLDCache && !opts.SkipLdCache && !result.LdCacheWritten {
+		result.LdconfigRan, result.Warnings, ldconfigErr = updateLDCache(ctx, c, &sftpContainerFS{client: sftpClient}, opts.Logger, opts.LdconfigPath, opts.LdconfigTimeout, opts.ForeignLdconfig, opts.EtcDir)
+		result.LdconfigErr = ldconfigErr
+		if ldconfigErr != nil && opts.Diagnostics != nil {
+			// The linker cache update is best effort so it is only reported.
+			writeFailureReport(opts.Diagnostics, ldconfigErr, opts.Logger)
+		}
+	}
+
+	if regenerateLDCache && !opts.SkipLdCache {
+		// The linker cache of the shared base may have been updated already.
+		result.Timings.LDCache += time.Since(start)
+	}
+
+	if !opts.DryRun {
+		countApplyResult(result, ldconfigErr)
+		logApplyTimings(opts.Logger, result.Timings)
+	}
+
+	if opts.RelabelSELinux && !opts.DryRun && selinuxEnabled() {
+		err = relabelSELinux(opts.rootFS, relabeledPaths(result, opts.WritableRoot))
+		if err != nil {
+			// The relabeling is best effort as the files may still be readable with their context.
+			loggerOrNop(opts.Logger).Warn("Failed relabeling the CDI files", logger.Ctx{"error": err})
+		}
+	}
+
+	if opts.Verify {
+		err = verifySymlinks(efs, result.CreatedSymlinks)
+		if err != nil {
+			if opts.Diagnostics != nil {
+				writeFailureReport(opts.Diagnostics, err, opts.Logger)
+			}
+
+			return result, rollbackApply(efs, result, err)
+		}
+	}
+
+	if len(opts.RequireSonames) > 0 && !opts.DryRun {
+		err = checkRequiredSonames(efs, opts.RequireSonames)
+		if err != nil {
+			if opts.Diagnostics != nil {
+				writeFailureReport(opts.Diagnostics, err, opts.Logger)
+			}
+
+			return result, rollbackApply(efs, result, err)
+		}
+	}
+
+	return result, nil
+}
+
+// rollbackApply rolls back the changes of result, including the device nodes it created in cfs, when
+// a step following the apply of the hooks failed with err, and returns err. Nothing is rolled back
+// unless ApplyOptions.Rollback was set.
+func rollbackApply(cfs containerFS, result *ApplyResult, err error) error {
+	if result.rollback == nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, path := range result.CreatedDeviceNodes {
+		removeErr := removeDeviceNode(cfs, path)
+		if removeErr != nil {
+			errs = append(errs, removeErr)
+		}
+	}
+
+	rollbackErr := result.rollback()
+	if rollbackErr != nil {
+		errs = append(errs, rollbackErr)
+	}
+
+	result.rollback = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w (rollback failed: %w)", err, errors.Join(errs...))
+	}
+
+	return err
+}
+
+// ApplyHooks applies the CDI hooks read from r to the container c like ApplyHooksToContainer does for
+// a file, and returns the changes made to the container. The hooks are decoded as YAML, which also
+// accepts JSON content, so that callers holding them in memory do not need to write them to a file
+// first. The changes are rolled back on failure.
+func ApplyHooks(r io.Reader, c instance.Container) (*ApplyResult, error) {
+	return applyHooksToContainer(hooksSource{r: r}, c, ApplyOptions{Rollback: true})
+}
+
+// ApplyHooksToRootFS applies the CDI hooks file at hooksFilePath to the rootfs directory at rootFS on
+// the host, with the behavior controlled by opts, and returns the changes made to the rootfs. It is
+// meant for the image builds and requires opts.BuildMode. The options running ldconfig in the
+// container are ignored. When opts.Verify finds broken symlinks, the changes are rolled back if
+// opts.Rollback is set.
+func ApplyHooksToRootFS(hooksFilePath string, rootFS string, opts ApplyOptions) (*ApplyResult, error) {
+	err := validateRootFS(rootFS)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.BuildMode {
+		return nil, errors.New("Applying CDI hooks to a rootfs directory requires the build mode")
+	}
+
+	cfs, err := openHostRootFS(rootFS)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = cfs.Close() }()
+
+	result, err := applyHooksToRootFSWithFS(hooksFilePath, cfs, opts)
+	if err != nil {
+		return result, err
+	}
+
+	if opts.RelabelSELinux && !opts.DryRun && selinuxEnabled() {
+		err = relabelSELinux(rootFS, relabeledPaths(result, opts.WritableRoot))
+		if err != nil {
+			loggerOrNop(opts.Logger).Warn("Failed relabeling the CDI files", logger.Ctx{"error": err})
+		}
+	}
+
+	return result, nil
+}
+
+// applyHooksToRootFSWithFS is the testable core of ApplyHooksToRootFS.
+func applyHooksToRootFSWithFS(hooksFilePath string, cfs containerFS, opts ApplyOptions) (*ApplyResult, error) {
+	l := loggerOrNop(opts.Logger)
+
+	result, regenerateLDCache, err := applyHooksWithFS(hooksFilePath, cfs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	efs, err := newEtcDirFS(cfs, opts.EtcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if regenerateLDCache && !opts.SkipLdCache {
+		if opts.NativeLdCache {
+			start := time.Now()
+			result.LdCacheWritten = updateLDCacheNativeFromConf(efs, opts.Logger)
+			result.Timings.LDCache = time.Since(start)
+		}
+
+		// The cache is rebuilt at first boot anyway, the native one only bridging the gap.
+		now := time.Now()
+		err = cfs.Chtimes("/usr", now, now)
+		if err != nil {
+			l.Warn("Failed updating mtime of /usr in the rootfs to trigger ldconfig.service", logger.Ctx{"error": err})
+		}
+	}
+
+	countApplyResult(result, nil)
+	logApplyTimings(l, result.Timings)
+
+	if opts.Verify {
+		err = verifySymlinks(efs, result.CreatedSymlinks)
+		if err != nil {
+			if opts.Diagnostics != nil {
+				writeFailureReport(opts.Diagnostics, err, opts.Logger)
+			}
+
+			return result, rollbackApply(efs, result, err)
+		}
+	}
+
+	return result, nil
+}
+
+// loadHooksFile reads and decodes the CDI hooks file at hooksFilePath.
+// The file is decoded as YAML when it has a `.yaml` or `.yml` extension and as JSON when it has a
+// `.json` extension. Any other file is decoded as YAML, which also accepts JSON content.
+// The relative linker cache updates are resolved with resolveLDCacheUpdates and all of them are
+// normalized with normalizeLDCacheUpdates.
+func loadHooksFile(hooksFilePath string) (*Hooks, error) {
+	return loadHooksFileWithOptions(hooksFilePath, false)
+}
+
+// loadHooksFileWithOptions is loadHooksFile keeping the last of the symlinks sharing a link when
+// overrideLinks is set.
+func loadHooksFileWithOptions(hooksFilePath string, overrideLinks bool) (*Hooks, error) {
+	hookFile, err := os.Open(hooksFilePath)
+	if err != nil {
+		err = fmt.Errorf("Failed opening the CDI hooks file at %q: %w", hooksFilePath, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, withKind(ErrHooksFileNotFound, err)
+		}
+
+		return nil, err
+	}
+
+	defer hookFile.Close()
+
+	hooks, err := decodeHooks(hookFile, filepath.Ext(hooksFilePath) == ".json")
+	if err != nil {
+		return nil, withKindf(ErrInvalidHook, "Failed decoding the CDI hooks file at %q: %w", hooksFilePath, err)
+	}
+
+	err = prepareHooks(hooks, overrideLinks)
+	if err != nil {
+		return nil, withKindf(ErrInvalidHook, "Invalid CDI hooks file at %q: %w", hooksFilePath, err)
+	}
+
+	return hooks, nil
+}
+
+// loadHooks reads and decodes the CDI hooks from r like loadHooksFile. The content is decoded as
+// YAML, which also accepts JSON content.
+func loadHooks(r io.Reader) (*Hooks, error) {
+	return loadHooksWithOptions(r, false)
+}
+
+// loadHooksWithOptions is loadHooks keeping the last of the symlinks sharing a link when
+// overrideLinks is set.
+func loadHooksWithOptions(r io.Reader, overrideLinks bool) (*Hooks, error) {
+	hooks, err := decodeHooks(r, false)
+	if err != nil {
+		return nil, withKindf(ErrInvalidHook, "Failed decoding the CDI hooks: %w", err)
+	}
+
+	err = prepareHooks(hooks, overrideLinks)
+	if err != nil {
+		return nil, withKindf(ErrInvalidHook, "Invalid CDI hooks: %w", err)
+	}
+
+	return hooks, nil
+}
+
+// hooksSource is where the CDI hooks are loaded from: the file at path or, when path is empty, the
+// content read from r.
+type hooksSource struct {
+	path string
+	r    io.Reader
+}
+
+// load loads the CDI hooks of s with loadHooksFileWithOptions or loadHooksWithOptions.
+func (s hooksSource) load(overrideLinks bool) (*Hooks, error) {
+	if s.path != "" {
+		return loadHooksFileWithOptions(s.path, overrideLinks)
+	}
+
+	return loadHooksWithOptions(s.r, overrideLinks)
+}
+
+// requiredHooksFields are the fields of the CDI hooks at least one of which must be present, as a
+// document without any of them usually has its keys misspelled.
+var requiredHooksFields = []string{"symlinks", "ld_cache_updates"}
+
+// decodeHooks decodes the CDI hooks from r as JSON when asJSON is set and as YAML otherwise.
+// The unknown fields are rejected, so that a misspelled key (e.g. `symlink`) is not silently dropped,
+// and the errors name the invalid field.
+func decodeHooks(r io.Reader, asJSON bool) (*Hooks, error) {
+	hooks := &Hooks{}
+	fields := map[string]any{}
+
+	var err error
+	if asJSON {
+		var content json.RawMessage
+		err = json.NewDecoder(r).Decode(&content)
+		if err == nil {
+			err = json.Unmarshal(content, &fields)
+		}
+
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(content))
+			decoder.DisallowUnknownFields()
+			err = describeJSONError(decoder.Decode(hooks))
+		}
+	} else {
+		var content []byte
+		content, err = io.ReadAll(util.MaxBytesReader(r, util.MaxYAMLFileBytes))
+		if err == nil {
+			err = yaml.Unmarshal(content, &fields)
+		}
+
+		if err == nil {
+			err = yaml.UnmarshalStrict(content, hooks)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.ContainsFunc(requiredHooksFields, func(field string) bool { _, ok := fields[field]; return ok }) {
+		return nil, fmt.Errorf("None of the %s fields is set", strings.Join(requiredHooksFields, " and "))
+	}
+
+	return hooks, nil
+}
+
+// describeJSONError returns err with the field of the CDI hooks it is about, for the decoding errors
+// of the fields.
+func describeJSONError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("The field %q has an invalid type, expected %s but got %s (offset %d)", typeErr.Field, typeErr.Type, typeErr.Value, typeErr.Offset)
+	}
+
+	// The unknown fields are only reported in the message of the error.
+	field, found := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if found {
+		return fmt.Errorf("Unknown field %s", field)
+	}
+
+	return err
+}
+
+// prepareHooks validates the decoded hooks, then resolves and normalizes their linker cache updates.
+// When overrideLinks is set, only the last of the symlinks sharing a link is kept.
+func prepareHooks(hooks *Hooks, overrideLinks bool) error {
+	if overrideLinks {
+		hooks.Symlinks = lastSymlinkEntries(hooks.Symlinks)
+	}
+
+	err := ValidateHooks(hooks)
+	if err != nil {
+		return err
+	}
+
+	hooks.LDCacheUpdates, err = resolveLDCacheUpdates(hooks.LDCacheUpdates, hooks.LDCacheBase)
+	if err != nil {
+		return err
+	}
+
+	hooks.LDCacheUpdates = normalizeLDCacheUpdates(hooks.LDCacheUpdates)
+
+	hooks.LDCacheArchs, err = resolveLDCacheArchs(hooks.LDCacheArchs, hooks.LDCacheBase)
+	if err != nil {
+		return err
+	}
+
+	// The conditions are keyed by library directory like the architectures.
+	hooks.LDCacheConditions, err = resolveLDCacheArchs(hooks.LDCacheConditions, hooks.LDCacheBase)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidateHooks checks that hooks are well formed before anything is applied. The link of each
+// symlink must be an absolute path in a directory other than the root one, its target must be set
+// and its kind known. Neither the link nor the target can hold a backslash or a NUL byte. The error
+// names the index of the first invalid symlink.
+// A link listed several times must have the same target and kind each time, as a different one
+// usually comes from a bug in the generation of the CDI spec. The errors match ErrInvalidHook.
+func ValidateHooks(hooks *Hooks) error {
+	links := make(map[string]SymlinkEntry, len(hooks.Symlinks))
+	for i, symlink := range hooks.Symlinks {
+		err := validateSymlinkEntry(symlink)
+		if err != nil {
+			return withKindf(ErrInvalidHook, "Invalid CDI symlink entry %d: %w", i, err)
+		}
+
+		link := filepath.Clean(symlink.Link)
+		existing, found := links[link]
+		if !found {
+			links[link] = symlink
+			continue
+		}
+
+		if absoluteSymlinkTarget(link, existing.Target) != absoluteSymlinkTarget(link, symlink.Target) || symlinkKind(existing) != symlinkKind(symlink) {
+			return withKindf(ErrInvalidHook, "Invalid CDI symlink entry %d: The link %q is listed with the targets %q and %q", i, symlink.Link, existing.Target, symlink.Target)
+		}
+	}
+
+	nodes := make(map[string]DeviceNode, len(hooks.DeviceNodes))
+	for i, node := range hooks.DeviceNodes {
+		err := validateDeviceNode(node)
+		if err != nil {
+			return withKindf(ErrInvalidHook, "Invalid CDI device node entry %d: %w", i, err)
+		}
+
+		path := filepath.Clean(node.Path)
+		existing, found := nodes[path]
+		if found && existing != node {
+			return withKindf(ErrInvalidHook, "Invalid CDI device node entry %d: The device node %q is listed several times", i, node.Path)
+		}
+
+		nodes[path] = node
+	}
+
+	err := validateLDCacheArchs(hooks.LDCacheArchs, hooks.LDCacheUpdates)
+	if err != nil {
+		return withKind(ErrInvalidHook, err)
+	}
+
+	err = validateLDCacheConditions(hooks.LDCacheConditions, hooks.LDCacheUpdates)
+	if err != nil {
+		return withKind(ErrInvalidHook, err)
+	}
+
+	_, err = linkerConfFilePath(hooks.LinkerConfSuffix, hooks.LinkerConfPriority)
+	if err != nil {
+		return withKind(ErrInvalidHook, err)
+	}
+
+	return nil
+}
+
+// lastSymlinkEntries returns symlinks with only the last of the entries sharing a link, in the order
+// of the kept entries.
+func lastSymlinkEntries(symlinks []SymlinkEntry) []SymlinkEntry {
+	seen := make(map[string]bool, len(symlinks))
+	kept := make([]SymlinkEntry, 0, len(symlinks))
+	for i := len(symlinks) - 1; i >= 0; i-- {
+		link := filepath.Clean(symlinks[i].Link)
+		if seen[link] {
+			continue
+		}
+
+		seen[link] = true
+		kept = append(kept, symlinks[i])
+	}
+
+	slices.Reverse(kept)
+
+	return kept
+}
+
+// validateSymlinkEntry checks that symlink is well formed.
+func validateSymlinkEntry(symlink SymlinkEntry) error {
+	if symlink.Link == "" {
+		return errors.New("The link is empty")
+	}
+
+	for _, p := range []string{symlink.Link, symlink.Target} {
+		err := validatePathChars(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !filepath.IsAbs(symlink.Link) {
+		return fmt.Errorf("The link %q is not an absolute path", symlink.Link)
+	}
+
+	link := filepath.Clean(symlink.Link)
+	if link == "/" {
+		return fmt.Errorf("The link %q is the root directory", symlink.Link)
+	}
+
+	if filepath.Dir(link) == "/" {
+		return fmt.Errorf("The link %q is directly in the root directory", symlink.Link)
+	}
+
+	if symlink.Target == "" {
+		return fmt.Errorf("The target of the link %q is empty", symlink.Link)
+	}
+
+	switch symlink.Kind {
+	case "", SymlinkKindSymlink, SymlinkKindHardlink:
+	default:
+		return fmt.Errorf("Unknown kind %q for the link %q", symlink.Kind, symlink.Link)
+	}
+
+	if symlink.Mode != "" {
+		_, err := parseFileMode(symlink.Mode)
+		if err != nil {
+			return fmt.Errorf("Invalid mode for the link %q: %w", symlink.Link, err)
+		}
+	}
+
+	err := validateSymlinkCondition(symlink)
+	if err != nil {
+		return err
+	}
+
+	if symlink.SearchDir != "" {
+		return validateSonameEntry(symlink)
+	}
+
+	return nil
+}
+
+// validatePathChars rejects the paths holding a backslash or a NUL byte. Both are valid in a Linux
+// path, the backslash being a literal character, but they almost always come from a CDI spec authored
+// with Windows paths or from a bug in its generation, and would only create broken links.
+func validatePathChars(p string) error {
+	if strings.Contains(p, "\\") {
+		return fmt.Errorf("The path %q contains a backslash", p)
+	}
+
+	if strings.ContainsRune(p, 0) {
+		return fmt.Errorf("The path %q contains a NUL byte", p)
+	}
+
+	return nil
+}
+
+// parseFileMode parses the octal permission bits in mode.
+func parseFileMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0o7777 {
+		return 0, fmt.Errorf("Invalid mode %q", mode)
+	}
+
+	perm := os.FileMode(value & 0o777)
+	if value&unix.S_ISUID != 0 {
+		perm |= os.ModeSetuid
+	}
+
+	if value&unix.S_ISGID != 0 {
+		perm |= os.ModeSetgid
+	}
+
+	if value&unix.S_ISVTX != 0 {
+		perm |= os.ModeSticky
+	}
+
+	return perm, nil
+}
+
+// containerRootFS returns the host path of the rootfs of c, as recorded in the ContainerRootFS of the
+// hooks generated for it.
+func containerRootFS(c instance.Container) string {
+	return filepath.Join(c.Path(), "rootfs")
+}
+
+// checkContainerRootFS checks that hooksRootFS, the ContainerRootFS of some hooks, is the rootfs at
+// rootFS. The paths are compared once cleaned and, if they still differ, once their symlinks are
+// resolved as the instance paths of LXD are symlinks to the storage pools. An empty hooksRootFS is
+// not checked.
+func checkContainerRootFS(hooksRootFS string, rootFS string) error {
+	if hooksRootFS == "" || filepath.Clean(hooksRootFS) == filepath.Clean(rootFS) {
+		return nil
+	}
+
+	resolvedHooksRootFS, err := filepath.EvalSymlinks(hooksRootFS)
+	if err == nil {
+		var resolvedRootFS string
+		resolvedRootFS, err = filepath.EvalSymlinks(rootFS)
+		if err == nil && resolvedHooksRootFS == resolvedRootFS {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("The CDI hooks are for the container rootfs %q and not %q", hooksRootFS, rootFS)
+}
+
+// resolveLDCacheUpdates joins the relative library directories of updates with base, or the container
+// root if it is empty. The absolute ones are kept as is. A relative directory escaping the container
+// root once resolved is rejected.
+func resolveLDCacheUpdates(updates []string, base string) ([]string, error) {
+	if base == "" {
+		base = "/"
+	}
+
+	if !filepath.IsAbs(base) {
+		return nil, fmt.Errorf("The CDI library directory base %q is not an absolute path", base)
+	}
+
+	resolved := make([]string, 0, len(updates))
+	for _, update := range updates {
+		if strings.TrimSpace(update) == "" || filepath.IsAbs(update) {
+			resolved = append(resolved, update)
+			continue
+		}
+
+		if pathEscapesRoot(base + "/" + update) {
+			return nil, fmt.Errorf("The CDI library directory %q escapes the container rootfs", update)
+		}
+
+		resolved = append(resolved, filepath.Join(base, update))
+	}
+
+	if updates == nil {
+		return nil, nil
+	}
+
+	return resolved, nil
+}
+
+// normalizeLDCacheUpdates cleans each library directory and drops the empty and duplicate ones,
+// keeping the order of first appearance.
+func normalizeLDCacheUpdates(updates []string) []string {
+	if updates == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(updates))
+	normalized := make([]string, 0, len(updates))
+	for _, update := range updates {
+		if strings.TrimSpace(update) == "" {
+			continue
+		}
+
+		update = filepath.Clean(update)
+		if seen[update] {
+			continue
+		}
+
+		seen[update] = true
+		normalized = append(normalized, update)
+	}
+
+	return normalized
+}
+
+// applyHooksWithFS applies the CDI hooks file at hooksFilePath with applyHooksSourceWithFS.
+func applyHooksWithFS(hooksFilePath string, cfs containerFS, opts ApplyOptions) (*ApplyResult, bool, error) {
+	return applyHooksSourceWithFS(hooksSource{path: hooksFilePath}, cfs, opts)
+}
+
+// applyHooksSourceWithFS is the testable core of applyHooksToContainer.
+// It applies the CDI hooks of src using the provided containerFS implementation. If any step fails
+// and opts.Rollback is set, the changes already made to the container filesystem are rolled back
+// before returning.
+// It returns the changes made to the container and whether the linker cache needs to be regenerated,
+// which is only the case when a symlink was created or replaced or a new entry was added to the linker
+// conf file. Musl based containers have no linker cache.
+func applyHooksSourceWithFS(src hooksSource, cfs containerFS, opts ApplyOptions) (_ *ApplyResult, _ bool, err error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	l := loggerOrNop(opts.Logger)
+
+	if opts.Diagnostics != nil {
+		defer func() {
+			if err != nil {
+				writeFailureReport(opts.Diagnostics, err, l)
+			}
+		}()
+	}
+
+	err = validateApplyOptions(opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if opts.DryRun {
+		hooks, err := src.load(opts.OverrideDuplicateLinks)
+		if err != nil {
+			return nil, false, &stageError{stage: FailureStageLoad, err: err}
+		}
+
+		actions, err := planLoadedHooksWithFS(hooks, cfs)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, action := range actions {
+			l.Debug("Planned CDI hooks change", logger.Ctx{"type": action.Type, "path": action.Path, "target": action.Target, "exists": action.Exists})
+		}
+
+		return &ApplyResult{PlannedActions: actions}, false, nil
+	}
+
+	start := time.Now()
+	hooks, err := src.load(opts.OverrideDuplicateLinks)
+	if err != nil {
+		return nil, false, &stageError{stage: FailureStageLoad, err: err}
+	}
+
+	decode := time.Since(start)
+
+	var result *ApplyResult
+	var regenerateLDCache bool
+	if opts.SharedBaseRootFS != "" {
+		result, regenerateLDCache, err = applySharedBase(ctx, hooks, cfs, opts)
+	} else {
+		result, regenerateLDCache, err = applyLoadedHooksWithFS(ctx, hooks, cfs, opts)
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	result.Timings.Decode = decode
+
+	return result, regenerateLDCache, nil
+}
+
+// validateApplyOptions checks that the portions of the hooks selected by opts can be applied together.
+func validateApplyOptions(opts ApplyOptions) error {
+	if opts.SymlinksOnly && opts.LdCacheOnly {
+		return errors.New("The SymlinksOnly and LdCacheOnly options are mutually exclusive")
+	}
+
+	if opts.LdCacheOnly && opts.SkipLdCache {
+		return errors.New("The LdCacheOnly option cannot be combined with SkipLdCache")
+	}
+
+	if opts.SkipMissingLibraryDirs && opts.RequireLibraryDirs {
+		return errors.New("The SkipMissingLibraryDirs and RequireLibraryDirs options are mutually exclusive")
+	}
+
+	for _, dir := range opts.AllowedDirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("The allowed directory %q is not an absolute path", dir)
+		}
+	}
+
+	for _, soname := range opts.RequireSonames {
+		if soname == "" || strings.Contains(soname, "/") {
+			return fmt.Errorf("The required soname %q is not a file name", soname)
+		}
+	}
+
+	if opts.EtcDir != "" {
+		err := validateEtcDir(opts.EtcDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.SharedBaseRootFS != "" {
+		if opts.DryRun || opts.BuildMode || opts.WritableRoot != "" {
+			return errors.New("The SharedBaseRootFS option cannot be combined with DryRun, BuildMode or WritableRoot")
+		}
+
+		if opts.StateFile == "" {
+			return errors.New("The SharedBaseRootFS option requires a StateFile to tell the base entries apart")
+		}
+	}
+
+	// Only the containers have their rootfs recorded.
+	if opts.BuildMode && opts.rootFS != "" {
+		return errors.New("The build mode only applies to a rootfs directory and not to a container")
+	}
+
+	return nil
+}
+
+// applyLoadedHooksWithFS applies the already loaded hooks like applyHooksWithFS, ignoring opts.DryRun
+// and opts.Diagnostics.
+func applyLoadedHooksWithFS(ctx context.Context, hooks *Hooks, cfs containerFS, opts ApplyOptions) (*ApplyResult, bool, error) {
+	l := loggerOrNop(opts.Logger)
+
+	err := validateApplyOptions(opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !opts.SkipRootFSCheck && opts.rootFS != "" {
+		err := checkContainerRootFS(hooks.ContainerRootFS, opts.rootFS)
+		if err != nil {
+			return nil, false, &stageError{stage: FailureStageLoad, err: err}
+		}
+	}
+
+	efs, err := newEtcDirFS(cfs, opts.EtcDir)
+	if err != nil {
+		return nil, false, &stageError{stage: FailureStageLoad, err: err}
+	}
+
+	baseFS := cfs
+	if efs.remapped() {
+		cfs = efs
+	}
+
+	flagsFS, closeFlagsFS := openFileFlagsFS(baseFS, opts.rootFS, l)
+	defer closeFlagsFS()
+
+	if flagsFS != nil {
+		baseFS = &immutableFS{containerFS: baseFS, flags: flagsFS, clear: opts.ClearImmutable, l: l}
+	}
+
+	// Detect the C library once for all the steps.
+	libc, err := detectLibc(cfs)
+	if err != nil {
+		return nil, false, &stageError{stage: FailureStageDetectLibc, err: fmt.Errorf("Failed detecting the C library of the container: %w", err)}
+	}
+
+	// The conditions are checked first as the soname of a missing library cannot be resolved.
+	hooks, skippedSymlinks, skippedUpdates, err := filterConditionalHooks(cfs, hooks, l)
+	if err != nil {
+		return nil, false, &stageError{stage: FailureStageLoad, err: err}
+	}
+
+	hooks, err = resolveSonameTargets(cfs, hooks)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if opts.AllowedDirs != nil {
+		err = checkAllowedDirs(cfs, hooks, opts.AllowedDirs)
+		if err != nil {
+			return nil, false, &stageError{stage: FailureStageLoad, err: err}
+		}
+	}
+
+	attempts := opts.RetryAttempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+
+	writeFS := &retryingFS{containerFS: baseFS, ctx: ctx, attempts: attempts, l: l}
+
+	tx := &hooksTransaction{
+		cfs:           writeFS,
+		systemFS:      cfs,
+		l:             l,
+		rootOwned:     opts.RootOwned,
+		replaceLdConf: opts.ReplaceLdConf,
+		symlinksOnly:  opts.SymlinksOnly,
+		ldCacheOnly:   opts.LdCacheOnly,
+		targets:       newTargetResolver(),
+
+		skipMissingLibDirs: opts.SkipMissingLibraryDirs,
+		requireLibDirs:     opts.RequireLibraryDirs,
+
+		preserveMainLinkerConf:    opts.PreserveMainLinkerConf,
+		relativeLinkerConfInclude: efs.remapped(),
+	}
+
+	if opts.WritableRoot != "" {
+		if !filepath.IsAbs(opts.WritableRoot) {
+			return nil, false, fmt.Errorf("The writable root %q is not an absolute path", opts.WritableRoot)
+		}
+
+		tx.cfs = &rootedFS{cfs: writeFS, root: opts.WritableRoot}
+	}
+
+	if efs.remapped() {
+		// Moving the etc paths last so that the etc directory is also used under the writable root.
+		tx.cfs = &etcDirFS{cfs: tx.cfs, dir: efs.dir}
+	}
+
+	result, err := applyHooks(ctx, tx, hooks, libc)
+	if err != nil {
+		if !opts.Rollback {
+			return nil, false, err
+		}
+
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			return nil, false, fmt.Errorf("%w (rollback failed: %w)", err, rollbackErr)
+		}
+
+		return nil, false, err
+	}
+
+	result.ConditionallySkippedSymlinks = skippedSymlinks
+	result.ConditionallySkippedLDCacheUpdates = skippedUpdates
+
+	if opts.Rollback {
+		// The immutable flags cannot be cleared anymore once returned, the rollback of a later step
+		// failing on an immutable path instead.
+		result.rollback = tx.Rollback
+	}
+
+	if opts.CheckSearchPaths {
+		result.UnsearchedSymlinks, err = unsearchedSymlinks(cfs, hooks, libc)
+		if err != nil {
+			l.Warn("Failed checking the library search paths of the CDI symlinks", logger.Ctx{"error": err})
+		}
+
+		for _, symlink := range result.UnsearchedSymlinks {
+			l.Warn("CDI library is outside of the dynamic linker search path", logger.Ctx{"link": symlink.Link, "target": symlink.Target})
+		}
+	}
+
+	if !opts.LdCacheOnly {
+		// The device nodes cannot be created through the container filesystem.
+		result.PendingDeviceNodes = hooks.DeviceNodes
+	}
+
+	if opts.SymlinksOnly {
+		return result, false, nil
+	}
+
+	changed := opts.LdCacheOnly || len(result.CreatedSymlinks) > 0 || len(result.LDCacheEntries) > 0 || len(result.DroppedLDCacheEntries) > 0 || result.MainLinkerConfUpdated
+
+	return result, changed && libc.flavor == LibcFlavorGlibc, nil
+}
+
+// applyHooks creates the symlinks and updates the linker configuration described by hooks,
+// recording every change in the transaction. It returns the symlinks that were created or skipped
+// and the entries added to the linker configuration.
+func applyHooks(ctx context.Context, tx *hooksTransaction, hooks *Hooks, libc libcInfo) (*ApplyResult, error) {
+	result := &ApplyResult{}
+
+	// Create the symlinks pointing at other symlinks of the batch after their targets.
+	symlinks, err := sortSymlinks(hooks.Symlinks)
+	if err != nil {
+		return nil, &stageError{stage: FailureStageSymlink, err: err}
+	}
+
+	if tx.ldCacheOnly {
+		symlinks = nil
+	}
+
+	// Creating the symlinks
+	start := time.Now()
+	for _, symlink := range symlinks {
+		err := ctx.Err()
+		if err != nil {
+			return nil, fmt.Errorf("Aborted applying CDI hooks: %w", err)
+		}
+
+		created, err := applySymlink(tx, symlink)
+		if err != nil {
+			return nil, &stageError{stage: FailureStageSymlink, symlinks: []SymlinkEntry{symlink}, err: err}
+		}
+
+		if created {
+			result.CreatedSymlinks = append(result.CreatedSymlinks, symlink)
+		} else {
+			result.SkippedSymlinks = append(result.SkippedSymlinks, symlink)
+		}
+	}
+
+	result.Timings.Symlinks = time.Since(start)
+	result.BackedUpFiles = tx.backedUpFiles
+	result.RepairedSymlinks = tx.repairedSymlinks
+	result.CrossDeviceSymlinks = tx.crossDeviceSymlinks
+
+	if tx.symlinksOnly {
+		return result, nil
+	}
+
+	start = time.Now()
+
+	// Checking the architecture of the libraries, once the symlinks to them are created.
+	err = checkLDCacheArchs(tx.cfs, hooks.LDCacheArchs, tx.l)
+	if err != nil {
+		return nil, &stageError{stage: FailureStageLinkerConf, entries: hooks.LDCacheUpdates, err: err}
+	}
+
+	updates := hooks.LDCacheUpdates
+	if tx.skipMissingLibDirs || tx.requireLibDirs {
+		updates, result.SkippedLDCacheUpdates, err = filterMissingLibraryDirs(tx, updates)
+		if err != nil {
+			return nil, &stageError{stage: FailureStageLinkerConf, entries: hooks.LDCacheUpdates, err: err}
+		}
+	}
+
+	// Updating the linker configuration. Replacing it also drops the stale entries when there are no
+	// library directories anymore.
+	if len(updates) > 0 || (tx.replaceLdConf && libc.flavor != LibcFlavorMusl) {
+		err := ctx.Err()
+		if err != nil {
+			return nil, fmt.Errorf("Aborted applying CDI hooks: %w", err)
+		}
+
+		var added, dropped []string
+		var confFilePath string
+		if libc.flavor == LibcFlavorMusl {
+			if libc.muslArch == "" {
+				err = errors.New("Failed finding the musl dynamic linker in /lib")
+			} else {
+				// Write to the directory the container sees, /etc being a symlink in some images.
+				confFilePath, err = resolveContainerFilePath(tx.cfs, muslPathFilePath(libc.muslArch))
+				if err == nil {
+					added, err = updateMuslPathFile(tx, confFilePath, updates)
+				}
+			}
+		} else {
+			confFilePath, err = linkerConfFilePath(hooks.LinkerConfSuffix, hooks.LinkerConfPriority)
+			if err == nil {
+				confFilePath, err = resolveContainerFilePath(tx.cfs, confFilePath)
+			}
+
+			if err == nil {
+				added, dropped, err = updateLinkerConf(tx, confFilePath, updates)
+			}
+
+			if err == nil && len(updates) > 0 && !tx.preserveMainLinkerConf {
+				result.MainLinkerConfUpdated, err = ensureLinkerConfIncluded(tx, confFilePath)
+			}
+		}
+
+		if err != nil {
+			return nil, &stageError{stage: FailureStageLinkerConf, entries: hooks.LDCacheUpdates, err: err}
+		}
+
+		result.LDCacheEntries = added
+		result.DroppedLDCacheEntries = dropped
+		if len(added) > 0 || len(dropped) > 0 {
+			result.LinkerConfFile = confFilePath
+		}
+	}
+
+	result.Timings.LinkerConf = time.Since(start)
+
+	return result, nil
+}
+
+// filterMissingLibraryDirs returns the library directories of updates that exist in the container,
+// once their symlinks are followed, along with the missing ones. Each missing directory is logged, or
+// is an error when tx.requireLibDirs is set. A directory is looked for where the symlinks are written
+// first, then in the container root.
+func filterMissingLibraryDirs(tx *hooksTransaction, updates []string) ([]string, []string, error) {
+	kept := make([]string, 0, len(updates))
+	missing := []string{}
+	for _, dir := range updates {
+		exists, err := isContainerDir(tx.cfs, dir)
+		if err == nil && !exists && tx.systemFS != nil && tx.systemFS != tx.cfs {
+			exists, err = isContainerDir(tx.systemFS, dir)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if exists {
+			kept = append(kept, dir)
+			continue
+		}
+
+		if tx.requireLibDirs {
+			return nil, nil, fmt.Errorf("The CDI library directory %q does not exist in the container", dir)
+		}
+
+		tx.l.Warn("Skipped missing CDI library directory", logger.Ctx{"dir": dir})
+		missing = append(missing, dir)
+	}
+
+	return kept, missing, nil
+}
+
+// isContainerDir returns whether dir is a directory inside the container once its symlinks are
+// followed.
+func isContainerDir(cfs containerFS, dir string) (bool, error) {
+	resolved, err := resolveContainerPath(cfs, dir)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the CDI library directory %q: %w", dir, err)
+	}
+
+	fileInfo, err := cfs.Lstat(resolved)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the CDI library directory %q: %w", dir, err)
+	}
+
+	return fileInfo.IsDir(), nil
+}
+
+// applySymlink creates the directory of a CDI symlink and the symlink itself, returning whether the
+// symlink was created or replaced.
+func applySymlink(tx *hooksTransaction, symlink SymlinkEntry) (bool, error) {
+	// Resolve hook link from target
+	target, err := tx.targets.resolve(symlink.Link, symlink.Target, symlink.KeepAbsolute)
+	if err != nil {
+		return false, fmt.Errorf("Failed resolving a CDI symlink: %w", err)
+	}
+
+	attrs, err := symlinkFileAttrs(symlink)
+	if err != nil {
+		return false, fmt.Errorf("Invalid mode for the CDI symlink %q: %w", symlink.Link, err)
+	}
+
+	// Try to create the directory if it doesn't exist
+	linkDir := filepath.Dir(symlink.Link)
+	err = tx.mkdirAllWithAttrs(linkDir, attrs)
+	if err != nil {
+		return false, fmt.Errorf("Failed creating the directory for the CDI symlink: %w", err)
+	}
+
+	var created bool
+	switch symlink.Kind {
+	case "", SymlinkKindSymlink:
+		created, err = createSymlinkInContainer(tx, target, symlink.Link, attrs)
+	case SymlinkKindHardlink:
+		created, err = createHardlinkInContainer(tx, target, symlink.Link)
+	default:
+		return false, fmt.Errorf("Unknown kind %q for the CDI link %q", symlink.Kind, symlink.Link)
+	}
+
+	if err != nil || !created {
+		return created, err
+	}
+
+	tx.forgetKnownDirs(filepath.Clean(symlink.Link))
+
+	crosses, err := symlinkCrossesDevices(tx.cfs, symlink.Link)
+	if err != nil {
+		tx.l.Debug("Failed checking the filesystem of the CDI symlink target", logger.Ctx{"link": symlink.Link, "error": err})
+	} else if crosses {
+		tx.l.Warn("CDI symlink target is on another filesystem than the link", logger.Ctx{"link": symlink.Link, "target": target})
+		tx.crossDeviceSymlinks = append(tx.crossDeviceSymlinks, symlink.Link)
+	}
+
+	return true, nil
+}
+
+// symlinkCrossesDevices returns whether the file the symlink at link resolves to is on another
+// filesystem than the link. It is false when the link is not a symlink, its target does not exist, or
+// the container filesystem does not report the devices of its files.
+func symlinkCrossesDevices(cfs containerFS, link string) (bool, error) {
+	linkInfo, err := cfs.Lstat(link)
+	if err != nil {
+		return false, err
+	}
+
+	linkDev, ok := fileDevice(linkInfo)
+	if !ok || linkInfo.Mode()&os.ModeSymlink == 0 {
+		return false, nil
+	}
+
+	resolved, err := resolveContainerPath(cfs, link)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	targetInfo, err := cfs.Lstat(resolved)
+	if err != nil {
+		return false, err
+	}
+
+	targetDev, ok := fileDevice(targetInfo)
+	return ok && targetDev != linkDev, nil
+}
+
+// fileDevice returns the device of the filesystem holding the file described by fileInfo, if the
+// filesystem reports it.
+func fileDevice(fileInfo os.FileInfo) (uint64, bool) {
+	sys, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(sys.Dev), true
+}
+
+// updateLinkerConf adds the given library directories to the linker conf file at ldConfFilePath,
+// skipping the ones that are already listed. Only the managed block of the file is changed, the lines
+// added by hand around it being kept. The new entries are appended in the order they are given so
+// that the precedence between the directories of each ABI (e.g. lib32 and lib64) is kept.
+// When the transaction replaces the linker conf, the managed block is instead rewritten to exactly
+// updates, dropping the entries left by previous hooks, and the file is removed once nothing is left.
+// It returns the entries that were added and the ones that were dropped.
+func updateLinkerConf(tx *hooksTransaction, ldConfFilePath string, updates []string) ([]string, []string, error) {
+	content, err := readContainerFile(tx.cfs, ldConfFilePath)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !created {
+		return nil, nil, fmt.Errorf("Failed reading the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	conf, err := parseLdConfFile(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed reading the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	// Build the managed block of the file, keeping the existing entries ahead of the new ones.
+	entries := []string{}
+	existingLinkerEntries := make(map[string]bool)
+	for _, entry := range conf.entries {
+		if !existingLinkerEntries[entry] {
+			entries = append(entries, entry)
+			existingLinkerEntries[entry] = true
+		}
+	}
+
+	newEntries := []string{}
+	for _, update := range updates {
+		if !existingLinkerEntries[update] {
+			newEntries = append(newEntries, update)
+			existingLinkerEntries[update] = true
+		}
+	}
+
+	var staleEntries []string
+	if tx.replaceLdConf {
+		for _, entry := range entries {
+			if !slices.Contains(updates, entry) {
+				staleEntries = append(staleEntries, entry)
+			}
+		}
+
+		// The block lists exactly the updates, in their order.
+		entries = []string{}
+		for _, update := range updates {
+			if !slices.Contains(entries, update) {
+				entries = append(entries, update)
+			}
+		}
+
+		if slices.Equal(conf.entries, entries) {
+			tx.l.Debug("CDI linker conf entries already present", logger.Ctx{"path": ldConfFilePath, "entries": updates})
+			return nil, nil, nil
+		}
+	} else if len(newEntries) == 0 {
+		tx.l.Debug("CDI linker conf entries already present", logger.Ctx{"path": ldConfFilePath, "entries": updates})
+		return nil, nil, nil
+	}
+
+	ldConfDirPath := filepath.Dir(ldConfFilePath)
+	err = tx.MkdirAll(ldConfDirPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed creating the linker conf directory at %q: %w", ldConfDirPath, err)
+	}
+
+	// Restore the original state on rollback.
+	tx.record(func() error {
+		if created {
+			err := tx.cfs.Remove(ldConfFilePath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed removing the linker conf file at %q: %w", ldConfFilePath, err)
+			}
+
+			return nil
+		}
+
+		err := writeFileAtomic(tx.cfs, ldConfFilePath, content, linkerConfFileMode)
+		if err != nil {
+			return fmt.Errorf("Failed restoring the linker conf file at %q: %w", ldConfFilePath, err)
+		}
+
+		return nil
+	})
+
+	if tx.replaceLdConf {
+		conf.entries = entries
+	} else {
+		conf.entries = append(entries, newEntries...)
+	}
+
+	if len(conf.entries) == 0 && !conf.hasUnmanagedLines() {
+		err = tx.cfs.Remove(ldConfFilePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed removing the linker conf file at %q: %w", ldConfFilePath, err)
+		}
+	} else {
+		err = writeFileAtomic(tx.cfs, ldConfFilePath, conf.content(), linkerConfFileMode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed writing the linker conf file at %q: %w", ldConfFilePath, err)
+		}
+	}
+
+	for _, entry := range newEntries {
+		tx.l.Debug("Added CDI linker conf entry", logger.Ctx{"path": ldConfFilePath, "entry": entry})
+	}
+
+	for _, entry := range staleEntries {
+		tx.l.Debug("Dropped stale CDI linker conf entry", logger.Ctx{"path": ldConfFilePath, "entry": entry})
+	}
+
+	return newEntries, staleEntries, nil
+}
+
+// readContainerFile returns the content of the file at path inside the container.
+func readContainerFile(cfs containerFS, path string) ([]byte, error) {
+	f, err := cfs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// writeFileAtomic replaces the file at path inside the container with content. The content is written
+// to a temporary file in the same directory, flushed to disk and renamed over path so that the file is
+// never left partially written. The file is given mode and is owned by the root user of the
+// container, whatever the idmap of the container is.
+func writeFileAtomic(cfs containerFS, path string, content []byte, mode os.FileMode) error {
+	tmpPath := filepath.Join(filepath.Dir(path), ".lxdcdi-"+filepath.Base(path)+".tmp")
+
+	f, err := cfs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("Failed creating the temporary file %q: %w", tmpPath, err)
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = syncFile(f)
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = cfs.Chmod(tmpPath, mode)
+	}
+
+	if err == nil {
+		err = cfs.Chown(tmpPath, 0, 0)
+	}
+
+	if err == nil {
+		err = cfs.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		_ = cfs.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// syncFile flushes f to disk when it supports it. SFTP servers without the fsync extension are
+// tolerated as the rename still keeps the file consistent for the running container.
+func syncFile(f io.ReadWriteCloser) error {
+	syncer, ok := f.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+
+	err := syncer.Sync()
+
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+
+	return err
+}
+
+// createSymlinkInContainer creates a symlink inside the container. An existing symlink pointing at
+// another target is atomically replaced while an existing symlink already pointing at target is left
+// untouched. An existing regular file is backed up with the mode and owner of attrs. It returns
+// whether the symlink was created or replaced.
+func createSymlinkInContainer(tx *hooksTransaction, target string, link string, attrs fileAttrs) (bool, error) {
+	fileInfo, err := tx.cfs.Lstat(link)
+	if err == nil && fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		oldTarget, err := tx.cfs.Readlink(link)
+		if err != nil {
+			return false, fmt.Errorf("Failed reading existing CDI symlink path %q: %w", link, err)
+		}
+
+		if oldTarget == target {
+			tx.l.Debug("Skipped existing CDI symlink", logger.Ctx{"link": link, "target": target})
+			return false, nil
+		}
+
+		err = replaceSymlink(tx.cfs, target, link)
+		if err != nil {
+			return false, err
+		}
+
+		// Put the previous symlink back on rollback.
+		tx.record(func() error {
+			err := replaceSymlink(tx.cfs, oldTarget, link)
+			if err != nil {
+				return fmt.Errorf("Failed restoring the CDI symlink %q to %q: %w", link, oldTarget, err)
+			}
+
+			return nil
+		})
+
+		tx.repairedSymlinks = append(tx.repairedSymlinks, link)
+		tx.l.Debug("Replaced stale CDI symlink", logger.Ctx{"link": link, "target": target, "oldTarget": oldTarget})
+		return true, nil
+	}
+
+	// A regular file at the link path (e.g. a stub library shipped by the image) would hide the CDI
+	// library, so it is moved out of the way.
+	if err == nil && fileInfo.Mode().IsRegular() {
+		err = backupFile(tx, link, fileInfo, attrs)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.cfs.Symlink(target, link)
+	if err != nil {
+		return false, fmt.Errorf("Failed creating the CDI symlink %q to %q: %w", link, target, err)
+	}
+
+	tx.record(func() error {
+		err := tx.cfs.Remove(link)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Failed removing the CDI symlink %q: %w", link, err)
+		}
+
+		return nil
+	})
+
+	tx.l.Debug("Created CDI symlink", logger.Ctx{"link": link, "target": target})
+	return true, nil
+}
+
+// symlinkBackupSuffix is appended to the path of a regular file replaced by a CDI symlink.
+const symlinkBackupSuffix = ".lxdcdi-orig"
+
+// backupFile renames the regular file at path, described by fileInfo, with the symlinkBackupSuffix
+// and gives the backup the mode and owner of attrs, when set, recording the changes so that they are
+// undone on rollback. An existing backup is never overwritten.
+func backupFile(tx *hooksTransaction, path string, fileInfo os.FileInfo, attrs fileAttrs) error {
+	backupPath := path + symlinkBackupSuffix
+
+	_, err := tx.cfs.Lstat(backupPath)
+	if err == nil {
+		return fmt.Errorf("Failed backing up %q: The backup %q already exists", path, backupPath)
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed checking the backup path %q: %w", backupPath, err)
+	}
+
+	err = tx.cfs.Rename(path, backupPath)
+	if err != nil {
+		return fmt.Errorf("Failed backing up %q to %q: %w", path, backupPath, err)
+	}
+
+	// The symlink created in place of the file is removed by its own undo function first.
+	tx.record(func() error {
+		err := tx.cfs.Rename(backupPath, path)
+		if err != nil {
+			return fmt.Errorf("Failed restoring %q from %q: %w", path, backupPath, err)
+		}
+
+		return nil
+	})
+
+	err = applyBackupAttrs(tx, backupPath, fileInfo, attrs)
+	if err != nil {
+		return err
+	}
+
+	tx.backedUpFiles = append(tx.backedUpFiles, path)
+	tx.l.Debug("Backed up file in the way of a CDI symlink", logger.Ctx{"path": path, "backup": backupPath})
+
+	return nil
+}
+
+// applyBackupAttrs gives the backup at backupPath of the file described by fileInfo the mode and
+// owner of attrs, recording how to put the original ones back.
+func applyBackupAttrs(tx *hooksTransaction, backupPath string, fileInfo os.FileInfo, attrs fileAttrs) error {
+	if attrs.hasMode {
+		err := tx.cfs.Chmod(backupPath, attrs.mode)
+		if err != nil {
+			return fmt.Errorf("Failed changing the mode of the backup %q: %w", backupPath, err)
+		}
+
+		tx.record(func() error {
+			err := tx.cfs.Chmod(backupPath, fileInfo.Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("Failed restoring the mode of the backup %q: %w", backupPath, err)
+			}
+
+			return nil
+		})
+	}
+
+	if attrs.hasOwner {
+		err := tx.cfs.Chown(backupPath, attrs.uid, attrs.gid)
+		if err != nil {
+			return fmt.Errorf("Failed changing the owner of the backup %q: %w", backupPath, err)
+		}
+
+		uid, gid, ok := fileOwner(fileInfo)
+		if ok {
+			tx.record(func() error {
+				err := tx.cfs.Chown(backupPath, uid, gid)
+				if err != nil {
+					return fmt.Errorf("Failed restoring the owner of the backup %q: %w", backupPath, err)
+				}
+
+				return nil
+			})
+		}
+	}
+
+	return nil
+}
+
+// restoreBackupFile renames the backup of the file at path made by backupFile back to path, if any.
+func restoreBackupFile(cfs containerFS, path string) error {
+	backupPath := path + symlinkBackupSuffix
+
+	_, err := cfs.Lstat(backupPath)
+	if err != nil {
+		if isMissingPath(err) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed checking the backup path %q: %w", backupPath, err)
+	}
+
+	err = cfs.Rename(backupPath, path)
+	if err != nil {
+		return fmt.Errorf("Failed restoring %q from %q: %w", path, backupPath, err)
+	}
+
+	return nil
+}
+
+// replaceSymlink atomically replaces the symlink at link with one pointing at target by creating a
+// temporary symlink next to it and renaming it over link.
+func replaceSymlink(cfs containerFS, target string, link string) error {
+	tmpLink := filepath.Join(filepath.Dir(link), ".lxdcdi-"+filepath.Base(link)+".tmp")
+
+	// Remove any leftover from an interrupted replacement.
+	err := cfs.Remove(tmpLink)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed removing the temporary CDI symlink %q: %w", tmpLink, err)
+	}
+
+	err = cfs.Symlink(target, tmpLink)
+	if err != nil {
+		return fmt.Errorf("Failed creating the temporary CDI symlink %q to %q: %w", tmpLink, target, err)
+	}
+
+	err = cfs.Rename(tmpLink, link)
+	if err != nil {
+		_ = cfs.Remove(tmpLink)
+		return fmt.Errorf("Failed replacing the CDI symlink %q with %q: %w", link, tmpLink, err)
+	}
+
+	return nil
+}
+
+// RemoveHooksFromContainer undoes the CDI hooks previously applied by ApplyHooksToContainer by
+// removing the symlinks and the linker configuration entries using SFTP.
+// It is safe to call when some of the entries, or the directories holding them, have already been
+// removed (e.g. by the package management of the guest), and succeeds when nothing is left to undo.
+// The linker cache is only regenerated when something was removed.
+// When the applied state file at AppliedStatePath exists, the changes it records are undone instead
+// of the ones of the hooks file, which does not need to exist anymore, and it is deleted.
+// The symlinks, library directories and device nodes also listed by the hooks files of the other devices of the
+// container, the `*`+CDIHooksFileSuffix files next to the one at hooksFilePath, are left in place
+// as these devices still rely on them.
+// The linker cache regeneration is logged to l. A nil logger disables logging.
+func RemoveHooksFromContainer(hooksFilePath string, c instance.Container, l logger.Logger) error {
+	unlock, err := lockHooks(context.Background(), c)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during device hot-unplug operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	// Prefer the applied state, which does not need the hooks file to have survived.
+	stateFile := AppliedStatePath(c, hooksFilePath)
+	state, err := loadAppliedState(stateFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	others, err := loadOtherDevicesHooks(hooksFilePath)
+	if err != nil {
+		return err
+	}
+
+	var regenerateLDCache bool
+	if state != nil {
+		regenerateLDCache, err = removeFromStateWithFS(withoutSharedState(state, others), &sftpContainerFS{client: sftpClient})
+	} else {
+		regenerateLDCache, err = removeHooksWithFS(hooksFilePath, &sftpContainerFS{client: sftpClient})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if regenerateLDCache {
+		etcDir := ""
+		if state != nil {
+			etcDir = state.EtcDir
+		}
+
+		_, _, _ = updateLDCache(context.Background(), c, &sftpContainerFS{client: sftpClient}, l, "", 0, nil, etcDir)
+	}
+
+	if state != nil {
+		return removeAppliedStateFile(stateFile)
+	}
+
+	return nil
+}
+
+// removeHooksWithFS is the testable core of RemoveHooksFromContainer.
+// It removes CDI hooks using the provided containerFS implementation and returns
+// whether the linker cache needs to be regenerated, which is only the case when a symlink or a linker
+// configuration entry was removed. The entries listed by the hooks files of the other devices are
+// kept.
+func removeHooksWithFS(hooksFilePath string, cfs containerFS) (bool, error) {
+	hooks, err := loadHooksFile(hooksFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	others, err := loadOtherDevicesHooks(hooksFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	hooks, sharedConfFile := withoutSharedEntries(hooks, others)
+
+	libc, err := detectLibc(cfs)
+	if err != nil {
+		return false, fmt.Errorf("Failed detecting the C library of the container: %w", err)
+	}
+
+	changed := false
+	targets := newTargetResolver()
+
+	// Removing the symlinks.
+	for _, symlink := range hooks.Symlinks {
+		if symlink.SearchDir != "" {
+			// The symlinks of a soname are removed even when its versioned file is gone.
+			target, found := sonameLinkTarget(cfs, symlink)
+			if symlink.Kind != SymlinkKindHardlink {
+				if found {
+					removed, err := removeSymlinkFromContainer(cfs, target, symlink.Link)
+					if err != nil {
+						return false, err
+					}
+
+					changed = changed || removed
+				}
+
+				continue
+			}
+
+			symlink, err = resolveSonameTarget(cfs, symlink)
+			if err != nil {
+				// The hardlink cannot be told apart from another file without its versioned file.
+				continue
+			}
+		}
+
+		target, err := targets.resolve(symlink.Link, symlink.Target, symlink.KeepAbsolute)
+		if err != nil {
+			return false, fmt.Errorf("Failed resolving a CDI symlink: %w", err)
+		}
+
+		var removed bool
+		if symlink.Kind == SymlinkKindHardlink {
+			removed, err = removeHardlinkFromContainer(cfs, target, symlink.Link)
+		} else {
+			removed, err = removeSymlinkFromContainer(cfs, target, symlink.Link)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		changed = changed || removed
+	}
+
+	// Removing the linker configuration entries.
+	if len(hooks.LDCacheUpdates) > 0 {
+		var removed bool
+		if libc.flavor == LibcFlavorMusl {
+			removed, err = removeMuslPathFileEntries(cfs, libc.muslArch, hooks.LDCacheUpdates)
+		} else {
+			removed, err = removeLinkerConf(cfs, hooks, sharedConfFile)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		changed = changed || removed
+	}
+
+	return changed && libc.flavor == LibcFlavorGlibc, nil
+}
+
+// loadOtherDevicesHooks loads the CDI hooks files of the other devices of the container, which are
+// the `*`+CDIHooksFileSuffix files in the directory of the one at hooksFilePath.
+func loadOtherDevicesHooks(hooksFilePath string) ([]*Hooks, error) {
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(hooksFilePath), "*"+CDIHooksFileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing the CDI hooks files of the other devices: %w", err)
+	}
+
+	others := make([]*Hooks, 0, len(paths))
+	for _, path := range paths {
+		if path == filepath.Clean(hooksFilePath) {
+			continue
+		}
+
+		hooks, err := loadHooksFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// The device was removed in the meantime.
+				continue
+			}
+
+			return nil, err
+		}
+
+		others = append(others, hooks)
+	}
+
+	return others, nil
+}
+
+// mergeSharedEntries returns the symlinks, library directories and device nodes listed by any of
+// others.
+func mergeSharedEntries(others []*Hooks) *Hooks {
+	shared := &Hooks{}
+	for _, hooks := range others {
+		shared.Symlinks = append(shared.Symlinks, hooks.Symlinks...)
+		shared.LDCacheUpdates = append(shared.LDCacheUpdates, hooks.LDCacheUpdates...)
+		shared.DeviceNodes = append(shared.DeviceNodes, hooks.DeviceNodes...)
+	}
+
+	return shared
+}
+
+// withoutSharedEntries returns a copy of hooks without the symlinks and library directories listed by
+// any of others, along with whether one of others writes to the linker conf file of hooks too.
+func withoutSharedEntries(hooks *Hooks, others []*Hooks) (*Hooks, bool) {
+	if len(others) == 0 {
+		return hooks, false
+	}
+
+	shared := mergeSharedEntries(others)
+	links := make(map[string]bool, len(shared.Symlinks))
+	for _, symlink := range shared.Symlinks {
+		links[filepath.Clean(symlink.Link)] = true
+	}
+
+	kept := *hooks
+	kept.Symlinks = nil
+	for _, symlink := range hooks.Symlinks {
+		if !links[filepath.Clean(symlink.Link)] {
+			kept.Symlinks = append(kept.Symlinks, symlink)
+		}
+	}
+
+	kept.LDCacheUpdates = nil
+	for _, dir := range hooks.LDCacheUpdates {
+		if !slices.Contains(shared.LDCacheUpdates, dir) {
+			kept.LDCacheUpdates = append(kept.LDCacheUpdates, dir)
+		}
+	}
+
+	sharedConfFile := slices.ContainsFunc(others, func(other *Hooks) bool {
+		return len(other.LDCacheUpdates) > 0 && other.LinkerConfSuffix == hooks.LinkerConfSuffix && other.LinkerConfPriority == hooks.LinkerConfPriority
+	})
+
+	return &kept, sharedConfFile
+}
+
+// isMissingPath returns whether err reports that a path does not exist, including when one of its
+// parents is not a directory anymore.
+func isMissingPath(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// removeSymlinkFromContainer removes the symlink at link only if it still points at target, and
+// restores the file it replaced, if any. A missing link or a link that was changed since the hooks were applied is left untouched.
+// It returns whether the symlink was removed.
+func removeSymlinkFromContainer(cfs containerFS, target string, link string) (bool, error) {
+	fileInfo, err := cfs.Lstat(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking the CDI symlink path %q: %w", link, err)
+	}
+
+	if fileInfo.Mode()&os.ModeSymlink != os.ModeSymlink {
+		return false, nil
+	}
+
+	currentTarget, err := cfs.Readlink(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed reading the CDI symlink %q: %w", link, err)
+	}
+
+	if currentTarget != target {
+		return false, nil
+	}
+
+	err = cfs.Remove(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed removing the CDI symlink %q: %w", link, err)
+	}
+
+	return true, restoreBackupFile(cfs, link)
+}
+
+// removeLinkerConf removes the linker configuration of hooks. A linker conf file of their own is
+// deleted, unless sharedFile is set as the hooks of another device write to it too, while the entries
+// are removed from the shared one. A missing linker conf directory leaves nothing to remove. It
+// returns whether the linker configuration changed.
+func removeLinkerConf(cfs containerFS, hooks *Hooks, sharedFile bool) (bool, error) {
+	ldConfFilePath, err := linkerConfFilePath(hooks.LinkerConfSuffix, hooks.LinkerConfPriority)
+	if err != nil {
+		return false, err
+	}
+
+	ldConfFilePath, err = resolveContainerFilePath(cfs, ldConfFilePath)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if hooks.LinkerConfSuffix == "" || sharedFile {
+		return removeLinkerConfEntries(cfs, ldConfFilePath, hooks.LDCacheUpdates)
+	}
+
+	err = cfs.Remove(ldConfFilePath)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed removing the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	return true, nil
+}
+
+// removeLinkerConfEntries removes the given library directories from the managed block of the linker
+// conf file at ldConfFilePath. The file is deleted when nothing else than the managed block was in it
+// and no entries are left in the block. It returns whether any entry was removed, the file being left
+// untouched otherwise.
+func removeLinkerConfEntries(cfs containerFS, ldConfFilePath string, updates []string) (bool, error) {
+	content, err := readContainerFile(cfs, ldConfFilePath)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed reading the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	removedEntries := make(map[string]bool, len(updates))
+	for _, update := range updates {
+		removedEntries[update] = true
+	}
+
+	conf, err := parseLdConfFile(bytes.NewReader(content))
+	if err != nil {
+		return false, fmt.Errorf("Failed reading the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	remainingEntries := []string{}
+	for _, entry := range conf.entries {
+		if !removedEntries[entry] {
+			remainingEntries = append(remainingEntries, entry)
+		}
+	}
+
+	if len(remainingEntries) == len(conf.entries) {
+		return false, nil
+	}
+
+	conf.entries = remainingEntries
+	if len(conf.entries) == 0 && !conf.hasUnmanagedLines() {
+		err = cfs.Remove(ldConfFilePath)
+		if err != nil && !isMissingPath(err) {
+			return false, fmt.Errorf("Failed removing the linker conf file at %q: %w", ldConfFilePath, err)
+		}
+
+		return true, nil
+	}
+
+	err = writeFileAtomic(cfs, ldConfFilePath, conf.content(), linkerConfFileMode)
+	if err != nil {
+		return false, fmt.Errorf("Failed writing the linker conf file at %q: %w", ldConfFilePath, err)
+	}
+
+	return true, nil
+}
+
+// LdconfigPath is the path of the ldconfig binary run inside the container to update the linker cache.
+// When it does not exist, ldconfig is looked up in the directories of the default PATH used for
+// instance commands.
+var LdconfigPath = "/sbin/ldconfig"
+
+const (
+	// ldconfigSearchPath is the default PATH used for instance commands.
+	ldconfigSearchPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// defaultLdconfigTimeout is the time given to ldconfig when no timeout is set.
+	defaultLdconfigTimeout = 30 * time.Second
+
+	// maxExecOutputBytes is the amount of command output kept, from the end of the output.
+	maxExecOutputBytes = 16 * 1024
+
+	// ldconfigCacheTmpFile is the path inside the container ldconfig writes the new linker cache to
+	// before it replaces ldCacheFile.
+	ldconfigCacheTmpFile = "/etc/.lxdcdi-ld.so.cache.tmp"
+)
+
+// findLdconfig returns the path of the ldconfig binary inside the container, trying ldconfigPath first
+// or LdconfigPath if it is empty.
+func findLdconfig(cfs containerFS, ldconfigPath string) (string, error) {
+	if ldconfigPath == "" {
+		ldconfigPath = LdconfigPath
+	}
+
+	candidates := []string{ldconfigPath}
+	for dir := range strings.SplitSeq(ldconfigSearchPath, ":") {
+		candidates = append(candidates, filepath.Join(dir, "ldconfig"))
+	}
+
+	for _, candidate := range candidates {
+		_, err := cfs.Lstat(candidate)
+		if err == nil {
+			return candidate, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("Failed checking for ldconfig at %q: %w", candidate, err)
+		}
+	}
+
+	return "", fmt.Errorf("Failed finding ldconfig in the container at %q or in %q", ldconfigPath, ldconfigSearchPath)
+}
+
+// updateLDCache updates the linker cache inside the instance. It ignores
+// possible errors and logs them instead since this is a best effort action and
+// failure should not impact the container's start or hotplugging.
+// A nil logger disables logging, an empty ldconfigPath uses LdconfigPath and a zero timeout uses
+// defaultLdconfigTimeout. A timed out ldconfig is killed.
+// The existing linker cache is only replaced once ldconfig successfully wrote a new one.
+// ldconfig is the binary of the container, run through the instance exec API in the namespaces of the
+// container, so it only ever sees the container filesystem. When it is built for an architecture the
+// host cannot run natively, foreignLdconfig is run instead, or the update is skipped without it.
+// ldconfig reads the main linker conf file and writes the linker cache of the etc directory etcDir
+// (see ApplyOptions.EtcDir).
+// It returns whether ldconfig ran successfully in the container and the reason it did not, if it
+// failed.
+func updateLDCache(ctx context.Context, inst instance.Instance, cfs containerFS, l logger.Logger, ldconfigPath string, timeout time.Duration, foreignLdconfig []string, etcDir string) (bool, []string, error) {
+	l = loggerOrNop(l)
+
+	if !inst.IsRunning() {
+		// For stopped containers, add touch /usr mtime. This triggers systemd's
+		// ldconfig.service at boot to pick up the CDI libraries.
+		// See systemctl cat ldconfig.service for details.
+		err := cfs.Chtimes("/usr", time.Now(), time.Now())
+		if err != nil {
+			l.Warn("Failed updating mtime of /usr in the container to trigger ldconfig.service", logger.Ctx{"error": err})
+			return false, nil, &stageError{stage: FailureStageLdconfig, err: err}
+		}
+
+		l.Debug("Updated mtime of /usr in the container to trigger ldconfig.service")
+		return false, nil, nil
+	}
+
+	ldconfig, err := findLdconfig(cfs, ldconfigPath)
+	if err != nil {
+		l.Warn("Failed updating the linker cache in the container", logger.Ctx{"error": err})
+		return false, nil, &stageError{stage: FailureStageLdconfig, err: err}
+	}
+
+	efs, err := newEtcDirFS(cfs, etcDir)
+	if err != nil {
+		l.Warn("Failed updating the linker cache in the container", logger.Ctx{"error": err})
+		return false, nil, &stageError{stage: FailureStageLdconfig, err: err}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultLdconfigTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Run ldconfig to update the linker cache, note we do not update symlinks via
+	// -X as those are handled by the CDI hooks. The cache is written to a temporary file so that the
+	// existing one is only replaced once ldconfig succeeded.
+	ldconfigCommand := []string{ldconfig}
+
+	foreign, arch, err := isForeignBinary(cfs, ldconfig)
+	if err != nil {
+		l.Warn("Failed checking the architecture of ldconfig in the container", logger.Ctx{"path": ldconfig, "error": err})
+	}
+
+	if foreign {
+		if len(foreignLdconfig) == 0 {
+			// ldconfig would only fail without an interpreter as the host cannot run it.
+			l.Warn("Skipped updating the linker cache as ldconfig in the container is for another architecture than the host", logger.Ctx{"path": ldconfig, "arch": arch})
+			return false, nil, nil
+		}
+
+		ldconfigCommand = foreignLdconfig
+		ldconfig = foreignLdconfig[0]
+	}
+
+	command := slices.Clone(ldconfigCommand)
+	verifyCommand := ldconfigCommand
+	if efs.remapped() {
+		command = append(command, "-f", efs.path(mainLinkerConfFile))
+		verifyCommand = append(slices.Clone(ldconfigCommand), "-C", efs.path(ldCacheFile))
+	}
+
+	command = append(command, "-X", "-C", efs.path(ldconfigCacheTmpFile))
+	l.Debug("Running ldconfig in the container", logger.Ctx{"command": command})
+	output, p, err := execInContainer(ctx, inst, command)
+	warnings := parseLdconfigWarnings(output)
+	if err == nil && p != 0 {
+		err = fmt.Errorf("%q exited with code %d", ldconfig, p)
+	}
+
+	if err != nil {
+		err = &LdconfigError{Output: output, ExitCode: p, Warnings: warnings, Err: err}
+	}
+
+	if err == nil {
+		err = efs.Rename(ldconfigCacheTmpFile, ldCacheFile)
+		if err != nil {
+			err = fmt.Errorf("Failed replacing the linker cache at %q: %w", ldCacheFile, err)
+		}
+	}
+
+	if err != nil {
+		// Keep the existing cache, a stale one being better than none.
+		removeErr := efs.Remove(ldconfigCacheTmpFile)
+		if removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			l.Warn("Failed removing the temporary linker cache in the container", logger.Ctx{"path": ldconfigCacheTmpFile, "error": removeErr})
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			l.Warn("Timed out running ldconfig in the container", logger.Ctx{"instance": inst.Name(), "timeout": timeout, "output": output})
+		} else {
+			l.Warn("Failed executing ldconfig in the container", logger.Ctx{"error": err, "exit code": p, "output": output})
+		}
+
+		return false, warnings, &stageError{stage: FailureStageLdconfig, err: err, output: output, exitCode: p}
+	}
+
+	l.Debug("Ran ldconfig in the container", logger.Ctx{"output": output})
+
+	for _, warning := range warnings {
+		l.Warn("ldconfig warned while updating the linker cache in the container", logger.Ctx{"warning": warning})
+	}
+
+	verifyLDCache(ctx, inst, efs, verifyCommand, l)
+
+	return true, warnings, nil
+}
+
+// verifyLDCache checks that each directory listed in the CDI linker conf files contributed entries
+// to the linker cache of the running container, logging a warning for each one that did not.
+// ldconfigCommand is the command running ldconfig in the container, without its -p argument.
+func verifyLDCache(ctx context.Context, inst instance.Instance, cfs containerFS, ldconfigCommand []string, l logger.Logger) {
+	dirs, err := readCDILinkerConfEntries(cfs)
+	if err != nil {
+		l.Warn("Failed reading the linker conf file to verify the linker cache", logger.Ctx{"error": err})
+		return
+	}
+
+	if len(dirs) == 0 {
+		return
+	}
+
+	output, p, err := execInContainer(ctx, inst, append(slices.Clone(ldconfigCommand), "-p"))
+	if err != nil {
+		l.Warn("Failed listing the linker cache in the container", logger.Ctx{"error": err, "exit code": p, "output": output})
+		return
+	}
+
+	for _, dir := range ldCacheDirsWithoutEntries(output, dirs) {
+		l.Warn("CDI library directory has no entries in the linker cache", logger.Ctx{"dir": dir})
+	}
+}
+
+// parseLdconfigWarnings returns the diagnostics in the output of ldconfig, without the name of the
+// program they are prefixed with. ldconfig only prints diagnostics when it is not run with -v or -p,
+// so that every line but the empty ones is one, and the fatal ones are told apart by its exit code.
+func parseLdconfigWarnings(output string) []string {
+	var warnings []string
+	for line := range strings.SplitSeq(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// Diagnostics look like `/sbin/ldconfig.real: /usr/lib/libfoo.so.1 is not a symbolic link`.
+		program, message, found := strings.Cut(line, ": ")
+		if found && strings.HasPrefix(filepath.Base(program), "ldconfig") {
+			line = message
+		}
+
+		warnings = append(warnings, line)
+	}
+
+	return warnings
+}
+
+// ldCacheDirsWithoutEntries returns the directories of dirs, in order, that have no library in the
+// output of `ldconfig -p`.
+func ldCacheDirsWithoutEntries(output string, dirs []string) []string {
+	cachedDirs := make(map[string]bool)
+	for line := range strings.SplitSeq(output, "\n") {
+		// Entries look like `libfoo.so.1 (libc6,x86-64) => /usr/lib/x86_64-linux-gnu/libfoo.so.1`.
+		_, path, found := strings.Cut(line, " => ")
+		if found {
+			cachedDirs[filepath.Dir(strings.TrimSpace(path))] = true
+		}
+	}
+
+	missing := []string{}
+	for _, dir := range dirs {
+		if !cachedDirs[filepath.Clean(dir)] {
+			missing = append(missing, dir)
+		}
+	}
+
+	return missing
+}
+
+// execInContainer runs command in the running instance and returns its combined output and exit code.
+// The command is killed when ctx is done, in which case the context error is returned. Only the last
+// maxExecOutputBytes of the output are returned.
+func execInContainer(ctx context.Context, inst instance.Instance, command []string) (string, int, error) {
+	// Capture the combined output in a file as the instance command expects file descriptors.
+	output, err := os.CreateTemp("", "lxd_cdi_exec_")
+	if err != nil {
+		return "", -1, fmt.Errorf("Failed creating a file to hold the command output: %w", err)
+	}
+
+	defer func() {
+		_ = output.Close()
+		_ = os.Remove(output.Name())
+	}()
+
+	cmd, err := inst.Exec(ctx, api.InstanceExecPost{
+		Command:   command,
+		WaitForWS: false,
+	}, nil, output, output)
+	if err != nil {
+		return "", -1, fmt.Errorf("Failed starting %q: %w", command[0], err)
+	}
+
+	type waitResult struct {
+		p   int
+		err error
+	}
+
+	done := make(chan waitResult, 1)
+	go func() {
+		p, err := cmd.Wait()
+		done <- waitResult{p: p, err: err}
+	}()
+
+	var res waitResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		_ = cmd.Signal(unix.SIGKILL)
+		res = <-done
+		res.err = fmt.Errorf("Failed waiting for %q: %w", command[0], ctx.Err())
+	}
+
+	content, readErr := readCommandOutput(output, maxExecOutputBytes)
+	if readErr != nil && res.err == nil {
+		res.err = fmt.Errorf("Failed reading the output of %q: %w", command[0], readErr)
+	}
+
+	return content, res.p, res.err
+}
+
+// readCommandOutput returns the content of the output file f, keeping only its last limit bytes.
+// A truncated output starts with a marker giving the number of dropped bytes.
+func readCommandOutput(f *os.File, limit int64) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	offset := max(info.Size()-limit, 0)
+	content := make([]byte, info.Size()-offset)
+	_, err = f.ReadAt(content, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	if offset > 0 {
+		return fmt.Sprintf("[%d bytes truncated]\n%s", offset, content), nil
+	}
+
+	return string(content), nil
 }
@@ -1,15 +1,28 @@
 package cdi
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/shared/api"
+	"github.com/canonical/lxd/shared/logger"
 )
 
 // localFS implements containerFS using the local filesystem for testing.
@@ -43,11 +56,126 @@ func (l *localFS) Lstat(path string) (os.FileInfo, error) {
 	return os.Lstat(l.rootFS + filepath.Clean(path))
 }
 
+func (l *localFS) Readlink(path string) (string, error) {
+	return os.Readlink(l.rootFS + filepath.Clean(path))
+}
+
+func (l *localFS) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(l.rootFS + filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+func (l *localFS) Rename(oldname, newname string) error {
+	return os.Rename(l.rootFS+filepath.Clean(oldname), l.rootFS+filepath.Clean(newname))
+}
+
+func (l *localFS) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(l.rootFS+filepath.Clean(path), mode)
+}
+
+func (l *localFS) Chown(path string, uid int, gid int) error {
+	// Changing the owner requires privileges, which the tests may not have.
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	return os.Chown(l.rootFS+filepath.Clean(path), uid, gid)
+}
+
+func (l *localFS) Link(oldname, newname string) error {
+	return os.Link(l.rootFS+filepath.Clean(oldname), l.rootFS+filepath.Clean(newname))
+}
+
+// failingFS wraps a containerFS and fails the symlink creation of failLink.
+type failingFS struct {
+	containerFS
+	failLink string
+}
+
+func (f *failingFS) Symlink(oldname, newname string) error {
+	if newname == f.failLink {
+		return errors.New("Injected failure")
+	}
+
+	return f.containerFS.Symlink(oldname, newname)
+}
+
+// chownRecorder wraps a containerFS and records the paths it is asked to chown.
+type chownRecorder struct {
+	containerFS
+	chowned []string
+}
+
+func (c *chownRecorder) Chown(path string, uid int, gid int) error {
+	c.chowned = append(c.chowned, fmt.Sprintf("%s:%d:%d", path, uid, gid))
+	return c.containerFS.Chown(path, uid, gid)
+}
+
+// lstatCounter wraps a containerFS and counts the Lstat calls per path.
+type lstatCounter struct {
+	containerFS
+	lstats map[string]int
+}
+
+func (c *lstatCounter) Lstat(path string) (os.FileInfo, error) {
+	c.lstats[path]++
+	return c.containerFS.Lstat(path)
+}
+
+// deviceFS wraps a containerFS and reports the files under devicePath as being on another device.
+type deviceFS struct {
+	containerFS
+	devicePath string
+}
+
+// deviceFileInfo is the file info of a file on another device.
+type deviceFileInfo struct {
+	os.FileInfo
+	stat syscall.Stat_t
+}
+
+func (i *deviceFileInfo) Sys() any { return &i.stat }
+
+func (d *deviceFS) Lstat(path string) (os.FileInfo, error) {
+	fileInfo, err := d.containerFS.Lstat(path)
+	if err != nil || !strings.HasPrefix(path, d.devicePath+"/") {
+		return fileInfo, err
+	}
+
+	stat := *fileInfo.Sys().(*syscall.Stat_t)
+	stat.Dev++
+	return &deviceFileInfo{FileInfo: fileInfo, stat: stat}, nil
+}
+
+// debugRecorder is a logger recording the debug messages it receives.
+type debugRecorder struct {
+	nopLogger
+	messages []string
+}
+
+func (r *debugRecorder) Debug(msg string, args ...logger.Ctx) {
+	r.messages = append(r.messages, msg)
+}
+
 // TestApplyHooksToContainer tests the ApplyHooksToContainer function.
 func TestApplyHooksToContainer(t *testing.T) {
 	t.Run("invalid hooks file path", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		err := applyHooksWithFS("/nonexistent/path.json", &localFS{rootFS: tmpDir})
+		_, _, err := applyHooksWithFS("/nonexistent/path.json", &localFS{rootFS: tmpDir}, ApplyOptions{})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "Failed opening the CDI hooks file")
 	})
@@ -58,9 +186,45 @@ func TestApplyHooksToContainer(t *testing.T) {
 		err := os.WriteFile(hooksFile, []byte("not json"), 0644)
 		require.NoError(t, err)
 
-		err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Failed decoding the CDI hooks file")
+	})
+
+	t.Run("YAML hooks file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksFile := filepath.Join(tmpDir, "hooks.yaml")
+		content := `symlinks:
+- target: /usr/lib/libfoo.so.1
+  link: /usr/lib/libfoo.so
+ld_cache_updates:
+- /usr/lib
+`
+		err := os.WriteFile(hooksFile, []byte(content), 0644)
+		require.NoError(t, err)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		ldConf, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib"), string(ldConf))
+	})
+
+	t.Run("invalid YAML in hooks file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksFile := filepath.Join(tmpDir, "hooks.yml")
+		err := os.WriteFile(hooksFile, []byte("symlinks:\n- target: [\n"), 0644)
+		require.NoError(t, err)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "Failed decoding the CDI hooks file")
+		assert.Contains(t, err.Error(), "line")
 	})
 
 	t.Run("empty hooks", func(t *testing.T) {
@@ -69,7 +233,7 @@ func TestApplyHooksToContainer(t *testing.T) {
 		hooks := Hooks{}
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		assert.NoError(t, err)
 	})
 
@@ -85,7 +249,7 @@ func TestApplyHooksToContainer(t *testing.T) {
 
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		require.NoError(t, err)
 
 		// Verify symlinks were created
@@ -119,8 +283,207 @@ func TestApplyHooksToContainer(t *testing.T) {
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
 		// Should not error on existing symlink
-		err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		assert.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+
+	t.Run("stale symlink is replaced", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.Symlink("libfoo.so.0", filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		result, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+		assert.Equal(t, []string{"/usr/lib/libfoo.so"}, result.RepairedSymlinks)
+
+		target, err := os.Readlink(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		// No temporary symlink is left behind.
+		entries, err := os.ReadDir(linkDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("regular file at the link path is backed up", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"), []byte("stub"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/libfoo.so"}, result.BackedUpFiles)
+
+		target, err := os.Readlink(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		content, err := os.ReadFile(filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix))
+		require.NoError(t, err)
+		assert.Equal(t, "stub", string(content))
+
+		// Removing the hooks restores the file.
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		content, err = os.ReadFile(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "stub", string(content))
+		assert.NoFileExists(t, filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix))
+	})
+
+	t.Run("symlinks crossing filesystems are reported", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+		createLibrary(t, tmpDir, "/mnt/nested/libbar.so.1")
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/mnt/nested/libbar.so.1", Link: "/usr/lib/libbar.so"},
+				{Target: "/mnt/nested/missing.so.1", Link: "/usr/lib/missing.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, result.CrossDeviceSymlinks)
+
+		require.NoError(t, os.RemoveAll(filepath.Join(tmpDir, "usr", "lib")))
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		result, _, err = applyHooksWithFS(hooksFile, &deviceFS{containerFS: &localFS{rootFS: tmpDir}, devicePath: "/mnt/nested"}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/libbar.so"}, result.CrossDeviceSymlinks)
+	})
+
+	t.Run("mode and owner of the created directories and the backup", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"), []byte("stub"), 0644)
+		require.NoError(t, err)
+
+		uid := uint32(1000)
+		gid := uint32(44)
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Mode: "0600", UID: &uid},
+				{Target: "libbar.so.1", Link: "/opt/vendor/lib/libbar.so", Mode: "0750", UID: &uid, GID: &gid},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		cfs := &chownRecorder{containerFS: &localFS{rootFS: tmpDir}}
+		_, _, err = applyHooksWithFS(hooksFile, cfs, ApplyOptions{RootOwned: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"/usr/lib/libfoo.so" + symlinkBackupSuffix + ":1000:0",
+			"/opt:1000:44",
+			"/opt/vendor:1000:44",
+			"/opt/vendor/lib:1000:44",
+		}, cfs.chowned)
+
+		fileInfo, err := os.Lstat(filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+		for _, dir := range []string{"opt", "opt/vendor", "opt/vendor/lib"} {
+			fileInfo, err := os.Stat(filepath.Join(tmpDir, dir))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), fileInfo.Mode().Perm(), dir)
+		}
+
+		// The existing link directory is left untouched.
+		fileInfo, err = os.Stat(linkDir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), fileInfo.Mode().Perm())
+	})
+
+	t.Run("rollback restores the mode of the backup", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"), []byte("stub"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Mode: "0600"},
+				{Target: "libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &failingFS{containerFS: &localFS{rootFS: tmpDir}, failLink: "/usr/lib/libbar.so"}, ApplyOptions{Rollback: true})
+		require.Error(t, err)
+
+		fileInfo, err := os.Lstat(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.True(t, fileInfo.Mode().IsRegular())
+		assert.Equal(t, os.FileMode(0644), fileInfo.Mode().Perm())
+	})
+
+	t.Run("existing backup is not overwritten", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"), []byte("stub"), 0644)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix), []byte("backup"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "already exists")
+
+		content, err := os.ReadFile(filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix))
+		require.NoError(t, err)
+		assert.Equal(t, "backup", string(content))
 	})
 
 	t.Run("creates symlinks in nested directories", func(t *testing.T) {
@@ -134,7 +497,7 @@ func TestApplyHooksToContainer(t *testing.T) {
 
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		require.NoError(t, err)
 
 		linkPath := filepath.Join(tmpDir, "usr", "lib", "x86_64", "libdeep.so")
@@ -142,6 +505,38 @@ func TestApplyHooksToContainer(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("created directories inherit the mode of their ancestor", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(tmpDir, "opt", "private"), 0750)
+		require.NoError(t, err)
+		err = os.Chmod(filepath.Join(tmpDir, "opt", "private"), 0750)
+		require.NoError(t, err)
+		err = os.Symlink("opt/private", filepath.Join(tmpDir, "private"))
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/private/lib/nested/libfoo.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		for _, dir := range []string{"lib", filepath.Join("lib", "nested")} {
+			info, err := os.Stat(filepath.Join(tmpDir, "opt", "private", dir))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+		}
+
+		info, err := os.Stat(filepath.Join(tmpDir, "opt", "private"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	})
+
 	t.Run("creates new ld conf file", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
@@ -151,10 +546,10 @@ func TestApplyHooksToContainer(t *testing.T) {
 
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		require.NoError(t, err)
 
-		ldConfPath := filepath.Join(tmpDir, "etc", "ld.so.conf.d", customCDILinkerConfFile)
+		ldConfPath := filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile)
 		content, err := os.ReadFile(ldConfPath)
 		require.NoError(t, err)
 
@@ -170,7 +565,7 @@ func TestApplyHooksToContainer(t *testing.T) {
 		require.NoError(t, err)
 
 		// Pre-create the conf file with one entry
-		ldConfPath := filepath.Join(ldConfDir, customCDILinkerConfFile)
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
 		err = os.WriteFile(ldConfPath, []byte("/usr/lib/existing\n"), 0644)
 		require.NoError(t, err)
 
@@ -180,170 +575,2302 @@ func TestApplyHooksToContainer(t *testing.T) {
 
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		require.NoError(t, err)
 
 		content, err := os.ReadFile(ldConfPath)
 		require.NoError(t, err)
 
 		// Should contain the existing entry once and the new entry
-		assert.Equal(t, "/usr/lib/existing\n/usr/lib/new-entry\n", string(content))
+		assert.Equal(t, ldConfBlock("/usr/lib/existing", "/usr/lib/new-entry"), string(content))
 	})
 
-	t.Run("symlinks and ld cache combined", func(t *testing.T) {
+	t.Run("rewrites a partially written ld conf file atomically", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err := os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+
+		// Pre-create the conf file with a duplicated entry and a line missing its newline.
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		err = os.WriteFile(ldConfPath, []byte("/usr/lib/existing\n/usr/lib/existing\n/usr/lib/partial"), 0644)
+		require.NoError(t, err)
+
 		hooks := Hooks{
-			Symlinks: []SymlinkEntry{
-				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
-			},
-			LDCacheUpdates: []string{"/usr/lib"},
+			LDCacheUpdates: []string{"/usr/lib/new-entry"},
 		}
 
 		hooksFile := writeHooksFile(t, tmpDir, hooks)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
 		require.NoError(t, err)
 
-		// Verify symlink
-		linkPath := filepath.Join(tmpDir, "usr", "lib", "libfoo.so")
-		_, err = os.Lstat(linkPath)
-		assert.NoError(t, err)
-
-		// Verify ld conf
-		ldConfPath := filepath.Join(tmpDir, "etc", "ld.so.conf.d", customCDILinkerConfFile)
 		content, err := os.ReadFile(ldConfPath)
 		require.NoError(t, err)
-		assert.Contains(t, string(content), "/usr/lib\n")
+		assert.Equal(t, ldConfBlock("/usr/lib/existing", "/usr/lib/partial", "/usr/lib/new-entry"), string(content))
+
+		entries, err := os.ReadDir(ldConfDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
 	})
 
-	t.Run("symlink with relative link path errors", func(t *testing.T) {
+	t.Run("ld conf file is made world readable", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		hooks := Hooks{
-			Symlinks: []SymlinkEntry{
-				{Target: "/usr/lib/libfoo.so.1", Link: "relative/path"},
-			},
-		}
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err := os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
 
-		hooksFile := writeHooksFile(t, tmpDir, hooks)
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		err = os.WriteFile(ldConfPath, []byte("/usr/lib/existing\n"), 0600)
+		require.NoError(t, err)
 
-		err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "Failed resolving a CDI symlink")
-	})
-}
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"/usr/lib/new-entry"}})
 
-func writeHooksFile(t *testing.T, dir string, hooks Hooks) string {
-	t.Helper()
-	data, err := json.Marshal(hooks)
-	require.NoError(t, err)
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
 
-	path := filepath.Join(dir, "hooks.json")
-	err = os.WriteFile(path, data, 0644)
-	require.NoError(t, err)
+		info, err := os.Stat(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, linkerConfFileMode, info.Mode().Perm())
+	})
 
-	return path
+	t.Run("ld conf entries keep their order across ABIs", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err := os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(ldConfDir, "00-lxdcdi.conf"), []byte("/usr/lib64\n"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib32", "/usr/lib64", "/usr/lib", "/usr/lib32"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(ldConfDir, "00-lxdcdi.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib64", "/usr/lib32", "/usr/lib"), string(content))
+	})
+
+	t.Run("ld conf entries are normalized and deduplicated", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/x86_64-linux-gnu/", "/usr/lib64", "/usr/lib/x86_64-linux-gnu", "", "/usr//lib64/.", "/usr/lib/nvidia/../nvidia"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", "00-lxdcdi.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/x86_64-linux-gnu", "/usr/lib64", "/usr/lib/nvidia"), string(content))
+	})
+
+	t.Run("relative ld conf entries are resolved against the base", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/existing", "nvidia/./lib64", "nvidia/lib/"},
+			LDCacheBase:    "/opt",
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/existing", "/opt/nvidia/lib64", "/opt/nvidia/lib"), string(content))
+
+		hooksFile = writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"usr/lib"}})
+		hooks2, err := loadHooksFile(hooksFile)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib"}, hooks2.LDCacheUpdates)
+	})
+
+	t.Run("relative ld conf entries escaping the rootfs error", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"../../../etc"}, LDCacheBase: "/opt/nvidia"})
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "escapes the container rootfs")
+
+		hooksFile = writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"lib"}, LDCacheBase: "opt"})
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "is not an absolute path")
+	})
+
+	t.Run("ld cache regenerated only when entries are added", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/x86_64-linux-gnu"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+
+		_, regenerateLDCache, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+
+	t.Run("changes are logged", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+			LDCacheUpdates: []string{"/usr/lib/x86_64-linux-gnu"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		l := &debugRecorder{}
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{Logger: l})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Created CDI symlink", "Added CDI linker conf entry"}, l.messages)
+	})
+
+	t.Run("symlinks and ld cache combined", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		// Verify symlink
+		linkPath := filepath.Join(tmpDir, "usr", "lib", "libfoo.so")
+		_, err = os.Lstat(linkPath)
+		assert.NoError(t, err)
+
+		// Verify ld conf
+		ldConfPath := filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile)
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "/usr/lib\n")
+	})
+
+	t.Run("result lists the changes", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.Symlink("libfoo.so.1", filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err = os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(ldConfDir, "00-lxdcdi.conf"), []byte("/usr/lib\n"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib", "/usr/lib/nvidia"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		result, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+		assert.Equal(t, []SymlinkEntry{{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"}}, result.CreatedSymlinks)
+		assert.Equal(t, []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"}}, result.SkippedSymlinks)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, result.LDCacheEntries)
+		assert.False(t, result.LdconfigRan)
+	})
+
+	t.Run("dry run makes no changes", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		l := &debugRecorder{}
+		result, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{DryRun: true, Logger: l})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+		assert.NotEmpty(t, l.messages)
+		assert.Equal(t, []PlannedAction{
+			{Type: PlannedActionCreateDirectory, Path: "/usr"},
+			{Type: PlannedActionCreateDirectory, Path: "/usr/lib"},
+			{Type: PlannedActionCreateSymlink, Path: "/usr/lib/libfoo.so", Target: "libfoo.so.1"},
+			{Type: PlannedActionCreateDirectory, Path: "/etc"},
+			{Type: PlannedActionCreateDirectory, Path: "/etc/ld.so.conf.d"},
+			{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib"},
+		}, result.PlannedActions)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("writable root", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{WritableRoot: "/upper"})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "upper", "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "upper", "etc", "ld.so.conf.d", "00-lxdcdi.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib"), string(content))
+
+		assert.NoDirExists(t, filepath.Join(tmpDir, "usr"))
+		assert.NoDirExists(t, filepath.Join(tmpDir, "etc"))
+	})
+
+	t.Run("created directories are root owned", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(tmpDir, "usr"), 0755)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+			Symlinks:       []SymlinkEntry{{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"}},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		cfs := &chownRecorder{containerFS: &localFS{rootFS: tmpDir}}
+		_, _, err = applyHooksWithFS(hooksFile, cfs, ApplyOptions{RootOwned: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"/usr/lib:0:0",
+			"/usr/lib/nvidia:0:0",
+			"/etc:0:0",
+			"/etc/ld.so.conf.d:0:0",
+			"/etc/ld.so.conf.d/.lxdcdi-00-lxdcdi.conf.tmp:0:0",
+		}, cfs.chowned)
+
+		cfs = &chownRecorder{containerFS: &localFS{rootFS: t.TempDir()}}
+		_, _, err = applyHooksWithFS(hooksFile, cfs, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/etc/ld.so.conf.d/.lxdcdi-00-lxdcdi.conf.tmp:0:0"}, cfs.chowned)
+	})
+
+	t.Run("relative writable root errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"/usr/lib"}})
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{WritableRoot: "upper"})
+		assert.ErrorContains(t, err, "is not an absolute path")
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{Context: ctx, Rollback: true})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("symlink escaping the rootfs errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "../../../../../etc/shadow", Link: "/usr/lib/libfoo.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "escapes the container rootfs")
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("mismatched container rootfs errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/other/rootfs",
+			Symlinks:        []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		opts := ApplyOptions{rootFS: "/var/lib/lxd/containers/c1/rootfs"}
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, opts)
+		assert.ErrorContains(t, err, "are for the container rootfs")
+		assert.NoDirExists(t, filepath.Join(tmpDir, "usr"))
+
+		// The check can be disabled for a relocated rootfs.
+		opts.SkipRootFSCheck = true
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, opts)
+		assert.NoError(t, err)
+	})
+
+	t.Run("symlink with relative link path errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "relative/path"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "is not an absolute path")
+	})
+}
+
+func TestValidateHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		symlink SymlinkEntry
+		err     string
+	}{
+		{name: "valid", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+		{name: "valid hardlink", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink}},
+		{name: "empty link", symlink: SymlinkEntry{Target: "libfoo.so.1"}, err: "The link is empty"},
+		{name: "relative link", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "usr/lib/libfoo.so"}, err: "is not an absolute path"},
+		{name: "root link", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/"}, err: "is the root directory"},
+		{name: "link in the root directory", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/libfoo.so"}, err: "is directly in the root directory"},
+		{name: "empty target", symlink: SymlinkEntry{Link: "/usr/lib/libfoo.so"}, err: "The target of the link"},
+		{name: "unknown kind", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: "copy"}, err: `Unknown kind "copy"`},
+		{name: "valid mode", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Mode: "2750"}},
+		{name: "invalid mode", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Mode: "0999"}, err: `Invalid mode "0999"`},
+		{name: "mode out of range", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Mode: "17777"}, err: `Invalid mode "17777"`},
+		{name: "backslash in the link", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: `C:\usr\lib\libfoo.so`}, err: "contains a backslash"},
+		{name: "backslash in the target", symlink: SymlinkEntry{Target: `..\lib64\libfoo.so.1`, Link: "/usr/lib/libfoo.so"}, err: `The path "..\\lib64\\libfoo.so.1" contains a backslash`},
+		{name: "NUL byte in the link", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so\x00"}, err: "contains a NUL byte"},
+		{name: "NUL byte in the target", symlink: SymlinkEntry{Target: "libfoo\x00.so.1", Link: "/usr/lib/libfoo.so"}, err: "contains a NUL byte"},
+		{name: "duplicate link", symlink: SymlinkEntry{Target: "libbar.so.1", Link: "/usr/lib//libbar.so"}},
+		{name: "duplicate link with another target", symlink: SymlinkEntry{Target: "libbar.so.2", Link: "/usr/lib/libbar.so"}, err: `The link "/usr/lib/libbar.so" is listed with the targets "/usr/lib/libbar.so.1" and "libbar.so.2"`},
+		{name: "duplicate link with another kind", symlink: SymlinkEntry{Target: "libbar.so.1", Link: "/usr/lib/libbar.so", Kind: SymlinkKindHardlink}, err: "is listed with the targets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks := &Hooks{
+				Symlinks: []SymlinkEntry{
+					{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+					tt.symlink,
+				},
+			}
+
+			err := ValidateHooks(hooks)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, "Invalid CDI symlink entry 1")
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestDecodeHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		asJSON  bool
+		want    string
+	}{
+		{name: "JSON", content: `{"symlinks": [{"target": "libfoo.so.1", "link": "/usr/lib/libfoo.so"}], "ld_cache_updates": null}`, asJSON: true},
+		{name: "YAML", content: "ld_cache_updates:\n- /usr/lib\n"},
+		{name: "JSON unknown field", content: `{"symlink": [{"target": "libfoo.so.1", "link": "/usr/lib/libfoo.so"}], "ld_cache_updates": []}`, asJSON: true, want: `Unknown field "symlink"`},
+		{name: "JSON unknown symlink field", content: `{"symlinks": [{"target": "libfoo.so.1", "lnk": "/usr/lib/libfoo.so"}]}`, asJSON: true, want: `Unknown field "lnk"`},
+		{name: "JSON invalid type", content: `{"symlinks": [{"target": "libfoo.so.1", "link": "/usr/lib/libfoo.so"}], "ld_cache_updates": "/usr/lib"}`, asJSON: true, want: `The field "ld_cache_updates" has an invalid type, expected []string but got string`},
+		{name: "JSON no required field", content: `{"container_rootfs": "/var/lib/lxd/containers/c1/rootfs"}`, asJSON: true, want: "None of the symlinks and ld_cache_updates fields is set"},
+		{name: "YAML unknown field", content: "symlink:\n- target: libfoo.so.1\n  link: /usr/lib/libfoo.so\n", want: "line 1: field symlink not found"},
+		{name: "YAML invalid type", content: "ld_cache_updates: /usr/lib\n", want: "line 1: cannot unmarshal !!str `/usr/lib` into []string"},
+		{name: "YAML no required field", content: "ld_cache_base: /usr\n", want: "None of the symlinks and ld_cache_updates fields is set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeHooks(strings.NewReader(tt.content), tt.asJSON)
+			if tt.want == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestApplyHooksDuplicateLinks(t *testing.T) {
+	hooks := Hooks{
+		Symlinks: []SymlinkEntry{
+			{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "libbar.so.1", Link: "/usr/lib/libbar.so"},
+			{Target: "libfoo.so.2", Link: "/usr/lib/libfoo.so"},
+		},
+	}
+
+	t.Run("fails without creating anything", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.2")
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.Error(t, err)
+		assert.ErrorContains(t, err, `Invalid CDI symlink entry 2: The link "/usr/lib/libfoo.so" is listed with the targets "libfoo.so.1" and "libfoo.so.2"`)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("keeps the last entry when overriding", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.2")
+
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{OverrideDuplicateLinks: true})
+		require.NoError(t, err)
+		assert.Equal(t, []SymlinkEntry{hooks.Symlinks[1], hooks.Symlinks[2]}, result.CreatedSymlinks)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.2", target)
+	})
+}
+
+// TestApplyHooksRollback tests that a failing apply leaves the container filesystem untouched.
+func TestApplyHooksRollback(t *testing.T) {
+	t.Run("failing symlink removes previously created symlinks and directories", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/x86_64/libfoo.so.1", Link: "/usr/lib/x86_64/libfoo.so"},
+				{Target: "/opt/nvidia/lib/libbar.so.1", Link: "/opt/nvidia/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/x86_64"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &failingFS{containerFS: &localFS{rootFS: tmpDir}, failLink: "/opt/nvidia/lib/libbar.so"}, ApplyOptions{Rollback: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Injected failure")
+
+		// Only the hooks file must be left in the rootfs.
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "hooks.json", entries[0].Name())
+	})
+
+	t.Run("failing symlink restores backed up files", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(linkDir, "libfoo.so"), []byte("stub"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &failingFS{containerFS: &localFS{rootFS: tmpDir}, failLink: "/usr/lib/libbar.so"}, ApplyOptions{Rollback: true})
+		require.Error(t, err)
+
+		content, err := os.ReadFile(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "stub", string(content))
+		assert.NoFileExists(t, filepath.Join(linkDir, "libfoo.so"+symlinkBackupSuffix))
+	})
+
+	t.Run("failing symlink restores replaced symlinks and the linker conf file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.Symlink("libfoo.so.0", filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &failingFS{containerFS: &localFS{rootFS: tmpDir}, failLink: "/usr/lib/libbar.so"}, ApplyOptions{Rollback: true})
+		require.Error(t, err)
+
+		target, err := os.Readlink(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.0", target)
+
+		_, err = os.Lstat(filepath.Join(linkDir, "libbar.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		// The pre-existing directory must not be removed.
+		assert.DirExists(t, linkDir)
+	})
+
+	t.Run("rollback restores the original linker conf content", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err := os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		err = os.WriteFile(ldConfPath, []byte("/usr/lib/existing\n"), 0644)
+		require.NoError(t, err)
+
+		tx := &hooksTransaction{cfs: &localFS{rootFS: tmpDir}, l: nopLogger{}}
+		added, _, err := updateLinkerConf(tx, filepath.Join(linkerConfDir, CDILinkerConfFile), []string{"/usr/lib/existing", "/usr/lib/new-entry"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/new-entry"}, added)
+
+		err = tx.Rollback()
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/lib/existing\n", string(content))
+	})
+
+	t.Run("changes are kept without rollback", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &failingFS{containerFS: &localFS{rootFS: tmpDir}, failLink: "/usr/lib/libbar.so"}, ApplyOptions{})
+		require.Error(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+	})
+}
+
+// TestRemoveHooksFromContainer tests the RemoveHooksFromContainer function.
+func TestRemoveHooksFromContainer(t *testing.T) {
+	t.Run("removes applied symlinks and ld conf file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = os.Stat(filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("keeps symlinks pointing elsewhere and other ld conf entries", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.Symlink("libfoo.so.2", filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err = os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		err = os.WriteFile(ldConfPath, []byte("/usr/lib/other\n/usr/lib\n"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.2", target)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/other"), string(content))
+	})
+
+	t.Run("removes only the linker conf file of the hooks", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		nvidiaHooksFile := filepath.Join(t.TempDir(), "nvidia.json")
+		amdHooksFile := filepath.Join(t.TempDir(), "amd.json")
+		for path, hooks := range map[string]Hooks{
+			nvidiaHooksFile: {LDCacheUpdates: []string{"/usr/lib/nvidia"}, LinkerConfSuffix: "nvidia"},
+			amdHooksFile:    {LDCacheUpdates: []string{"/usr/lib/amd"}, LinkerConfSuffix: "amd"},
+		} {
+			content, err := json.Marshal(hooks)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, content, 0644))
+
+			_, _, err = applyHooksWithFS(path, &localFS{rootFS: tmpDir}, ApplyOptions{})
+			require.NoError(t, err)
+		}
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		assert.FileExists(t, filepath.Join(ldConfDir, "00-lxdcdi-nvidia.conf"))
+		assert.FileExists(t, filepath.Join(ldConfDir, "00-lxdcdi-amd.conf"))
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/amd", "/usr/lib/nvidia"}, entries)
+
+		_, err = removeHooksWithFS(nvidiaHooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, filepath.Join(ldConfDir, "00-lxdcdi-nvidia.conf"))
+		content, err := os.ReadFile(filepath.Join(ldConfDir, "00-lxdcdi-amd.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/amd"), string(content))
+	})
+
+	t.Run("keeps the entries of the other devices", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libcuda.so.1")
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.1")
+
+		devicesDir := t.TempDir()
+		gpu0HooksFile := filepath.Join(devicesDir, "gpu0"+CDIHooksFileSuffix)
+		gpu1HooksFile := filepath.Join(devicesDir, "gpu1"+CDIHooksFileSuffix)
+		for path, hooks := range map[string]Hooks{
+			gpu0HooksFile: {
+				Symlinks: []SymlinkEntry{
+					{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+					{Target: "libnvidia-ml.so.1", Link: "/usr/lib/nvidia/libnvidia-ml.so"},
+				},
+				LDCacheUpdates:   []string{"/usr/lib/nvidia", "/usr/lib/gpu0"},
+				LinkerConfSuffix: "nvidia",
+			},
+			gpu1HooksFile: {
+				Symlinks:         []SymlinkEntry{{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"}},
+				LDCacheUpdates:   []string{"/usr/lib/nvidia"},
+				LinkerConfSuffix: "nvidia",
+			},
+		} {
+			content, err := json.Marshal(hooks)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, content, 0644))
+		}
+
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "gpu0"), 0755))
+		_, _, err := applyHooksWithFS(gpu0HooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		_, err = removeHooksWithFS(gpu0HooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		// The symlink and the library directory gpu1 lists too are kept, in the linker conf file both use.
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libcuda.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libcuda.so.1", target)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "nvidia", "libnvidia-ml.so"))
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", "00-lxdcdi-nvidia.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/nvidia"), string(content))
+
+		// Once gpu1 is gone too, everything is removed.
+		require.NoError(t, os.Remove(gpu1HooksFile))
+		_, err = removeHooksWithFS(gpu0HooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "nvidia", "libcuda.so"))
+		assert.NoFileExists(t, filepath.Join(tmpDir, "etc", "ld.so.conf.d", "00-lxdcdi-nvidia.conf"))
+	})
+
+	t.Run("invalid linker conf file suffix errors", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{LDCacheUpdates: []string{"/usr/lib"}, LinkerConfSuffix: "../passwd"})
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "Invalid CDI linker conf file suffix")
+	})
+
+	t.Run("entries already gone", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		regenerateLDCache, err := removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		assert.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+
+	t.Run("linker conf directory already gone", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		hooks := Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so"}},
+			LDCacheUpdates: []string{"/usr/lib/cdi"},
+		}
+
+		hooksFile := writeHooksFile(t, t.TempDir(), hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		require.NoError(t, os.RemoveAll(filepath.Join(tmpDir, "etc", "ld.so.conf.d")))
+
+		regenerateLDCache, err := removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so"))
+
+		// Nothing is left to undo.
+		regenerateLDCache, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+
+	t.Run("parent directories replaced by files", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "usr", "lib", "cdi"), nil, 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc"), nil, 0644))
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/cdi/libbar.so", Kind: SymlinkKindHardlink},
+			},
+			LDCacheUpdates:   []string{"/usr/lib/cdi"},
+			LinkerConfSuffix: "nvidia",
+		}
+
+		regenerateLDCache, err := removeHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+}
+
+func TestApplyHooksEtcSymlink(t *testing.T) {
+	hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}}
+
+	t.Run("relative symlink", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "etc"), 0755))
+		require.NoError(t, os.Symlink("usr/etc", filepath.Join(tmpDir, "etc")))
+
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/etc/ld.so.conf.d/"+CDILinkerConfFile, result.LinkerConfFile)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "usr", "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/nvidia"), string(content))
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, entries)
+
+		_, err = removeHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "etc", "ld.so.conf.d", CDILinkerConfFile))
+	})
+
+	t.Run("absolute symlink stays inside the rootfs", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hostDir := t.TempDir()
+		require.NoError(t, os.Symlink(hostDir, filepath.Join(tmpDir, "etc")))
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		// The absolute target is the one the container sees, inside its rootfs.
+		content, err := os.ReadFile(filepath.Join(tmpDir, hostDir, "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/nvidia"), string(content))
+
+		hostEntries, err := os.ReadDir(hostDir)
+		require.NoError(t, err)
+		assert.Empty(t, hostEntries)
+	})
+
+	t.Run("symlinked linker conf directory", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.Symlink("/usr/share/ld.so.conf.d", filepath.Join(tmpDir, "etc", "ld.so.conf.d")))
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(tmpDir, "usr", "share", "ld.so.conf.d", CDILinkerConfFile))
+	})
+
+	t.Run("symlink escaping the rootfs", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.Symlink("../../outside", filepath.Join(tmpDir, "etc")))
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		assert.ErrorContains(t, err, "resolves outside of the container rootfs")
+		assert.NoDirExists(t, filepath.Join(filepath.Dir(tmpDir), "outside"))
+	})
+}
+
+func writeHooksFile(t testing.TB, dir string, hooks Hooks) string {
+	t.Helper()
+	data, err := json.Marshal(hooks)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "hooks.json")
+	err = os.WriteFile(path, data, 0644)
+	require.NoError(t, err)
+
+	return path
+}
+
+// ldConfBlock returns the content of a linker conf file holding only a managed block of entries.
+func ldConfBlock(entries ...string) string {
+	return ldConfBlockBegin + "\n" + strings.Join(entries, "\n") + "\n" + ldConfBlockEnd + "\n"
+}
+
+func TestLinkerConfPath(t *testing.T) {
+	assert.Equal(t, "/var/lib/lxd/containers/c1/rootfs/etc/ld.so.conf.d/00-lxdcdi.conf", LinkerConfPath("/var/lib/lxd/containers/c1/rootfs"))
+
+	path, err := linkerConfFilePath("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, LinkerConfPath("/"), path)
+}
+
+func TestParseLdConfEntries(t *testing.T) {
+	t.Run("Trimmed entries without comments in order", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), CDILinkerConfFile)
+		err := os.WriteFile(path, []byte("# CDI libraries\n  /usr/lib/nvidia  \n\n/usr/lib32 # 32-bit\n   \n/usr/lib/nvidia\n"), 0644)
+		require.NoError(t, err)
+
+		entries, err := ParseLdConfEntries(path)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib32", "/usr/lib/nvidia"}, entries)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		entries, err := ParseLdConfEntries(filepath.Join(t.TempDir(), CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, entries)
+	})
+
+	t.Run("Only the managed block", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), CDILinkerConfFile)
+		err := os.WriteFile(path, []byte("/opt/manual\n"+ldConfBlockBegin+"\n/usr/lib/nvidia\n"+ldConfBlockEnd+"\n/opt/other\n"), 0644)
+		require.NoError(t, err)
+
+		entries, err := ParseLdConfEntries(path)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, entries)
+	})
+
+	t.Run("Block without end marker", func(t *testing.T) {
+		conf, err := parseLdConfFile(strings.NewReader("/opt/manual\n" + ldConfBlockBegin + "\n/usr/lib/nvidia\n"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/opt/manual"}, conf.head)
+		assert.Equal(t, []string{"/usr/lib/nvidia"}, conf.entries)
+		assert.Empty(t, conf.tail)
+	})
+
+	t.Run("Commented entries are dropped on update", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		require.NoError(t, os.MkdirAll(ldConfDir, 0755))
+
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		require.NoError(t, os.WriteFile(ldConfPath, []byte("# /usr/lib/old\n/usr/lib/existing\n"), 0644))
+
+		tx := &hooksTransaction{cfs: &localFS{rootFS: tmpDir}, l: nopLogger{}}
+		added, _, err := updateLinkerConf(tx, filepath.Join(linkerConfDir, CDILinkerConfFile), []string{"/usr/lib/old"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/old"}, added)
+
+		entries, err := ParseLdConfEntries(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/existing", "/usr/lib/old"}, entries)
+	})
+
+	t.Run("Lines outside the managed block are kept", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		require.NoError(t, os.MkdirAll(ldConfDir, 0755))
+
+		head := "# Added by the admin\n/opt/manual\n"
+		tail := "/opt/other # after\n"
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		require.NoError(t, os.WriteFile(ldConfPath, []byte(head+ldConfBlock("/usr/lib/existing")+tail), 0644))
+
+		cfs := &localFS{rootFS: tmpDir}
+		tx := &hooksTransaction{cfs: cfs, l: nopLogger{}}
+		added, _, err := updateLinkerConf(tx, filepath.Join(linkerConfDir, CDILinkerConfFile), []string{"/opt/manual", "/usr/lib/existing", "/usr/lib/new"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/opt/manual", "/usr/lib/new"}, added)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head+ldConfBlock("/usr/lib/existing", "/opt/manual", "/usr/lib/new")+tail, string(content))
+
+		_, err = removeLinkerConfEntries(cfs, filepath.Join(linkerConfDir, CDILinkerConfFile), []string{"/opt/manual", "/usr/lib/existing", "/usr/lib/new"})
+		require.NoError(t, err)
+
+		content, err = os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head+tail, string(content))
+	})
+}
+
+func TestLinkerConfTrailingNewline(t *testing.T) {
+	tmpDir := t.TempDir()
+	ldConfPath := filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile)
+
+	apply := func(t *testing.T, updates []string, opts ApplyOptions) {
+		t.Helper()
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: updates}), &localFS{rootFS: tmpDir}, opts)
+		require.NoError(t, err)
+	}
+
+	// assertContent checks that the file ends with exactly one newline and has no blank line.
+	assertContent := func(t *testing.T, want string) {
+		t.Helper()
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(content))
+		assert.True(t, strings.HasSuffix(string(content), "\n"))
+		assert.False(t, strings.HasSuffix(string(content), "\n\n"))
+		assert.NotContains(t, string(content), "\n\n")
+	}
+
+	t.Run("create", func(t *testing.T) {
+		apply(t, []string{"/usr/lib/a"}, ApplyOptions{})
+		assertContent(t, ldConfBlock("/usr/lib/a"))
+	})
+
+	t.Run("append", func(t *testing.T) {
+		apply(t, []string{"/usr/lib/b"}, ApplyOptions{})
+		assertContent(t, ldConfBlock("/usr/lib/a", "/usr/lib/b"))
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		apply(t, []string{"/usr/lib/c"}, ApplyOptions{ReplaceLdConf: true})
+		assertContent(t, ldConfBlock("/usr/lib/c"))
+	})
+
+	t.Run("hand edited file", func(t *testing.T) {
+		// The admin dropped the final newline and left blank lines after the block.
+		require.NoError(t, os.WriteFile(ldConfPath, []byte(ldConfBlock("/usr/lib/c")+"/opt/manual\n\n\n"), 0644))
+		apply(t, []string{"/usr/lib/d"}, ApplyOptions{})
+		assertContent(t, ldConfBlock("/usr/lib/c", "/usr/lib/d")+"/opt/manual\n")
+
+		require.NoError(t, os.WriteFile(ldConfPath, []byte(strings.TrimSuffix(ldConfBlock("/usr/lib/d"), "\n")), 0644))
+		apply(t, []string{"/usr/lib/e"}, ApplyOptions{})
+		assertContent(t, ldConfBlock("/usr/lib/d", "/usr/lib/e"))
+	})
+}
+
+func TestApplyHooksReplaceLdConf(t *testing.T) {
+	head := "# Added by the admin\n/opt/manual\n"
+
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		require.NoError(t, os.MkdirAll(ldConfDir, 0755))
+
+		ldConfPath := filepath.Join(ldConfDir, CDILinkerConfFile)
+		require.NoError(t, os.WriteFile(ldConfPath, []byte(head+ldConfBlock("/usr/lib/old", "/usr/lib/kept")), 0644))
+
+		return tmpDir, ldConfPath
+	}
+
+	t.Run("stale entries are dropped", func(t *testing.T) {
+		tmpDir, ldConfPath := setup(t)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/new", "/usr/lib/kept"}}
+		result, regenerate, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{ReplaceLdConf: true})
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.Equal(t, []string{"/usr/lib/new"}, result.LDCacheEntries)
+		assert.Equal(t, []string{"/usr/lib/old"}, result.DroppedLDCacheEntries)
+		assert.Equal(t, filepath.Join(linkerConfDir, CDILinkerConfFile), result.LinkerConfFile)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head+ldConfBlock("/usr/lib/new", "/usr/lib/kept"), string(content))
+	})
+
+	t.Run("merged without the option", func(t *testing.T) {
+		tmpDir, ldConfPath := setup(t)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/new", "/usr/lib/kept"}}
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, result.DroppedLDCacheEntries)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head+ldConfBlock("/usr/lib/old", "/usr/lib/kept", "/usr/lib/new"), string(content))
+	})
+
+	t.Run("unchanged entries", func(t *testing.T) {
+		tmpDir, _ := setup(t)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/old", "/usr/lib/kept"}}
+		result, regenerate, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{ReplaceLdConf: true})
+		require.NoError(t, err)
+		assert.False(t, regenerate)
+		assert.Empty(t, result.LDCacheEntries)
+		assert.Empty(t, result.DroppedLDCacheEntries)
+	})
+
+	t.Run("no library directories anymore", func(t *testing.T) {
+		tmpDir, ldConfPath := setup(t)
+
+		result, regenerate, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{}), &localFS{rootFS: tmpDir}, ApplyOptions{ReplaceLdConf: true})
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.Equal(t, []string{"/usr/lib/old", "/usr/lib/kept"}, result.DroppedLDCacheEntries)
+
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head, string(content))
+
+		// Without unmanaged lines, the file is removed.
+		require.NoError(t, os.WriteFile(ldConfPath, []byte(ldConfBlock("/usr/lib/old")), 0644))
+		_, _, err = applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{}), &localFS{rootFS: tmpDir}, ApplyOptions{ReplaceLdConf: true})
+		require.NoError(t, err)
+		assert.NoFileExists(t, ldConfPath)
+	})
+
+	t.Run("rollback restores the dropped entries", func(t *testing.T) {
+		tmpDir, ldConfPath := setup(t)
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/new"}}), &localFS{rootFS: tmpDir}, ApplyOptions{ReplaceLdConf: true})
+		require.NoError(t, err)
+
+		tx := &hooksTransaction{cfs: &localFS{rootFS: tmpDir}, l: nopLogger{}, replaceLdConf: true}
+		_, dropped, err := updateLinkerConf(tx, filepath.Join(linkerConfDir, CDILinkerConfFile), []string{"/usr/lib/other"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/new"}, dropped)
+
+		require.NoError(t, tx.Rollback())
+		content, err := os.ReadFile(ldConfPath)
+		require.NoError(t, err)
+		assert.Equal(t, head+ldConfBlock("/usr/lib/new"), string(content))
+	})
+}
+
+func TestCheckContainerRootFS(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	rootFS := filepath.Join(tmpDir, "storage-pools", "default", "containers", "c1", "rootfs")
+	err := os.MkdirAll(rootFS, 0755)
+	require.NoError(t, err)
+
+	err = os.Mkdir(filepath.Join(tmpDir, "containers"), 0755)
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Dir(rootFS), filepath.Join(tmpDir, "containers", "c1"))
+	require.NoError(t, err)
+
+	symlinkedRootFS := filepath.Join(tmpDir, "containers", "c1", "rootfs")
+
+	assert.NoError(t, checkContainerRootFS("", symlinkedRootFS))
+	assert.NoError(t, checkContainerRootFS(symlinkedRootFS+"/", symlinkedRootFS))
+	assert.NoError(t, checkContainerRootFS(rootFS, symlinkedRootFS))
+	assert.Error(t, checkContainerRootFS(filepath.Join(tmpDir, "containers", "c2", "rootfs"), symlinkedRootFS))
+}
+
+func TestResolveTargetRelativeToLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      string
+		target    string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:      "relative target returned as-is",
+			link:      "/home/user/link",
+			target:    "relative/path",
+			expected:  "relative/path",
+			expectErr: false,
+		},
+		{
+			name:      "absolute target in same directory",
+			link:      "/home/user/link",
+			target:    "/home/user/target",
+			expected:  "target",
+			expectErr: false,
+		},
+		{
+			name:      "absolute target in subdirectory",
+			link:      "/home/user/link",
+			target:    "/home/user/subdir/target",
+			expected:  filepath.Join("subdir", "target"),
+			expectErr: false,
+		},
+		{
+			name:      "absolute target in parent directory",
+			link:      "/home/user/subdir/link",
+			target:    "/home/user/target",
+			expected:  filepath.Join("..", "target"),
+			expectErr: false,
+		},
+		{
+			name:      "absolute target in sibling directory",
+			link:      "/home/user/dir1/link",
+			target:    "/home/user/dir2/target",
+			expected:  filepath.Join("..", "dir2", "target"),
+			expectErr: false,
+		},
+		{
+			name:      "absolute target at root level",
+			link:      "/home/user/link",
+			target:    "/target",
+			expected:  filepath.Join("..", "..", "target"),
+			expectErr: false,
+		},
+		{
+			name:      "paths with trailing slashes get cleaned",
+			link:      "/home/user/link",
+			target:    "/home/user/target/",
+			expected:  "target",
+			expectErr: false,
+		},
+		{
+			name:      "paths with redundant separators get cleaned",
+			link:      "/home//user///link",
+			target:    "/home//user//target",
+			expected:  "target",
+			expectErr: false,
+		},
+		{
+			name:      "paths with dot components get cleaned",
+			link:      "/home/./user/link",
+			target:    "/home/user/./target",
+			expected:  "target",
+			expectErr: false,
+		},
+		{
+			name:      "relative link path returns error",
+			link:      "relative/link",
+			target:    "/absolute/target",
+			expected:  "",
+			expectErr: true,
+		},
+		{
+			name:      "link escaping the rootfs returns error",
+			link:      "/usr/../../etc/shadow",
+			target:    "/usr/lib/libfoo.so",
+			expected:  "",
+			expectErr: true,
+		},
+		{
+			name:      "absolute target escaping the rootfs returns error",
+			link:      "/usr/lib/libfoo.so",
+			target:    "/../../etc/shadow",
+			expected:  "",
+			expectErr: true,
+		},
+		{
+			name:      "relative target escaping the rootfs returns error",
+			link:      "/usr/lib/libfoo.so",
+			target:    "../../../../etc/shadow",
+			expected:  "",
+			expectErr: true,
+		},
+		{
+			name:      "relative target climbing to the rootfs root is allowed",
+			link:      "/usr/lib/libfoo.so",
+			target:    "../../etc/libfoo.so",
+			expected:  "../../etc/libfoo.so",
+			expectErr: false,
+		},
+		{
+			name:      "empty link path returns error",
+			link:      "",
+			target:    "/absolute/target",
+			expected:  "",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := resolveTargetRelativeToLink(tc.link, tc.target)
+
+			if tc.expectErr {
+				assert.Error(t, err, "Expected an error for link=%q and target=%q", tc.link, tc.target)
+			} else {
+				assert.NoError(t, err, "Expected no error for link=%q and target=%q", tc.link, tc.target)
+			}
+
+			assert.Equal(t, tc.expected, result, "Unexpected result value %q for link=%q and target=%q", result, tc.link, tc.target)
+		})
+	}
+}
+
+func TestResolveTargetKeepAbsolute(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		expected string
+	}{
+		{name: "absolute target is kept", target: "/opt/host/lib/../lib/libfoo.so.1", expected: "/opt/host/lib/libfoo.so.1"},
+		{name: "relative target is kept", target: "libfoo.so.1.2", expected: "libfoo.so.1.2"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := resolveTarget("/usr/lib/cdi/libfoo.so.1", tc.target, true)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+
+	_, err := resolveTarget("/usr/lib/cdi/libfoo.so.1", "../../../../libfoo.so.1", true)
+	assert.ErrorIs(t, err, ErrSymlinkEscape)
+
+	t.Run("applied symlink keeps its absolute target", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/opt/host/lib/libfoo.so.1")
+
+		hooks := Hooks{Symlinks: []SymlinkEntry{
+			{Target: "/opt/host/lib/libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so.1", KeepAbsolute: true},
+			{Target: "/opt/host/lib/libfoo.so.1", Link: "/usr/lib/cdi/libbar.so.1"},
+		}}
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "/opt/host/lib/libfoo.so.1", target)
+
+		target, err = os.Readlink(filepath.Join(tmpDir, "usr/lib/cdi/libbar.so.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "../../../opt/host/lib/libfoo.so.1", target)
+
+		// The symlink is found applied again and removed along with the hooks.
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Len(t, result.SkippedSymlinks, 2)
+
+		_, err = removeHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+	})
+}
+
+func TestFindLdconfig(t *testing.T) {
+	createBinary := func(t *testing.T, rootFS string, path string) {
+		t.Helper()
+
+		err := os.MkdirAll(filepath.Join(rootFS, filepath.Dir(path)), 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(rootFS, path), nil, 0755)
+		require.NoError(t, err)
+	}
+
+	t.Run("default path", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createBinary(t, tmpDir, "/sbin/ldconfig")
+		createBinary(t, tmpDir, "/usr/bin/ldconfig")
+
+		ldconfig, err := findLdconfig(&localFS{rootFS: tmpDir}, "")
+		require.NoError(t, err)
+		assert.Equal(t, "/sbin/ldconfig", ldconfig)
+	})
+
+	t.Run("overridden path", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createBinary(t, tmpDir, "/opt/glibc/sbin/ldconfig")
+		createBinary(t, tmpDir, "/sbin/ldconfig")
+
+		defaultPath := LdconfigPath
+		t.Cleanup(func() { LdconfigPath = defaultPath })
+		LdconfigPath = "/opt/glibc/sbin/ldconfig"
+
+		ldconfig, err := findLdconfig(&localFS{rootFS: tmpDir}, "")
+		require.NoError(t, err)
+		assert.Equal(t, "/opt/glibc/sbin/ldconfig", ldconfig)
+	})
+
+	t.Run("per call path", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createBinary(t, tmpDir, "/opt/glibc/sbin/ldconfig")
+		createBinary(t, tmpDir, "/sbin/ldconfig")
+
+		ldconfig, err := findLdconfig(&localFS{rootFS: tmpDir}, "/opt/glibc/sbin/ldconfig")
+		require.NoError(t, err)
+		assert.Equal(t, "/opt/glibc/sbin/ldconfig", ldconfig)
+	})
+
+	t.Run("fallback to PATH", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createBinary(t, tmpDir, "/usr/sbin/ldconfig")
+
+		ldconfig, err := findLdconfig(&localFS{rootFS: tmpDir}, "")
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/sbin/ldconfig", ldconfig)
+	})
+
+	t.Run("no ldconfig", func(t *testing.T) {
+		_, err := findLdconfig(&localFS{rootFS: t.TempDir()}, "")
+		assert.ErrorContains(t, err, "Failed finding ldconfig in the container")
+	})
+}
+
+func TestLDCacheDirsWithoutEntries(t *testing.T) {
+	output := `4 libs found in cache ` + "`/etc/ld.so.cache'" + `
+	libnvidia-ml.so.1 (libc6,x86-64) => /usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1
+	libcuda.so.1 (libc6,x86-64) => /usr/lib64/libcuda.so.1
+	libcuda.so.1 (libc6) => /usr/lib32/libcuda.so.1
+	libc.so.6 (libc6,x86-64, OS ABI: Linux 3.2.0) => /lib/x86_64-linux-gnu/libc.so.6
+`
+
+	missing := ldCacheDirsWithoutEntries(output, []string{"/usr/lib64", "/usr/lib32/", "/usr/lib/nvidia", "/usr/lib/x86_64-linux-gnu", "/opt/lib"})
+	assert.Equal(t, []string{"/usr/lib/nvidia", "/opt/lib"}, missing)
+
+	assert.Equal(t, []string{"/usr/lib64"}, ldCacheDirsWithoutEntries("", []string{"/usr/lib64"}))
+}
+
+func TestSortSymlinks(t *testing.T) {
+	t.Run("chained symlinks are created after their targets", func(t *testing.T) {
+		symlinks := []SymlinkEntry{
+			{Target: "libcuda.so.1", Link: "/usr/lib/libcuda.so"},
+			{Target: "/usr/lib/libnvidia-ml.so.1", Link: "/usr/lib/libnvidia-ml.so"},
+			{Target: "libcuda.so.535.104", Link: "/usr/lib/libcuda.so.1"},
+		}
+
+		sorted, err := sortSymlinks(symlinks)
+		require.NoError(t, err)
+		assert.Equal(t, []SymlinkEntry{symlinks[2], symlinks[0], symlinks[1]}, sorted)
+	})
+
+	t.Run("independent symlinks keep their order", func(t *testing.T) {
+		symlinks := []SymlinkEntry{
+			{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "libbar.so.1", Link: "/usr/lib/libbar.so"},
+		}
+
+		sorted, err := sortSymlinks(symlinks)
+		require.NoError(t, err)
+		assert.Equal(t, symlinks, sorted)
+	})
+
+	t.Run("cycle errors", func(t *testing.T) {
+		symlinks := []SymlinkEntry{
+			{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "/usr/lib/libfoo.so", Link: "/usr/lib/libfoo.so.1"},
+		}
+
+		_, err := sortSymlinks(symlinks)
+		assert.ErrorContains(t, err, "The CDI symlinks form a cycle: /usr/lib/libfoo.so -> /usr/lib/libfoo.so.1 -> /usr/lib/libfoo.so")
+	})
+
+	t.Run("self reference errors", func(t *testing.T) {
+		_, err := sortSymlinks([]SymlinkEntry{{Target: "./libfoo.so", Link: "/usr/lib/libfoo.so"}})
+		assert.ErrorContains(t, err, "points at itself")
+	})
+}
+
+// hangingCmd is an instance command that writes its output and only exits once killed.
+type hangingCmd struct {
+	instance.Cmd
+	killed chan struct{}
+}
+
+func (c *hangingCmd) Wait() (int, error) {
+	<-c.killed
+	return 137, nil
+}
+
+func (c *hangingCmd) Signal(s unix.Signal) error {
+	close(c.killed)
+	return nil
+}
+
+// hangingInstance is a running instance whose commands hang.
+type hangingInstance struct {
+	instance.Instance
+}
+
+func (i *hangingInstance) Exec(ctx context.Context, req api.InstanceExecPost, stdin *os.File, stdout *os.File, stderr *os.File) (instance.Cmd, error) {
+	_, err := stdout.Write(bytes.Repeat([]byte("x"), maxExecOutputBytes+10))
+	if err != nil {
+		return nil, err
+	}
+
+	return &hangingCmd{killed: make(chan struct{})}, nil
+}
+
+// namedContainer is a container of the default project.
+type namedContainer struct {
+	instance.Container
+	name string
+	path string
+}
+
+func (c *namedContainer) Name() string { return c.name }
+
+func (c *namedContainer) Project() api.Project { return api.Project{Name: api.ProjectDefaultName} }
+
+func (c *namedContainer) Path() string { return c.path }
+
+func TestLockHooks(t *testing.T) {
+	// The instance path is a symlink to the storage pool, like in LXD.
+	poolDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(poolDir, "c1", "rootfs"), 0755))
+	instancePath := filepath.Join(t.TempDir(), "c1")
+	require.NoError(t, os.Symlink(filepath.Join(poolDir, "c1"), instancePath))
+
+	c1 := &namedContainer{name: "c1", path: instancePath}
+
+	unlock, err := lockHooks(context.Background(), c1)
+	require.NoError(t, err)
+
+	// Another container is not locked.
+	otherUnlock, err := lockHooks(context.Background(), &namedContainer{name: "c2", path: filepath.Join(poolDir, "c2")})
+	require.NoError(t, err)
+	otherUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = lockHooks(ctx, c1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The changes made on the rootfs mount are excluded too.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = lockRootFS(ctx, filepath.Join(poolDir, "c1", "rootfs"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlock()
+
+	unlock, err = lockRootFS(context.Background(), filepath.Join(poolDir, "c1", "rootfs"))
+	require.NoError(t, err)
+	unlock()
+
+	unlock, err = lockHooks(context.Background(), c1)
+	require.NoError(t, err)
+	unlock()
+}
+
+// exitCmd is an instance command exiting with code.
+type exitCmd struct {
+	instance.Cmd
+	code int
+}
+
+func (c *exitCmd) Wait() (int, error) { return c.code, nil }
+
+// ldconfigInstance is a running instance whose ldconfig writes the cache given with -C to its rootfs
+// and then exits with exitCode.
+type ldconfigInstance struct {
+	instance.Instance
+	rootFS   string
+	exitCode int
+	output   string
+	commands [][]string
+}
+
+func (i *ldconfigInstance) IsRunning() bool { return true }
+
+func (i *ldconfigInstance) Name() string { return "c1" }
+
+func (i *ldconfigInstance) Exec(ctx context.Context, req api.InstanceExecPost, stdin *os.File, stdout *os.File, stderr *os.File) (instance.Cmd, error) {
+	i.commands = append(i.commands, req.Command)
+
+	cacheIndex := slices.Index(req.Command, "-C")
+	if cacheIndex < 0 {
+		return &exitCmd{}, nil
+	}
+
+	err := os.WriteFile(filepath.Join(i.rootFS, req.Command[cacheIndex+1]), []byte("new cache"), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stdout.WriteString(i.output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exitCmd{code: i.exitCode}, nil
+}
+
+func TestUpdateLDCache(t *testing.T) {
+	setup := func(t *testing.T) string {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), []byte("old cache"), 0644))
+		createLibrary(t, tmpDir, LdconfigPath)
+		return tmpDir
+	}
+
+	t.Run("replaces the cache once ldconfig succeeded", func(t *testing.T) {
+		tmpDir := setup(t)
+		inst := &ldconfigInstance{rootFS: tmpDir}
+
+		ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		require.NoError(t, err)
+		assert.True(t, ran)
+		assert.Equal(t, []string{LdconfigPath, "-X", "-C", ldconfigCacheTmpFile}, inst.commands[0])
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+		assert.Equal(t, "new cache", string(content))
+		assert.NoFileExists(t, filepath.Join(tmpDir, ldconfigCacheTmpFile))
+	})
+
+	t.Run("keeps the cache when ldconfig fails", func(t *testing.T) {
+		tmpDir := setup(t)
+		inst := &ldconfigInstance{rootFS: tmpDir, exitCode: 1}
+
+		ran, _, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		assert.ErrorContains(t, err, "exited with code 1")
+		assert.False(t, ran)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+		assert.Equal(t, "old cache", string(content))
+		assert.NoFileExists(t, filepath.Join(tmpDir, ldconfigCacheTmpFile))
+	})
+
+	t.Run("reports the warnings", func(t *testing.T) {
+		tmpDir := setup(t)
+		inst := &ldconfigInstance{rootFS: tmpDir, output: "/sbin/ldconfig.real: /usr/lib/cdi/libfoo.so.1 is not a symbolic link\n\n"}
+
+		ran, warnings, err := updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		require.NoError(t, err)
+		assert.True(t, ran)
+		assert.Equal(t, []string{"/usr/lib/cdi/libfoo.so.1 is not a symbolic link"}, warnings)
+
+		inst = &ldconfigInstance{rootFS: tmpDir, exitCode: 1, output: "ldconfig: Can't create temporary cache file /etc/ld.so.cache~: Read-only file system\n"}
+		_, warnings, err = updateLDCache(context.Background(), inst, &localFS{rootFS: tmpDir}, nil, "", 0, nil, "")
+		assert.ErrorContains(t, err, "exited with code 1: Can't create temporary cache file /etc/ld.so.cache~: Read-only file system")
+		assert.Equal(t, []string{"Can't create temporary cache file /etc/ld.so.cache~: Read-only file system"}, warnings)
+
+		var ldconfigErr *LdconfigError
+		require.ErrorAs(t, err, &ldconfigErr)
+		assert.Equal(t, warnings, ldconfigErr.Warnings)
+	})
+}
+
+func TestParseLdconfigWarnings(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{name: "no output", output: "", want: nil},
+		{name: "program prefix", output: "ldconfig: /lib/libbar.so is not a symbolic link\n", want: []string{"/lib/libbar.so is not a symbolic link"}},
+		{name: "full program path", output: "/sbin/ldconfig.real: Path `/usr/lib' given more than once\n", want: []string{"Path `/usr/lib' given more than once"}},
+		{name: "unprefixed line", output: "  something went wrong  \n", want: []string{"something went wrong"}},
+		{name: "several lines", output: "ldconfig: a\n\nldconfig: b\n", want: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, parseLdconfigWarnings(test.output))
+		})
+	}
+}
+
+func TestExecInContainer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	output, _, err := execInContainer(ctx, &hangingInstance{}, []string{"/sbin/ldconfig", "-X"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "[10 bytes truncated]\n"+strings.Repeat("x", maxExecOutputBytes), output)
+}
+
+func TestApplyHooks(t *testing.T) {
+	apply := func(r io.Reader, rootFS string) error {
+		_, _, err := applyHooksSourceWithFS(hooksSource{r: r}, &localFS{rootFS: rootFS}, ApplyOptions{Rollback: true})
+		return err
+	}
+
+	t.Run("JSON content", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		r := strings.NewReader(`{"symlinks": [{"target": "libfoo.so.1", "link": "/usr/lib/libfoo.so"}], "ld_cache_updates": ["/usr/lib"]}`)
+		require.NoError(t, apply(r, tmpDir))
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib"), string(content))
+	})
+
+	t.Run("YAML content", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+
+		r := strings.NewReader("symlinks:\n- target: libfoo.so.1\n  link: /usr/lib/libfoo.so\n")
+		require.NoError(t, apply(r, tmpDir))
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+	})
+
+	t.Run("invalid content", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := apply(strings.NewReader(`{"symlinks": [{"target": "libfoo.so.1", "link": "libfoo.so"}]}`), tmpDir)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Invalid CDI hooks")
+
+		err = apply(strings.NewReader("symlinks: {"), tmpDir)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Failed decoding the CDI hooks")
+
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("rollback on failure", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "libbar.so"), 0755))
+
+		r := strings.NewReader(`{"symlinks": [{"target": "libfoo.so.1", "link": "/usr/lib/libfoo.so"}, {"target": "libfoo.so.1", "link": "/usr/lib/libbar.so"}]}`)
+		require.Error(t, apply(r, tmpDir))
+
+		_, err := os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestMkdirAllKnownDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfs := &lstatCounter{containerFS: &localFS{rootFS: tmpDir}, lstats: map[string]int{}}
+	tx := &hooksTransaction{cfs: cfs, l: nopLogger{}}
+
+	require.NoError(t, tx.MkdirAll("/opt/nvidia/lib"))
+	require.NoError(t, tx.MkdirAll("/opt/nvidia/lib/"))
+	assert.Equal(t, 1, cfs.lstats["/opt/nvidia/lib"])
+	assert.DirExists(t, filepath.Join(tmpDir, "opt", "nvidia", "lib"))
+
+	// A link replacing a directory makes it unknown again.
+	tx.forgetKnownDirs("/opt/nvidia")
+	require.NoError(t, tx.MkdirAll("/opt/nvidia/lib"))
+	assert.Equal(t, 2, cfs.lstats["/opt/nvidia/lib"])
+
+	// The rollback removes the created directories.
+	require.NoError(t, tx.Rollback())
+	assert.NoDirExists(t, filepath.Join(tmpDir, "opt"))
+	require.NoError(t, tx.MkdirAll("/opt/nvidia/lib"))
+	assert.DirExists(t, filepath.Join(tmpDir, "opt", "nvidia", "lib"))
+}
+
+func BenchmarkApplyHooks(b *testing.B) {
+	hooks := Hooks{}
+	for i := range 100 {
+		dir := fmt.Sprintf("/usr/lib/nvidia/%d", i%4)
+		hooks.Symlinks = append(hooks.Symlinks, SymlinkEntry{Target: fmt.Sprintf("lib%d.so.1", i), Link: fmt.Sprintf("%s/lib%d.so", dir, i)})
+	}
+
+	hooksFile := writeHooksFile(b, b.TempDir(), hooks)
+	rootsDir := b.TempDir()
+
+	// Each Lstat is a round trip to the container when going through SFTP.
+	lstats := 0
+	for b.Loop() {
+		b.StopTimer()
+		rootFS, err := os.MkdirTemp(rootsDir, "rootfs")
+		require.NoError(b, err)
+		cfs := &lstatCounter{containerFS: &localFS{rootFS: rootFS}, lstats: map[string]int{}}
+		b.StartTimer()
+
+		_, _, err = applyHooksWithFS(hooksFile, cfs, ApplyOptions{})
+		require.NoError(b, err)
+
+		for _, count := range cfs.lstats {
+			lstats += count
+		}
+	}
+
+	b.ReportMetric(float64(lstats)/float64(b.N), "lstats/op")
+}
+
+func TestApplyHooksPortions(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libfoo.so.1.2")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc", "ld.so.conf.d"), 0755))
+
+		hooks := Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1.2", Link: "/usr/lib/cdi/libfoo.so.1"}},
+			LDCacheUpdates: []string{"/usr/lib/cdi"},
+		}
+
+		return tmpDir, writeHooksFile(t, t.TempDir(), hooks)
+	}
+
+	ldConfPath := filepath.Join(linkerConfDir, CDILinkerConfFile)
+
+	t.Run("symlinks only", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, regenerate, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{SymlinksOnly: true})
+		require.NoError(t, err)
+		assert.False(t, regenerate)
+		assert.Len(t, result.CreatedSymlinks, 1)
+		assert.Empty(t, result.LDCacheEntries)
+		assert.NoFileExists(t, filepath.Join(tmpDir, ldConfPath))
+	})
+
+	t.Run("linker cache only", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, regenerate, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{LdCacheOnly: true})
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.Empty(t, result.CreatedSymlinks)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+
+		// The cache is regenerated for the symlinks of an earlier step even when the linker
+		// configuration is up to date.
+		_, regenerate, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{LdCacheOnly: true})
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+	})
+
+	t.Run("both steps apply the whole hooks", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{SymlinksOnly: true})
+		require.NoError(t, err)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{LdCacheOnly: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1.2", target)
+	})
+
+	tests := []struct {
+		name string
+		opts ApplyOptions
+	}{
+		{name: "symlinks and linker cache only", opts: ApplyOptions{SymlinksOnly: true, LdCacheOnly: true}},
+		{name: "linker cache only without the linker cache", opts: ApplyOptions{LdCacheOnly: true, SkipLdCache: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpDir, hooksFile := setup(t)
+
+			_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, test.opts)
+			assert.Error(t, err)
+			assert.NoFileExists(t, filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+		})
+	}
 }
 
-func TestResolveTargetRelativeToLink(t *testing.T) {
+func TestApplyHooksToRootFS(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libfoo.so.1.2")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+
+		past := time.Now().Add(-24 * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(tmpDir, "usr"), past, past))
+
+		hooks := Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/c1/rootfs",
+			Symlinks:        []SymlinkEntry{{Target: "libfoo.so.1.2", Link: "/usr/lib/cdi/libfoo.so.1"}},
+			LDCacheUpdates:  []string{"/usr/lib/cdi"},
+		}
+
+		return tmpDir, writeHooksFile(t, t.TempDir(), hooks)
+	}
+
+	t.Run("hooks are baked in the rootfs", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, err := applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, Verify: true})
+		require.NoError(t, err)
+		assert.Len(t, result.CreatedSymlinks, 1)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+		assert.False(t, result.LdconfigRan)
+
+		// The cache is rebuilt at first boot.
+		usrInfo, err := os.Stat(filepath.Join(tmpDir, "usr"))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), usrInfo.ModTime(), time.Hour)
+	})
+
+	t.Run("broken symlinks are rolled back", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "cdi"), 0755))
+
+		hooksFile := writeHooksFile(t, t.TempDir(), Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "libmissing.so.1", Link: "/usr/lib/cdi/libmissing.so"}},
+			LDCacheUpdates: []string{"/usr/lib/cdi"},
+		})
+
+		_, err := applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, Verify: true, Rollback: true})
+		require.Error(t, err)
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libmissing.so"))
+		assert.NoFileExists(t, filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+
+		// The changes are kept without the rollback.
+		_, err = applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, Verify: true})
+		require.Error(t, err)
+
+		_, err = os.Lstat(filepath.Join(tmpDir, "usr", "lib", "cdi", "libmissing.so"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("skipping the linker cache", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		_, err := applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, SkipLdCache: true})
+		require.NoError(t, err)
+
+		usrInfo, err := os.Stat(filepath.Join(tmpDir, "usr"))
+		require.NoError(t, err)
+		assert.Less(t, usrInfo.ModTime(), time.Now().Add(-time.Hour))
+	})
+
+	t.Run("build mode is required", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		_, err := ApplyHooksToRootFS(hooksFile, tmpDir, ApplyOptions{})
+		assert.ErrorContains(t, err, "requires the build mode")
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr/lib/cdi/libfoo.so.1"))
+	})
+
+	t.Run("build mode is rejected for containers", func(t *testing.T) {
+		err := validateApplyOptions(ApplyOptions{BuildMode: true, rootFS: "/var/lib/lxd/containers/c1/rootfs"})
+		assert.ErrorContains(t, err, "only applies to a rootfs directory")
+	})
+}
+
+func TestApplyHooksTimings(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libfoo.so.1.2")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+
+		hooks := Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1.2", Link: "/usr/lib/cdi/libfoo.so.1"}},
+			LDCacheUpdates: []string{"/usr/lib/cdi"},
+		}
+
+		return tmpDir, writeHooksFile(t, t.TempDir(), hooks)
+	}
+
+	t.Run("every stage is timed", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+		l := &debugRecorder{}
+
+		result, err := applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, NativeLdCache: true, Logger: l})
+		require.NoError(t, err)
+		assert.Positive(t, result.Timings.Decode)
+		assert.Positive(t, result.Timings.Symlinks)
+		assert.Positive(t, result.Timings.LinkerConf)
+		assert.Positive(t, result.Timings.LDCache)
+		assert.Contains(t, l.messages, "Timed the stages of the CDI hooks apply")
+	})
+
+	t.Run("skipped stages are not timed", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, err := applyHooksToRootFSWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{BuildMode: true, SymlinksOnly: true})
+		require.NoError(t, err)
+		assert.Positive(t, result.Timings.Symlinks)
+		assert.Zero(t, result.Timings.LinkerConf)
+		assert.Zero(t, result.Timings.LDCache)
+	})
+}
+
+func TestApplyHooksMissingLibraryDirs(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libcuda.so.1")
+		require.NoError(t, os.Symlink("nvidia", filepath.Join(tmpDir, "usr", "lib", "cuda")))
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib/cuda", "/usr/lib/missing"}}
+
+		return tmpDir, writeHooksFile(t, t.TempDir(), hooks)
+	}
+
+	t.Run("missing directories are kept by default", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/cuda", "/usr/lib/missing"}, result.LDCacheEntries)
+		assert.Empty(t, result.SkippedLDCacheUpdates)
+	})
+
+	t.Run("missing directories are skipped", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{SkipMissingLibraryDirs: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/cuda"}, result.LDCacheEntries)
+		assert.Equal(t, []string{"/usr/lib/missing"}, result.SkippedLDCacheUpdates)
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/cuda"}, entries)
+	})
+
+	t.Run("missing directories are an error", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{RequireLibraryDirs: true, Rollback: true})
+		assert.ErrorContains(t, err, `The CDI library directory "/usr/lib/missing" does not exist in the container`)
+		assert.NoFileExists(t, filepath.Join(tmpDir, linkerConfDir, CDILinkerConfFile))
+	})
+
+	t.Run("a file is not a directory", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/libfoo.so")
+
+		hooksFile := writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/libfoo.so"}})
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{RequireLibraryDirs: true})
+		assert.ErrorContains(t, err, "does not exist in the container")
+	})
+
+	t.Run("options are mutually exclusive", func(t *testing.T) {
+		tmpDir, hooksFile := setup(t)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{SkipMissingLibraryDirs: true, RequireLibraryDirs: true})
+		assert.ErrorContains(t, err, "mutually exclusive")
+	})
+}
+
+func TestTargetResolver(t *testing.T) {
 	tests := []struct {
-		name      string
-		link      string
-		target    string
-		expected  string
-		expectErr bool
+		link   string
+		target string
 	}{
-		{
-			name:      "relative target returned as-is",
-			link:      "/home/user/link",
-			target:    "relative/path",
-			expected:  "relative/path",
-			expectErr: false,
-		},
-		{
-			name:      "absolute target in same directory",
-			link:      "/home/user/link",
-			target:    "/home/user/target",
-			expected:  "target",
-			expectErr: false,
-		},
-		{
-			name:      "absolute target in subdirectory",
-			link:      "/home/user/link",
-			target:    "/home/user/subdir/target",
-			expected:  filepath.Join("subdir", "target"),
-			expectErr: false,
-		},
-		{
-			name:      "absolute target in parent directory",
-			link:      "/home/user/subdir/link",
-			target:    "/home/user/target",
-			expected:  filepath.Join("..", "target"),
-			expectErr: false,
-		},
-		{
-			name:      "absolute target in sibling directory",
-			link:      "/home/user/dir1/link",
-			target:    "/home/user/dir2/target",
-			expected:  filepath.Join("..", "dir2", "target"),
-			expectErr: false,
-		},
-		{
-			name:      "absolute target at root level",
-			link:      "/home/user/link",
-			target:    "/target",
-			expected:  filepath.Join("..", "..", "target"),
-			expectErr: false,
-		},
-		{
-			name:      "paths with trailing slashes get cleaned",
-			link:      "/home/user/link",
-			target:    "/home/user/target/",
-			expected:  "target",
-			expectErr: false,
-		},
-		{
-			name:      "paths with redundant separators get cleaned",
-			link:      "/home//user///link",
-			target:    "/home//user//target",
-			expected:  "target",
-			expectErr: false,
-		},
-		{
-			name:      "paths with dot components get cleaned",
-			link:      "/home/./user/link",
-			target:    "/home/user/./target",
-			expected:  "target",
-			expectErr: false,
-		},
-		{
-			name:      "relative link path returns error",
-			link:      "relative/link",
-			target:    "/absolute/target",
-			expected:  "",
-			expectErr: true,
-		},
-		{
-			name:      "empty link path returns error",
-			link:      "",
-			target:    "/absolute/target",
-			expected:  "",
-			expectErr: true,
-		},
+		{link: "/usr/lib/x86_64-linux-gnu/libcuda.so", target: "/usr/lib/x86_64-linux-gnu/libcuda.so.1"},
+		{link: "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so", target: "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1"},
+		{link: "/usr/lib/cdi/libcuda.so", target: "/opt/nvidia/lib/libcuda.so.1"},
+		{link: "/usr/lib/cdi/libnvidia-ml.so", target: "/opt/nvidia/lib/libnvidia-ml.so.1"},
+		{link: "/usr/lib/cdi/libcuda.so.1", target: "libcuda.so.535"},
+		{link: "/usr/lib/cdi/root", target: "/"},
+		{link: "/usr/lib/cdi/../cdi/lib", target: "/opt/./nvidia/lib/"},
+		{link: "/usr/lib/cdi/escape", target: "/../etc/passwd"},
+		{link: "/usr/lib/cdi/self", target: "/usr/lib/cdi"},
+		{link: "/usr/lib/cdi/parent", target: "/usr/lib/"},
+		{link: "/usr/lib/cdi/usr", target: "/usr"},
 	}
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			result, err := resolveTargetRelativeToLink(tc.link, tc.target)
+	r := newTargetResolver()
 
-			if tc.expectErr {
-				assert.Error(t, err, "Expected an error for link=%q and target=%q", tc.link, tc.target)
-			} else {
-				assert.NoError(t, err, "Expected no error for link=%q and target=%q", tc.link, tc.target)
-			}
+	for _, test := range tests {
+		for _, keepAbsolute := range []bool{false, true} {
+			want, wantErr := resolveTarget(test.link, test.target, keepAbsolute)
+			got, err := r.resolve(test.link, test.target, keepAbsolute)
+			assert.Equal(t, wantErr, err, "link %q, target %q", test.link, test.target)
+			assert.Equal(t, want, got, "link %q, target %q", test.link, test.target)
+		}
+	}
 
-			assert.Equal(t, tc.expected, result, "Unexpected result value %q for link=%q and target=%q", result, tc.link, tc.target)
+	// The symlinks of a directory pointing at another one share their relative directory.
+	assert.Len(t, r.relDirs, 3)
+
+	t.Run("target is the directory of the link", func(t *testing.T) {
+		target, err := r.resolve("/usr/lib/cdi/self", "/usr/lib/cdi", false)
+		require.NoError(t, err)
+		assert.Equal(t, ".", target)
+	})
+
+	t.Run("target is the parent of the link", func(t *testing.T) {
+		// Another symlink of the directory caches the path to its parent first.
+		_, err := r.resolve("/usr/lib/cdi/libfoo.so", "/usr/lib/libfoo.so.1", false)
+		require.NoError(t, err)
+
+		target, err := r.resolve("/usr/lib/cdi/parent", "/usr/lib", false)
+		require.NoError(t, err)
+		assert.Equal(t, "..", target)
+	})
+}
+
+func BenchmarkResolveTargets(b *testing.B) {
+	symlinks := make([]SymlinkEntry, 0, 200)
+	for i := range 200 {
+		symlinks = append(symlinks, SymlinkEntry{
+			Target: fmt.Sprintf("/usr/lib/x86_64-linux-gnu/nvidia/current/lib%d.so.535.104.05", i),
+			Link:   fmt.Sprintf("/usr/lib/x86_64-linux-gnu/cdi/%d/lib%d.so.1", i%4, i),
 		})
 	}
+
+	// Each resolution computes a relative path.
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, symlink := range symlinks {
+				_, err := resolveTarget(symlink.Link, symlink.Target, false)
+				require.NoError(b, err)
+			}
+		}
+
+		b.ReportMetric(float64(len(symlinks)), "rels/op")
+	})
+
+	// The relative path is only computed once per pair of directories.
+	b.Run("memoized", func(b *testing.B) {
+		b.ReportAllocs()
+		rels := 0
+		for b.Loop() {
+			// A resolver only lives for one apply.
+			r := newTargetResolver()
+			for _, symlink := range symlinks {
+				_, err := r.resolve(symlink.Link, symlink.Target, false)
+				require.NoError(b, err)
+			}
+
+			rels = len(r.relDirs)
+		}
+
+		b.ReportMetric(float64(rels), "rels/op")
+	})
+}
+
+func TestApplyHooksUmask(t *testing.T) {
+	// The umask is the one of the whole process, so it is restored for the other tests.
+	oldUmask := unix.Umask(0077)
+	t.Cleanup(func() { unix.Umask(oldUmask) })
+
+	filePerm := func(t *testing.T, path string) os.FileMode {
+		t.Helper()
+
+		fileInfo, err := os.Stat(path)
+		require.NoError(t, err)
+
+		return fileInfo.Mode().Perm()
+	}
+
+	t.Run("glibc", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.Chmod(tmpDir, 0755))
+
+		cfs, err := openHostRootFS(tmpDir)
+		require.NoError(t, err)
+
+		defer func() { _ = cfs.Close() }()
+
+		hooks := Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/nvidia/libfoo.so"}},
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+		}
+
+		_, _, err = applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), cfs, ApplyOptions{})
+		require.NoError(t, err)
+
+		for _, dir := range []string{"etc", "etc/ld.so.conf.d", "usr", "usr/lib", "usr/lib/nvidia"} {
+			assert.Equal(t, os.FileMode(0755), filePerm(t, filepath.Join(tmpDir, dir)), dir)
+		}
+
+		assert.Equal(t, os.FileMode(0644), filePerm(t, filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile)))
+
+		// The native linker cache is readable by everyone too.
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), marshalLDCache(nil), 0600))
+		writeSharedLibrary(t, filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so.1"), "libfoo.so.1")
+		require.NoError(t, updateLDCacheNative(cfs, []string{"/usr/lib/nvidia"}, nil))
+		assert.Equal(t, os.FileMode(0644), filePerm(t, filepath.Join(tmpDir, "etc", "ld.so.cache")))
+	})
+
+	t.Run("musl", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.Chmod(tmpDir, 0755))
+		createMuslRootFS(t, tmpDir)
+
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}}), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, os.FileMode(0755), filePerm(t, filepath.Join(tmpDir, "etc")))
+		assert.Equal(t, os.FileMode(0644), filePerm(t, filepath.Join(tmpDir, "etc", "ld-musl-x86_64.path")))
+	})
+}
+
+func TestApplyHooksLinkerConfPriority(t *testing.T) {
+	t.Run("priorities order the linker conf files", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.conf"), []byte("include /etc/ld.so.conf.d/*.conf\n"), 0644))
+
+		amdHooksFile := writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/amd"}, LinkerConfSuffix: "amd", LinkerConfPriority: 10})
+		nvidiaHooksFile := writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}, LinkerConfSuffix: "nvidia", LinkerConfPriority: 5})
+		sharedHooksFile := writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/shared"}, LinkerConfPriority: 5})
+		for _, path := range []string{amdHooksFile, nvidiaHooksFile, sharedHooksFile} {
+			_, _, err := applyHooksWithFS(path, &localFS{rootFS: tmpDir}, ApplyOptions{})
+			require.NoError(t, err)
+		}
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		assert.FileExists(t, filepath.Join(ldConfDir, "05-lxdcdi-nvidia.conf"))
+		assert.FileExists(t, filepath.Join(ldConfDir, "05-lxdcdi.conf"))
+		assert.FileExists(t, filepath.Join(ldConfDir, "10-lxdcdi-amd.conf"))
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/shared", "/usr/lib/amd"}, dirs[:3])
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/usr/lib/amd", "/usr/lib/nvidia", "/usr/lib/shared"}, entries)
+
+		_, err = removeHooksWithFS(nvidiaHooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(ldConfDir, "05-lxdcdi-nvidia.conf"))
+
+		_, err = removeHooksWithFS(sharedHooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(ldConfDir, "05-lxdcdi.conf"))
+		assert.FileExists(t, filepath.Join(ldConfDir, "10-lxdcdi-amd.conf"))
+	})
+
+	t.Run("invalid priorities", func(t *testing.T) {
+		for _, priority := range []int{-1, 100} {
+			err := ValidateHooks(&Hooks{LinkerConfPriority: priority})
+			assert.ErrorIs(t, err, ErrInvalidHook)
+			assert.ErrorContains(t, err, "it must be between 0 and 99")
+		}
+
+		assert.NoError(t, ValidateHooks(&Hooks{LinkerConfPriority: 99}))
+	})
+
+	t.Run("linker conf file names", func(t *testing.T) {
+		tests := map[string]bool{
+			"00-lxdcdi.conf":        true,
+			"05-lxdcdi-nvidia.conf": true,
+			"99-lxdcdi-amd.conf":    true,
+			"5-lxdcdi.conf":         false,
+			"05-lxdcdi.conf.bak":    false,
+			"05-other.conf":         false,
+			"ab-lxdcdi.conf":        false,
+			"libc.conf":             false,
+		}
+
+		for name, want := range tests {
+			assert.Equal(t, want, isCDILinkerConfFile(name), name)
+		}
+	})
 }
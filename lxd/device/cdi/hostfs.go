@@ -0,0 +1,167 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostRootFS implements containerFS on a rootfs directory of the host, like the image rootfs of the
+// build mode, which has no container to go through. The container paths are resolved within the
+// rootfs by os.Root so that symlinks cannot point outside of it.
+type hostRootFS struct {
+	root *os.Root
+}
+
+// validateRootFS checks that the container rootfs mount at path on the host is an absolute path to a
+// directory, so that the entry points taking it fail early with ErrInvalidRootFS rather than deep in
+// the changes. The symlinks are followed as the instance paths of LXD are symlinks to the storage pools.
+func validateRootFS(path string) error {
+	if path == "" {
+		return withKind(ErrInvalidRootFS, errors.New("No container rootfs mount"))
+	}
+
+	if !filepath.IsAbs(path) {
+		return withKindf(ErrInvalidRootFS, "The container rootfs mount %q is not an absolute path", path)
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return withKindf(ErrInvalidRootFS, "Failed checking the container rootfs mount %q: %w", path, err)
+	}
+
+	if !fileInfo.IsDir() {
+		return withKindf(ErrInvalidRootFS, "The container rootfs mount %q is not a directory", path)
+	}
+
+	return nil
+}
+
+// openHostRootFS opens the container rootfs mounted at path on the host once validated by
+// validateRootFS.
+func openHostRootFS(path string) (*hostRootFS, error) {
+	err := validateRootFS(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := os.OpenRoot(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening the container rootfs %q: %w", path, err)
+	}
+
+	return &hostRootFS{root: root}, nil
+}
+
+// Close closes the rootfs.
+func (h *hostRootFS) Close() error {
+	return h.root.Close()
+}
+
+// path returns the container path p relative to the rootfs.
+func (h *hostRootFS) path(p string) string {
+	rel := strings.TrimPrefix(filepath.Clean("/"+p), "/")
+	if rel == "" {
+		return "."
+	}
+
+	return rel
+}
+
+// MkdirAll creates the directory at path and any missing parents.
+func (h *hostRootFS) MkdirAll(path string) error { return h.root.MkdirAll(h.path(path), 0755) }
+
+// Symlink creates newname as a symlink to oldname.
+func (h *hostRootFS) Symlink(oldname, newname string) error {
+	return h.root.Symlink(oldname, h.path(newname))
+}
+
+// OpenFile opens the file at path with the given flags.
+func (h *hostRootFS) OpenFile(path string, flags int) (io.ReadWriteCloser, error) {
+	return h.root.OpenFile(h.path(path), flags, 0644)
+}
+
+// Remove removes the file or empty directory at path.
+func (h *hostRootFS) Remove(path string) error { return h.root.Remove(h.path(path)) }
+
+// Chtimes changes the access and modification times of the file at path.
+func (h *hostRootFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return h.root.Chtimes(h.path(path), atime, mtime)
+}
+
+// Lstat returns the file info of path without following a final symlink.
+func (h *hostRootFS) Lstat(path string) (os.FileInfo, error) { return h.root.Lstat(h.path(path)) }
+
+// Readlink returns the target of the symlink at path.
+func (h *hostRootFS) Readlink(path string) (string, error) { return h.root.Readlink(h.path(path)) }
+
+// ReadDir returns the file info of the entries of the directory at path.
+func (h *hostRootFS) ReadDir(path string) ([]os.FileInfo, error) {
+	dir, err := h.root.Open(h.path(path))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Rename renames oldname to newname.
+func (h *hostRootFS) Rename(oldname, newname string) error {
+	return h.root.Rename(h.path(oldname), h.path(newname))
+}
+
+// Chmod changes the mode of the file at path.
+func (h *hostRootFS) Chmod(path string, mode os.FileMode) error {
+	return h.root.Chmod(h.path(path), mode)
+}
+
+// Chown changes the owner of the file at path.
+func (h *hostRootFS) Chown(path string, uid int, gid int) error {
+	return h.root.Chown(h.path(path), uid, gid)
+}
+
+// Link creates newname as a hard link to oldname.
+func (h *hostRootFS) Link(oldname, newname string) error {
+	return h.root.Link(h.path(oldname), h.path(newname))
+}
+
+// Mknod creates the device node at path with the given mode, including its type bits, and device
+// number. Its directory is opened within the rootfs so that the node cannot be created outside of it.
+func (h *hostRootFS) Mknod(path string, mode uint32, dev uint64) error {
+	dir, err := h.root.Open(h.path(filepath.Dir(path)))
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	err = unix.Mknodat(int(dir.Fd()), filepath.Base(path), mode, int(dev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+
+	return nil
+}
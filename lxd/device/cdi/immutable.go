@@ -0,0 +1,229 @@
+package cdi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// fsImmutableFlag is the FS_IMMUTABLE_FL inode flag of linux/fs.h, set by `chattr +i`.
+const fsImmutableFlag = 0x00000010
+
+// fileFlagsFS reads and sets the inode flags of the files of a container, as changed by chattr(1).
+type fileFlagsFS interface {
+	FileFlags(path string) (int, error)
+	SetFileFlags(path string, flags int) error
+}
+
+// FileFlags returns the inode flags of the file or directory at path.
+func (h *hostRootFS) FileFlags(path string) (int, error) {
+	f, err := h.root.OpenFile(h.path(path), unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return 0, &os.PathError{Op: "ioctl", Path: path, Err: err}
+	}
+
+	return int(flags), nil
+}
+
+// SetFileFlags sets the inode flags of the file or directory at path.
+func (h *hostRootFS) SetFileFlags(path string, flags int) error {
+	f, err := h.root.OpenFile(h.path(path), unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags)
+	if err != nil {
+		return &os.PathError{Op: "ioctl", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// openFileFlagsFS returns how to read the inode flags of the files of cfs, which is cfs itself when it
+// supports it and otherwise the container rootfs mounted at rootFS on the host, e.g. for SFTP. It
+// returns nil when the flags cannot be read, along with the function releasing the returned one.
+func openFileFlagsFS(cfs containerFS, rootFS string, l logger.Logger) (fileFlagsFS, func()) {
+	flagsFS, ok := cfs.(fileFlagsFS)
+	if ok {
+		return flagsFS, func() {}
+	}
+
+	if rootFS == "" {
+		return nil, func() {}
+	}
+
+	hostFS, err := openHostRootFS(rootFS)
+	if err != nil {
+		l.Debug("Failed opening the container rootfs to check its immutable files", logger.Ctx{"rootfs": rootFS, "error": err})
+		return nil, func() {}
+	}
+
+	return hostFS, func() { _ = hostFS.Close() }
+}
+
+// immutableFS wraps a containerFS and reports the changes failing on an immutable file or directory
+// (see chattr(1)) with ErrImmutableFile, as the permission error they fail with otherwise does not
+// tell why even root cannot change them. When clear is set, the immutable flag is cleared for the
+// change instead and restored right after it.
+type immutableFS struct {
+	containerFS
+	flags fileFlagsFS
+	clear bool
+	l     logger.Logger
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents.
+func (i *immutableFS) MkdirAll(path string) error {
+	return i.change(func() error { return i.containerFS.MkdirAll(path) }, path)
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (i *immutableFS) Symlink(oldname, newname string) error {
+	return i.change(func() error { return i.containerFS.Symlink(oldname, newname) }, newname)
+}
+
+// OpenFile opens the named file with the specified flags.
+func (i *immutableFS) OpenFile(path string, flags int) (io.ReadWriteCloser, error) {
+	var f io.ReadWriteCloser
+	err := i.change(func() error {
+		var err error
+		f, err = i.containerFS.OpenFile(path, flags)
+		return err
+	}, path)
+
+	return f, err
+}
+
+// Remove removes the named file.
+func (i *immutableFS) Remove(path string) error {
+	return i.change(func() error { return i.containerFS.Remove(path) }, path)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (i *immutableFS) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return i.change(func() error { return i.containerFS.Chtimes(path, atime, mtime) }, path)
+}
+
+// Rename atomically renames oldname to newname, replacing newname if it already exists.
+func (i *immutableFS) Rename(oldname, newname string) error {
+	return i.change(func() error { return i.containerFS.Rename(oldname, newname) }, oldname, newname)
+}
+
+// Chmod changes the mode of the named file.
+func (i *immutableFS) Chmod(path string, mode os.FileMode) error {
+	return i.change(func() error { return i.containerFS.Chmod(path, mode) }, path)
+}
+
+// Chown changes the owner of the named file.
+func (i *immutableFS) Chown(path string, uid int, gid int) error {
+	return i.change(func() error { return i.containerFS.Chown(path, uid, gid) }, path)
+}
+
+// Link creates newname as a hard link to the oldname file.
+func (i *immutableFS) Link(oldname, newname string) error {
+	return i.change(func() error { return i.containerFS.Link(oldname, newname) }, oldname, newname)
+}
+
+// change runs op changing paths. When it fails with a permission error and some of paths or of their
+// directories are immutable, the error is reported with ErrImmutableFile, or op is run again with
+// their immutable flag cleared when i.clear is set.
+func (i *immutableFS) change(op func() error, paths ...string) error {
+	err := op()
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	immutable := i.immutablePaths(paths)
+	if len(immutable) == 0 {
+		return err
+	}
+
+	if !i.clear {
+		return withKindf(ErrImmutableFile, "The path %q is immutable, which prevents changing it even as root (see chattr(1)): %w", immutable[0], err)
+	}
+
+	cleared := map[string]int{}
+	defer func() {
+		for path, flags := range cleared {
+			// The path may have been removed or replaced by op, the flag only being restored on what is there.
+			err := i.flags.SetFileFlags(path, flags)
+			if err != nil && !isMissingPath(err) {
+				i.l.Warn("Failed restoring the immutable flag", logger.Ctx{"path": path, "error": err})
+			}
+		}
+	}()
+
+	for _, path := range immutable {
+		flags, err := i.flags.FileFlags(path)
+		if err != nil {
+			return withKindf(ErrImmutableFile, "Failed reading the flags of the immutable path %q: %w", path, err)
+		}
+
+		err = i.flags.SetFileFlags(path, flags&^fsImmutableFlag)
+		if err != nil {
+			return withKindf(ErrImmutableFile, "Failed clearing the immutable flag of %q: %w", path, err)
+		}
+
+		cleared[path] = flags
+		i.l.Debug("Cleared the immutable flag for a CDI change", logger.Ctx{"path": path})
+	}
+
+	return op()
+}
+
+// immutablePaths returns which of paths and of their directories are immutable. A missing path is
+// checked through its nearest existing ancestor, which is the one preventing its creation. The
+// symlinks and the paths whose flags cannot be read are left out.
+func (i *immutableFS) immutablePaths(paths []string) []string {
+	var candidates []string
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		for path != "/" {
+			_, err := i.containerFS.Lstat(path)
+			if err == nil || !isMissingPath(err) {
+				break
+			}
+
+			path = filepath.Dir(path)
+		}
+
+		for _, candidate := range []string{path, filepath.Dir(path)} {
+			if !slices.Contains(candidates, candidate) {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	var immutable []string
+	for _, candidate := range candidates {
+		fileInfo, err := i.containerFS.Lstat(candidate)
+		if err != nil || fileInfo.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		flags, err := i.flags.FileFlags(candidate)
+		if err == nil && flags&fsImmutableFlag != 0 {
+			immutable = append(immutable, candidate)
+		}
+	}
+
+	return immutable
+}
@@ -0,0 +1,108 @@
+package cdi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHooksImmutable(t *testing.T) {
+	openRootFS := func(t *testing.T) (string, *hostRootFS) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libfoo.so.1")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc", "ld.so.conf.d"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.conf"), []byte("/usr/local/lib\n"), 0644))
+
+		cfs, err := openHostRootFS(tmpDir)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = cfs.Close() })
+
+		// Probe for the ability to set the immutable flag, which requires CAP_LINUX_IMMUTABLE and a
+		// filesystem supporting it.
+		flags, err := cfs.FileFlags("/usr/lib/cdi")
+		if err == nil {
+			err = cfs.SetFileFlags("/usr/lib/cdi", flags)
+		}
+
+		if err != nil {
+			t.Skipf("Setting the inode flags is not supported: %v", err)
+		}
+
+		return tmpDir, cfs
+	}
+
+	setImmutable := func(t *testing.T, cfs *hostRootFS, path string) {
+		flags, err := cfs.FileFlags(path)
+		require.NoError(t, err)
+
+		err = cfs.SetFileFlags(path, flags|fsImmutableFlag)
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("Setting the immutable flag is not permitted")
+		}
+
+		require.NoError(t, err)
+
+		// The temporary directory cannot be removed with immutable files.
+		t.Cleanup(func() { _ = cfs.SetFileFlags(path, flags) })
+	}
+
+	isImmutable := func(t *testing.T, cfs *hostRootFS, path string) bool {
+		flags, err := cfs.FileFlags(path)
+		require.NoError(t, err)
+		return flags&fsImmutableFlag != 0
+	}
+
+	symlinkHooks := &Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so"}}}
+
+	t.Run("immutable directory reported", func(t *testing.T) {
+		tmpDir, cfs := openRootFS(t)
+		setImmutable(t, cfs, "/usr/lib/cdi")
+
+		_, _, err := applyLoadedHooksWithFS(context.Background(), symlinkHooks, cfs, ApplyOptions{})
+		assert.ErrorIs(t, err, ErrImmutableFile)
+		assert.ErrorContains(t, err, `The path "/usr/lib/cdi" is immutable`)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so"))
+	})
+
+	t.Run("immutable main linker conf file reported", func(t *testing.T) {
+		_, cfs := openRootFS(t)
+		setImmutable(t, cfs, "/etc/ld.so.conf")
+
+		_, _, err := applyLoadedHooksWithFS(context.Background(), &Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}}, cfs, ApplyOptions{Rollback: true})
+		assert.ErrorIs(t, err, ErrImmutableFile)
+		assert.ErrorContains(t, err, `The path "/etc/ld.so.conf" is immutable`)
+	})
+
+	t.Run("immutable flag cleared and restored", func(t *testing.T) {
+		tmpDir, cfs := openRootFS(t)
+		setImmutable(t, cfs, "/usr/lib/cdi")
+		setImmutable(t, cfs, "/etc/ld.so.conf")
+
+		hooks := &Hooks{Symlinks: symlinkHooks.Symlinks, LDCacheUpdates: []string{"/usr/lib/cdi"}}
+		result, _, err := applyLoadedHooksWithFS(context.Background(), hooks, cfs, ApplyOptions{ClearImmutable: true})
+		require.NoError(t, err)
+		assert.Equal(t, symlinkHooks.Symlinks, result.CreatedSymlinks)
+		assert.True(t, result.MainLinkerConfUpdated)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		assert.True(t, isImmutable(t, cfs, "/usr/lib/cdi"))
+		assert.True(t, isImmutable(t, cfs, "/etc/ld.so.conf"))
+	})
+
+	t.Run("other permission errors left as they are", func(t *testing.T) {
+		_, cfs := openRootFS(t)
+		i := &immutableFS{containerFS: cfs, flags: cfs, l: nopLogger{}}
+
+		err := i.change(func() error { return os.ErrPermission }, "/usr/lib/cdi/libfoo.so")
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.NotErrorIs(t, err, ErrImmutableFile)
+	})
+}
@@ -0,0 +1,116 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// InspectAppliedHooks reconstructs, as best it can, the CDI hooks currently applied to a container
+// without the original hooks file. The library directories are read from the CDI linker conf files
+// and the symlinks are the ones found directly in those directories, as this is where the CDI
+// specifications create them. The symlink targets are returned as stored in the container.
+// No library directory is reported for the musl based containers (see detectLibc).
+func InspectAppliedHooks(c instance.Container) (*Hooks, error) {
+	// Use FileSFTPNoLock so that the state can be inspected during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return inspectAppliedHooksWithFS(&sftpContainerFS{client: sftpClient})
+}
+
+// HasAppliedHooks returns whether CDI hooks are applied to the container c, that is whether one of
+// the CDI linker conf files lists a library directory. Unlike InspectAppliedHooks, only the linker
+// conf files are read, which makes it a cheap guard against applying the hooks again, e.g. when the
+// container restarts with a persistent rootfs.
+// The musl based containers never report any applied hooks (see detectLibc).
+func HasAppliedHooks(c instance.Container) (bool, error) {
+	// Use FileSFTPNoLock so that the state can be inspected during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return false, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return hasAppliedHooksWithFS(&sftpContainerFS{client: sftpClient})
+}
+
+// hasAppliedHooksWithFS is the testable core of HasAppliedHooks.
+func hasAppliedHooksWithFS(cfs containerFS) (bool, error) {
+	paths, err := cdiLinkerConfFiles(cfs)
+	if err != nil {
+		return false, err
+	}
+
+	for _, path := range paths {
+		entries, err := readLinkerConfEntries(cfs, path)
+		if err != nil {
+			return false, err
+		}
+
+		if len(entries) > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// inspectAppliedHooksWithFS is the testable core of InspectAppliedHooks.
+func inspectAppliedHooksWithFS(cfs containerFS) (*Hooks, error) {
+	dirs, err := readCDILinkerConfEntries(cfs)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := &Hooks{
+		LDCacheUpdates: normalizeLDCacheUpdates(dirs),
+		Symlinks:       []SymlinkEntry{},
+	}
+
+	if hooks.LDCacheUpdates == nil {
+		hooks.LDCacheUpdates = []string{}
+	}
+
+	for _, dir := range hooks.LDCacheUpdates {
+		files, err := cfs.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Failed listing the CDI library directory %q: %w", dir, err)
+		}
+
+		for _, file := range files {
+			if file.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+
+			link := filepath.Join(dir, file.Name())
+			target, err := cfs.Readlink(link)
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading the CDI symlink %q: %w", link, err)
+			}
+
+			hooks.Symlinks = append(hooks.Symlinks, SymlinkEntry{Target: target, Link: link})
+		}
+	}
+
+	slices.SortFunc(hooks.Symlinks, func(a SymlinkEntry, b SymlinkEntry) int {
+		return strings.Compare(a.Link, b.Link)
+	})
+
+	return hooks, nil
+}
@@ -0,0 +1,83 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectAppliedHooks(t *testing.T) {
+	t.Run("no CDI state", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks, err := inspectAppliedHooksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Empty(t, hooks.LDCacheUpdates)
+		assert.Empty(t, hooks.Symlinks)
+	})
+
+	t.Run("reconstructs applied hooks", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "nvidia"), 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libcuda.so.535"), nil, 0644)
+		require.NoError(t, err)
+
+		applied := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib/missing"},
+			Symlinks: []SymlinkEntry{
+				{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+				{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+			},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, applied)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		hooks, err := inspectAppliedHooksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib/missing"}, hooks.LDCacheUpdates)
+		assert.Equal(t, []SymlinkEntry{
+			{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+			{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+		}, hooks.Symlinks)
+	})
+}
+
+func TestHasAppliedHooks(t *testing.T) {
+	t.Run("no CDI state", func(t *testing.T) {
+		applied, err := hasAppliedHooksWithFS(&localFS{rootFS: t.TempDir()})
+		require.NoError(t, err)
+		assert.False(t, applied)
+	})
+
+	t.Run("applied hooks", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooksFile := writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}, LinkerConfSuffix: "nvidia"})
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		applied, err := hasAppliedHooksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.True(t, applied)
+	})
+
+	t.Run("empty managed block", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		require.NoError(t, os.MkdirAll(ldConfDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(ldConfDir, CDILinkerConfFile), []byte(ldConfBlock()), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(ldConfDir, "libc.conf"), []byte("/usr/local/lib\n"), 0644))
+
+		applied, err := hasAppliedHooksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.False(t, applied)
+	})
+}
@@ -0,0 +1,484 @@
+package cdi
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+const (
+	// ldCacheFile is the path of the glibc linker cache inside the container.
+	ldCacheFile = "/etc/ld.so.cache"
+
+	// ldCacheOldMagic is the magic of the legacy linker cache format, which glibc up to 2.31 writes
+	// ahead of the new format by default.
+	ldCacheOldMagic = "ld.so-1.7.0"
+	// ldCacheNewMagic is the magic and version of the new linker cache format.
+	ldCacheNewMagic = "glibc-ld.so.cache1.1"
+
+	// ldCacheOldHeaderSize and ldCacheOldEntrySize are the sizes of the legacy header and entries.
+	ldCacheOldHeaderSize = 16
+	ldCacheOldEntrySize  = 12
+	// ldCacheNewHeaderSize and ldCacheNewEntrySize are the sizes of the new header and entries.
+	ldCacheNewHeaderSize = 48
+	ldCacheNewEntrySize  = 24
+
+	// ldCacheEndianLittle and ldCacheEndianBig are the endianness flags of the new format header.
+	ldCacheEndianLittle = 2
+	ldCacheEndianBig    = 3
+
+	// ldCacheHwcapExtension marks the entries referring to a glibc-hwcaps subdirectory.
+	ldCacheHwcapExtension = uint64(1) << 62
+)
+
+// errUnsupportedLDCache is returned when the linker cache cannot be updated natively.
+var errUnsupportedLDCache = errors.New("Unsupported linker cache")
+
+// ldCacheEntry is a library entry of the glibc linker cache.
+type ldCacheEntry struct {
+	flags     int32
+	key       string
+	value     string
+	osVersion uint32
+	hwcap     uint64
+}
+
+// parseLDCache returns the entries of the glibc linker cache in data.
+// Caches in the legacy only format, in a foreign byte order or using glibc-hwcaps entries are not
+// supported.
+func parseLDCache(data []byte) ([]ldCacheEntry, error) {
+	return decodeLDCache(data, false)
+}
+
+// decodeLDCache is parseLDCache also returning the glibc-hwcaps entries when allowHwcaps is set. Their
+// key and value are as reliable as the others but the file cannot be written back natively.
+func decodeLDCache(data []byte, allowHwcaps bool) ([]ldCacheEntry, error) {
+	// Skip the legacy part of the compat format, the new format follows it aligned to 8 bytes.
+	if bytes.HasPrefix(data, []byte(ldCacheOldMagic)) {
+		if len(data) < ldCacheOldHeaderSize {
+			return nil, fmt.Errorf("%w: Truncated legacy header", errUnsupportedLDCache)
+		}
+
+		offset := ldCacheOldHeaderSize + int(binary.NativeEndian.Uint32(data[12:16]))*ldCacheOldEntrySize
+		offset = (offset + 7) &^ 7
+		if offset > len(data) {
+			return nil, fmt.Errorf("%w: Truncated legacy entries", errUnsupportedLDCache)
+		}
+
+		data = data[offset:]
+	}
+
+	if len(data) < ldCacheNewHeaderSize || !bytes.HasPrefix(data, []byte(ldCacheNewMagic)) {
+		return nil, fmt.Errorf("%w: Unknown format", errUnsupportedLDCache)
+	}
+
+	var order binary.ByteOrder
+	switch data[28] {
+	case 0:
+		order = binary.NativeEndian
+	case ldCacheEndianLittle:
+		order = binary.LittleEndian
+	case ldCacheEndianBig:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: Invalid byte order", errUnsupportedLDCache)
+	}
+
+	if order.Uint16([]byte{1, 0}) != binary.NativeEndian.Uint16([]byte{1, 0}) {
+		return nil, fmt.Errorf("%w: Foreign byte order", errUnsupportedLDCache)
+	}
+
+	nlibs := int(order.Uint32(data[20:24]))
+	if ldCacheNewHeaderSize+nlibs*ldCacheNewEntrySize > len(data) {
+		return nil, fmt.Errorf("%w: Truncated entries", errUnsupportedLDCache)
+	}
+
+	cString := func(offset uint32) (string, error) {
+		if int(offset) >= len(data) {
+			return "", fmt.Errorf("%w: String offset out of range", errUnsupportedLDCache)
+		}
+
+		end := bytes.IndexByte(data[offset:], 0)
+		if end < 0 {
+			return "", fmt.Errorf("%w: Unterminated string", errUnsupportedLDCache)
+		}
+
+		return string(data[offset : int(offset)+end]), nil
+	}
+
+	entries := make([]ldCacheEntry, 0, nlibs)
+	for i := range nlibs {
+		raw := data[ldCacheNewHeaderSize+i*ldCacheNewEntrySize:]
+
+		entry := ldCacheEntry{
+			flags:     int32(order.Uint32(raw[0:4])),
+			osVersion: order.Uint32(raw[12:16]),
+			hwcap:     order.Uint64(raw[16:24]),
+		}
+
+		if entry.hwcap&ldCacheHwcapExtension != 0 && !allowHwcaps {
+			return nil, fmt.Errorf("%w: glibc-hwcaps entries", errUnsupportedLDCache)
+		}
+
+		var err error
+		entry.key, err = cString(order.Uint32(raw[4:8]))
+		if err != nil {
+			return nil, err
+		}
+
+		entry.value, err = cString(order.Uint32(raw[8:12]))
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// dlCacheLibcmp compares two library names the way the glibc dynamic linker does, comparing the
+// runs of digits numerically.
+func dlCacheLibcmp(a string, b string) int {
+	// at returns the byte of s at i, or NUL past its end like the C string it mirrors.
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+
+		return 0
+	}
+
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+
+	i, j := 0, 0
+	for at(a, i) != 0 {
+		if isDigit(at(a, i)) {
+			if !isDigit(at(b, j)) {
+				return 1
+			}
+
+			val1, val2 := 0, 0
+			for isDigit(at(a, i)) {
+				val1 = val1*10 + int(a[i]-'0')
+				i++
+			}
+
+			for isDigit(at(b, j)) {
+				val2 = val2*10 + int(b[j]-'0')
+				j++
+			}
+
+			if val1 != val2 {
+				return val1 - val2
+			}
+		} else if isDigit(at(b, j)) {
+			return -1
+		} else if at(a, i) != at(b, j) {
+			return int(at(a, i)) - int(at(b, j))
+		} else {
+			i++
+			j++
+		}
+	}
+
+	return -int(at(b, j))
+}
+
+// sortLDCacheEntries sorts the entries in the order expected by the binary search of the glibc
+// dynamic linker.
+func sortLDCacheEntries(entries []ldCacheEntry) {
+	slices.SortStableFunc(entries, func(e1 ldCacheEntry, e2 ldCacheEntry) int {
+		res := dlCacheLibcmp(e2.key, e1.key)
+		if res != 0 {
+			return res
+		}
+
+		if e1.flags != e2.flags {
+			return int(e2.flags) - int(e1.flags)
+		}
+
+		if e1.hwcap > e2.hwcap {
+			return -1
+		} else if e1.hwcap < e2.hwcap {
+			return 1
+		}
+
+		return 0
+	})
+}
+
+// marshalLDCache returns the entries encoded in the new glibc linker cache format.
+func marshalLDCache(entries []ldCacheEntry) []byte {
+	stringsOffset := ldCacheNewHeaderSize + len(entries)*ldCacheNewEntrySize
+
+	var table bytes.Buffer
+	offsets := map[string]uint32{}
+	stringOffset := func(s string) uint32 {
+		offset, found := offsets[s]
+		if !found {
+			offset = uint32(stringsOffset + table.Len())
+			offsets[s] = offset
+			table.WriteString(s)
+			table.WriteByte(0)
+		}
+
+		return offset
+	}
+
+	endian := byte(ldCacheEndianLittle)
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		endian = ldCacheEndianBig
+	}
+
+	data := make([]byte, stringsOffset, stringsOffset+len(entries)*32)
+	copy(data, ldCacheNewMagic)
+	binary.NativeEndian.PutUint32(data[20:24], uint32(len(entries)))
+	data[28] = endian
+
+	for i, entry := range entries {
+		raw := data[ldCacheNewHeaderSize+i*ldCacheNewEntrySize:]
+		binary.NativeEndian.PutUint32(raw[0:4], uint32(entry.flags))
+		binary.NativeEndian.PutUint32(raw[4:8], stringOffset(entry.key))
+		binary.NativeEndian.PutUint32(raw[8:12], stringOffset(entry.value))
+		binary.NativeEndian.PutUint32(raw[12:16], entry.osVersion)
+		binary.NativeEndian.PutUint64(raw[16:24], entry.hwcap)
+	}
+
+	binary.NativeEndian.PutUint32(data[24:28], uint32(table.Len()))
+
+	return append(data, table.Bytes()...)
+}
+
+// ldCacheFlags returns the linker cache flags of the shared library f, as set by ldconfig.
+func ldCacheFlags(f *elf.File) (int32, error) {
+	const flagELFLibc6 = 0x0003
+
+	switch {
+	case f.Machine == elf.EM_X86_64 && f.Class == elf.ELFCLASS64:
+		return flagELFLibc6 | 0x0300, nil
+	case f.Machine == elf.EM_386:
+		return flagELFLibc6, nil
+	case f.Machine == elf.EM_AARCH64:
+		return flagELFLibc6 | 0x0a00, nil
+	case f.Machine == elf.EM_S390 && f.Class == elf.ELFCLASS64:
+		return flagELFLibc6 | 0x0400, nil
+	case f.Machine == elf.EM_PPC64:
+		return flagELFLibc6 | 0x0500, nil
+	}
+
+	return 0, fmt.Errorf("%w: Unsupported ELF machine %s", errUnsupportedLDCache, f.Machine)
+}
+
+// readLibrarySoname returns the soname and the linker cache flags of the shared library at path, or
+// an empty soname if the file is not an ELF shared library.
+func readLibrarySoname(cfs containerFS, path string) (string, int32, error) {
+	f, err := cfs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed opening the library %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return "", 0, fmt.Errorf("Failed reading the library %q: %w", path, err)
+		}
+
+		r = bytes.NewReader(content)
+	}
+
+	elfFile, err := elf.NewFile(r)
+	if err != nil || elfFile.Type != elf.ET_DYN {
+		// Not a shared library (e.g. a linker script).
+		return "", 0, nil
+	}
+
+	flags, err := ldCacheFlags(elfFile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	sonames, err := elfFile.DynString(elf.DT_SONAME)
+	if err != nil || len(sonames) == 0 {
+		return filepath.Base(path), flags, nil
+	}
+
+	return sonames[0], flags, nil
+}
+
+// scanLibraryDir returns the linker cache entries of the shared libraries in dir. Like `ldconfig -X`,
+// a library is only listed under its soname when a file with that name exists in dir.
+func scanLibraryDir(cfs containerFS, dir string) ([]ldCacheEntry, error) {
+	files, err := cfs.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing the library directory %q: %w", dir, err)
+	}
+
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+
+	entries := []ldCacheEntry{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if !file.Mode().IsRegular() && file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(file.Name(), "lib") || !strings.Contains(file.Name(), ".so") {
+			continue
+		}
+
+		soname, flags, err := readLibrarySoname(cfs, filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if soname == "" || !names[soname] {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%d", soname, flags)
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		entries = append(entries, ldCacheEntry{flags: flags, key: soname, value: filepath.Join(dir, soname)})
+	}
+
+	return entries, nil
+}
+
+// updateLDCacheNative merges the shared libraries of dirs into the linker cache of the container,
+// replacing the cache atomically so that it is never missing. The entries previously cached for dirs
+// are replaced, as are the entries of other directories providing the same sonames so that the CDI
+// libraries take precedence.
+// It returns an error wrapping errUnsupportedLDCache when the cache cannot be updated natively, in
+// which case ldconfig should be used instead.
+func updateLDCacheNative(cfs containerFS, dirs []string, l logger.Logger) error {
+	l = loggerOrNop(l)
+
+	f, err := cfs.OpenFile(ldCacheFile, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("%w: Failed opening the linker cache at %q: %w", errUnsupportedLDCache, ldCacheFile, err)
+	}
+
+	content, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed reading the linker cache at %q: %w", ldCacheFile, err)
+	}
+
+	existing, err := parseLDCache(content)
+	if err != nil {
+		return err
+	}
+
+	added := []ldCacheEntry{}
+	replaced := map[string]bool{}
+	for _, dir := range dirs {
+		dirEntries, err := scanLibraryDir(cfs, dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range dirEntries {
+			key := fmt.Sprintf("%s/%d", entry.key, entry.flags)
+			if replaced[key] {
+				continue
+			}
+
+			replaced[key] = true
+			added = append(added, entry)
+		}
+	}
+
+	cdiDirs := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		cdiDirs[filepath.Clean(dir)] = true
+	}
+
+	entries := make([]ldCacheEntry, 0, len(existing)+len(added))
+	for _, entry := range existing {
+		if cdiDirs[filepath.Dir(entry.value)] || (entry.hwcap == 0 && replaced[fmt.Sprintf("%s/%d", entry.key, entry.flags)]) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	entries = append(entries, added...)
+	sortLDCacheEntries(entries)
+
+	// Write the new cache next to the current one and move it in place like ldconfig does.
+	tmpPath := ldCacheFile + "~"
+	tmp, err := cfs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("Failed creating the linker cache at %q: %w", tmpPath, err)
+	}
+
+	_, err = tmp.Write(marshalLDCache(entries))
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	// The cache must be readable by every process of the container, whatever the umask of the host.
+	if err == nil {
+		err = cfs.Chmod(tmpPath, linkerConfFileMode)
+	}
+
+	if err != nil {
+		_ = cfs.Remove(tmpPath)
+		return fmt.Errorf("Failed writing the linker cache at %q: %w", tmpPath, err)
+	}
+
+	err = cfs.Rename(tmpPath, ldCacheFile)
+	if err != nil {
+		_ = cfs.Remove(tmpPath)
+		return fmt.Errorf("Failed replacing the linker cache at %q: %w", ldCacheFile, err)
+	}
+
+	l.Debug("Updated the linker cache in the container", logger.Ctx{"path": ldCacheFile, "entries": len(added)})
+
+	return nil
+}
+
+// updateLDCacheNativeFromConf updates the linker cache of the container natively with the directories
+// listed in the CDI linker conf files. Failures are logged rather than returned as the callers either
+// fall back to ldconfig or leave the cache to be regenerated in the container.
+// It returns whether the linker cache was updated.
+func updateLDCacheNativeFromConf(cfs containerFS, l logger.Logger) bool {
+	l = loggerOrNop(l)
+
+	dirs, err := readCDILinkerConfEntries(cfs)
+	if err == nil {
+		err = updateLDCacheNative(cfs, dirs, l)
+	}
+
+	if err != nil {
+		if errors.Is(err, errUnsupportedLDCache) {
+			l.Debug("Not updating the linker cache of the container natively", logger.Ctx{"error": err})
+		} else {
+			l.Warn("Failed updating the linker cache of the container natively", logger.Ctx{"error": err})
+		}
+
+		return false
+	}
+
+	return true
+}
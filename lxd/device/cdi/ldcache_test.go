@@ -0,0 +1,159 @@
+package cdi
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSharedLibrary writes a minimal x86_64 ELF shared library with the given soname at path.
+func writeSharedLibrary(t *testing.T, path string, soname string) {
+	t.Helper()
+
+	dynstr := append([]byte{0}, append([]byte(soname), 0)...)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	var dynamic bytes.Buffer
+	for _, dyn := range []elf.Dyn64{{Tag: int64(elf.DT_SONAME), Val: 1}, {Tag: int64(elf.DT_NULL)}} {
+		require.NoError(t, binary.Write(&dynamic, binary.LittleEndian, dyn))
+	}
+
+	dynstrOffset := uint64(64)
+	dynamicOffset := (dynstrOffset + uint64(len(dynstr)) + 7) &^ 7
+	shstrtabOffset := dynamicOffset + uint64(dynamic.Len())
+	shOffset := (shstrtabOffset + uint64(len(shstrtab)) + 7) &^ 7
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shOffset,
+		Ehsize:    64,
+		Phentsize: 56,
+		Shentsize: 64,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOffset, Size: uint64(len(dynstr)), Addralign: 1},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Off: dynamicOffset, Size: uint64(dynamic.Len()), Link: 1, Addralign: 8, Entsize: 16},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOffset, Size: uint64(len(shstrtab)), Addralign: 1},
+	}
+
+	content := make([]byte, shOffset)
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, header))
+	copy(content, buf.Bytes())
+	copy(content[dynstrOffset:], dynstr)
+	copy(content[dynamicOffset:], dynamic.Bytes())
+	copy(content[shstrtabOffset:], shstrtab)
+
+	buf.Reset()
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, sections))
+	content = append(content, buf.Bytes()...)
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, content, 0644))
+}
+
+func TestDlCacheLibcmp(t *testing.T) {
+	assert.Positive(t, dlCacheLibcmp("libfoo.so.10", "libfoo.so.9"))
+	assert.Negative(t, dlCacheLibcmp("libfoo.so.9", "libfoo.so.10"))
+	assert.Zero(t, dlCacheLibcmp("libfoo.so.1", "libfoo.so.1"))
+	assert.Negative(t, dlCacheLibcmp("libfoo.so", "libfoo.so.1"))
+	assert.Positive(t, dlCacheLibcmp("libfoo.so.1", "libfoo.so"))
+	assert.Positive(t, dlCacheLibcmp("libfoo1.so", "libfoo.so"))
+	assert.Negative(t, dlCacheLibcmp("libbar.so", "libfoo.so"))
+}
+
+func TestParseLDCache(t *testing.T) {
+	entries := []ldCacheEntry{
+		{flags: 0x0303, key: "libc.so.6", value: "/lib/x86_64-linux-gnu/libc.so.6"},
+		{flags: 0x0003, key: "libc.so.6", value: "/lib/i386-linux-gnu/libc.so.6", osVersion: 1},
+	}
+
+	parsed, err := parseLDCache(marshalLDCache(entries))
+	require.NoError(t, err)
+	assert.Equal(t, entries, parsed)
+
+	_, err = parseLDCache([]byte("not a linker cache"))
+	assert.ErrorIs(t, err, errUnsupportedLDCache)
+
+	// The legacy part of the compat format is skipped.
+	legacy := make([]byte, ldCacheOldHeaderSize+ldCacheOldEntrySize)
+	copy(legacy, ldCacheOldMagic)
+	binary.NativeEndian.PutUint32(legacy[12:16], 1)
+	legacy = append(legacy, make([]byte, 4)...)
+	parsed, err = parseLDCache(append(legacy, marshalLDCache(entries)...))
+	require.NoError(t, err)
+	assert.Equal(t, entries, parsed)
+
+	hwcaps := marshalLDCache([]ldCacheEntry{{flags: 0x0303, key: "libc.so.6", value: "/lib/libc.so.6", hwcap: ldCacheHwcapExtension}})
+	_, err = parseLDCache(hwcaps)
+	assert.ErrorIs(t, err, errUnsupportedLDCache)
+}
+
+func TestUpdateLDCacheNative(t *testing.T) {
+	t.Run("merges the CDI libraries", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		existing := []ldCacheEntry{
+			{flags: 0x0303, key: "libc.so.6", value: "/lib/x86_64-linux-gnu/libc.so.6"},
+			{flags: 0x0303, key: "libcuda.so.1", value: "/lib/x86_64-linux-gnu/libcuda.so.1"},
+			{flags: 0x0303, key: "libold.so.1", value: "/usr/lib/nvidia/libold.so.1"},
+		}
+
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), marshalLDCache(existing), 0644))
+
+		libDir := filepath.Join(tmpDir, "usr", "lib", "nvidia")
+		writeSharedLibrary(t, filepath.Join(libDir, "libcuda.so.535"), "libcuda.so.1")
+		require.NoError(t, os.Symlink("libcuda.so.535", filepath.Join(libDir, "libcuda.so.1")))
+		require.NoError(t, os.Symlink("libcuda.so.1", filepath.Join(libDir, "libcuda.so")))
+		// The soname link of this library does not exist, so it is not cached.
+		writeSharedLibrary(t, filepath.Join(libDir, "libnvml.so.535"), "libnvml.so.1")
+		require.NoError(t, os.WriteFile(filepath.Join(libDir, "libscript.so"), []byte("INPUT(libcuda.so.1)\n"), 0644))
+
+		err := updateLDCacheNative(&localFS{rootFS: tmpDir}, []string{"/usr/lib/nvidia"}, nil)
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+
+		entries, err := parseLDCache(content)
+		require.NoError(t, err)
+		assert.Equal(t, []ldCacheEntry{
+			{flags: 0x0303, key: "libcuda.so.1", value: "/usr/lib/nvidia/libcuda.so.1"},
+			{flags: 0x0303, key: "libc.so.6", value: "/lib/x86_64-linux-gnu/libc.so.6"},
+		}, entries)
+
+		assert.NoFileExists(t, filepath.Join(tmpDir, "etc", "ld.so.cache~"))
+	})
+
+	t.Run("unsupported cache", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		err := updateLDCacheNative(&localFS{rootFS: tmpDir}, []string{"/usr/lib/nvidia"}, nil)
+		assert.ErrorIs(t, err, errUnsupportedLDCache)
+		assert.False(t, updateLDCacheNativeFromConf(&localFS{rootFS: tmpDir}, nil))
+
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), []byte("ld.so-1.7.0"), 0644))
+
+		err = updateLDCacheNative(&localFS{rootFS: tmpDir}, []string{"/usr/lib/nvidia"}, nil)
+		assert.ErrorIs(t, err, errUnsupportedLDCache)
+	})
+}
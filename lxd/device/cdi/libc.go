@@ -0,0 +1,302 @@
+package cdi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// LibcFlavor represents the C library implementation used by a container.
+type LibcFlavor int
+
+const (
+	// LibcFlavorGlibc is the GNU C library, using ld.so.conf.d and ld.so.cache.
+	LibcFlavorGlibc LibcFlavor = iota
+	// LibcFlavorMusl is the musl C library (e.g. Alpine), using /etc/ld-musl-<arch>.path and no cache.
+	LibcFlavorMusl
+)
+
+// String returns the name of the C library.
+func (f LibcFlavor) String() string {
+	if f == LibcFlavorMusl {
+		return "musl"
+	}
+
+	return "glibc"
+}
+
+// libcInfo is the C library detected in a container.
+type libcInfo struct {
+	flavor LibcFlavor
+	// muslArch is the architecture of the musl dynamic linker, for musl containers.
+	muslArch string
+}
+
+// muslDefaultLibraryDirs is the search path used by the musl dynamic linker when no path file exists.
+var muslDefaultLibraryDirs = []string{"/lib", "/usr/local/lib", "/usr/lib"}
+
+// muslLoaderArch returns the architecture of the musl dynamic linker found in /lib
+// (e.g. "x86_64" for /lib/ld-musl-x86_64.so.1), or an empty string if there is none.
+func muslLoaderArch(cfs containerFS) (string, error) {
+	entries, err := cfs.ReadDir("/lib")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Failed listing the library directory %q: %w", "/lib", err)
+	}
+
+	for _, entry := range entries {
+		name, found := strings.CutPrefix(entry.Name(), "ld-musl-")
+		if !found {
+			continue
+		}
+
+		arch, _, found := strings.Cut(name, ".so")
+		if found && arch != "" {
+			return arch, nil
+		}
+	}
+
+	return "", nil
+}
+
+// DetectLibcFlavor detects the C library used by a container by looking for the musl dynamic linker,
+// defaulting to glibc otherwise.
+func DetectLibcFlavor(c instance.Container) (LibcFlavor, error) {
+	// Use FileSFTPNoLock so that the detection can happen during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return LibcFlavorGlibc, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return detectLibcFlavor(&sftpContainerFS{client: sftpClient})
+}
+
+// detectLibcFlavor is the testable core of DetectLibcFlavor.
+func detectLibcFlavor(cfs containerFS) (LibcFlavor, error) {
+	libc, err := detectLibc(cfs)
+	return libc.flavor, err
+}
+
+// detectLibc detects the C library used by a container along with the architecture of its musl
+// dynamic linker, so that it is only looked up once.
+// Musl based containers share their path file with the rest of the system, so the entry points
+// working from the CDI linker conf files, like InspectAppliedHooks, HasAppliedHooks and
+// PruneBrokenCDILinks, find no CDI library directory in them.
+func detectLibc(cfs containerFS) (libcInfo, error) {
+	arch, err := muslLoaderArch(cfs)
+	if err != nil {
+		return libcInfo{flavor: LibcFlavorGlibc}, err
+	}
+
+	if arch != "" {
+		return libcInfo{flavor: LibcFlavorMusl, muslArch: arch}, nil
+	}
+
+	return libcInfo{flavor: LibcFlavorGlibc}, nil
+}
+
+// muslPathFilePath returns the path of the musl dynamic linker path file for the given architecture.
+func muslPathFilePath(arch string) string {
+	return "/etc/ld-musl-" + arch + ".path"
+}
+
+// readMuslPathFile returns the library directories listed in the musl path file at path.
+// The musl dynamic linker accepts both newlines and colons as separators.
+func readMuslPathFile(cfs containerFS, path string) ([]byte, []string, error) {
+	f, err := cfs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed reading the musl path file at %q: %w", path, err)
+	}
+
+	dirs := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		for dir := range strings.SplitSeq(scanner.Text(), ":") {
+			dir = strings.TrimSpace(dir)
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	if scanner.Err() != nil {
+		return nil, nil, fmt.Errorf("Failed reading the musl path file at %q: %w", path, scanner.Err())
+	}
+
+	return content, dirs, nil
+}
+
+// writeMuslPathFile replaces the content of the musl path file at path with the given directories.
+func writeMuslPathFile(cfs containerFS, path string, dirs []string) error {
+	f, err := cfs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("Failed opening the musl path file at %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	for _, dir := range dirs {
+		_, err = fmt.Fprintln(f, dir)
+		if err != nil {
+			return fmt.Errorf("Failed writing to the musl path file at %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// updateMuslPathFile adds the given library directories to the musl path file, ahead of the
+// existing ones so that the CDI libraries take precedence. When the file does not exist yet, it is
+// created with the default musl search path following the CDI entries.
+// The path is the one of the path file of the musl dynamic linker of the container.
+// It returns the entries that were added.
+func updateMuslPathFile(tx *hooksTransaction, path string, updates []string) ([]string, error) {
+	content, existingDirs, err := readMuslPathFile(tx.cfs, path)
+	created := errors.Is(err, fs.ErrNotExist)
+	if created {
+		existingDirs = muslDefaultLibraryDirs
+	} else if err != nil {
+		return nil, err
+	}
+
+	existingEntries := make(map[string]bool, len(existingDirs))
+	for _, dir := range existingDirs {
+		existingEntries[dir] = true
+	}
+
+	newDirs := []string{}
+	for _, update := range updates {
+		if !existingEntries[update] {
+			newDirs = append(newDirs, update)
+			existingEntries[update] = true
+		}
+	}
+
+	if len(newDirs) == 0 {
+		tx.l.Debug("CDI musl path file entries already present", logger.Ctx{"path": path, "entries": updates})
+		return nil, nil
+	}
+
+	// Restore the original state on rollback.
+	tx.record(func() error {
+		if created {
+			err := tx.cfs.Remove(path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed removing the musl path file at %q: %w", path, err)
+			}
+
+			return nil
+		}
+
+		f, err := tx.cfs.OpenFile(path, os.O_WRONLY|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("Failed opening the musl path file at %q: %w", path, err)
+		}
+
+		defer f.Close()
+
+		_, err = f.Write(content)
+		if err != nil {
+			return fmt.Errorf("Failed restoring the musl path file at %q: %w", path, err)
+		}
+
+		return nil
+	})
+
+	err = tx.MkdirAll(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating the directory for the musl path file: %w", err)
+	}
+
+	err = writeMuslPathFile(tx.cfs, path, append(newDirs, existingDirs...))
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		// The mode the file was created with depends on the umask of the host.
+		err = tx.cfs.Chmod(path, linkerConfFileMode)
+		if err != nil {
+			return nil, fmt.Errorf("Failed changing the mode of the musl path file at %q: %w", path, err)
+		}
+	}
+
+	tx.l.Debug("Added CDI musl path file entries", logger.Ctx{"path": path, "entries": newDirs})
+
+	return newDirs, nil
+}
+
+// removeMuslPathFileEntries removes the given library directories from the musl path file of the
+// musl dynamic linker for arch.
+// The default musl search path is always kept as the file is shared with the rest of the system.
+// It returns whether any entry was removed.
+func removeMuslPathFileEntries(cfs containerFS, arch string, updates []string) (bool, error) {
+	if arch == "" {
+		return false, nil
+	}
+
+	path, err := resolveContainerFilePath(cfs, muslPathFilePath(arch))
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	_, existingDirs, err := readMuslPathFile(cfs, path)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	removedEntries := make(map[string]bool, len(updates))
+	for _, update := range updates {
+		removedEntries[update] = true
+	}
+
+	for _, dir := range muslDefaultLibraryDirs {
+		delete(removedEntries, dir)
+	}
+
+	remainingDirs := make([]string, 0, len(existingDirs))
+	for _, dir := range existingDirs {
+		if !removedEntries[dir] {
+			remainingDirs = append(remainingDirs, dir)
+		}
+	}
+
+	if len(remainingDirs) == len(existingDirs) {
+		return false, nil
+	}
+
+	err = writeMuslPathFile(cfs, path, remainingDirs)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
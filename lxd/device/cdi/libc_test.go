@@ -0,0 +1,131 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createMuslRootFS creates the musl dynamic linker inside rootFS.
+func createMuslRootFS(t *testing.T, rootFS string) {
+	t.Helper()
+
+	libDir := filepath.Join(rootFS, "lib")
+	err := os.MkdirAll(libDir, 0755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(libDir, "ld-musl-x86_64.so.1"), nil, 0755)
+	require.NoError(t, err)
+}
+
+func TestDetectLibcFlavor(t *testing.T) {
+	t.Run("glibc when no musl loader", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		flavor, err := detectLibcFlavor(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, LibcFlavorGlibc, flavor)
+	})
+
+	t.Run("musl when musl loader present", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createMuslRootFS(t, tmpDir)
+
+		flavor, err := detectLibcFlavor(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, LibcFlavorMusl, flavor)
+		assert.Equal(t, "musl", flavor.String())
+
+		libc, err := detectLibc(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, libcInfo{flavor: LibcFlavorMusl, muslArch: "x86_64"}, libc)
+	})
+}
+
+func TestApplyHooksToMuslContainer(t *testing.T) {
+	t.Run("creates musl path file with default search path", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createMuslRootFS(t, tmpDir)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}}
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, regenerateLDCache, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld-musl-x86_64.path"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/lib/nvidia\n/lib\n/usr/local/lib\n/usr/lib\n", string(content))
+
+		assert.NoDirExists(t, filepath.Join(tmpDir, "etc", "ld.so.conf.d"))
+	})
+
+	t.Run("musl path file behind a symlinked /etc", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createMuslRootFS(t, tmpDir)
+		require.NoError(t, os.Symlink("/usr/etc", filepath.Join(tmpDir, "etc")))
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}}
+		hooksFile := writeHooksFile(t, t.TempDir(), hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		pathFile := filepath.Join(tmpDir, "usr", "etc", "ld-musl-x86_64.path")
+		assert.FileExists(t, pathFile)
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(pathFile)
+		require.NoError(t, err)
+		assert.Equal(t, "/lib\n/usr/local/lib\n/usr/lib\n", string(content))
+	})
+
+	t.Run("prepends to existing musl path file without duplicates", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createMuslRootFS(t, tmpDir)
+
+		pathFile := filepath.Join(tmpDir, "etc", "ld-musl-x86_64.path")
+		err := os.MkdirAll(filepath.Dir(pathFile), 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(pathFile, []byte("/lib:/usr/lib\n"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib", "/usr/lib/nvidia"}}
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(pathFile)
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/lib/nvidia\n/lib\n/usr/lib\n", string(content))
+
+		_, err = removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		content, err = os.ReadFile(pathFile)
+		require.NoError(t, err)
+		assert.Equal(t, "/lib\n/usr/lib\n", string(content))
+	})
+
+	t.Run("writes musl path file in the writable root", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createMuslRootFS(t, tmpDir)
+
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/nvidia"}}
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{WritableRoot: "/upper"})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "upper", "etc", "ld-musl-x86_64.path"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/lib/nvidia\n/lib\n/usr/local/lib\n/usr/lib\n", string(content))
+	})
+}
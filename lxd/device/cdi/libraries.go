@@ -0,0 +1,90 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// LibraryEntry is a library known to the dynamic linker of a container, as listed by `ldconfig -p`.
+type LibraryEntry struct {
+	// Soname is the name the library is looked up by.
+	Soname string `json:"soname" yaml:"soname"`
+	// Arch is the ABI of the library, like "libc6,x86-64".
+	Arch string `json:"arch" yaml:"arch"`
+	// Path is the path of the library inside the container, as recorded in the linker cache.
+	Path string `json:"path" yaml:"path"`
+	// ResolvedPath is the file Path leads to once its symlinks are followed, or empty if it does not
+	// exist.
+	ResolvedPath string `json:"resolved_path" yaml:"resolved_path"`
+}
+
+// WalkContainerLibraries returns the libraries the dynamic linker of the container c knows about, in
+// the order of its linker cache. This is what the loader of the container sees when looking a library
+// up by its soname, which helps telling why a library provided by the CDI hooks is not found. Musl
+// based containers have no linker cache.
+func WalkContainerLibraries(c instance.Container) ([]LibraryEntry, error) {
+	// Use FileSFTPNoLock so that the libraries can be listed during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return walkContainerLibrariesWithFS(&sftpContainerFS{client: sftpClient})
+}
+
+// walkContainerLibrariesWithFS is the testable core of WalkContainerLibraries.
+func walkContainerLibrariesWithFS(cfs containerFS) ([]LibraryEntry, error) {
+	content, err := readContainerFile(cfs, ldCacheFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the linker cache %q: %w", ldCacheFile, err)
+	}
+
+	entries, err := parseLDCache(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing the linker cache %q: %w", ldCacheFile, err)
+	}
+
+	libraries := make([]LibraryEntry, 0, len(entries))
+	for _, entry := range entries {
+		library := LibraryEntry{
+			Soname: entry.key,
+			Arch:   ldCacheFlagsArch(entry.flags),
+			Path:   entry.value,
+		}
+
+		library.ResolvedPath, err = resolveContainerPath(cfs, entry.value)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Failed resolving the library %q: %w", entry.value, err)
+		}
+
+		libraries = append(libraries, library)
+	}
+
+	return libraries, nil
+}
+
+// ldCacheFlagsArch returns the ABI described by the linker cache flags, the way `ldconfig -p` prints it.
+func ldCacheFlagsArch(flags int32) string {
+	const flagELFLibc6 = 0x0003
+
+	arch := "unknown"
+	if flags&0x00ff == flagELFLibc6 {
+		arch = "libc6"
+	}
+
+	switch flags & 0xff00 {
+	case 0x0300:
+		arch += ",x86-64"
+	case 0x0400, 0x0500:
+		arch += ",64bit"
+	case 0x0a00:
+		arch += ",AArch64"
+	}
+
+	return arch
+}
@@ -0,0 +1,67 @@
+package cdi
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkContainerLibraries(t *testing.T) {
+	t.Run("libraries of the linker cache are listed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cfs := &localFS{rootFS: tmpDir}
+
+		createLibrary(t, tmpDir, "/usr/lib/x86_64-linux-gnu/libcuda.so.535.104.05")
+		require.NoError(t, os.Symlink("libcuda.so.535.104.05", filepath.Join(tmpDir, "usr/lib/x86_64-linux-gnu/libcuda.so.1")))
+
+		entries := []ldCacheEntry{
+			{flags: 0x0303, key: "libcuda.so.1", value: "/usr/lib/x86_64-linux-gnu/libcuda.so.1"},
+			{flags: 0x0003, key: "libgone.so.1", value: "/usr/lib/i386-linux-gnu/libgone.so.1"},
+		}
+
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), marshalLDCache(entries), 0644))
+
+		libraries, err := walkContainerLibrariesWithFS(cfs)
+		require.NoError(t, err)
+		assert.Equal(t, []LibraryEntry{
+			{Soname: "libcuda.so.1", Arch: "libc6,x86-64", Path: "/usr/lib/x86_64-linux-gnu/libcuda.so.1", ResolvedPath: "/usr/lib/x86_64-linux-gnu/libcuda.so.535.104.05"},
+			{Soname: "libgone.so.1", Arch: "libc6", Path: "/usr/lib/i386-linux-gnu/libgone.so.1"},
+		}, libraries)
+	})
+
+	t.Run("missing linker cache", func(t *testing.T) {
+		_, err := walkContainerLibrariesWithFS(&localFS{rootFS: t.TempDir()})
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("invalid linker cache", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), []byte("garbage"), 0644))
+
+		_, err := walkContainerLibrariesWithFS(&localFS{rootFS: tmpDir})
+		assert.ErrorIs(t, err, errUnsupportedLDCache)
+	})
+}
+
+func TestLdCacheFlagsArch(t *testing.T) {
+	tests := []struct {
+		flags int32
+		want  string
+	}{
+		{flags: 0x0303, want: "libc6,x86-64"},
+		{flags: 0x0003, want: "libc6"},
+		{flags: 0x0a03, want: "libc6,AArch64"},
+		{flags: 0x0403, want: "libc6,64bit"},
+		{flags: 0x0001, want: "unknown"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, ldCacheFlagsArch(test.flags))
+	}
+}
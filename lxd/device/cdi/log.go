@@ -50,3 +50,39 @@ func (l *CDILogger) Debugf(format string, args ...any) {
 func (l *CDILogger) Tracef(format string, args ...any) {
 	l.lxdLogger.Trace(fmt.Sprintf(format, args...))
 }
+
+// nopLogger is a logger discarding all messages, used when no logger is given to the CDI hooks functions.
+type nopLogger struct{}
+
+// Panic discards the message.
+func (nopLogger) Panic(msg string, args ...logger.Ctx) {}
+
+// Fatal discards the message.
+func (nopLogger) Fatal(msg string, args ...logger.Ctx) {}
+
+// Error discards the message.
+func (nopLogger) Error(msg string, args ...logger.Ctx) {}
+
+// Warn discards the message.
+func (nopLogger) Warn(msg string, args ...logger.Ctx) {}
+
+// Info discards the message.
+func (nopLogger) Info(msg string, args ...logger.Ctx) {}
+
+// Debug discards the message.
+func (nopLogger) Debug(msg string, args ...logger.Ctx) {}
+
+// Trace discards the message.
+func (nopLogger) Trace(msg string, args ...logger.Ctx) {}
+
+// AddContext returns the same discarding logger.
+func (l nopLogger) AddContext(logger.Ctx) logger.Logger { return l }
+
+// loggerOrNop returns l, or a logger discarding all messages if l is nil.
+func loggerOrNop(l logger.Logger) logger.Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+
+	return l
+}
@@ -0,0 +1,216 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// ApplyHooksManifest applies the CDI hooks of several files to a container, like calling
+// ApplyHooksToContainer for each of them in order, but regenerates the linker cache only once at the
+// end. The hooks are merged with mergeHooksFiles before anything is changed so that conflicting
+// files leave the container untouched.
+// The changes made to the container are logged at the debug level to l. A nil logger disables logging.
+func ApplyHooksManifest(hooksFilePaths []string, c instance.Container, l logger.Logger) error {
+	start := time.Now()
+	hooks, err := mergeHooksFiles(hooksFilePaths)
+	if err != nil {
+		return err
+	}
+
+	decode := time.Since(start)
+
+	unlock, err := lockHooks(context.Background(), c)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	cfs := &sftpContainerFS{client: sftpClient}
+
+	result, regenerateLDCache, err := applyLoadedHooksWithFS(context.Background(), hooks, cfs, ApplyOptions{Logger: l, Rollback: true, rootFS: containerRootFS(c)})
+	if err != nil {
+		return err
+	}
+
+	result.Timings.Decode = decode
+
+	if len(result.PendingDeviceNodes) > 0 && c.IsPrivileged() {
+		err = createContainerDeviceNodes(containerRootFS(c), result, l)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ldconfigErr error
+	if regenerateLDCache {
+		start = time.Now()
+		result.LdconfigRan, result.Warnings, ldconfigErr = updateLDCache(context.Background(), c, cfs, l, "", 0, nil, "")
+		result.Timings.LDCache = time.Since(start)
+	}
+
+	countApplyResult(result, ldconfigErr)
+	logApplyTimings(l, result.Timings)
+
+	return nil
+}
+
+// mergeHooksFiles loads the CDI hooks files at hooksFilePaths and merges them in order into a
+// single set of hooks with MergeHooks.
+func mergeHooksFiles(hooksFilePaths []string) (*Hooks, error) {
+	merged := &Hooks{}
+	for i, hooksFilePath := range hooksFilePaths {
+		hooks, err := loadHooksFile(hooksFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		merged, err = MergeHooks(merged, hooks)
+		if err != nil {
+			return nil, fmt.Errorf("Failed merging the CDI hooks file %q with %q: %w", hooksFilePath, hooksFilePaths[:i], err)
+		}
+	}
+
+	return merged, nil
+}
+
+// MergeHooks merges the CDI hooks b into a, neither of them being modified. The library directories
+// are concatenated, a's first, and only kept once. The symlinks listed by both are only kept once too.
+// A link with different targets or kinds in a and b is a conflict, as are two different container
+// rootfs and two different linker conf file suffixes since the merged hooks use a single linker conf
+// file. The device nodes listed by both are only kept once and a path with different nodes is a
+// conflict too, as is a library directory with different architectures. The relative library directories are resolved against the base of their own hooks.
+func MergeHooks(a, b *Hooks) (*Hooks, error) {
+	merged := &Hooks{}
+	links := make(map[string]SymlinkEntry)
+	nodes := make(map[string]DeviceNode)
+
+	for _, hooks := range []*Hooks{a, b} {
+		if hooks == nil {
+			continue
+		}
+
+		for _, symlink := range hooks.Symlinks {
+			link := filepath.Clean(symlink.Link)
+
+			existing, found := links[link]
+			if !found {
+				links[link] = symlink
+				merged.Symlinks = append(merged.Symlinks, symlink)
+				continue
+			}
+
+			if absoluteSymlinkTarget(link, existing.Target) != absoluteSymlinkTarget(link, symlink.Target) || symlinkKind(existing) != symlinkKind(symlink) {
+				return nil, fmt.Errorf("Conflicting CDI symlink %q: %q and %q", link, existing.Target, symlink.Target)
+			}
+		}
+
+		for _, node := range hooks.DeviceNodes {
+			path := filepath.Clean(node.Path)
+
+			existing, found := nodes[path]
+			if !found {
+				nodes[path] = node
+				merged.DeviceNodes = append(merged.DeviceNodes, node)
+				continue
+			}
+
+			if existing != node {
+				return nil, fmt.Errorf("Conflicting CDI device node %q", path)
+			}
+		}
+
+		if hooks.ContainerRootFS != "" {
+			if merged.ContainerRootFS != "" && filepath.Clean(merged.ContainerRootFS) != filepath.Clean(hooks.ContainerRootFS) {
+				return nil, fmt.Errorf("Conflicting CDI container rootfs: %q and %q", merged.ContainerRootFS, hooks.ContainerRootFS)
+			}
+
+			merged.ContainerRootFS = hooks.ContainerRootFS
+		}
+
+		if hooks.LinkerConfSuffix != "" {
+			if merged.LinkerConfSuffix != "" && merged.LinkerConfSuffix != hooks.LinkerConfSuffix {
+				return nil, fmt.Errorf("Conflicting CDI linker conf file suffix: %q and %q", merged.LinkerConfSuffix, hooks.LinkerConfSuffix)
+			}
+
+			merged.LinkerConfSuffix = hooks.LinkerConfSuffix
+		}
+
+		if hooks.LinkerConfPriority != 0 {
+			if merged.LinkerConfPriority != 0 && merged.LinkerConfPriority != hooks.LinkerConfPriority {
+				return nil, fmt.Errorf("Conflicting CDI linker conf file priority: %d and %d", merged.LinkerConfPriority, hooks.LinkerConfPriority)
+			}
+
+			merged.LinkerConfPriority = hooks.LinkerConfPriority
+		}
+
+		updates, err := resolveLDCacheUpdates(hooks.LDCacheUpdates, hooks.LDCacheBase)
+		if err != nil {
+			return nil, err
+		}
+
+		archs, err := resolveLDCacheArchs(hooks.LDCacheArchs, hooks.LDCacheBase)
+		if err != nil {
+			return nil, err
+		}
+
+		for dir, arch := range archs {
+			existing, found := merged.LDCacheArchs[dir]
+			if found && existing != arch {
+				return nil, fmt.Errorf("Conflicting CDI library directory architecture %q: %q and %q", dir, existing, arch)
+			}
+
+			if merged.LDCacheArchs == nil {
+				merged.LDCacheArchs = make(map[string]string)
+			}
+
+			merged.LDCacheArchs[dir] = arch
+		}
+
+		conditions, err := resolveLDCacheArchs(hooks.LDCacheConditions, hooks.LDCacheBase)
+		if err != nil {
+			return nil, err
+		}
+
+		for dir, condition := range conditions {
+			existing, found := merged.LDCacheConditions[dir]
+			if found && existing != condition {
+				return nil, fmt.Errorf("Conflicting CDI library directory condition %q: %q and %q", dir, existing, condition)
+			}
+
+			if merged.LDCacheConditions == nil {
+				merged.LDCacheConditions = make(map[string]string)
+			}
+
+			merged.LDCacheConditions[dir] = condition
+		}
+
+		merged.LDCacheUpdates = append(merged.LDCacheUpdates, updates...)
+	}
+
+	merged.LDCacheUpdates = normalizeLDCacheUpdates(merged.LDCacheUpdates)
+
+	return merged, nil
+}
+
+// symlinkKind returns the kind of link symlink creates.
+func symlinkKind(symlink SymlinkEntry) string {
+	if symlink.Kind == "" {
+		return SymlinkKindSymlink
+	}
+
+	return symlink.Kind
+}
@@ -0,0 +1,156 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeHooksFiles(t *testing.T) {
+	t.Run("deduplicates symlinks and entries across files", func(t *testing.T) {
+		first := writeHooksFile(t, t.TempDir(), Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib32/nvidia"},
+		})
+
+		second := writeHooksFile(t, t.TempDir(), Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/nvidia/", "/usr/lib/extra"},
+		})
+
+		hooks, err := mergeHooksFiles([]string{first, second})
+		require.NoError(t, err)
+
+		assert.Equal(t, []SymlinkEntry{
+			{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+		}, hooks.Symlinks)
+		assert.Equal(t, []string{"/usr/lib/nvidia", "/usr/lib32/nvidia", "/usr/lib/extra"}, hooks.LDCacheUpdates)
+
+		// The merged hooks apply as a single batch.
+		rootFS := t.TempDir()
+		_, regenerateLDCache, err := applyLoadedHooksWithFS(t.Context(), hooks, &localFS{rootFS: rootFS}, ApplyOptions{Rollback: true})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+
+		content, err := os.ReadFile(filepath.Join(rootFS, "etc", "ld.so.conf.d", CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, ldConfBlock("/usr/lib/nvidia", "/usr/lib32/nvidia", "/usr/lib/extra"), string(content))
+	})
+
+	t.Run("conflicting symlinks name both files", func(t *testing.T) {
+		first := writeHooksFile(t, t.TempDir(), Hooks{
+			Symlinks: []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+		})
+
+		second := writeHooksFile(t, t.TempDir(), Hooks{
+			Symlinks: []SymlinkEntry{{Target: "/usr/lib/libfoo.so.2", Link: "/usr/lib/libfoo.so"}},
+		})
+
+		_, err := mergeHooksFiles([]string{first, second})
+		assert.ErrorContains(t, err, `Conflicting CDI symlink "/usr/lib/libfoo.so"`)
+		assert.ErrorContains(t, err, first)
+		assert.ErrorContains(t, err, second)
+	})
+
+	t.Run("conflicting linker conf file suffixes error", func(t *testing.T) {
+		first := writeHooksFile(t, t.TempDir(), Hooks{LinkerConfSuffix: "gpu0"})
+		second := writeHooksFile(t, t.TempDir(), Hooks{LinkerConfSuffix: "gpu1"})
+
+		_, err := mergeHooksFiles([]string{first, second})
+		assert.ErrorContains(t, err, "Conflicting CDI linker conf file suffix")
+	})
+}
+
+func TestMergeHooks(t *testing.T) {
+	t.Run("union without duplicates", func(t *testing.T) {
+		a := &Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/c1/rootfs",
+			Symlinks:        []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+			LDCacheUpdates:  []string{"/usr/lib/nvidia", "/usr/lib32/nvidia"},
+		}
+
+		b := &Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/c1/rootfs/",
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "libbar.so.1", Link: "/opt/amd/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"lib", "/usr/lib/nvidia/"},
+			LDCacheBase:    "/opt/amd",
+		}
+
+		merged, err := MergeHooks(a, b)
+		require.NoError(t, err)
+		assert.Equal(t, &Hooks{
+			ContainerRootFS: "/var/lib/lxd/containers/c1/rootfs/",
+			Symlinks: []SymlinkEntry{
+				{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "libbar.so.1", Link: "/opt/amd/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/nvidia", "/usr/lib32/nvidia", "/opt/amd/lib"},
+		}, merged)
+
+		// The inputs are left untouched.
+		assert.Equal(t, []string{"lib", "/usr/lib/nvidia/"}, b.LDCacheUpdates)
+		assert.Len(t, a.Symlinks, 1)
+	})
+
+	t.Run("nil hooks", func(t *testing.T) {
+		a := &Hooks{LDCacheUpdates: []string{"/usr/lib"}}
+
+		merged, err := MergeHooks(a, nil)
+		require.NoError(t, err)
+		assert.Equal(t, a, merged)
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		tests := []struct {
+			name string
+			b    *Hooks
+			err  string
+		}{
+			{
+				name: "symlink target",
+				b:    &Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.2", Link: "/usr/lib/libfoo.so"}}},
+				err:  `Conflicting CDI symlink "/usr/lib/libfoo.so": "libfoo.so.1" and "libfoo.so.2"`,
+			},
+			{
+				name: "symlink kind",
+				b:    &Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so", Kind: SymlinkKindHardlink}}},
+				err:  `Conflicting CDI symlink "/usr/lib/libfoo.so"`,
+			},
+			{
+				name: "container rootfs",
+				b:    &Hooks{ContainerRootFS: "/var/lib/lxd/containers/c2/rootfs"},
+				err:  "Conflicting CDI container rootfs",
+			},
+			{
+				name: "linker conf file suffix",
+				b:    &Hooks{LinkerConfSuffix: "amd"},
+				err:  "Conflicting CDI linker conf file suffix",
+			},
+		}
+
+		a := &Hooks{
+			ContainerRootFS:  "/var/lib/lxd/containers/c1/rootfs",
+			Symlinks:         []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+			LinkerConfSuffix: "nvidia",
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := MergeHooks(a, tt.b)
+				assert.ErrorContains(t, err, tt.err)
+			})
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package cdi
+
+import (
+	"sync/atomic"
+)
+
+// HookOutcome represents an outcome of applying CDI hooks to a container, counted for the metrics.
+type HookOutcome int8
+
+// This defines every possible hook outcome to be used as a metric label.
+const (
+	HookOutcomeSymlinkCreated HookOutcome = iota
+	HookOutcomeSymlinkSkipped
+	HookOutcomeSymlinkRepaired
+	HookOutcomeLdCacheRegenerated
+	HookOutcomeLdconfigFailed
+)
+
+var hookOutcomeNames = map[HookOutcome]string{
+	HookOutcomeSymlinkCreated:     "symlink_created",
+	HookOutcomeSymlinkSkipped:     "symlink_skipped",
+	HookOutcomeSymlinkRepaired:    "symlink_repaired",
+	HookOutcomeLdCacheRegenerated: "ld_cache_regenerated",
+	HookOutcomeLdconfigFailed:     "ldconfig_failed",
+}
+
+var hookOutcomes = func() map[HookOutcome]*atomic.Int64 {
+	counters := make(map[HookOutcome]*atomic.Int64, len(hookOutcomeNames))
+	for outcome := range hookOutcomeNames {
+		counters[outcome] = new(atomic.Int64)
+	}
+
+	return counters
+}()
+
+// GetHookOutcomesNames returns a map containing all possible hook outcomes and their names.
+// This is also used to iterate through the possible outcomes.
+func GetHookOutcomesNames() map[HookOutcome]string {
+	return hookOutcomeNames
+}
+
+// GetHookOutcomes gets the number of times outcome happened since LXD started.
+func GetHookOutcomes(outcome HookOutcome) int64 {
+	return hookOutcomes[outcome].Load()
+}
+
+// countHookOutcome adds n occurrences of outcome.
+func countHookOutcome(outcome HookOutcome, n int) {
+	hookOutcomes[outcome].Add(int64(n))
+}
+
+// countApplyResult counts the outcomes of applying CDI hooks described by result, ldconfigErr being the
+// failure of the linker cache regeneration, if any.
+func countApplyResult(result *ApplyResult, ldconfigErr error) {
+	countHookOutcome(HookOutcomeSymlinkCreated, len(result.CreatedSymlinks)-len(result.RepairedSymlinks))
+	countHookOutcome(HookOutcomeSymlinkRepaired, len(result.RepairedSymlinks))
+	countHookOutcome(HookOutcomeSymlinkSkipped, len(result.SkippedSymlinks))
+
+	if result.LdconfigRan || result.LdCacheWritten {
+		countHookOutcome(HookOutcomeLdCacheRegenerated, 1)
+	}
+
+	if ldconfigErr != nil {
+		countHookOutcome(HookOutcomeLdconfigFailed, 1)
+	}
+}
@@ -0,0 +1,32 @@
+package cdi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountApplyResult(t *testing.T) {
+	before := make(map[HookOutcome]int64, len(GetHookOutcomesNames()))
+	for outcome := range GetHookOutcomesNames() {
+		before[outcome] = GetHookOutcomes(outcome)
+	}
+
+	result := &ApplyResult{
+		CreatedSymlinks: []SymlinkEntry{
+			{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+		},
+		RepairedSymlinks: []string{"/usr/lib/libbar.so"},
+		SkippedSymlinks:  []SymlinkEntry{{Target: "/usr/lib/libbaz.so.1", Link: "/usr/lib/libbaz.so"}},
+	}
+
+	countApplyResult(result, errors.New("ldconfig failed"))
+
+	assert.Equal(t, before[HookOutcomeSymlinkCreated]+1, GetHookOutcomes(HookOutcomeSymlinkCreated))
+	assert.Equal(t, before[HookOutcomeSymlinkRepaired]+1, GetHookOutcomes(HookOutcomeSymlinkRepaired))
+	assert.Equal(t, before[HookOutcomeSymlinkSkipped]+1, GetHookOutcomes(HookOutcomeSymlinkSkipped))
+	assert.Equal(t, before[HookOutcomeLdCacheRegenerated], GetHookOutcomes(HookOutcomeLdCacheRegenerated))
+	assert.Equal(t, before[HookOutcomeLdconfigFailed]+1, GetHookOutcomes(HookOutcomeLdconfigFailed))
+}
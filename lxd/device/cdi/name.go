@@ -0,0 +1,61 @@
+package cdi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// EncodeDeviceName builds the name of a device created for a CDI passthrough
+// (e.g. cdi.unix.<device_name>.<encoded_dest_path>) from one of the CDIUnixPrefix or CDIDiskPrefix
+// prefixes, the name of the CDI device and the destination path in the container.
+// The destination path is base64url encoded so that it never contains dots or slashes and can be
+// recovered with DecodeDeviceName.
+func EncodeDeviceName(prefix string, deviceName string, destPath string) string {
+	return prefix + "." + deviceName + "." + base64.RawURLEncoding.EncodeToString([]byte(destPath))
+}
+
+// DecodeDeviceName splits a device name built by EncodeDeviceName into its prefix, CDI device name
+// and destination path.
+func DecodeDeviceName(name string) (prefix string, deviceName string, destPath string, err error) {
+	var rest string
+	for _, p := range []string{CDIUnixPrefix, CDIDiskPrefix} {
+		after, found := strings.CutPrefix(name, p+".")
+		if found {
+			prefix = p
+			rest = after
+			break
+		}
+	}
+
+	if prefix == "" {
+		return "", "", "", fmt.Errorf("Invalid CDI device name %q: Unknown prefix", name)
+	}
+
+	// The encoded destination path never contains a dot, so the device name is everything up to the last one.
+	deviceName, encodedDestPath, found := cutLast(rest, ".")
+	if !found {
+		return "", "", "", fmt.Errorf("Invalid CDI device name %q: Missing destination path", name)
+	}
+
+	if deviceName == "" {
+		return "", "", "", fmt.Errorf("Invalid CDI device name %q: Empty device name", name)
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encodedDestPath)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Invalid CDI device name %q: Failed decoding destination path: %w", name, err)
+	}
+
+	return prefix, deviceName, string(decoded), nil
+}
+
+// cutLast slices s around the last instance of sep, returning the text before and after sep.
+func cutLast(s string, sep string) (before string, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,58 @@
+package cdi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeDeviceName(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string
+		deviceName string
+		destPath   string
+	}{
+		{"Unix device", CDIUnixPrefix, "gpu0", "/dev/nvidia0"},
+		{"Disk with dots", CDIDiskPrefix, "gpu0", "/usr/lib/x86_64-linux-gnu/libcuda.so.1"},
+		{"Disk with spaces", CDIDiskPrefix, "gpu0", "/opt/my libs/lib foo.so"},
+		{"Device name with dots", CDIDiskPrefix, "my.gpu", "/usr/lib/libfoo.so"},
+		{"Relative path", CDIDiskPrefix, "gpu0", "usr/lib/../lib/libfoo.so"},
+		{"Empty path", CDIUnixPrefix, "gpu0", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := EncodeDeviceName(tt.prefix, tt.deviceName, tt.destPath)
+			assert.NotContains(t, encoded, "/")
+
+			prefix, deviceName, destPath, err := DecodeDeviceName(encoded)
+			require.NoError(t, err)
+			assert.Equal(t, tt.prefix, prefix)
+			assert.Equal(t, tt.deviceName, deviceName)
+			assert.Equal(t, tt.destPath, destPath)
+		})
+	}
+}
+
+func TestDecodeDeviceNameInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"Unknown prefix", "cdi.foo.gpu0.L2Rldg", "Unknown prefix"},
+		{"Prefix only", "cdi.unix.", "Missing destination path"},
+		{"Missing destination path", "cdi.unix.gpu0", "Missing destination path"},
+		{"Empty device name", "cdi.unix..L2Rldg", "Empty device name"},
+		{"Invalid encoding", "cdi.disk.gpu0.not/base64", "Failed decoding destination path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := DecodeDeviceName(tt.input)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
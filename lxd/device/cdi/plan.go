@@ -0,0 +1,314 @@
+package cdi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// PlannedActionType is the kind of change described by a PlannedAction.
+type PlannedActionType string
+
+const (
+	// PlannedActionCreateDirectory is the creation of a missing directory.
+	PlannedActionCreateDirectory PlannedActionType = "create-directory"
+	// PlannedActionCreateSymlink is the creation (or replacement) of a symlink.
+	PlannedActionCreateSymlink PlannedActionType = "create-symlink"
+	// PlannedActionAddLDCacheEntry is the addition of a library directory to the linker configuration.
+	PlannedActionAddLDCacheEntry PlannedActionType = "add-ld-cache-entry"
+)
+
+// PlannedAction describes a change that ApplyHooksToContainer would make to a container.
+type PlannedAction struct {
+	// Type is the kind of change.
+	Type PlannedActionType `json:"type" yaml:"type"`
+	// Path is the directory, the symlink or the linker configuration file being changed.
+	Path string `json:"path" yaml:"path"`
+	// Target is the symlink target (relative to the link) or the library directory to add.
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+	// Exists indicates whether a symlink already exists at Path or whether the library
+	// directory is already listed in the linker configuration.
+	Exists bool `json:"exists" yaml:"exists"`
+	// CurrentTarget is the target of the symlink already existing at Path.
+	CurrentTarget string `json:"current_target,omitempty" yaml:"current_target,omitempty"`
+	// TargetMatches indicates whether the symlink already existing at Path points at Target.
+	TargetMatches bool `json:"target_matches" yaml:"target_matches"`
+}
+
+// ApplyHooksToContainerDryRun returns the changes ApplyHooksToContainer would make to a container
+// without modifying it.
+func ApplyHooksToContainerDryRun(hooksFilePath string, c instance.Container) ([]PlannedAction, error) {
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return planHooksWithFS(hooksFilePath, &sftpContainerFS{client: sftpClient})
+}
+
+// planHooksWithFS is the testable core of ApplyHooksToContainerDryRun.
+func planHooksWithFS(hooksFilePath string, cfs containerFS) ([]PlannedAction, error) {
+	hooks, err := loadHooksFile(hooksFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return planLoadedHooksWithFS(hooks, cfs)
+}
+
+// planLoadedHooksWithFS plans the already loaded hooks like planHooksWithFS.
+func planLoadedHooksWithFS(hooks *Hooks, cfs containerFS) ([]PlannedAction, error) {
+	libc, err := detectLibc(cfs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed detecting the C library of the container: %w", err)
+	}
+
+	hooks, _, _, err = filterConditionalHooks(cfs, hooks, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err = resolveSonameTargets(cfs, hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := []PlannedAction{}
+	plannedDirs := make(map[string]bool)
+	planDir := func(path string) error {
+		dirs, err := missingDirs(cfs, path)
+		if err != nil {
+			return fmt.Errorf("Failed checking the directory %q: %w", path, err)
+		}
+
+		for _, dir := range dirs {
+			if !plannedDirs[dir] {
+				plannedDirs[dir] = true
+				plan = append(plan, PlannedAction{Type: PlannedActionCreateDirectory, Path: dir})
+			}
+		}
+
+		return nil
+	}
+
+	for _, symlink := range hooks.Symlinks {
+		target, err := resolveTarget(symlink.Link, symlink.Target, symlink.KeepAbsolute)
+		if err != nil {
+			return nil, fmt.Errorf("Failed resolving a CDI symlink: %w", err)
+		}
+
+		err = planDir(filepath.Dir(symlink.Link))
+		if err != nil {
+			return nil, err
+		}
+
+		action := PlannedAction{Type: PlannedActionCreateSymlink, Path: symlink.Link, Target: target}
+
+		fileInfo, err := cfs.Lstat(symlink.Link)
+		if err == nil && fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+			currentTarget, err := cfs.Readlink(symlink.Link)
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading existing CDI symlink path %q: %w", symlink.Link, err)
+			}
+
+			action.Exists = true
+			action.CurrentTarget = currentTarget
+			action.TargetMatches = currentTarget == target
+		}
+
+		plan = append(plan, action)
+	}
+
+	if len(hooks.LDCacheUpdates) == 0 {
+		return plan, nil
+	}
+
+	var confFilePath string
+	var existingEntries []string
+	if libc.flavor == LibcFlavorMusl {
+		err = planDir("/etc")
+		if err != nil {
+			return nil, err
+		}
+
+		confFilePath = muslPathFilePath(libc.muslArch)
+		_, existingEntries, err = readMuslPathFile(cfs, confFilePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The path file is created with the default search path.
+			existingEntries = muslDefaultLibraryDirs
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		err = planDir(linkerConfDir)
+		if err != nil {
+			return nil, err
+		}
+
+		confFilePath, err = linkerConfFilePath(hooks.LinkerConfSuffix, hooks.LinkerConfPriority)
+		if err != nil {
+			return nil, err
+		}
+
+		existingEntries, err = readLinkerConfEntries(cfs, confFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listed := make(map[string]bool, len(existingEntries))
+	for _, entry := range existingEntries {
+		listed[entry] = true
+	}
+
+	for _, update := range hooks.LDCacheUpdates {
+		plan = append(plan, PlannedAction{Type: PlannedActionAddLDCacheEntry, Path: confFilePath, Target: update, Exists: listed[update]})
+		listed[update] = true
+	}
+
+	return plan, nil
+}
+
+const (
+	// PlanFormatText renders a plan as tables grouped by kind of change, for operators.
+	PlanFormatText = "text"
+	// PlanFormatJSON renders a plan as a versioned JSON document, for automation.
+	PlanFormatJSON = "json"
+)
+
+// planJSONVersion is the version of the JSON document written by RenderPlan. It is bumped whenever a
+// change to the document could break its consumers.
+const planJSONVersion = 1
+
+// planJSON is the JSON document written by RenderPlan.
+type planJSON struct {
+	Version int             `json:"version"`
+	Actions []PlannedAction `json:"actions"`
+}
+
+// RenderPlan writes the plan returned by ApplyHooksToContainerDryRun to w in the given format, either
+// PlanFormatText or PlanFormatJSON. The text lists the symlinks, the directories and the linker cache
+// entries in separate tables, while the JSON document keeps the actions in the order they would be
+// applied along with the version of the document.
+func RenderPlan(plan []PlannedAction, w io.Writer, format string) error {
+	switch format {
+	case PlanFormatText:
+		return renderPlanText(plan, w)
+	case PlanFormatJSON:
+		doc := planJSON{Version: planJSONVersion, Actions: plan}
+		if doc.Actions == nil {
+			doc.Actions = []PlannedAction{}
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		err := encoder.Encode(doc)
+		if err != nil {
+			return fmt.Errorf("Failed writing the CDI hooks plan: %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("Unknown CDI hooks plan format %q", format)
+	}
+}
+
+// renderPlanText writes plan to w as one table per kind of change.
+func renderPlanText(plan []PlannedAction, w io.Writer) error {
+	groups := []struct {
+		title      string
+		actionType PlannedActionType
+		header     string
+		row        func(action PlannedAction) string
+	}{
+		{
+			title:      "Symlinks",
+			actionType: PlannedActionCreateSymlink,
+			header:     "LINK\tTARGET\tACTION",
+			row: func(action PlannedAction) string {
+				switch {
+				case action.TargetMatches:
+					return action.Path + "\t" + action.Target + "\tnone"
+				case action.Exists:
+					return action.Path + "\t" + action.Target + "\treplace (currently " + action.CurrentTarget + ")"
+				default:
+					return action.Path + "\t" + action.Target + "\tcreate"
+				}
+			},
+		},
+		{
+			title:      "Directories",
+			actionType: PlannedActionCreateDirectory,
+			header:     "PATH\tACTION",
+			row: func(action PlannedAction) string {
+				return action.Path + "\tcreate"
+			},
+		},
+		{
+			title:      "Linker cache",
+			actionType: PlannedActionAddLDCacheEntry,
+			header:     "FILE\tDIRECTORY\tACTION",
+			row: func(action PlannedAction) string {
+				if action.Exists {
+					return action.Path + "\t" + action.Target + "\tnone"
+				}
+
+				return action.Path + "\t" + action.Target + "\tadd"
+			},
+		},
+	}
+
+	written := false
+	for _, group := range groups {
+		rows := []string{}
+		for _, action := range plan {
+			if action.Type == group.actionType {
+				rows = append(rows, group.row(action))
+			}
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		if written {
+			_, err := io.WriteString(w, "\n")
+			if err != nil {
+				return fmt.Errorf("Failed writing the CDI hooks plan: %w", err)
+			}
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintf(tw, "%s:\n  %s\n", group.title, group.header)
+		for _, row := range rows {
+			_, _ = fmt.Fprintf(tw, "  %s\n", row)
+		}
+
+		err := tw.Flush()
+		if err != nil {
+			return fmt.Errorf("Failed writing the CDI hooks plan: %w", err)
+		}
+
+		written = true
+	}
+
+	if !written {
+		_, err := io.WriteString(w, "No changes\n")
+		if err != nil {
+			return fmt.Errorf("Failed writing the CDI hooks plan: %w", err)
+		}
+	}
+
+	return nil
+}
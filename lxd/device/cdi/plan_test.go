@@ -0,0 +1,169 @@
+package cdi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHooksToContainerDryRun(t *testing.T) {
+	t.Run("plans all changes on an empty rootfs", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/x86_64/libfoo.so.1", Link: "/usr/lib/x86_64/libfoo.so"},
+				{Target: "/usr/lib/x86_64/libbar.so.1", Link: "/usr/lib/x86_64/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib/x86_64"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		plan, err := planHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		expected := []PlannedAction{
+			{Type: PlannedActionCreateDirectory, Path: "/usr"},
+			{Type: PlannedActionCreateDirectory, Path: "/usr/lib"},
+			{Type: PlannedActionCreateDirectory, Path: "/usr/lib/x86_64"},
+			{Type: PlannedActionCreateSymlink, Path: "/usr/lib/x86_64/libfoo.so", Target: "libfoo.so.1"},
+			{Type: PlannedActionCreateSymlink, Path: "/usr/lib/x86_64/libbar.so", Target: "libbar.so.1"},
+			{Type: PlannedActionCreateDirectory, Path: "/etc"},
+			{Type: PlannedActionCreateDirectory, Path: "/etc/ld.so.conf.d"},
+			{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib/x86_64"},
+		}
+
+		assert.Equal(t, expected, plan)
+
+		// The rootfs must not have been modified.
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("reports existing symlinks and ld cache entries", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		linkDir := filepath.Join(tmpDir, "usr", "lib")
+		err := os.MkdirAll(linkDir, 0755)
+		require.NoError(t, err)
+		err = os.Symlink("libfoo.so.1", filepath.Join(linkDir, "libfoo.so"))
+		require.NoError(t, err)
+		err = os.Symlink("libbar.so.0", filepath.Join(linkDir, "libbar.so"))
+		require.NoError(t, err)
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		err = os.MkdirAll(ldConfDir, 0755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(ldConfDir, CDILinkerConfFile), []byte("/usr/lib\n"), 0644)
+		require.NoError(t, err)
+
+		hooks := Hooks{
+			Symlinks: []SymlinkEntry{
+				{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+				{Target: "/usr/lib/libbar.so.1", Link: "/usr/lib/libbar.so"},
+			},
+			LDCacheUpdates: []string{"/usr/lib", "/usr/lib/nvidia"},
+		}
+
+		hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+		plan, err := planHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		expected := []PlannedAction{
+			{Type: PlannedActionCreateSymlink, Path: "/usr/lib/libfoo.so", Target: "libfoo.so.1", Exists: true, CurrentTarget: "libfoo.so.1", TargetMatches: true},
+			{Type: PlannedActionCreateSymlink, Path: "/usr/lib/libbar.so", Target: "libbar.so.1", Exists: true, CurrentTarget: "libbar.so.0"},
+			{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib", Exists: true},
+			{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib/nvidia"},
+		}
+
+		assert.Equal(t, expected, plan)
+	})
+}
+
+func TestRenderPlan(t *testing.T) {
+	plan := []PlannedAction{
+		{Type: PlannedActionCreateDirectory, Path: "/usr/lib/nvidia"},
+		{Type: PlannedActionCreateSymlink, Path: "/usr/lib/nvidia/libcuda.so", Target: "libcuda.so.1"},
+		{Type: PlannedActionCreateSymlink, Path: "/usr/lib/libfoo.so", Target: "libfoo.so.2", Exists: true, CurrentTarget: "libfoo.so.1"},
+		{Type: PlannedActionCreateSymlink, Path: "/usr/lib/libbar.so", Target: "libbar.so.1", Exists: true, CurrentTarget: "libbar.so.1", TargetMatches: true},
+		{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib/nvidia"},
+		{Type: PlannedActionAddLDCacheEntry, Path: "/etc/ld.so.conf.d/" + CDILinkerConfFile, Target: "/usr/lib", Exists: true},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := RenderPlan(plan, &buf, PlanFormatText)
+		require.NoError(t, err)
+
+		expected := `Symlinks:
+  LINK                        TARGET        ACTION
+  /usr/lib/nvidia/libcuda.so  libcuda.so.1  create
+  /usr/lib/libfoo.so          libfoo.so.2   replace (currently libfoo.so.1)
+  /usr/lib/libbar.so          libbar.so.1   none
+
+Directories:
+  PATH             ACTION
+  /usr/lib/nvidia  create
+
+Linker cache:
+  FILE                              DIRECTORY        ACTION
+  /etc/ld.so.conf.d/00-lxdcdi.conf  /usr/lib/nvidia  add
+  /etc/ld.so.conf.d/00-lxdcdi.conf  /usr/lib         none
+`
+		assert.Equal(t, expected, buf.String())
+	})
+
+	t.Run("text without changes", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := RenderPlan(nil, &buf, PlanFormatText)
+		require.NoError(t, err)
+		assert.Equal(t, "No changes\n", buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := RenderPlan(plan[:2], &buf, PlanFormatJSON)
+		require.NoError(t, err)
+
+		expected := `{
+  "version": 1,
+  "actions": [
+    {
+      "type": "create-directory",
+      "path": "/usr/lib/nvidia",
+      "exists": false,
+      "target_matches": false
+    },
+    {
+      "type": "create-symlink",
+      "path": "/usr/lib/nvidia/libcuda.so",
+      "target": "libcuda.so.1",
+      "exists": false,
+      "target_matches": false
+    }
+  ]
+}
+`
+		assert.Equal(t, expected, buf.String())
+	})
+
+	t.Run("json without changes", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := RenderPlan(nil, &buf, PlanFormatJSON)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"version": 1, "actions": []}`, buf.String())
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		err := RenderPlan(plan, io.Discard, "yaml")
+		assert.ErrorContains(t, err, `Unknown CDI hooks plan format "yaml"`)
+	})
+}
@@ -0,0 +1,72 @@
+package cdi
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// checkAllowedDirs checks that the parent directory of every symlink of hooks and every library
+// directory of hooks is within one of the allowed directories (see ApplyOptions.AllowedDirs). The
+// directories are checked as listed and once the symlinks of the container are followed, so that a
+// symlink to /etc under an allowed directory does not defeat the policy.
+func checkAllowedDirs(cfs containerFS, hooks *Hooks, allowed []string) error {
+	check := func(dir string, what string) error {
+		dir = filepath.Clean(dir)
+		if !isAllowedDir(dir, allowed) {
+			return withKindf(ErrDirNotAllowed, "The %s %q is not within the allowed directories", what, dir)
+		}
+
+		resolved, err := resolveExistingPath(cfs, dir)
+		if err != nil {
+			return fmt.Errorf("Failed resolving the %s %q: %w", what, dir, err)
+		}
+
+		if !isAllowedDir(resolved, allowed) {
+			return withKindf(ErrDirNotAllowed, "The %s %q resolves to %q, which is not within the allowed directories", what, dir, resolved)
+		}
+
+		return nil
+	}
+
+	for _, symlink := range hooks.Symlinks {
+		err := check(filepath.Dir(filepath.Clean(symlink.Link)), "directory of the CDI symlink")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, update := range hooks.LDCacheUpdates {
+		err := check(update, "CDI library directory")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isAllowedDir returns whether the absolute path dir is one of the allowed directories or one of their
+// descendants.
+func isAllowedDir(dir string, allowed []string) bool {
+	return slices.ContainsFunc(allowed, func(prefix string) bool { return isUnderMount(dir, filepath.Clean(prefix)) })
+}
+
+// resolveExistingPath resolves the symlinks of the container path p like resolveContainerPath, the
+// missing part of it, which would be created as directories, being kept as it is.
+func resolveExistingPath(cfs containerFS, p string) (string, error) {
+	missing := ""
+	for {
+		resolved, err := resolveContainerPath(cfs, p)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+
+		if !isMissingPath(err) || p == "/" {
+			return "", err
+		}
+
+		missing = filepath.Join(filepath.Base(p), missing)
+		p = filepath.Dir(p)
+	}
+}
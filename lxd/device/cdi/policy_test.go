@@ -0,0 +1,87 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHooksAllowedDirs(t *testing.T) {
+	allowed := []string{"/usr/lib", "/opt/nvidia/"}
+
+	tests := []struct {
+		name    string
+		hooks   Hooks
+		setup   func(t *testing.T, rootFS string)
+		wantErr string
+	}{
+		{
+			name: "allowed directories",
+			hooks: Hooks{
+				Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/x86_64-linux-gnu/libfoo.so"}},
+				LDCacheUpdates: []string{"/opt/nvidia/lib", "/usr/lib"},
+			},
+		},
+		{
+			name:    "symlink outside of the allowed directories",
+			hooks:   Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/etc/libfoo.so"}}},
+			wantErr: `The directory of the CDI symlink "/etc" is not within the allowed directories`,
+		},
+		{
+			name:    "library directory outside of the allowed directories",
+			hooks:   Hooks{LDCacheUpdates: []string{"/bin"}},
+			wantErr: `The CDI library directory "/bin" is not within the allowed directories`,
+		},
+		{
+			name:    "sibling of an allowed directory",
+			hooks:   Hooks{LDCacheUpdates: []string{"/usr/lib64"}},
+			wantErr: "is not within the allowed directories",
+		},
+		{
+			name:  "symlink to outside of the allowed directories",
+			hooks: Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/etc/nvidia/libfoo.so"}}},
+			setup: func(t *testing.T, rootFS string) {
+				require.NoError(t, os.MkdirAll(filepath.Join(rootFS, "etc"), 0755))
+				require.NoError(t, os.Symlink("/etc", filepath.Join(rootFS, "usr", "lib", "etc")))
+			},
+			wantErr: `resolves to "/etc/nvidia"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib"), 0755))
+			if tt.setup != nil {
+				tt.setup(t, tmpDir)
+			}
+
+			_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), tt.hooks), &localFS{rootFS: tmpDir}, ApplyOptions{AllowedDirs: allowed})
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrDirNotAllowed)
+			assert.ErrorContains(t, err, tt.wantErr)
+
+			// Nothing is changed.
+			_, err = os.Lstat(filepath.Join(tmpDir, "etc", "ld.so.conf.d"))
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+
+	t.Run("relative allowed directory", func(t *testing.T) {
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{}), &localFS{rootFS: t.TempDir()}, ApplyOptions{AllowedDirs: []string{"usr/lib"}})
+		assert.ErrorContains(t, err, `The allowed directory "usr/lib" is not an absolute path`)
+	})
+
+	t.Run("empty allowlist", func(t *testing.T) {
+		hooks := Hooks{LDCacheUpdates: []string{"/usr/lib"}}
+		_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: t.TempDir()}, ApplyOptions{AllowedDirs: []string{}})
+		assert.ErrorIs(t, err, ErrDirNotAllowed)
+	})
+}
@@ -0,0 +1,139 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// PruneBrokenCDILinks removes the CDI symlinks of the container c whose targets do not exist
+// anymore, e.g. once an image update or a device change removed the libraries they pointed at, and
+// returns the paths of the removed symlinks inside the container. Like InspectAppliedHooks, the
+// symlinks looked at are the ones found directly in the library directories of the CDI linker conf
+// files, as this is where the CDI specifications create them. Only the symlinks with a relative
+// target are removed, the absolute ones being left to their owner. Nothing is pruned in the musl
+// based containers (see detectLibc). The changes are made under a lock of the rootfs, using SFTP,
+// and the linker cache is updated with updateLDCache.
+func PruneBrokenCDILinks(c instance.Container) ([]string, error) {
+	unlock, err := lockHooks(context.Background(), c)
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	cfs := &sftpContainerFS{client: sftpClient}
+
+	pruned, err := pruneBrokenCDILinksWithFS(cfs)
+	if err != nil {
+		return pruned, err
+	}
+
+	if len(pruned) > 0 {
+		_, _, _ = updateLDCache(context.Background(), c, cfs, nil, "", 0, nil, "")
+	}
+
+	return pruned, nil
+}
+
+// pruneBrokenCDILinksWithFS is the testable core of PruneBrokenCDILinks. On failure, it returns the
+// symlinks removed so far along with the error.
+func pruneBrokenCDILinksWithFS(cfs containerFS) ([]string, error) {
+	dirs, err := readCDILinkerConfEntries(cfs)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, dir := range dirs {
+		resolvedDir, err := resolveContainerPath(cfs, dir)
+		if err != nil {
+			if isMissingPath(err) {
+				continue
+			}
+
+			return pruned, fmt.Errorf("Failed resolving the CDI library directory %q: %w", dir, err)
+		}
+
+		files, err := cfs.ReadDir(resolvedDir)
+		if err != nil {
+			if isMissingPath(err) {
+				continue
+			}
+
+			return pruned, fmt.Errorf("Failed listing the CDI library directory %q: %w", dir, err)
+		}
+
+		for _, file := range files {
+			if file.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+
+			link := filepath.Join(resolvedDir, file.Name())
+			if slices.Contains(pruned, link) {
+				// The directory was already listed through another path.
+				continue
+			}
+
+			broken, err := isBrokenRelativeSymlink(cfs, link)
+			if err != nil {
+				return pruned, err
+			}
+
+			if !broken {
+				continue
+			}
+
+			err = cfs.Remove(link)
+			if err != nil && !isMissingPath(err) {
+				return pruned, fmt.Errorf("Failed removing the broken CDI symlink %q: %w", link, err)
+			}
+
+			pruned = append(pruned, link)
+		}
+	}
+
+	slices.Sort(pruned)
+
+	return pruned, nil
+}
+
+// isBrokenRelativeSymlink returns whether the symlink at link inside the container has a relative
+// target that does not exist.
+func isBrokenRelativeSymlink(cfs containerFS, link string) (bool, error) {
+	target, err := cfs.Readlink(link)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed reading the CDI symlink %q: %w", link, err)
+	}
+
+	if filepath.IsAbs(target) {
+		return false, nil
+	}
+
+	_, err = resolveContainerPath(cfs, link)
+	if err != nil {
+		if isMissingPath(err) {
+			return true, nil
+		}
+
+		return false, fmt.Errorf("Failed resolving the CDI symlink %q: %w", link, err)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,66 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneBrokenCDILinks(t *testing.T) {
+	setup := func(t *testing.T) string {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libcuda.so.535")
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.535")
+
+		hooksFile := writeHooksFile(t, tmpDir, Hooks{
+			LDCacheUpdates: []string{"/usr/lib/nvidia"},
+			Symlinks: []SymlinkEntry{
+				{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+				{Target: "libcuda.so.1", Link: "/usr/lib/nvidia/libcuda.so"},
+				{Target: "libnvidia-ml.so.535", Link: "/usr/lib/nvidia/libnvidia-ml.so.1"},
+			},
+		})
+
+		_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+
+		return tmpDir
+	}
+
+	t.Run("nothing to prune", func(t *testing.T) {
+		tmpDir := setup(t)
+
+		pruned, err := pruneBrokenCDILinksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Empty(t, pruned)
+	})
+
+	t.Run("prunes the broken symlinks", func(t *testing.T) {
+		tmpDir := setup(t)
+		libDir := filepath.Join(tmpDir, "usr", "lib", "nvidia")
+
+		// The driver update removed the libraries of the previous version.
+		require.NoError(t, os.Remove(filepath.Join(libDir, "libcuda.so.535")))
+
+		// Neither the absolute symlinks nor the ones outside of the CDI library directories are pruned.
+		require.NoError(t, os.Symlink("/usr/lib/nvidia/libmissing.so.1", filepath.Join(libDir, "libabsolute.so")))
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "other"), 0755))
+		require.NoError(t, os.Symlink("libmissing.so.1", filepath.Join(tmpDir, "usr", "lib", "other", "libmissing.so")))
+
+		pruned, err := pruneBrokenCDILinksWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/nvidia/libcuda.so", "/usr/lib/nvidia/libcuda.so.1"}, pruned)
+
+		for _, link := range pruned {
+			assert.NoFileExists(t, filepath.Join(tmpDir, link))
+		}
+
+		for _, link := range []string{"/usr/lib/nvidia/libnvidia-ml.so.1", "/usr/lib/nvidia/libabsolute.so", "/usr/lib/other/libmissing.so"} {
+			_, err := os.Lstat(filepath.Join(tmpDir, link))
+			assert.NoError(t, err, link)
+		}
+	})
+}
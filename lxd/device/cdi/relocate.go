@@ -0,0 +1,70 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+)
+
+// RelocateHooks returns a copy of hooks for the container rootfs now mounted at newMount on the host
+// instead of oldMount, as after a migration or a remount. The ContainerRootFS of the hooks is the only
+// host path they hold and, when set, it must be oldMount. The symlinks and library directories are
+// paths inside the container so they are kept as they are, but one of them referring to oldMount
+// means that the hooks leaked a host path, which cannot be relocated safely, and is an error.
+// hooks is not modified.
+func RelocateHooks(oldMount string, newMount string, hooks *Hooks) (*Hooks, error) {
+	if hooks == nil {
+		return nil, errors.New("No CDI hooks to relocate")
+	}
+
+	for _, mount := range []string{oldMount, newMount} {
+		if !filepath.IsAbs(mount) {
+			return nil, fmt.Errorf("The container rootfs mount %q is not an absolute path", mount)
+		}
+	}
+
+	oldMount = filepath.Clean(oldMount)
+	newMount = filepath.Clean(newMount)
+
+	relocated := *hooks
+	relocated.LDCacheUpdates = slices.Clone(hooks.LDCacheUpdates)
+	relocated.Symlinks = slices.Clone(hooks.Symlinks)
+	relocated.LDCacheArchs = maps.Clone(hooks.LDCacheArchs)
+	relocated.LDCacheConditions = maps.Clone(hooks.LDCacheConditions)
+
+	if hooks.ContainerRootFS != "" {
+		if filepath.Clean(hooks.ContainerRootFS) != oldMount {
+			return nil, fmt.Errorf("The CDI hooks are for the container rootfs %q and not %q", hooks.ContainerRootFS, oldMount)
+		}
+
+		relocated.ContainerRootFS = newMount
+	}
+
+	for _, symlink := range hooks.Symlinks {
+		for _, path := range []string{symlink.Link, absoluteSymlinkTarget(filepath.Clean(symlink.Link), symlink.Target)} {
+			if isUnderMount(path, oldMount) {
+				return nil, fmt.Errorf("The CDI symlink %q refers to the container rootfs mount %q", symlink.Link, oldMount)
+			}
+		}
+	}
+
+	for _, update := range append([]string{hooks.LDCacheBase}, hooks.LDCacheUpdates...) {
+		if isUnderMount(update, oldMount) {
+			return nil, fmt.Errorf("The CDI library directory %q refers to the container rootfs mount %q", update, oldMount)
+		}
+	}
+
+	return &relocated, nil
+}
+
+// isUnderMount returns whether the absolute path p is mount or one of its descendants.
+func isUnderMount(p string, mount string) bool {
+	if !filepath.IsAbs(p) {
+		return false
+	}
+
+	rel, err := filepath.Rel(mount, filepath.Clean(p))
+	return err == nil && filepath.IsLocal(rel)
+}
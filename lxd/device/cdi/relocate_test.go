@@ -0,0 +1,98 @@
+package cdi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelocateHooks(t *testing.T) {
+	oldMount := "/var/snap/lxd/common/lxd/containers/c1/rootfs"
+	newMount := "/var/snap/lxd/common/lxd/storage-pools/default/containers/c1/rootfs"
+
+	hooks := func() *Hooks {
+		return &Hooks{
+			ContainerRootFS: oldMount + "/",
+			LDCacheUpdates:  []string{"/usr/lib/cdi"},
+			Symlinks:        []SymlinkEntry{{Target: "libfoo.so.1.2", Link: "/usr/lib/cdi/libfoo.so.1"}},
+		}
+	}
+
+	t.Run("container rootfs is relocated", func(t *testing.T) {
+		original := hooks()
+
+		relocated, err := RelocateHooks(oldMount, newMount, original)
+		require.NoError(t, err)
+		assert.Equal(t, newMount, relocated.ContainerRootFS)
+		assert.Equal(t, original.LDCacheUpdates, relocated.LDCacheUpdates)
+		assert.Equal(t, original.Symlinks, relocated.Symlinks)
+
+		// The original hooks are left untouched.
+		assert.Equal(t, hooks(), original)
+		relocated.Symlinks[0].Link = "/changed"
+		assert.Equal(t, "/usr/lib/cdi/libfoo.so.1", original.Symlinks[0].Link)
+	})
+
+	t.Run("hooks without a container rootfs", func(t *testing.T) {
+		original := hooks()
+		original.ContainerRootFS = ""
+
+		relocated, err := RelocateHooks(oldMount, newMount, original)
+		require.NoError(t, err)
+		assert.Empty(t, relocated.ContainerRootFS)
+	})
+
+	tests := []struct {
+		name     string
+		oldMount string
+		newMount string
+		modify   func(hooks *Hooks)
+		wantErr  string
+	}{
+		{name: "nil hooks", oldMount: oldMount, newMount: newMount, wantErr: "No CDI hooks to relocate"},
+		{name: "relative old mount", oldMount: "rootfs", newMount: newMount, modify: func(*Hooks) {}, wantErr: "is not an absolute path"},
+		{name: "relative new mount", oldMount: oldMount, newMount: "rootfs", modify: func(*Hooks) {}, wantErr: "is not an absolute path"},
+		{name: "other container rootfs", oldMount: "/var/lib/lxd/containers/c2/rootfs", newMount: newMount, modify: func(*Hooks) {}, wantErr: "are for the container rootfs"},
+		{
+			name:     "link under the old mount",
+			oldMount: oldMount,
+			newMount: newMount,
+			modify: func(hooks *Hooks) {
+				hooks.Symlinks[0].Link = oldMount + "/usr/lib/cdi/libfoo.so.1"
+			},
+			wantErr: "refers to the container rootfs mount",
+		},
+		{
+			name:     "target under the old mount",
+			oldMount: oldMount,
+			newMount: newMount,
+			modify: func(hooks *Hooks) {
+				hooks.Symlinks[0].Target = oldMount + "/usr/lib/cdi/libfoo.so.1.2"
+			},
+			wantErr: "refers to the container rootfs mount",
+		},
+		{
+			name:     "library directory under the old mount",
+			oldMount: oldMount,
+			newMount: newMount,
+			modify: func(hooks *Hooks) {
+				hooks.LDCacheUpdates = append(hooks.LDCacheUpdates, oldMount+"/usr/lib/cdi")
+			},
+			wantErr: "refers to the container rootfs mount",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var h *Hooks
+			if test.modify != nil {
+				h = hooks()
+				test.modify(h)
+			}
+
+			_, err := RelocateHooks(test.oldMount, test.newMount, h)
+			assert.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
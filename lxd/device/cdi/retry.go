@@ -0,0 +1,63 @@
+package cdi
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// defaultRetryAttempts is the number of attempts given to the directory and symlink creations when
+// ApplyOptions.RetryAttempts is not set.
+const defaultRetryAttempts = 3
+
+// retryBackoff is the wait before the second attempt, doubled before each following one.
+var retryBackoff = 10 * time.Millisecond
+
+// retryingFS wraps a containerFS and retries the directory and symlink creations failing with a
+// transient error, as happens on busy hosts while other rootfs are set up or torn down.
+type retryingFS struct {
+	containerFS
+	ctx      context.Context
+	attempts int
+	l        logger.Logger
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents.
+func (r *retryingFS) MkdirAll(path string) error {
+	return r.retry("mkdir", path, func() error { return r.containerFS.MkdirAll(path) })
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (r *retryingFS) Symlink(oldname, newname string) error {
+	return r.retry("symlink", newname, func() error { return r.containerFS.Symlink(oldname, newname) })
+}
+
+// retry runs op until it succeeds, fails with an error that is not transient or runs out of attempts.
+func (r *retryingFS) retry(name string, path string, op func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= r.attempts || !isTransientError(err) {
+			return err
+		}
+
+		r.l.Debug("Retrying CDI file operation after a transient error", logger.Ctx{"operation": name, "path": path, "attempt": attempt, "error": err})
+
+		select {
+		case <-r.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// isTransientError returns whether err is worth retrying. Only the errors carrying an errno can be
+// told apart, which SFTP does not report.
+func isTransientError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY)
+}
@@ -0,0 +1,110 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyFS wraps a containerFS and fails the first calls to Symlink and MkdirAll with err.
+type flakyFS struct {
+	containerFS
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *flakyFS) fail(path string) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return &os.PathError{Op: "flaky", Path: path, Err: f.err}
+	}
+
+	return nil
+}
+
+func (f *flakyFS) MkdirAll(path string) error {
+	err := f.fail(path)
+	if err != nil {
+		return err
+	}
+
+	return f.containerFS.MkdirAll(path)
+}
+
+func (f *flakyFS) Symlink(oldname, newname string) error {
+	err := f.fail(newname)
+	if err != nil {
+		return err
+	}
+
+	return f.containerFS.Symlink(oldname, newname)
+}
+
+func TestApplyHooksRetry(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+
+	hooks := Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/nvidia/libfoo.so"}}}
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		attempts  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "transient errors are retried", err: syscall.EAGAIN, failures: 2, wantCalls: 4},
+		{name: "busy errors are retried", err: syscall.EBUSY, failures: 1, wantCalls: 3},
+		{name: "retries are bounded", err: syscall.EBUSY, failures: 3, wantCalls: 3, wantErr: true},
+		{name: "configured attempts", err: syscall.EAGAIN, failures: 4, attempts: 5, wantCalls: 6},
+		{name: "retries disabled", err: syscall.EAGAIN, failures: 1, attempts: 1, wantCalls: 1, wantErr: true},
+		{name: "permission errors fail immediately", err: syscall.EPERM, failures: 1, wantCalls: 1, wantErr: true},
+		{name: "no space errors fail immediately", err: syscall.ENOSPC, failures: 1, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			cfs := &flakyFS{containerFS: &localFS{rootFS: tmpDir}, err: tt.err, failures: tt.failures}
+
+			_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), cfs, ApplyOptions{Rollback: true, RetryAttempts: tt.attempts})
+			assert.Equal(t, tt.wantCalls, cfs.calls)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "nvidia", "libfoo.so"))
+			require.NoError(t, err)
+			assert.Equal(t, "libfoo.so.1", target)
+		})
+	}
+
+	t.Run("cancelled context stops the retries", func(t *testing.T) {
+		retryBackoff = time.Hour
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := &retryingFS{containerFS: &localFS{rootFS: t.TempDir()}, ctx: ctx, attempts: 3, l: nopLogger{}}
+		calls := 0
+		err := r.retry("mkdir", "/usr", func() error {
+			calls++
+			return fmt.Errorf("Failed: %w", syscall.EAGAIN)
+		})
+
+		assert.ErrorIs(t, err, syscall.EAGAIN)
+		assert.Equal(t, 1, calls)
+	})
+}
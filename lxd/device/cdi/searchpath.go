@@ -0,0 +1,272 @@
+package cdi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/shared/logger"
+)
+
+const (
+	// mainLinkerConfFile is the main glibc linker conf file, which the linker conf files of
+	// linkerConfDir are only read from when it includes them.
+	mainLinkerConfFile = "/etc/ld.so.conf"
+
+	// maxLinkerConfIncludeDepth bounds the nesting of the include directives of the linker conf files.
+	maxLinkerConfIncludeDepth = 16
+)
+
+// LoaderSearchPath returns the ordered directories the dynamic linker of the container c searches
+// for the shared libraries, as ldconfig builds the linker cache from them. For glibc, these are the
+// directories of /etc/ld.so.conf, following its include directives in order, then the trusted
+// directories. The linker conf files of /etc/ld.so.conf.d, and so the CDI library directories, are
+// only part of it when /etc/ld.so.conf includes them, which is why it is the way to check that the
+// CDI linker configuration took effect. For musl, these are the directories of the musl path file,
+// or the default ones without it. The linker cache itself is not read so that the search path is
+// known before it is first generated.
+func LoaderSearchPath(c instance.Container) ([]string, error) {
+	// Use FileSFTPNoLock so that the search path can be inspected during instance operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	return loaderSearchPathWithFS(&sftpContainerFS{client: sftpClient})
+}
+
+// loaderSearchPathWithFS is the testable core of LoaderSearchPath.
+func loaderSearchPathWithFS(cfs containerFS) ([]string, error) {
+	libc, err := detectLibc(cfs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed detecting the C library of the container: %w", err)
+	}
+
+	if libc.flavor == LibcFlavorMusl {
+		return librarySearchDirs(cfs, libc)
+	}
+
+	walk := &linkerConfWalk{cfs: cfs}
+	err = walk.read(mainLinkerConfFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// ldconfig adds the trusted directories after the configured ones.
+	dirs := append(walk.dirs, glibcDefaultLibraryDirs...)
+
+	searchPath := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !slices.Contains(searchPath, dir) {
+			searchPath = append(searchPath, dir)
+		}
+	}
+
+	return searchPath, nil
+}
+
+// linkerConfWalk reads the linker conf files of the container from the main one like ldconfig.
+type linkerConfWalk struct {
+	cfs containerFS
+	// dirs are the library directories, in the order ldconfig reads them.
+	dirs []string
+	// files are the paths of the linker conf files read, once their symlinks are followed.
+	files []string
+}
+
+// read appends the library directories of the linker conf file at path to w.dirs, expanding its
+// include directives in order like ldconfig. A missing file lists no directory. The patterns of the
+// include directives are relative to the directory of the file including them, and the files they
+// match are read in lexical order.
+func (w *linkerConfWalk) read(path string, depth int) error {
+	if depth > maxLinkerConfIncludeDepth {
+		return fmt.Errorf("Too many levels of includes reading the linker conf file %q", path)
+	}
+
+	resolved, err := resolveContainerPath(w.cfs, path)
+	var content []byte
+	if err == nil {
+		content, err = readContainerFile(w.cfs, resolved)
+	}
+
+	if err != nil {
+		if isMissingPath(err) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed reading the linker conf file %q: %w", path, err)
+	}
+
+	w.files = append(w.files, resolved)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+
+				paths, err := globContainerFiles(w.cfs, pattern)
+				if err != nil {
+					return err
+				}
+
+				for _, included := range paths {
+					err = w.read(included, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+		case "hwcap":
+			// Obsolete and ignored by ldconfig.
+		default:
+			w.dirs = append(w.dirs, filepath.Clean(line))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// globContainerFiles returns the paths inside the container matching the pattern, in lexical order.
+// Only the last component of the pattern can hold wildcards, which is the case of the linker conf
+// include directives in practice. A missing directory matches nothing.
+func globContainerFiles(cfs containerFS, pattern string) ([]string, error) {
+	dir, name := filepath.Split(filepath.Clean(pattern))
+	if !strings.ContainsAny(name, "*?[") {
+		return []string{filepath.Join(dir, name)}, nil
+	}
+
+	resolved, err := resolveContainerPath(cfs, dir)
+	if err != nil {
+		if isMissingPath(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed resolving the directory of %q: %w", pattern, err)
+	}
+
+	files, err := cfs.ReadDir(resolved)
+	if err != nil {
+		if isMissingPath(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed listing the directory of %q: %w", pattern, err)
+	}
+
+	paths := []string{}
+	for _, file := range files {
+		matched, err := filepath.Match(name, file.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid linker conf include pattern %q: %w", pattern, err)
+		}
+
+		if matched && !file.IsDir() {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+// ensureLinkerConfIncluded makes sure that ldconfig reads the linker conf file at confFilePath, which
+// some minimal images break by shipping a main linker conf file without the include directive of the
+// linker conf directory. The missing directive is appended to the main linker conf file in a managed
+// block, recording the change in the transaction. It returns whether the main linker conf file was
+// changed. A rootfs without a main linker conf file is left as it is.
+// The directive is kept when the hooks are removed as it only restores the usual configuration.
+func ensureLinkerConfIncluded(tx *hooksTransaction, confFilePath string) (bool, error) {
+	resolvedConf, err := resolveContainerPath(tx.cfs, confFilePath)
+	if err != nil {
+		return false, fmt.Errorf("Failed resolving the linker conf file %q: %w", confFilePath, err)
+	}
+
+	walk := &linkerConfWalk{cfs: tx.cfs}
+	err = walk.read(mainLinkerConfFile, 0)
+	if err != nil {
+		return false, err
+	}
+
+	if slices.Contains(walk.files, resolvedConf) {
+		return false, nil
+	}
+
+	path, err := resolveContainerFilePath(tx.cfs, mainLinkerConfFile)
+	if err != nil {
+		return false, err
+	}
+
+	content, err := readContainerFile(tx.cfs, path)
+	if err != nil {
+		if isMissingPath(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed reading the linker conf file at %q: %w", path, err)
+	}
+
+	if bytes.Contains(content, []byte(ldConfBlockBegin)) {
+		// The managed block is there but does not match the linker conf file, e.g. as it is in
+		// another directory, which is left to the administrator.
+		tx.l.Warn("The CDI linker conf file is not included by the main linker conf file", logger.Ctx{"path": confFilePath, "main": path})
+		return false, nil
+	}
+
+	fileInfo, err := tx.cfs.Lstat(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed checking the linker conf file at %q: %w", path, err)
+	}
+
+	mode := fileInfo.Mode().Perm()
+
+	var b bytes.Buffer
+	b.Write(content)
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		b.WriteString("\n")
+	}
+
+	include := linkerConfDir
+	if tx.relativeLinkerConfInclude {
+		// ldconfig reads the relative includes from the directory of the main linker conf file.
+		include = filepath.Base(linkerConfDir)
+	}
+
+	fmt.Fprintf(&b, "%s\ninclude %s/*.conf\n%s\n", ldConfBlockBegin, include, ldConfBlockEnd)
+
+	tx.record(func() error {
+		err := writeFileAtomic(tx.cfs, path, content, mode)
+		if err != nil {
+			return fmt.Errorf("Failed restoring the linker conf file at %q: %w", path, err)
+		}
+
+		return nil
+	})
+
+	err = writeFileAtomic(tx.cfs, path, b.Bytes(), mode)
+	if err != nil {
+		return false, fmt.Errorf("Failed writing the linker conf file at %q: %w", path, err)
+	}
+
+	tx.l.Debug("Added the linker conf directory to the main linker conf file", logger.Ctx{"path": path})
+
+	return true, nil
+}
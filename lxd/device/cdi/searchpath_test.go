@@ -0,0 +1,161 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoaderSearchPath(t *testing.T) {
+	writeConf := func(t *testing.T, rootFS string, path string, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootFS, filepath.Dir(path)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(rootFS, path), []byte(content), 0644))
+	}
+
+	t.Run("configured directories before the trusted ones", func(t *testing.T) {
+		rootFS := t.TempDir()
+		writeConf(t, rootFS, "/etc/ld.so.conf", "# Multiarch\ninclude /etc/ld.so.conf.d/*.conf\n/opt/last\n")
+		writeConf(t, rootFS, "/etc/ld.so.conf.d/x86_64-linux-gnu.conf", "/usr/local/lib/x86_64-linux-gnu\n/lib/x86_64-linux-gnu\n")
+		writeConf(t, rootFS, "/etc/ld.so.conf.d/"+CDILinkerConfFile, ldConfBlock("/usr/lib/cdi", "/usr/lib"))
+		writeConf(t, rootFS, "/etc/ld.so.conf.d/README", "/not/a/conf/file\n")
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/cdi", "/usr/lib", "/usr/local/lib/x86_64-linux-gnu", "/lib/x86_64-linux-gnu", "/opt/last", "/lib", "/lib64", "/usr/lib64"}, dirs)
+	})
+
+	t.Run("linker conf directory not included", func(t *testing.T) {
+		rootFS := t.TempDir()
+		writeConf(t, rootFS, "/etc/ld.so.conf", "/usr/lib/custom\n")
+		writeConf(t, rootFS, "/etc/ld.so.conf.d/"+CDILinkerConfFile, ldConfBlock("/usr/lib/cdi"))
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/custom", "/lib", "/usr/lib", "/lib64", "/usr/lib64"}, dirs)
+	})
+
+	t.Run("relative includes", func(t *testing.T) {
+		rootFS := t.TempDir()
+		writeConf(t, rootFS, "/etc/ld.so.conf", "include\tld.so.conf.d/*.conf other.conf\n")
+		writeConf(t, rootFS, "/etc/ld.so.conf.d/a.conf", "/usr/lib/a\n")
+		writeConf(t, rootFS, "/etc/other.conf", "hwcap 0 nosegneg\n/usr/lib/other\n")
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/a", "/usr/lib/other", "/lib", "/usr/lib", "/lib64", "/usr/lib64"}, dirs)
+	})
+
+	t.Run("rootfs without linker configuration or cache", func(t *testing.T) {
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: t.TempDir()})
+		require.NoError(t, err)
+		assert.Equal(t, glibcDefaultLibraryDirs, dirs)
+	})
+
+	t.Run("include cycle", func(t *testing.T) {
+		rootFS := t.TempDir()
+		writeConf(t, rootFS, "/etc/ld.so.conf", "include /etc/ld.so.conf\n")
+
+		_, err := loaderSearchPathWithFS(&localFS{rootFS: rootFS})
+		assert.ErrorContains(t, err, "Too many levels of includes")
+	})
+
+	t.Run("musl", func(t *testing.T) {
+		rootFS := t.TempDir()
+		createLibrary(t, rootFS, "/lib/ld-musl-x86_64.so.1")
+		writeConf(t, rootFS, "/etc/ld-musl-x86_64.path", "/usr/lib/cdi:/lib\n")
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: rootFS})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/cdi", "/lib"}, dirs)
+	})
+}
+
+func TestApplyHooksMainLinkerConf(t *testing.T) {
+	hooks := Hooks{LDCacheUpdates: []string{"/usr/lib/cdi"}}
+	block := ldConfBlockBegin + "\ninclude /etc/ld.so.conf.d/*.conf\n" + ldConfBlockEnd + "\n"
+
+	setup := func(t *testing.T, mainConf string) string {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.conf"), []byte(mainConf), 0640))
+
+		return tmpDir
+	}
+
+	t.Run("missing include directive is added", func(t *testing.T) {
+		tmpDir := setup(t, "/usr/local/lib")
+
+		result, regenerate, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.True(t, result.MainLinkerConfUpdated)
+		assert.True(t, regenerate)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/local/lib\n"+block, string(content))
+
+		fileInfo, err := os.Stat(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm())
+
+		dirs, err := loaderSearchPathWithFS(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Contains(t, dirs, "/usr/lib/cdi")
+
+		// The directive is only added once.
+		result, _, err = applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib/other"}}), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.False(t, result.MainLinkerConfUpdated)
+
+		content, err = os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/local/lib\n"+block, string(content))
+	})
+
+	t.Run("included linker conf directory is kept", func(t *testing.T) {
+		mainConf := "include /etc/ld.so.conf.d/*.conf\n"
+		tmpDir := setup(t, mainConf)
+
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.False(t, result.MainLinkerConfUpdated)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, mainConf, string(content))
+	})
+
+	t.Run("main linker conf file preserved", func(t *testing.T) {
+		tmpDir := setup(t, "/usr/local/lib\n")
+
+		result, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), hooks), &localFS{rootFS: tmpDir}, ApplyOptions{PreserveMainLinkerConf: true})
+		require.NoError(t, err)
+		assert.False(t, result.MainLinkerConfUpdated)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/local/lib\n", string(content))
+	})
+
+	t.Run("rollback restores the main linker conf file", func(t *testing.T) {
+		tmpDir := setup(t, "/usr/local/lib\n")
+
+		cfs := &localFS{rootFS: tmpDir}
+		tx := &hooksTransaction{cfs: cfs, systemFS: cfs, l: nopLogger{}}
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc", "ld.so.conf.d"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.conf.d", CDILinkerConfFile), []byte(ldConfBlock("/usr/lib/cdi")), 0644))
+
+		changed, err := ensureLinkerConfIncluded(tx, filepath.Join(linkerConfDir, CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		require.NoError(t, tx.Rollback())
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "etc", "ld.so.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "/usr/local/lib\n", string(content))
+	})
+}
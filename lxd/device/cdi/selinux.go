@@ -0,0 +1,106 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// selinuxFSPath is the mount point of the SELinux filesystem, which is only mounted when SELinux is
+// enabled on the host.
+var selinuxFSPath = "/sys/fs/selinux"
+
+// selinuxXattr is the extended attribute holding the SELinux context of a file.
+const selinuxXattr = "security.selinux"
+
+// selinuxEnabled returns whether SELinux is enabled on the host, the same way libselinux does.
+func selinuxEnabled() bool {
+	_, err := os.Stat(filepath.Join(selinuxFSPath, "enforce"))
+	return err == nil
+}
+
+// relabeledPaths returns the container paths of the files created by applying CDI hooks, as
+// described by result, under writableRoot when it is set.
+func relabeledPaths(result *ApplyResult, writableRoot string) []string {
+	paths := make([]string, 0, len(result.CreatedSymlinks)+1)
+	for _, symlink := range result.CreatedSymlinks {
+		paths = append(paths, filepath.Join("/", writableRoot, symlink.Link))
+	}
+
+	if result.LinkerConfFile != "" {
+		paths = append(paths, filepath.Join("/", writableRoot, result.LinkerConfFile))
+	}
+
+	return paths
+}
+
+// relabelSELinux gives each of the container paths of the rootfs at hostRootFS the SELinux context of
+// the directory it is in. The paths are resolved inside the rootfs so that symlinks cannot make the
+// relabeling escape it. All the paths are relabeled even if some of them fail, and the returned
+// error joins all the failures.
+func relabelSELinux(hostRootFS string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	root, err := os.OpenRoot(hostRootFS)
+	if err != nil {
+		return fmt.Errorf("Failed opening the container rootfs %q: %w", hostRootFS, err)
+	}
+
+	defer func() { _ = root.Close() }()
+
+	var errs []error
+	for _, path := range paths {
+		err := copyDirXattr(root, path, selinuxXattr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed relabeling %q: %w", path, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// copyDirXattr sets the extended attribute name of the file at the container path inside root,
+// without following it if it is a symlink, to the value it has on the directory the file is in.
+func copyDirXattr(root *os.Root, path string, name string) error {
+	dirPath := strings.TrimPrefix(filepath.Dir(filepath.Clean(path)), "/")
+	if dirPath == "" {
+		dirPath = "."
+	}
+
+	dir, err := root.Open(dirPath)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	fd := int(dir.Fd())
+
+	size, err := unix.Fgetxattr(fd, name, nil)
+	if err != nil {
+		return fmt.Errorf("Failed getting %q of the directory: %w", name, err)
+	}
+
+	value := make([]byte, size)
+	size, err = unix.Fgetxattr(fd, name, value)
+	if err != nil {
+		return fmt.Errorf("Failed getting %q of the directory: %w", name, err)
+	}
+
+	// Go through the file descriptor of the directory so that only the base name is looked up.
+	fdPath := "/proc/self/fd/" + strconv.Itoa(fd) + "/" + filepath.Base(path)
+
+	err = unix.Lsetxattr(fdPath, name, value[:size], 0)
+	if err != nil {
+		return fmt.Errorf("Failed setting %q: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package cdi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSELinuxEnabled(t *testing.T) {
+	oldSELinuxFSPath := selinuxFSPath
+	t.Cleanup(func() { selinuxFSPath = oldSELinuxFSPath })
+
+	selinuxFSPath = t.TempDir()
+	assert.False(t, selinuxEnabled())
+
+	err := os.WriteFile(filepath.Join(selinuxFSPath, "enforce"), []byte("1"), 0644)
+	require.NoError(t, err)
+	assert.True(t, selinuxEnabled())
+}
+
+func TestRelabeledPaths(t *testing.T) {
+	result := &ApplyResult{
+		CreatedSymlinks: []SymlinkEntry{{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+		LinkerConfFile:  "/etc/ld.so.conf.d/00-lxdcdi.conf",
+	}
+
+	assert.Equal(t, []string{"/usr/lib/libfoo.so", "/etc/ld.so.conf.d/00-lxdcdi.conf"}, relabeledPaths(result, ""))
+	assert.Equal(t, []string{"/upper/usr/lib/libfoo.so", "/upper/etc/ld.so.conf.d/00-lxdcdi.conf"}, relabeledPaths(result, "/upper"))
+}
+
+func TestCopyDirXattr(t *testing.T) {
+	tmpDir := t.TempDir()
+	libDir := filepath.Join(tmpDir, "usr", "lib")
+	err := os.MkdirAll(libDir, 0755)
+	require.NoError(t, err)
+
+	// The user namespace is used as setting security attributes needs an LSM.
+	err = unix.Setxattr(libDir, "user.cdi", []byte("lib_t"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("Extended user attributes are not supported")
+	}
+
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(libDir, "libfoo.so.1"), nil, 0644)
+	require.NoError(t, err)
+
+	root, err := os.OpenRoot(tmpDir)
+	require.NoError(t, err)
+	defer root.Close()
+
+	err = copyDirXattr(root, "/usr/lib/libfoo.so.1", "user.cdi")
+	require.NoError(t, err)
+
+	value := make([]byte, 16)
+	n, err := unix.Getxattr(filepath.Join(libDir, "libfoo.so.1"), "user.cdi", value)
+	require.NoError(t, err)
+	assert.Equal(t, "lib_t", string(value[:n]))
+
+	// A path escaping the rootfs through a symlink is rejected.
+	err = os.Symlink("/", filepath.Join(tmpDir, "host"))
+	require.NoError(t, err)
+
+	err = copyDirXattr(root, "/host/etc/passwd", "user.cdi")
+	assert.Error(t, err)
+}
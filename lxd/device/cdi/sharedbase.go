@@ -0,0 +1,152 @@
+package cdi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// applySharedBase applies the loaded hooks to the shared base rootfs at opts.SharedBaseRootFS and to
+// the container through cfs (see ApplyOptions.SharedBaseRootFS), under a lock of the base as the other
+// containers sharing it may be applying their hooks at the same time.
+func applySharedBase(ctx context.Context, hooks *Hooks, cfs containerFS, opts ApplyOptions) (*ApplyResult, bool, error) {
+	unlock, err := lockRootFS(ctx, opts.SharedBaseRootFS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer unlock()
+
+	baseFS, err := openHostRootFS(opts.SharedBaseRootFS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer func() { _ = baseFS.Close() }()
+
+	return applySharedBaseWithFS(ctx, hooks, baseFS, cfs, opts)
+}
+
+// applySharedBaseWithFS is the testable core of applySharedBase. The hooks are applied to baseFS, its
+// linker cache being updated natively, then the entries cfs does not see from the base are applied to
+// cfs. It returns the changes like applyLoadedHooksWithFS, with the base entries split from the ones
+// of the container, and whether the linker cache of the container needs to be regenerated.
+// The changes made to the base are not rolled back when the apply to the container fails, as the
+// other containers sharing the base may already rely on them.
+func applySharedBaseWithFS(ctx context.Context, hooks *Hooks, baseFS containerFS, cfs containerFS, opts ApplyOptions) (*ApplyResult, bool, error) {
+	l := loggerOrNop(opts.Logger)
+
+	baseOpts := opts
+	baseOpts.SharedBaseRootFS = ""
+	baseOpts.StateFile = ""
+
+	// The hooks are generated for the rootfs of the container rather than for the base.
+	baseOpts.rootFS = ""
+
+	// The device nodes are only created in the container.
+	baseHooks := *hooks
+	baseHooks.DeviceNodes = nil
+
+	baseResult, regenerateBase, err := applyLoadedHooksWithFS(ctx, &baseHooks, baseFS, baseOpts)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed applying the CDI hooks to the shared base rootfs: %w", err)
+	}
+
+	baseEFS, err := newEtcDirFS(baseFS, opts.EtcDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// ldconfig cannot run in the base, which is not a container, leaving the container to update its
+	// cache without NativeLdCache.
+	start := time.Now()
+	baseCacheWritten := false
+	if regenerateBase && !opts.SkipLdCache && opts.NativeLdCache {
+		baseCacheWritten = updateLDCacheNativeFromConf(baseEFS, l)
+	}
+
+	baseLDCache := time.Since(start)
+
+	efs, err := newEtcDirFS(cfs, opts.EtcDir)
+	if err != nil {
+		return nil, false, &stageError{stage: FailureStageLoad, err: err}
+	}
+
+	// The overlay of the container shadows the base entries it removed or replaced, which are then
+	// applied to the container.
+	toCreate, _, cacheToAdd, _, err := diffHooksWithFS(hooks, efs)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed comparing the CDI hooks with the container: %w", err)
+	}
+
+	containerHooks := *hooks
+	containerHooks.Symlinks = toCreate
+	containerHooks.LDCacheUpdates = cacheToAdd
+
+	// Replacing the linker conf file of the container would drop the entries seen from the base.
+	containerOpts := opts
+	containerOpts.ReplaceLdConf = false
+
+	result, regenerateLDCache, err := applyLoadedHooksWithFS(ctx, &containerHooks, cfs, containerOpts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !opts.LdCacheOnly {
+		result.BaseSymlinks = []SymlinkEntry{}
+		for _, symlink := range hooks.Symlinks {
+			if !slices.ContainsFunc(toCreate, func(created SymlinkEntry) bool { return filepath.Clean(created.Link) == filepath.Clean(symlink.Link) }) {
+				result.BaseSymlinks = append(result.BaseSymlinks, symlink)
+			}
+		}
+	}
+
+	if !opts.SymlinksOnly {
+		result.BaseLDCacheEntries = []string{}
+		for _, update := range normalizeLDCacheUpdates(hooks.LDCacheUpdates) {
+			if !slices.Contains(cacheToAdd, update) {
+				result.BaseLDCacheEntries = append(result.BaseLDCacheEntries, update)
+			}
+		}
+
+		shared := sharesLDCache(baseEFS, efs)
+
+		// The container only benefits from the cache of the base when it does not hold its own copy of it,
+		// and when the base one could be updated.
+		if regenerateBase && (!baseCacheWritten || !shared) {
+			regenerateLDCache = true
+		}
+
+		// A copy of the cache made before the base entries were applied lacks them.
+		if !shared && (len(result.BaseSymlinks) > 0 || len(result.BaseLDCacheEntries) > 0) {
+			regenerateLDCache = true
+		}
+	}
+
+	result.Warnings = append(baseResult.Warnings, result.Warnings...)
+	result.Timings.Symlinks += baseResult.Timings.Symlinks
+	result.Timings.LinkerConf += baseResult.Timings.LinkerConf
+	result.Timings.LDCache = baseLDCache
+
+	l.Debug("Applied the CDI hooks to the shared base rootfs", logger.Ctx{"symlinks": len(result.BaseSymlinks), "entries": result.BaseLDCacheEntries, "containerSymlinks": len(result.CreatedSymlinks), "containerEntries": result.LDCacheEntries})
+
+	return result, regenerateLDCache, nil
+}
+
+// sharesLDCache returns whether the container sees the linker cache of the shared base through its
+// overlay, which it does not once it holds its own copy of it, e.g. after ldconfig ran in the
+// container. Two missing caches, as with musl, are shared.
+func sharesLDCache(baseFS containerFS, cfs containerFS) bool {
+	baseCache, baseErr := readContainerFile(baseFS, ldCacheFile)
+	cache, err := readContainerFile(cfs, ldCacheFile)
+	if baseErr != nil || err != nil {
+		return isMissingPath(baseErr) && isMissingPath(err)
+	}
+
+	return bytes.Equal(baseCache, cache)
+}
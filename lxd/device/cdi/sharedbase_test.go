@@ -0,0 +1,108 @@
+package cdi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySharedBase(t *testing.T) {
+	hooks := &Hooks{
+		LDCacheUpdates: []string{"/usr/lib/cdi"},
+		Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/cdi/libfoo.so"}},
+	}
+
+	opts := ApplyOptions{SharedBaseRootFS: "/golden", StateFile: "/state.json", NativeLdCache: true}
+
+	setup := func(t *testing.T) string {
+		tmpDir := t.TempDir()
+		writeSharedLibrary(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libfoo.so.1"), "libfoo.so.1")
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc", "ld.so.conf.d"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.conf"), []byte("include /etc/ld.so.conf.d/*.conf\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), marshalLDCache(nil), 0644))
+
+		return tmpDir
+	}
+
+	t.Run("entries seen from the base", func(t *testing.T) {
+		baseDir := setup(t)
+
+		// The container sees the base unchanged, as through an overlay with nothing shadowing it.
+		result, regenerate, err := applySharedBaseWithFS(context.Background(), hooks, &localFS{rootFS: baseDir}, &localFS{rootFS: baseDir}, opts)
+		require.NoError(t, err)
+		assert.False(t, regenerate)
+		assert.Empty(t, result.CreatedSymlinks)
+		assert.Empty(t, result.LDCacheEntries)
+		assert.Equal(t, hooks.Symlinks, result.BaseSymlinks)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.BaseLDCacheEntries)
+
+		content, err := os.ReadFile(filepath.Join(baseDir, "etc", "ld.so.cache"))
+		require.NoError(t, err)
+
+		entries, err := parseLDCache(content)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "libfoo.so.1", entries[0].key)
+
+		// Removing the hooks from the container leaves the base to the other containers.
+		regenerate, err = removeFromStateWithFS(newAppliedState(result, "", ""), &localFS{rootFS: baseDir})
+		require.NoError(t, err)
+		assert.False(t, regenerate)
+
+		target, err := os.Readlink(filepath.Join(baseDir, "usr", "lib", "cdi", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+		assert.FileExists(t, filepath.Join(baseDir, "etc", "ld.so.conf.d", CDILinkerConfFile))
+	})
+
+	t.Run("entries shadowed by the container", func(t *testing.T) {
+		baseDir := setup(t)
+		containerDir := setup(t)
+
+		// The container holds its own copy of the directories and of the linker cache.
+		require.NoError(t, os.WriteFile(filepath.Join(containerDir, "etc", "ld.so.cache"), append(marshalLDCache(nil), 0), 0644))
+
+		result, regenerate, err := applySharedBaseWithFS(context.Background(), hooks, &localFS{rootFS: baseDir}, &localFS{rootFS: containerDir}, opts)
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.Equal(t, hooks.Symlinks, result.CreatedSymlinks)
+		assert.Equal(t, []string{"/usr/lib/cdi"}, result.LDCacheEntries)
+		assert.Empty(t, result.BaseSymlinks)
+		assert.Empty(t, result.BaseLDCacheEntries)
+
+		for _, dir := range []string{baseDir, containerDir} {
+			target, err := os.Readlink(filepath.Join(dir, "usr", "lib", "cdi", "libfoo.so"))
+			require.NoError(t, err)
+			assert.Equal(t, "libfoo.so.1", target)
+		}
+
+		_, err = removeFromStateWithFS(newAppliedState(result, "", ""), &localFS{rootFS: containerDir})
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(containerDir, "usr", "lib", "cdi", "libfoo.so"))
+
+		_, err = os.Lstat(filepath.Join(baseDir, "usr", "lib", "cdi", "libfoo.so"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		tests := []struct {
+			name string
+			opts ApplyOptions
+			want string
+		}{
+			{name: "no state file", opts: ApplyOptions{SharedBaseRootFS: "/golden"}, want: "requires a StateFile"},
+			{name: "dry run", opts: ApplyOptions{SharedBaseRootFS: "/golden", StateFile: "/state.json", DryRun: true}, want: "cannot be combined"},
+			{name: "writable root", opts: ApplyOptions{SharedBaseRootFS: "/golden", StateFile: "/state.json", WritableRoot: "/var/lib/cdi"}, want: "cannot be combined"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.ErrorContains(t, validateApplyOptions(tt.opts), tt.want)
+			})
+		}
+	})
+}
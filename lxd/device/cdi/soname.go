@@ -0,0 +1,142 @@
+package cdi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// validateSonameEntry checks the soname and the search directory of a symlink whose target is found
+// by resolveSonameTarget.
+func validateSonameEntry(symlink SymlinkEntry) error {
+	err := validatePathChars(symlink.SearchDir)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(symlink.SearchDir) {
+		return fmt.Errorf("The search directory %q of the link %q is not an absolute path", symlink.SearchDir, symlink.Link)
+	}
+
+	if strings.Contains(symlink.Target, "/") {
+		return fmt.Errorf("The target %q of the link %q is not a soname, as it has a search directory", symlink.Target, symlink.Link)
+	}
+
+	return nil
+}
+
+// isSonameCandidate returns whether the file named name is a versioned file of soname, e.g.
+// libnvidia-ml.so.1.535.104.05 for libnvidia-ml.so.1.
+func isSonameCandidate(name string, soname string) bool {
+	matched, err := filepath.Match(soname+".*", name)
+	return err == nil && matched
+}
+
+// sonameCandidates returns the search directory of symlink once the symlinks of the container are
+// followed, along with the sorted names of the regular files in it that are versioned files of the
+// soname Target.
+func sonameCandidates(cfs containerFS, symlink SymlinkEntry) (string, []string, error) {
+	searchDir, err := resolveContainerDir(cfs, symlink.SearchDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed resolving the search directory %q of the link %q: %w", symlink.SearchDir, symlink.Link, err)
+	}
+
+	entries, err := cfs.ReadDir(searchDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed reading the search directory %q of the link %q: %w", symlink.SearchDir, symlink.Link, err)
+	}
+
+	candidates := []string{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && isSonameCandidate(entry.Name(), symlink.Target) {
+			candidates = append(candidates, entry.Name())
+		}
+	}
+
+	slices.Sort(candidates)
+
+	return searchDir, candidates, nil
+}
+
+// resolveSonameTarget returns symlink with its target set to the versioned file of the soname Target
+// found in its SearchDir, once the symlinks of the container are followed, and without a search
+// directory. The symlinks without a search directory are returned as they are. Only the regular files
+// are candidates and exactly one of them must match.
+func resolveSonameTarget(cfs containerFS, symlink SymlinkEntry) (SymlinkEntry, error) {
+	if symlink.SearchDir == "" {
+		return symlink, nil
+	}
+
+	searchDir, candidates, err := sonameCandidates(cfs, symlink)
+	if err != nil {
+		return SymlinkEntry{}, err
+	}
+
+	switch len(candidates) {
+	case 0:
+		return SymlinkEntry{}, fmt.Errorf("No file of the soname %q found in %q for the link %q", symlink.Target, symlink.SearchDir, symlink.Link)
+	case 1:
+	default:
+		return SymlinkEntry{}, fmt.Errorf("Several files of the soname %q found in %q for the link %q: %s", symlink.Target, symlink.SearchDir, symlink.Link, strings.Join(candidates, ", "))
+	}
+
+	symlink.Target = filepath.Join(searchDir, candidates[0])
+	symlink.SearchDir = ""
+
+	return symlink, nil
+}
+
+// resolveSonameTargets returns hooks with the soname targets of their symlinks resolved with
+// resolveSonameTarget. The hooks are returned as they are when none of their symlinks has a search
+// directory and are never changed.
+func resolveSonameTargets(cfs containerFS, hooks *Hooks) (*Hooks, error) {
+	if !slices.ContainsFunc(hooks.Symlinks, func(symlink SymlinkEntry) bool { return symlink.SearchDir != "" }) {
+		return hooks, nil
+	}
+
+	resolved := *hooks
+	resolved.Symlinks = make([]SymlinkEntry, 0, len(hooks.Symlinks))
+	for _, symlink := range hooks.Symlinks {
+		resolvedSymlink, err := resolveSonameTarget(cfs, symlink)
+		if err != nil {
+			return nil, &stageError{stage: FailureStageSymlink, symlinks: []SymlinkEntry{symlink}, err: err}
+		}
+
+		resolved.Symlinks = append(resolved.Symlinks, resolvedSymlink)
+	}
+
+	return &resolved, nil
+}
+
+// sonameLinkTarget returns the target of the symlink at the link of symlink when it points at a
+// versioned file of its soname in its search directory, whether that file still exists or not, so that
+// the symlinks created for a soname can be removed once the libraries are gone.
+func sonameLinkTarget(cfs containerFS, symlink SymlinkEntry) (string, bool) {
+	fileInfo, err := cfs.Lstat(symlink.Link)
+	if err != nil || fileInfo.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+
+	target, err := cfs.Readlink(symlink.Link)
+	if err != nil {
+		return "", false
+	}
+
+	absTarget := absoluteSymlinkTarget(filepath.Clean(symlink.Link), target)
+	if !isSonameCandidate(filepath.Base(absTarget), symlink.Target) {
+		return "", false
+	}
+
+	searchDir, err := resolveContainerDir(cfs, symlink.SearchDir)
+	if err != nil {
+		searchDir = filepath.Clean(symlink.SearchDir)
+	}
+
+	if filepath.Dir(absTarget) != searchDir && filepath.Dir(absTarget) != filepath.Clean(symlink.SearchDir) {
+		return "", false
+	}
+
+	return target, true
+}
@@ -0,0 +1,85 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyHooksSoname(t *testing.T) {
+	symlink := SymlinkEntry{Target: "libnvidia-ml.so.1", Link: "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1", SearchDir: "/usr/lib/nvidia"}
+
+	t.Run("links the versioned file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.535.104.05")
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.1.535.104.05")
+
+		// Neither the symlinks nor the files of other sonames are candidates.
+		require.NoError(t, os.Symlink("libnvidia-ml.so.1.535.104.05", filepath.Join(tmpDir, "usr", "lib", "nvidia", "libnvidia-ml.so.1.535")))
+		createLibrary(t, tmpDir, "/usr/lib/nvidia/libnvidia-ml.so.10.1")
+
+		hooksFile := writeHooksFile(t, t.TempDir(), Hooks{Symlinks: []SymlinkEntry{symlink}})
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []SymlinkEntry{{Target: "/usr/lib/nvidia/libnvidia-ml.so.1.535.104.05", Link: symlink.Link}}, result.CreatedSymlinks)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "x86_64-linux-gnu", "libnvidia-ml.so.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "../nvidia/libnvidia-ml.so.1.535.104.05", target)
+
+		// The symlink is removed once the driver is gone.
+		require.NoError(t, os.RemoveAll(filepath.Join(tmpDir, "usr", "lib", "nvidia")))
+
+		regenerate, err := removeHooksWithFS(hooksFile, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.True(t, regenerate)
+		assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "x86_64-linux-gnu", "libnvidia-ml.so.1"))
+	})
+
+	t.Run("no candidate or several", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			files []string
+			want  string
+		}{
+			{name: "none", want: `No file of the soname "libnvidia-ml.so.1" found in "/usr/lib/nvidia" for the link "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1"`},
+			{name: "several", files: []string{"libnvidia-ml.so.1.535", "libnvidia-ml.so.1.550"}, want: `Several files of the soname "libnvidia-ml.so.1" found in "/usr/lib/nvidia" for the link "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.1": libnvidia-ml.so.1.535, libnvidia-ml.so.1.550`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tmpDir := t.TempDir()
+				require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr", "lib", "nvidia"), 0755))
+				for _, file := range tt.files {
+					createLibrary(t, tmpDir, filepath.Join("/usr/lib/nvidia", file))
+				}
+
+				hooksFile := writeHooksFile(t, t.TempDir(), Hooks{Symlinks: []SymlinkEntry{symlink}})
+				_, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+				assert.ErrorContains(t, err, tt.want)
+				assert.NoFileExists(t, filepath.Join(tmpDir, "usr", "lib", "x86_64-linux-gnu", "libnvidia-ml.so.1"))
+			})
+		}
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			symlink SymlinkEntry
+			want    string
+		}{
+			{name: "relative search directory", symlink: SymlinkEntry{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so.1", SearchDir: "usr/lib/cdi"}, want: `The search directory "usr/lib/cdi" of the link "/usr/lib/libfoo.so.1" is not an absolute path`},
+			{name: "path target", symlink: SymlinkEntry{Target: "cdi/libfoo.so.1", Link: "/usr/lib/libfoo.so.1", SearchDir: "/usr/lib"}, want: `The target "cdi/libfoo.so.1" of the link "/usr/lib/libfoo.so.1" is not a soname`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := ValidateHooks(&Hooks{Symlinks: []SymlinkEntry{tt.symlink}})
+				assert.ErrorContains(t, err, tt.want)
+			})
+		}
+	})
+}
@@ -0,0 +1,292 @@
+package cdi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+// appliedStateFilePrefix is the prefix of the applied state files written in the directory of a
+// container by AppliedStatePath.
+const appliedStateFilePrefix = ".lxdcdi-applied"
+
+// AppliedState is what an apply of CDI hooks created in a container, as recorded in the file set by
+// ApplyOptions.StateFile. Unlike the hooks, it only lists the changes made by the apply, leaving out
+// the symlinks and linker configuration entries that were already there, so that RemoveFromState
+// undoes exactly these changes without the original hooks file.
+type AppliedState struct {
+	// Symlinks are the symlinks (and hard links) that were created or replaced.
+	Symlinks []SymlinkEntry `json:"symlinks"`
+	// BackedUpFiles are the files that occupied the path of a symlink and were backed up, to be
+	// restored once the symlink is removed.
+	BackedUpFiles []string `json:"backed_up_files,omitempty"`
+	// LinkerConfFile is the linker conf file (or musl path file) LDCacheEntries were added to.
+	LinkerConfFile string `json:"linker_conf_file,omitempty"`
+	// LDCacheEntries are the library directories added to the linker configuration.
+	LDCacheEntries []string `json:"ld_cache_entries,omitempty"`
+	// DeviceNodes are the paths of the device nodes that were created.
+	DeviceNodes []string `json:"device_nodes,omitempty"`
+	// WritableRoot is the ApplyOptions.WritableRoot the symlinks and the linker configuration were
+	// written under.
+	WritableRoot string `json:"writable_root,omitempty"`
+	// EtcDir is the ApplyOptions.EtcDir the linker configuration was written under.
+	EtcDir string `json:"etc_dir,omitempty"`
+	// SharedBaseRootFS is the ApplyOptions.SharedBaseRootFS the base entries were applied to.
+	SharedBaseRootFS string `json:"shared_base_rootfs,omitempty"`
+	// BaseSymlinks are the symlinks the container sees from the shared base. They are left in place by
+	// RemoveFromState, the other containers sharing the base relying on them.
+	BaseSymlinks []SymlinkEntry `json:"base_symlinks,omitempty"`
+	// BaseLDCacheEntries are the library directories the container sees in the linker configuration of
+	// the shared base. They are left in place by RemoveFromState too.
+	BaseLDCacheEntries []string `json:"base_ld_cache_entries,omitempty"`
+}
+
+// AppliedStatePath returns the path of the applied state file of the CDI hooks file at hooksFilePath
+// in the directory of c (e.g. `.lxdcdi-applied-gpu0.json` for `gpu0_cdi_hooks.json`), which
+// RemoveHooksFromContainer uses instead of the hooks file when it exists.
+func AppliedStatePath(c instance.Container, hooksFilePath string) string {
+	name := filepath.Base(hooksFilePath)
+	trimmed := strings.TrimSuffix(name, CDIHooksFileSuffix)
+	if trimmed == name {
+		trimmed = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	return filepath.Join(c.Path(), appliedStateFilePrefix+"-"+trimmed+".json")
+}
+
+// newAppliedState returns the applied state of the apply described by result.
+func newAppliedState(result *ApplyResult, writableRoot string, etcDir string) *AppliedState {
+	return &AppliedState{
+		Symlinks:       result.CreatedSymlinks,
+		BackedUpFiles:  result.BackedUpFiles,
+		LinkerConfFile: result.LinkerConfFile,
+		LDCacheEntries: result.LDCacheEntries,
+		DeviceNodes:    result.CreatedDeviceNodes,
+		WritableRoot:   writableRoot,
+		EtcDir:         etcDir,
+
+		BaseSymlinks:       result.BaseSymlinks,
+		BaseLDCacheEntries: result.BaseLDCacheEntries,
+	}
+}
+
+// writeAppliedState writes state to the file at path on the host, replacing it atomically.
+func writeAppliedState(path string, state *AppliedState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed encoding the CDI applied state: %w", err)
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(path), ".lxdcdi-"+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed writing the CDI applied state file %q: %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Failed writing the CDI applied state file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadAppliedState reads and decodes the applied state file at path on the host.
+func loadAppliedState(path string) (*AppliedState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading the CDI applied state file %q: %w", path, err)
+	}
+
+	state := &AppliedState{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("Failed decoding the CDI applied state file %q: %w", path, err)
+	}
+
+	if state.WritableRoot != "" && !filepath.IsAbs(state.WritableRoot) {
+		return nil, fmt.Errorf("Invalid CDI applied state file %q: The writable root %q is not an absolute path", path, state.WritableRoot)
+	}
+
+	if state.EtcDir != "" {
+		err = validateEtcDir(state.EtcDir)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CDI applied state file %q: %w", path, err)
+		}
+	}
+
+	return state, nil
+}
+
+// RemoveFromState undoes the changes recorded in the applied state file at stateFile (see
+// ApplyOptions.StateFile) in the container c using SFTP, then deletes the state file. Like
+// RemoveHooksFromContainer, the symlinks changed since they were created are left untouched and the
+// changes already undone are skipped. The linker cache is updated with updateLDCache.
+func RemoveFromState(stateFile string, c instance.Container) error {
+	state, err := loadAppliedState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockHooks(context.Background(), c)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := c.FileSFTPNoLock()
+	if err != nil {
+		return fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	cfs := &sftpContainerFS{client: sftpClient}
+
+	regenerateLDCache, err := removeFromStateWithFS(state, cfs)
+	if err != nil {
+		return err
+	}
+
+	if regenerateLDCache {
+		_, _, _ = updateLDCache(context.Background(), c, cfs, nil, "", 0, nil, state.EtcDir)
+	}
+
+	return removeAppliedStateFile(stateFile)
+}
+
+// removeAppliedStateFile deletes the applied state file at path on the host.
+func removeAppliedStateFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed removing the CDI applied state file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// withoutSharedState returns a copy of state without the symlinks, library directories and device
+// nodes listed by any of the hooks of others, which the other devices of the container still rely on.
+func withoutSharedState(state *AppliedState, others []*Hooks) *AppliedState {
+	if len(others) == 0 {
+		return state
+	}
+
+	shared := mergeSharedEntries(others)
+	stale, _ := splitStaleState(state, shared)
+
+	kept := *state
+	kept.Symlinks = stale.Symlinks
+	kept.BackedUpFiles = stale.BackedUpFiles
+	kept.LDCacheEntries = stale.LDCacheEntries
+	kept.DeviceNodes = nil
+	for _, path := range state.DeviceNodes {
+		if !slices.ContainsFunc(shared.DeviceNodes, func(node DeviceNode) bool { return filepath.Clean(node.Path) == filepath.Clean(path) }) {
+			kept.DeviceNodes = append(kept.DeviceNodes, path)
+		}
+	}
+
+	return &kept
+}
+
+// removeFromStateWithFS is the testable core of RemoveFromState. It undoes the changes recorded in
+// state and returns whether the linker cache needs to be regenerated.
+func removeFromStateWithFS(state *AppliedState, cfs containerFS) (bool, error) {
+	efs, err := newEtcDirFS(cfs, state.EtcDir)
+	if err != nil {
+		return false, err
+	}
+
+	libc, err := detectLibc(efs)
+	if err != nil {
+		return false, fmt.Errorf("Failed detecting the C library of the container: %w", err)
+	}
+
+	writeFS := cfs
+	if state.WritableRoot != "" {
+		writeFS = &rootedFS{cfs: cfs, root: state.WritableRoot}
+	}
+
+	if efs.remapped() {
+		writeFS = &etcDirFS{cfs: writeFS, dir: efs.dir}
+	}
+
+	changed := false
+
+	// Removing the symlinks in the reverse order of their creation, the ones pointing at other symlinks
+	// of the batch having been created after their targets.
+	for i := len(state.Symlinks) - 1; i >= 0; i-- {
+		symlink := state.Symlinks[i]
+		target, err := resolveTarget(symlink.Link, symlink.Target, symlink.KeepAbsolute)
+		if err != nil {
+			return false, fmt.Errorf("Failed resolving a CDI symlink: %w", err)
+		}
+
+		var removed bool
+		if symlink.Kind == SymlinkKindHardlink {
+			removed, err = removeHardlinkFromContainer(writeFS, target, symlink.Link)
+		} else {
+			removed, err = removeSymlinkFromContainer(writeFS, target, symlink.Link)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		changed = changed || removed
+	}
+
+	// The backups were already restored along with their symlinks, unless the symlinks were removed
+	// by someone else.
+	for _, path := range state.BackedUpFiles {
+		_, err := writeFS.Lstat(path)
+		if err == nil {
+			continue
+		}
+
+		if !isMissingPath(err) {
+			return false, fmt.Errorf("Failed checking the backed up path %q: %w", path, err)
+		}
+
+		err = restoreBackupFile(writeFS, path)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(state.LDCacheEntries) > 0 {
+		var removed bool
+		if libc.flavor == LibcFlavorMusl {
+			removed, err = removeMuslPathFileEntries(writeFS, libc.muslArch, state.LDCacheEntries)
+		} else if state.LinkerConfFile != "" {
+			removed, err = removeLinkerConfEntries(writeFS, state.LinkerConfFile, state.LDCacheEntries)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		changed = changed || removed
+	}
+
+	// The device nodes are created directly in the container rootfs.
+	for _, path := range state.DeviceNodes {
+		err := removeDeviceNode(cfs, path)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return changed && libc.flavor == LibcFlavorGlibc, nil
+}
@@ -0,0 +1,151 @@
+package cdi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd/lxd/instance"
+)
+
+type pathContainer struct {
+	instance.Container
+	path string
+}
+
+func (c *pathContainer) Path() string { return c.path }
+
+func (c *pathContainer) IsRunning() bool { return false }
+
+// newRootFSContainer returns a container whose rootfs is a new temporary directory, along with the
+// path of the rootfs.
+func newRootFSContainer(t *testing.T) (*pathContainer, string) {
+	t.Helper()
+
+	path := t.TempDir()
+	rootFS := filepath.Join(path, "rootfs")
+	require.NoError(t, os.Mkdir(rootFS, 0755))
+
+	return &pathContainer{path: path}, rootFS
+}
+
+func TestRemoveFromState(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		tmpDir := t.TempDir()
+		createLibrary(t, tmpDir, "/opt/cdi/libcuda.so.1")
+		createLibrary(t, tmpDir, "/usr/lib/cdi/libcuda.so")
+
+		ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+		require.NoError(t, os.MkdirAll(ldConfDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(ldConfDir, CDILinkerConfFile), []byte(ldConfBlock("/usr/lib/existing")), 0644))
+
+		hooks := Hooks{
+			LDCacheUpdates: []string{"/usr/lib/existing", "/usr/lib/cdi"},
+			Symlinks:       []SymlinkEntry{{Target: "/opt/cdi/libcuda.so.1", Link: "/usr/lib/cdi/libcuda.so"}},
+		}
+
+		hooksFile := writeHooksFile(t, t.TempDir(), hooks)
+		result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"/usr/lib/cdi/libcuda.so"}, result.BackedUpFiles)
+
+		stateFile := filepath.Join(t.TempDir(), appliedStateFilePrefix+".json")
+		require.NoError(t, writeAppliedState(stateFile, newAppliedState(result, "", "")))
+
+		// The state does not need the hooks file.
+		require.NoError(t, os.Remove(hooksFile))
+
+		return tmpDir, stateFile
+	}
+
+	remove := func(t *testing.T, tmpDir string, stateFile string) {
+		state, err := loadAppliedState(stateFile)
+		require.NoError(t, err)
+
+		_, err = removeFromStateWithFS(state, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+	}
+
+	t.Run("undoes exactly the recorded changes", func(t *testing.T) {
+		tmpDir, stateFile := setup(t)
+
+		remove(t, tmpDir, stateFile)
+
+		content, err := os.ReadFile(filepath.Join(tmpDir, "usr", "lib", "cdi", "libcuda.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "library", string(content))
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/existing"}, entries)
+	})
+
+	t.Run("keeps the symlinks changed since", func(t *testing.T) {
+		tmpDir, stateFile := setup(t)
+
+		link := filepath.Join(tmpDir, "usr", "lib", "cdi", "libcuda.so")
+		require.NoError(t, os.Remove(link))
+		require.NoError(t, os.Symlink("libcuda.so.2", link))
+
+		remove(t, tmpDir, stateFile)
+
+		target, err := os.Readlink(link)
+		require.NoError(t, err)
+		assert.Equal(t, "libcuda.so.2", target)
+	})
+
+	t.Run("restores the backups of the symlinks already removed", func(t *testing.T) {
+		tmpDir, stateFile := setup(t)
+
+		require.NoError(t, os.Remove(filepath.Join(tmpDir, "usr", "lib", "cdi", "libcuda.so")))
+
+		state, err := loadAppliedState(stateFile)
+		require.NoError(t, err)
+
+		regenerateLDCache, err := removeFromStateWithFS(state, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.True(t, regenerateLDCache)
+		assert.FileExists(t, filepath.Join(tmpDir, "usr", "lib", "cdi", "libcuda.so"))
+
+		// Nothing is left to undo.
+		regenerateLDCache, err = removeFromStateWithFS(state, &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.False(t, regenerateLDCache)
+	})
+
+	t.Run("keeps the entries of the other devices", func(t *testing.T) {
+		tmpDir, stateFile := setup(t)
+
+		state, err := loadAppliedState(stateFile)
+		require.NoError(t, err)
+
+		others := []*Hooks{{Symlinks: []SymlinkEntry{{Target: "/opt/cdi/libcuda.so.1", Link: "/usr/lib/cdi/libcuda.so"}}}}
+		_, err = removeFromStateWithFS(withoutSharedState(state, others), &localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "cdi", "libcuda.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "../../../opt/cdi/libcuda.so.1", target)
+
+		entries, err := readCDILinkerConfEntries(&localFS{rootFS: tmpDir})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib/existing"}, entries)
+	})
+
+	t.Run("missing state file", func(t *testing.T) {
+		c, _ := newRootFSContainer(t)
+
+		err := RemoveFromState(filepath.Join(t.TempDir(), "missing.json"), c)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestAppliedStatePath(t *testing.T) {
+	c := &pathContainer{path: "/var/lib/lxd/containers/c1"}
+
+	assert.Equal(t, "/var/lib/lxd/containers/c1/.lxdcdi-applied-gpu0.json", AppliedStatePath(c, "/var/lib/lxd/devices/c1/gpu0"+CDIHooksFileSuffix))
+	assert.Equal(t, "/var/lib/lxd/containers/c1/.lxdcdi-applied-nvidia.json", AppliedStatePath(c, "/tmp/nvidia.yaml"))
+}
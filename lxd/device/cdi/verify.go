@@ -0,0 +1,295 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxSymlinkHops is the maximum number of symlinks followed when resolving a path inside the container,
+// matching the Linux MAXSYMLINKS limit.
+const maxSymlinkHops = 40
+
+// BrokenLinksError is returned when CDI symlinks do not resolve to an existing file inside the container.
+type BrokenLinksError struct {
+	Links []SymlinkEntry
+}
+
+func (e *BrokenLinksError) Error() string {
+	links := make([]string, 0, len(e.Links))
+	for _, link := range e.Links {
+		links = append(links, fmt.Sprintf("%s -> %s", link.Link, link.Target))
+	}
+
+	return fmt.Sprintf("Found %d broken CDI symlinks: %s", len(e.Links), strings.Join(links, ", "))
+}
+
+// MissingSonamesError is returned when sonames required by ApplyOptions.RequireSonames are not in the
+// linker cache of the container.
+type MissingSonamesError struct {
+	Sonames []string
+}
+
+func (e *MissingSonamesError) Error() string {
+	return fmt.Sprintf("The linker cache is missing %d required sonames: %s", len(e.Sonames), strings.Join(e.Sonames, ", "))
+}
+
+// resolveContainerPath returns the path inside the container that p resolves to once all the symlinks
+// are followed. Absolute symlink targets are resolved relative to the container root.
+func resolveContainerPath(cfs containerFS, p string) (string, error) {
+	remaining := strings.Split(strings.TrimPrefix(filepath.Clean(p), "/"), "/")
+	resolved := "/"
+	hops := 0
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+
+		// The resolved path never contains symlinks so ".." can be resolved lexically.
+		next := filepath.Join(resolved, component)
+		fileInfo, err := cfs.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("Too many levels of symbolic links resolving %q", p)
+		}
+
+		target, err := cfs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+
+		remaining = append(strings.Split(strings.TrimPrefix(target, "/"), "/"), remaining...)
+	}
+
+	return resolved, nil
+}
+
+// resolveContainerDir returns the path inside the container of the directory dir, which may not exist
+// yet, once the symlinks of its existing components are followed. The missing components are kept as
+// they are so that the directory can be created on the same side of the symlinks as the container
+// sees it. Unlike resolveContainerPath, a symlink leading above the container root is an error since
+// following it on the host would escape the container rootfs.
+func resolveContainerDir(cfs containerFS, dir string) (string, error) {
+	remaining := strings.Split(strings.TrimPrefix(filepath.Clean(dir), "/"), "/")
+	resolved := "/"
+	missing := false
+	hops := 0
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+
+		if component == ".." {
+			if resolved == "/" {
+				return "", withKindf(ErrSymlinkEscape, "The directory %q resolves outside of the container rootfs", dir)
+			}
+
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		if missing {
+			resolved = next
+			continue
+		}
+
+		fileInfo, err := cfs.Lstat(next)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("Failed checking %q: %w", next, err)
+			}
+
+			missing = true
+			resolved = next
+			continue
+		}
+
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("Too many levels of symbolic links resolving %q", dir)
+		}
+
+		target, err := cfs.Readlink(next)
+		if err != nil {
+			return "", fmt.Errorf("Failed reading the symlink %q: %w", next, err)
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+
+		remaining = append(strings.Split(strings.TrimPrefix(target, "/"), "/"), remaining...)
+	}
+
+	return resolved, nil
+}
+
+// resolveContainerFilePath returns the path of the file at path inside the container with its
+// directory resolved by resolveContainerDir.
+func resolveContainerFilePath(cfs containerFS, path string) (string, error) {
+	dir, err := resolveContainerDir(cfs, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// verifySymlinks checks that each of the symlinks resolves to an existing file inside the container.
+// It returns a BrokenLinksError listing the ones that do not.
+func verifySymlinks(cfs containerFS, symlinks []SymlinkEntry) error {
+	broken := []SymlinkEntry{}
+	for _, symlink := range symlinks {
+		_, err := resolveContainerPath(cfs, symlink.Link)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed verifying the CDI symlink %q: %w", symlink.Link, err)
+			}
+
+			broken = append(broken, symlink)
+		}
+	}
+
+	if len(broken) > 0 {
+		return &BrokenLinksError{Links: broken}
+	}
+
+	return nil
+}
+
+// checkRequiredSonames checks that each of the sonames is in the linker cache of the container.
+// It returns a MissingSonamesError listing the ones that are not, all of them if there is no cache.
+func checkRequiredSonames(cfs containerFS, sonames []string) error {
+	cached := map[string]bool{}
+
+	content, err := readContainerFile(cfs, ldCacheFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed reading the linker cache %q: %w", ldCacheFile, err)
+	}
+
+	if err == nil {
+		// The glibc-hwcaps entries resolve their soname as well as the others.
+		entries, err := decodeLDCache(content, true)
+		if err != nil {
+			return fmt.Errorf("Failed parsing the linker cache %q: %w", ldCacheFile, err)
+		}
+
+		for _, entry := range entries {
+			cached[entry.key] = true
+		}
+	}
+
+	missing := []string{}
+	for _, soname := range sonames {
+		if !cached[soname] && !slices.Contains(missing, soname) {
+			missing = append(missing, soname)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &MissingSonamesError{Sonames: missing}
+	}
+
+	return nil
+}
+
+// glibcDefaultLibraryDirs are the trusted directories always searched by the glibc dynamic linker.
+var glibcDefaultLibraryDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}
+
+// librarySearchDirs returns the directories searched by the dynamic linker of the container, besides
+// the ones listed in the CDI hooks.
+func librarySearchDirs(cfs containerFS, libc libcInfo) ([]string, error) {
+	if libc.flavor == LibcFlavorMusl {
+		_, dirs, err := readMuslPathFile(cfs, muslPathFilePath(libc.muslArch))
+		if errors.Is(err, fs.ErrNotExist) {
+			return muslDefaultLibraryDirs, nil
+		}
+
+		return dirs, err
+	}
+
+	dirs := slices.Clone(glibcDefaultLibraryDirs)
+	files, err := cfs.ReadDir(linkerConfDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed listing the linker conf directory %q: %w", linkerConfDir, err)
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".conf") {
+			continue
+		}
+
+		entries, err := readLinkerConfEntries(cfs, filepath.Join(linkerConfDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry, "#") {
+				dirs = append(dirs, entry)
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// unsearchedSymlinks returns the symlinks to shared libraries of hooks that the dynamic linker of the
+// container cannot find. A library can be found when either the symlink or its target is in one of the
+// LDCacheUpdates directories or of the directories searched by default.
+func unsearchedSymlinks(cfs containerFS, hooks *Hooks, libc libcInfo) ([]SymlinkEntry, error) {
+	dirs, err := librarySearchDirs(cfs, libc)
+	if err != nil {
+		return nil, err
+	}
+
+	searched := make(map[string]bool, len(dirs)+len(hooks.LDCacheUpdates))
+	for _, dir := range append(dirs, hooks.LDCacheUpdates...) {
+		searched[filepath.Clean(dir)] = true
+	}
+
+	unsearched := []SymlinkEntry{}
+	for _, symlink := range hooks.Symlinks {
+		if !strings.Contains(filepath.Base(symlink.Link), ".so") {
+			continue
+		}
+
+		target := absoluteSymlinkTarget(symlink.Link, symlink.Target)
+		if searched[filepath.Dir(symlink.Link)] || searched[filepath.Dir(target)] {
+			continue
+		}
+
+		unsearched = append(unsearched, symlink)
+	}
+
+	return unsearched, nil
+}
@@ -0,0 +1,148 @@
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveContainerPath(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// /lib -> usr/lib, /usr/lib/libcuda.so -> libcuda.so.1 -> /usr/lib/libcuda.so.535
+	err := os.MkdirAll(filepath.Join(tmpDir, "usr", "lib"), 0755)
+	require.NoError(t, err)
+	err = os.Symlink("usr/lib", filepath.Join(tmpDir, "lib"))
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tmpDir, "usr", "lib", "libcuda.so.535"), nil, 0644)
+	require.NoError(t, err)
+	err = os.Symlink("/usr/lib/libcuda.so.535", filepath.Join(tmpDir, "usr", "lib", "libcuda.so.1"))
+	require.NoError(t, err)
+	err = os.Symlink("libcuda.so.1", filepath.Join(tmpDir, "usr", "lib", "libcuda.so"))
+	require.NoError(t, err)
+	err = os.Symlink("loop2", filepath.Join(tmpDir, "usr", "lib", "loop1"))
+	require.NoError(t, err)
+	err = os.Symlink("loop1", filepath.Join(tmpDir, "usr", "lib", "loop2"))
+	require.NoError(t, err)
+
+	cfs := &localFS{rootFS: tmpDir}
+
+	resolved, err := resolveContainerPath(cfs, "/lib/libcuda.so")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/lib/libcuda.so.535", resolved)
+
+	resolved, err = resolveContainerPath(cfs, "/lib/../usr/./lib/libcuda.so.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/lib/libcuda.so.535", resolved)
+
+	_, err = resolveContainerPath(cfs, "/lib/libmissing.so")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = resolveContainerPath(cfs, "/usr/lib/loop1")
+	assert.ErrorContains(t, err, "Too many levels of symbolic links")
+}
+
+func TestVerifySymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	libDir := filepath.Join(tmpDir, "usr", "lib")
+	err := os.MkdirAll(libDir, 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(libDir, "libfoo.so.1"), nil, 0644)
+	require.NoError(t, err)
+
+	hooks := Hooks{
+		Symlinks: []SymlinkEntry{
+			{Target: "/usr/lib/libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "/usr/lib/libcuda.so.1", Link: "/usr/lib/libcuda.so"},
+		},
+	}
+
+	hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+	result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+	require.NoError(t, err)
+
+	err = verifySymlinks(&localFS{rootFS: tmpDir}, result.CreatedSymlinks)
+
+	var brokenLinksErr *BrokenLinksError
+	require.True(t, errors.As(err, &brokenLinksErr))
+	assert.Equal(t, []SymlinkEntry{{Target: "/usr/lib/libcuda.so.1", Link: "/usr/lib/libcuda.so"}}, brokenLinksErr.Links)
+	assert.Equal(t, "Found 1 broken CDI symlinks: /usr/lib/libcuda.so -> /usr/lib/libcuda.so.1", err.Error())
+
+	err = verifySymlinks(&localFS{rootFS: tmpDir}, result.CreatedSymlinks[:1])
+	assert.NoError(t, err)
+}
+
+func TestUnsearchedSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	ldConfDir := filepath.Join(tmpDir, "etc", "ld.so.conf.d")
+	err := os.MkdirAll(ldConfDir, 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(ldConfDir, "x86_64-linux-gnu.conf"), []byte("# Multiarch support\n/usr/lib/x86_64-linux-gnu\n"), 0644)
+	require.NoError(t, err)
+
+	hooks := Hooks{
+		LDCacheUpdates: []string{"/usr/lib/nvidia"},
+		Symlinks: []SymlinkEntry{
+			{Target: "libcuda.so.535", Link: "/usr/lib/nvidia/libcuda.so.1"},
+			{Target: "/opt/nvidia/lib/libnvml.so.535", Link: "/usr/lib/x86_64-linux-gnu/libnvml.so.1"},
+			{Target: "/usr/lib64/libfoo.so.1", Link: "/opt/foo/libfoo.so"},
+			{Target: "libbar.so.1", Link: "/opt/bar/libbar.so"},
+			{Target: "/opt/bar/bin/bar", Link: "/usr/local/bin/bar"},
+		},
+	}
+
+	hooksFile := writeHooksFile(t, tmpDir, hooks)
+
+	result, _, err := applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{CheckSearchPaths: true})
+	require.NoError(t, err)
+	assert.Equal(t, []SymlinkEntry{{Target: "libbar.so.1", Link: "/opt/bar/libbar.so"}}, result.UnsearchedSymlinks)
+
+	result, _, err = applyHooksWithFS(hooksFile, &localFS{rootFS: tmpDir}, ApplyOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, result.UnsearchedSymlinks)
+}
+
+func TestCheckRequiredSonames(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfs := &localFS{rootFS: tmpDir}
+
+	// Without a linker cache, none of the sonames is found.
+	err := checkRequiredSonames(cfs, []string{"libcuda.so.1"})
+
+	var missingSonamesErr *MissingSonamesError
+	require.True(t, errors.As(err, &missingSonamesErr))
+	assert.Equal(t, []string{"libcuda.so.1"}, missingSonamesErr.Sonames)
+
+	entries := []ldCacheEntry{
+		{flags: 0x0303, key: "libc.so.6", value: "/lib/x86_64-linux-gnu/libc.so.6"},
+		{flags: 0x0303, key: "libcuda.so.1", value: "/usr/lib/nvidia/libcuda.so.1"},
+		{flags: 0x0303, key: "libnvidia-ml.so.1", value: "/usr/lib/nvidia/libnvidia-ml.so.1", hwcap: ldCacheHwcapExtension},
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "etc", "ld.so.cache"), marshalLDCache(entries), 0644))
+
+	err = checkRequiredSonames(cfs, []string{"libcuda.so.1", "libnvidia-ml.so.1"})
+	assert.NoError(t, err)
+
+	err = checkRequiredSonames(cfs, []string{"libcuda.so.1", "libnvidia-encode.so.1", "libnvcuvid.so.1", "libnvidia-encode.so.1"})
+	require.True(t, errors.As(err, &missingSonamesErr))
+	assert.Equal(t, []string{"libnvidia-encode.so.1", "libnvcuvid.so.1"}, missingSonamesErr.Sonames)
+	assert.Equal(t, "The linker cache is missing 2 required sonames: libnvidia-encode.so.1, libnvcuvid.so.1", err.Error())
+	assert.Equal(t, FailureStageVerify, newFailureReport(err).Stage)
+
+	t.Run("invalid sonames", func(t *testing.T) {
+		for _, soname := range []string{"", "nvidia/libcuda.so.1"} {
+			_, _, err := applyHooksWithFS(writeHooksFile(t, t.TempDir(), Hooks{LDCacheUpdates: []string{"/usr/lib"}}), &localFS{rootFS: t.TempDir()}, ApplyOptions{RequireSonames: []string{soname}})
+			assert.ErrorContains(t, err, fmt.Sprintf("The required soname %q is not a file name", soname))
+		}
+	})
+}
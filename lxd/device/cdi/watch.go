@@ -0,0 +1,240 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+
+	in "k8s.io/utils/inotify"
+
+	"github.com/canonical/lxd/lxd/instance"
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// WatchAndApply applies the CDI hooks file at hooksFilePath to the container c like ApplyHooks,
+// then applies it again whenever the file is written or replaced, until ctx is cancelled. It is
+// meant for the development of CDI specs, so that a container picks up the changes of its hooks
+// without running the apply again by hand. The hooks are only applied again when their content
+// changed, and then only when some of their symlinks or library directories are missing, the ones
+// dropped from the hooks since the previous apply being removed. The failures of the first apply
+// are returned while the ones of the following applies, e.g. for a hooks file saved half edited,
+// are logged and the watch goes on. It returns nil once ctx is cancelled.
+func WatchAndApply(ctx context.Context, hooksFilePath string, c instance.Container) error {
+	hooksFilePath, err := filepath.Abs(hooksFilePath)
+	if err != nil {
+		return fmt.Errorf("Failed resolving the CDI hooks file path %q: %w", hooksFilePath, err)
+	}
+
+	w := &hooksWatcher{hooksFilePath: hooksFilePath, container: c}
+
+	return watchHooksFile(ctx, hooksFilePath, w.apply)
+}
+
+// watchHooksFile calls apply once, then again whenever the CDI hooks file at the absolute
+// hooksFilePath is written or replaced, until ctx is cancelled, like WatchAndApply.
+func watchHooksFile(ctx context.Context, hooksFilePath string, apply func(ctx context.Context) error) error {
+	watcher, err := in.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Failed initializing the CDI hooks file watcher: %w", err)
+	}
+
+	defer func() { _ = watcher.Close() }()
+
+	// The directory is watched rather than the file as editors usually replace the file on save.
+	err = watcher.AddWatch(filepath.Dir(hooksFilePath), in.InCloseWrite|in.InMovedTo)
+	if err != nil {
+		return fmt.Errorf("Failed watching the CDI hooks file %q: %w", hooksFilePath, err)
+	}
+
+	err = apply(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Event:
+			if filepath.Clean(event.Name) != hooksFilePath {
+				continue
+			}
+
+			err := apply(ctx)
+			if err != nil {
+				logger.Warn("Failed applying the changed CDI hooks", logger.Ctx{"path": hooksFilePath, "error": err})
+			}
+
+		case err := <-watcher.Error:
+			logger.Warn("Failed watching the CDI hooks file", logger.Ctx{"path": hooksFilePath, "error": err})
+		}
+	}
+}
+
+// hooksWatcher applies the successive versions of a CDI hooks file for WatchAndApply.
+type hooksWatcher struct {
+	hooksFilePath string
+	container     instance.Container
+
+	// hooks are the hooks last applied.
+	hooks *Hooks
+	// state is what the applies created so far, so that the entries dropped from the hooks can be
+	// removed.
+	state *AppliedState
+}
+
+// apply loads the hooks file and applies it to the container under the lock of its rootfs when it
+// changed.
+func (w *hooksWatcher) apply(ctx context.Context) error {
+	hooks, err := loadHooksFile(w.hooksFilePath)
+	if err != nil {
+		return err
+	}
+
+	if w.hooks != nil && reflect.DeepEqual(hooks, w.hooks) {
+		return nil
+	}
+
+	unlock, err := lockHooks(ctx, w.container)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Use FileSFTPNoLock so we can use the SFTP client during instance start operations.
+	sftpClient, err := w.container.FileSFTPNoLock()
+	if err != nil {
+		return fmt.Errorf("Failed getting SFTP client: %w", err)
+	}
+
+	defer func() { _ = sftpClient.Close() }()
+
+	err = w.applyWithFS(ctx, hooks, &sftpContainerFS{client: sftpClient})
+	if err != nil {
+		return err
+	}
+
+	w.hooks = hooks
+
+	return nil
+}
+
+// applyWithFS is the testable core of apply. It removes what the previous applies created and hooks
+// do not list anymore, then applies hooks unless all of their entries are already there.
+func (w *hooksWatcher) applyWithFS(ctx context.Context, hooks *Hooks, cfs containerFS) error {
+	regenerateLDCache := false
+
+	if w.state != nil {
+		stale, kept := splitStaleState(w.state, hooks)
+
+		removed, err := removeFromStateWithFS(stale, cfs)
+		if err != nil {
+			// The stale entries are kept in the state so that the next apply removes them.
+			return err
+		}
+
+		w.state = kept
+		regenerateLDCache = removed
+	}
+
+	toCreate, _, cacheToAdd, _, err := diffHooksWithFS(hooks, cfs)
+	if err != nil {
+		return err
+	}
+
+	if len(toCreate) > 0 || len(cacheToAdd) > 0 {
+		result, regenerate, err := applyLoadedHooksWithFS(ctx, hooks, cfs, ApplyOptions{Rollback: true})
+		if err != nil {
+			return err
+		}
+
+		w.state = mergeAppliedState(w.state, newAppliedState(result, "", ""))
+		regenerateLDCache = regenerateLDCache || regenerate
+	}
+
+	if regenerateLDCache {
+		_, _, _ = updateLDCache(ctx, w.container, cfs, logger.AddContext(logger.Ctx{"path": w.hooksFilePath}), "", 0, nil, "")
+	}
+
+	return nil
+}
+
+// splitStaleState splits state into what hooks do not list anymore, to be removed, and what they
+// still list.
+func splitStaleState(state *AppliedState, hooks *Hooks) (stale *AppliedState, kept *AppliedState) {
+	stale = &AppliedState{LinkerConfFile: state.LinkerConfFile}
+	kept = &AppliedState{LinkerConfFile: state.LinkerConfFile}
+
+	links := make(map[string]bool, len(hooks.Symlinks))
+	for _, symlink := range hooks.Symlinks {
+		links[filepath.Clean(symlink.Link)] = true
+	}
+
+	for _, symlink := range state.Symlinks {
+		if links[filepath.Clean(symlink.Link)] {
+			kept.Symlinks = append(kept.Symlinks, symlink)
+		} else {
+			stale.Symlinks = append(stale.Symlinks, symlink)
+		}
+	}
+
+	for _, path := range state.BackedUpFiles {
+		if links[filepath.Clean(path)] {
+			kept.BackedUpFiles = append(kept.BackedUpFiles, path)
+		} else {
+			stale.BackedUpFiles = append(stale.BackedUpFiles, path)
+		}
+	}
+
+	for _, entry := range state.LDCacheEntries {
+		if slices.Contains(hooks.LDCacheUpdates, entry) {
+			kept.LDCacheEntries = append(kept.LDCacheEntries, entry)
+		} else {
+			stale.LDCacheEntries = append(stale.LDCacheEntries, entry)
+		}
+	}
+
+	return stale, kept
+}
+
+// mergeAppliedState returns the applied state of the apply of next after the ones of state, next
+// replacing the symlinks of state sharing a link. A nil state is empty.
+func mergeAppliedState(state *AppliedState, next *AppliedState) *AppliedState {
+	if state == nil {
+		return next
+	}
+
+	merged := &AppliedState{LinkerConfFile: state.LinkerConfFile}
+	if next.LinkerConfFile != "" {
+		merged.LinkerConfFile = next.LinkerConfFile
+	}
+
+	for _, symlink := range state.Symlinks {
+		if !slices.ContainsFunc(next.Symlinks, func(s SymlinkEntry) bool { return filepath.Clean(s.Link) == filepath.Clean(symlink.Link) }) {
+			merged.Symlinks = append(merged.Symlinks, symlink)
+		}
+	}
+
+	merged.Symlinks = append(merged.Symlinks, next.Symlinks...)
+
+	for _, paths := range [][]string{state.BackedUpFiles, next.BackedUpFiles} {
+		for _, path := range paths {
+			if !slices.Contains(merged.BackedUpFiles, path) {
+				merged.BackedUpFiles = append(merged.BackedUpFiles, path)
+			}
+		}
+	}
+
+	for _, entries := range [][]string{state.LDCacheEntries, next.LDCacheEntries} {
+		for _, entry := range entries {
+			if !slices.Contains(merged.LDCacheEntries, entry) {
+				merged.LDCacheEntries = append(merged.LDCacheEntries, entry)
+			}
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,146 @@
+package cdi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// removeFailingFS wraps a containerFS and fails all the removals.
+type removeFailingFS struct {
+	containerFS
+}
+
+func (r *removeFailingFS) Remove(path string) error {
+	return errors.New("Injected failure")
+}
+
+func TestHooksWatcher(t *testing.T) {
+	tmpDir := t.TempDir()
+	createLibrary(t, tmpDir, "/usr/lib/libfoo.so.1")
+	createLibrary(t, tmpDir, "/usr/lib/libbar.so.1")
+
+	cfs := &localFS{rootFS: tmpDir}
+	w := &hooksWatcher{container: &pathContainer{}}
+
+	first := &Hooks{
+		Symlinks: []SymlinkEntry{
+			{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"},
+			{Target: "libbar.so.1", Link: "/usr/lib/libbar.so"},
+		},
+		LDCacheUpdates: []string{"/usr/lib", "/opt/lib"},
+	}
+
+	require.NoError(t, w.applyWithFS(context.Background(), first, cfs))
+	assert.Len(t, w.state.Symlinks, 2)
+	assert.Equal(t, []string{"/usr/lib", "/opt/lib"}, w.state.LDCacheEntries)
+
+	t.Run("failed removal keeps the stale entries", func(t *testing.T) {
+		second := &Hooks{Symlinks: first.Symlinks[:1], LDCacheUpdates: []string{"/usr/lib"}}
+
+		err := w.applyWithFS(context.Background(), second, &removeFailingFS{containerFS: cfs})
+		require.Error(t, err)
+		assert.Len(t, w.state.Symlinks, 2)
+		assert.Equal(t, []string{"/usr/lib", "/opt/lib"}, w.state.LDCacheEntries)
+	})
+
+	t.Run("entries dropped from the hooks are removed", func(t *testing.T) {
+		second := &Hooks{
+			Symlinks:       []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}},
+			LDCacheUpdates: []string{"/usr/lib"},
+		}
+
+		require.NoError(t, w.applyWithFS(context.Background(), second, cfs))
+
+		_, err := os.Lstat(filepath.Join(tmpDir, "usr", "lib", "libbar.so"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		entries, err := readLinkerConfEntries(cfs, filepath.Join(linkerConfDir, CDILinkerConfFile))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/lib"}, entries)
+
+		assert.Equal(t, []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}}, w.state.Symlinks)
+		assert.Equal(t, []string{"/usr/lib"}, w.state.LDCacheEntries)
+	})
+
+	t.Run("changed target is replaced", func(t *testing.T) {
+		third := &Hooks{Symlinks: []SymlinkEntry{{Target: "libbar.so.1", Link: "/usr/lib/libfoo.so"}}, LDCacheUpdates: []string{"/usr/lib"}}
+
+		require.NoError(t, w.applyWithFS(context.Background(), third, cfs))
+
+		target, err := os.Readlink(filepath.Join(tmpDir, "usr", "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libbar.so.1", target)
+		assert.Equal(t, third.Symlinks, w.state.Symlinks)
+	})
+}
+
+func TestWatchAndApply(t *testing.T) {
+	c, rootFS := newRootFSContainer(t)
+	createLibrary(t, rootFS, "/usr/lib/libfoo.so.1")
+
+	hooksDir := t.TempDir()
+	hooksFile := writeHooksFile(t, hooksDir, Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so"}}})
+
+	w := &hooksWatcher{hooksFilePath: hooksFile, container: c}
+	apply := func(ctx context.Context) error {
+		hooks, err := loadHooksFile(hooksFile)
+		if err != nil {
+			return err
+		}
+
+		return w.applyWithFS(ctx, hooks, &localFS{rootFS: rootFS})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- watchHooksFile(ctx, hooksFile, apply) }()
+
+	linkExists := func(link string) func() bool {
+		return func() bool {
+			_, err := os.Lstat(filepath.Join(rootFS, link))
+			return err == nil
+		}
+	}
+
+	require.Eventually(t, linkExists("/usr/lib/libfoo.so"), 5*time.Second, 10*time.Millisecond)
+
+	// Replace the hooks file like an editor does on save.
+	content, err := json.Marshal(Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so.0"}}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "hooks.json.tmp"), content, 0644))
+	require.NoError(t, os.Rename(filepath.Join(hooksDir, "hooks.json.tmp"), hooksFile))
+
+	require.Eventually(t, linkExists("/usr/lib/libfoo.so.0"), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !linkExists("/usr/lib/libfoo.so")() }, 5*time.Second, 10*time.Millisecond)
+
+	// An invalid hooks file is logged and the watch goes on.
+	require.NoError(t, os.WriteFile(hooksFile, []byte("{"), 0644))
+	writeHooksFile(t, hooksDir, Hooks{Symlinks: []SymlinkEntry{{Target: "libfoo.so.1", Link: "/usr/lib/libfoo.so.2"}}})
+	require.Eventually(t, linkExists("/usr/lib/libfoo.so.2"), 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchAndApply did not return once the context was cancelled")
+	}
+
+	t.Run("invalid hooks file", func(t *testing.T) {
+		err := WatchAndApply(context.Background(), filepath.Join(t.TempDir(), "missing.json"), c)
+		assert.ErrorIs(t, err, ErrHooksFileNotFound)
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/canonical/lxd/lxd/instance"
 	"github.com/canonical/lxd/lxd/storage/filesystem"
 	"github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/logger"
 )
 
 // cdiHooksFilePath returns the path to the CDI hooks file for the named device.
@@ -34,6 +35,11 @@ func cdiConfigDevicesFilePath(devicesPath, devName string) string {
 // * `unix-char` (representing the card and non-card devices)
 // * `disk` (representing the mounts).
 func startCDIDevices(d *deviceCommon, configDevices cdi.ConfigDevices, runConf *deviceConfig.RunConfig) error {
+	err := cdi.ValidateConfigDevices(&configDevices)
+	if err != nil {
+		return err
+	}
+
 	srcFDHandlers := make([]*os.File, 0)
 	defer func() {
 		for _, f := range srcFDHandlers {
@@ -48,7 +54,7 @@ func startCDIDevices(d *deviceCommon, configDevices cdi.ConfigDevices, runConf *
 	// Check if there are any remaining CDI devices in the instance devices directory.
 	// If there are, we need to remove them. These can be present in the case where the device stop hook was not called
 	// (e.g. due to an abrupt host shutdown).
-	err := filepath.WalkDir(devicesPath, func(path string, e fs.DirEntry, err error) error {
+	err = filepath.WalkDir(devicesPath, func(path string, e fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -319,6 +325,17 @@ func postStopCDIDevice(d *deviceCommon, allowMissingFiles bool) error {
 	}
 
 	hooksFile := cdiHooksFilePath(d.inst.DevicesPath(), d.name)
+
+	// When the device is hot-unplugged, undo the CDI hooks so that the symlinks and linker entries
+	// do not keep pointing at libraries that are no longer mounted in the container.
+	c, ok := d.inst.(instance.Container)
+	if ok && d.inst.IsRunning() && shared.PathExists(hooksFile) {
+		err = cdi.RemoveHooksFromContainer(hooksFile, c, d.logger)
+		if err != nil {
+			d.logger.Warn("Failed removing CDI hooks from the container", logger.Ctx{"err": err})
+		}
+	}
+
 	err = os.Remove(hooksFile)
 	if err != nil && (!allowMissingFiles || !errors.Is(err, fs.ErrNotExist)) {
 		return fmt.Errorf("Failed deleting CDI hooks file for device %q: %w", d.name, err)
@@ -152,6 +152,8 @@ const (
 	UptimeSeconds
 	// WarningsTotal represents the number of active warnings.
 	WarningsTotal
+	// CDIHookOutcomesTotal represents the total number of outcomes of applying CDI hooks.
+	CDIHookOutcomesTotal
 )
 
 // MetricNames associates a metric type to its name.
@@ -224,6 +226,7 @@ var MetricNames = map[MetricType]string{
 	UptimeSeconds:               "lxd_uptime_seconds",
 	WarningsTotal:               "lxd_warnings_total",
 	Instances:                   "lxd_instances",
+	CDIHookOutcomesTotal:        "lxd_cdi_hook_outcomes_total",
 }
 
 // MetricHeaders represents the metric headers which contain help messages as specified by OpenMetrics.
@@ -296,4 +299,5 @@ var MetricHeaders = map[MetricType]string{
 	UptimeSeconds:               "# HELP lxd_uptime_seconds The daemon uptime in seconds.",
 	WarningsTotal:               "# HELP lxd_warnings_total The number of active warnings.",
 	Instances:                   "# HELP lxd_instances The number of instances.",
+	CDIHookOutcomesTotal:        "# HELP lxd_cdi_hook_outcomes_total The total number of outcomes of applying CDI hooks to containers.",
 }